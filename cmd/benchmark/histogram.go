@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// histSubBits gives each power of two 128 buckets, so a recorded latency is
+// off by under 1% whatever its magnitude, as in an HDR histogram.
+const histSubBits = 7
+
+// histogram counts latencies in log-linear buckets: exact below 256ns,
+// then 128 equal buckets per power of two. Its size is fixed however many
+// latencies it records.
+type histogram struct {
+	counts []uint64
+	n      uint64
+	max    time.Duration
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, (64-histSubBits+1)<<histSubBits)}
+}
+
+func histBucket(v uint64) int {
+	if v < 2<<histSubBits {
+		return int(v)
+	}
+	// v>>shift has histSubBits+1 bits: the leading one and the sub-bucket.
+	shift := bits.Len64(v) - histSubBits - 1
+	return (shift+1)<<histSubBits + int(v>>shift) - 1<<histSubBits
+}
+
+// histBucketMax is the largest value bucket i holds.
+func histBucketMax(i int) uint64 {
+	if i < 2<<histSubBits {
+		return uint64(i)
+	}
+	shift := i>>histSubBits - 1
+	sub := uint64(i&(1<<histSubBits-1)) + 1<<histSubBits
+	return (sub+1)<<shift - 1
+}
+
+func (h *histogram) record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.counts[histBucket(uint64(d))]++
+	h.n++
+	h.max = max(h.max, d)
+}
+
+func (h *histogram) merge(o *histogram) {
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.n += o.n
+	h.max = max(h.max, o.max)
+}
+
+// percentile is the latency at or below which fraction p of the recorded
+// latencies fall, to within the bucket's 1%; 0 with nothing recorded.
+func (h *histogram) percentile(p float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	target := uint64(p*float64(h.n) + 0.5)
+	target = max(target, 1)
+	var seen uint64
+	for i, c := range h.counts {
+		if seen += c; seen >= target {
+			return min(time.Duration(histBucketMax(i)), h.max)
+		}
+	}
+	return h.max
+}
+
+// runResult is what a run of runPool measured.
+type runResult struct {
+	hist    *histogram
+	errors  int
+	elapsed time.Duration
+}
+
+func (r runResult) qps() float64 {
+	return float64(r.hist.n) / r.elapsed.Seconds()
+}
+
+func (r runResult) String() string {
+	return fmt.Sprintf("%d ops in %v | QPS: %.0f | p50 %v  p90 %v  p99 %v  p999 %v  max %v | errors %d",
+		r.hist.n, r.elapsed.Round(time.Millisecond), r.qps(),
+		r.hist.percentile(0.50), r.hist.percentile(0.90), r.hist.percentile(0.99),
+		r.hist.percentile(0.999), r.hist.max, r.errors)
+}
+
+// runPool runs n calls of op over workers goroutines, op(w, i) being the
+// i'th call overall, made by worker w, and times each one.
+func runPool(n, workers int, op func(w, i int) error) runResult {
+	hists := make([]*histogram, workers)
+	errs := make([]int, workers)
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < workers; w++ {
+		hists[w] = newHistogram()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int(next.Add(1) - 1); i < n; i = int(next.Add(1) - 1) {
+				t := time.Now()
+				err := op(w, i)
+				hists[w].record(time.Since(t))
+				if err != nil {
+					errs[w]++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	res := runResult{hist: newHistogram(), elapsed: time.Since(start)}
+	for w := range hists {
+		res.hist.merge(hists[w])
+		res.errors += errs[w]
+	}
+	return res
+}
@@ -2,50 +2,89 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
-	"neurodb/pkg/protocol"
-	"time"
+	"neurodb/pkg/client"
 )
 
 func main() {
 	httpAddr := flag.String("http", "http://localhost:8080", "HTTP API base URL")
-	tcpAddr := flag.String("tcp", "localhost:9090", "TCP server address")
+	tcpAddr := flag.String("tcp", "localhost:9090", "TCP server address, or unix:///path for a Unix socket")
 	nReq := flag.Int("n", 5000, "Number of requests per run")
+	mode := flag.String("mode", "compare", "compare: sequential puts over HTTP vs TCP; workload: mixed operations over TCP")
+	mix := flag.String("mix", "put=70,get=25,scan=5", "workload: operation weights")
+	workers := flag.Int("c", 1, "Concurrent clients")
+	dist := flag.String("dist", "sequential", "workload: key distribution, sequential, random or zipf")
+	keys := flag.Int64("keys", 100000, "workload: keys are drawn from [0, keys)")
+	scanLen := flag.Int("scan-len", 100, "workload: records per scan")
+	valueSize := flag.Int("value-size", 10, "workload: bytes per value")
 	flag.Parse()
+	if *workers <= 0 {
+		log.Fatal("-c must be positive")
+	}
 
-	fmt.Printf("NeuroDB Protocol Benchmark (N=%d)\n", *nReq)
+	if *mode == "workload" {
+		ops, err := parseMix(*mix)
+		if err != nil {
+			log.Fatalf("-mix: %v", err)
+		}
+		if *dist != "sequential" && *dist != "random" && *dist != "zipf" {
+			log.Fatalf("-dist must be sequential, random or zipf, got %q", *dist)
+		}
+		if *keys < 2 || *scanLen <= 0 || *valueSize < 0 {
+			log.Fatal("-scan-len must be positive, -keys at least 2 and -value-size not negative")
+		}
+		fmt.Printf("NeuroDB Workload Benchmark (N=%d, c=%d)\n", *nReq, *workers)
+		fmt.Printf("  TCP=%s  mix=%s  dist=%s  keys=%d\n", *tcpAddr, *mix, *dist, *keys)
+		fmt.Println("---------------------------------------------------")
+		wl := &workload{addr: *tcpAddr, ops: *nReq, workers: *workers, mix: ops, dist: *dist,
+			keys: *keys, scanLen: *scanLen, valueSize: *valueSize}
+		res, stats, err := wl.run()
+		if err != nil {
+			log.Fatalf("TCP Connect failed: %v", err)
+		}
+		printWorkload(res, stats)
+		return
+	}
+	if *mode != "compare" {
+		log.Fatalf("-mode must be compare or workload, got %q", *mode)
+	}
+
+	fmt.Printf("NeuroDB Protocol Benchmark (N=%d, c=%d)\n", *nReq, *workers)
 	fmt.Printf("  HTTP=%s  TCP=%s\n", *httpAddr, *tcpAddr)
 	fmt.Println("---------------------------------------------------")
 
 	fmt.Println(">> Starting HTTP Benchmark (JSON over HTTP 1.1)...")
-	httpDuration := runHTTPBenchmark(*httpAddr, *nReq)
-	fmt.Printf("   HTTP Time: %v | QPS: %.0f\n\n", httpDuration, float64(*nReq)/httpDuration.Seconds())
+	httpRes := runHTTPBenchmark(*httpAddr, *nReq, *workers)
+	fmt.Printf("   HTTP %v\n\n", httpRes)
 
 	fmt.Println(">> Starting TCP Benchmark (Binary Protocol)...")
-	tcpDuration := runTCPBenchmark(*tcpAddr, *nReq)
-	fmt.Printf("   TCP  Time: %v | QPS: %.0f\n", tcpDuration, float64(*nReq)/tcpDuration.Seconds())
+	tcpRes, err := runTCPBenchmark(*tcpAddr, *nReq, *workers)
+	if err != nil {
+		log.Fatalf("TCP Connect failed: %v", err)
+	}
+	fmt.Printf("   TCP  %v\n", tcpRes)
 
 	fmt.Println("---------------------------------------------------")
-	speedup := httpDuration.Seconds() / tcpDuration.Seconds()
+	speedup := tcpRes.qps() / httpRes.qps()
 	fmt.Printf("Conclusion: TCP is %.2fx faster than HTTP!\n", speedup)
 }
 
-func runHTTPBenchmark(httpAddr string, n int) time.Duration {
-	start := time.Now()
+// runHTTPBenchmark puts keys 0..n-1 through the HTTP API from workers
+// goroutines sharing one connection pool.
+func runHTTPBenchmark(httpAddr string, n, workers int) runResult {
 	client := &http.Client{
 		Transport: &http.Transport{
-			MaxIdleConnsPerHost: 100,
+			MaxIdleConnsPerHost: max(100, workers),
 		},
 	}
+	defer client.CloseIdleConnections()
 
-	for i := 0; i < n; i++ {
+	return runPool(n, workers, func(_, i int) error {
 		data := map[string]interface{}{
 			"key":   i,
 			"value": "bench_data",
@@ -54,39 +93,38 @@ func runHTTPBenchmark(httpAddr string, n int) time.Duration {
 
 		resp, err := client.Post(httpAddr+"/api/put", "application/json", bytes.NewReader(jsonData))
 		if err != nil {
-			log.Fatalf("HTTP Req failed: %v", err)
+			return err
 		}
 		io.Copy(io.Discard, resp.Body)
 		resp.Body.Close()
-	}
-	return time.Since(start)
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+		return nil
+	})
 }
 
-func runTCPBenchmark(addr string, n int) time.Duration {
-	start := time.Now()
-
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		log.Fatalf("TCP Connect failed: %v", err)
-	}
-	defer conn.Close()
-
-	keyBuf := make([]byte, 8)
-	val := []byte("bench_data")
-
-	for i := 0; i < n; i++ {
-		binary.BigEndian.PutUint64(keyBuf, uint64(i))
-
-		err := protocol.Encode(conn, protocol.OpPut, keyBuf, val)
-		if err != nil {
-			log.Fatalf("TCP Write failed: %v", err)
+// runTCPBenchmark puts keys 0..n-1 over the binary protocol, one client
+// connection per worker.
+func runTCPBenchmark(addr string, n, workers int) (runResult, error) {
+	clients := make([]*client.Client, workers)
+	defer func() {
+		for _, cli := range clients {
+			if cli != nil {
+				cli.Close()
+			}
 		}
-
-		_, err = protocol.Decode(conn)
+	}()
+	for w := range clients {
+		cli, err := client.Dial(addr)
 		if err != nil {
-			log.Fatalf("TCP Read failed: %v", err)
+			return runResult{}, err
 		}
+		clients[w] = cli
 	}
 
-	return time.Since(start)
+	val := []byte("bench_data")
+	return runPool(n, workers, func(w, i int) error {
+		return clients[w].Put(int64(i), val)
+	}), nil
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"neurodb/pkg/api"
+	"neurodb/pkg/client"
+	"neurodb/pkg/config"
+	"neurodb/pkg/core"
+	"neurodb/pkg/network"
+	"neurodb/pkg/protocol"
+)
+
+func TestHistogramPercentiles(t *testing.T) {
+	h := newHistogram()
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Microsecond)
+	}
+	for _, tc := range []struct {
+		p    float64
+		want time.Duration
+	}{
+		{0.50, 500 * time.Microsecond},
+		{0.90, 900 * time.Microsecond},
+		{0.99, 990 * time.Microsecond},
+		{0.999, 999 * time.Microsecond},
+	} {
+		got := h.percentile(tc.p)
+		if got < tc.want || float64(got) > 1.01*float64(tc.want) {
+			t.Errorf("p%v = %v, want %v within 1%%", tc.p*100, got, tc.want)
+		}
+	}
+	if h.n != 1000 || h.max != time.Millisecond || h.percentile(1) != time.Millisecond {
+		t.Errorf("expected 1000 latencies up to 1ms, got %d up to %v", h.n, h.max)
+	}
+}
+
+func TestConcurrentBenchmarkAgainstInProcessServer(t *testing.T) {
+	store := core.NewHybridStore(&config.Config{
+		Storage: config.StorageConfig{
+			Path:                   t.TempDir(),
+			WalBufferSize:          1024,
+			MemTableFlushThreshold: 100,
+			CompactionThreshold:    4,
+			WalBatchSize:           16,
+		},
+		System: config.SystemConfig{
+			ShardCount:     2,
+			BloomSize:      4096,
+			BloomFalseProb: 0.01,
+		},
+	})
+	defer store.Close()
+
+	apiServer := api.NewServer(store)
+	apiServer.RegisterRoutes()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go apiServer.Serve(ln)
+	tcpServer := network.NewTCPServer(store, 0)
+	tcpAddr := protocol.UnixScheme + filepath.Join(t.TempDir(), "neuro.sock")
+	go tcpServer.Start(tcpAddr)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		apiServer.Shutdown(ctx)
+		tcpServer.Shutdown(ctx)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		cli, err := client.Dial(tcpAddr, client.WithMaxRetries(0))
+		if err == nil {
+			cli.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dial %s: %v", tcpAddr, err)
+		}
+	}
+
+	const n, workers = 400, 4
+	httpRes := runHTTPBenchmark("http://"+ln.Addr().String(), n, workers)
+	tcpRes, err := runTCPBenchmark(tcpAddr, n, workers)
+	if err != nil {
+		t.Fatalf("TCP benchmark: %v", err)
+	}
+	// Both comparison runs wrote keys 0..n-1.
+	if val, ok := store.Get(n - 1); !ok || string(val) != "bench_data" {
+		t.Fatalf("expected key %d written by the benchmark, got %q", n-1, val)
+	}
+	wl := &workload{addr: tcpAddr, ops: n, workers: workers, mix: map[string]int{"put": 2, "get": 1, "scan": 1},
+		dist: "zipf", keys: 1000, scanLen: 10, valueSize: 8}
+	wlRes, stats, err := wl.run()
+	if err != nil {
+		t.Fatalf("workload: %v", err)
+	}
+
+	for name, res := range map[string]runResult{"http": httpRes, "tcp": tcpRes, "workload": wlRes} {
+		if res.hist.n != n || res.errors != 0 {
+			t.Fatalf("%s: %d requests with %d errors, want %d without errors", name, res.hist.n, res.errors, n)
+		}
+		p50, p90, p99, p999 := res.hist.percentile(0.50), res.hist.percentile(0.90), res.hist.percentile(0.99), res.hist.percentile(0.999)
+		if p50 <= 0 || p50 > p90 || p90 > p99 || p99 > p999 || p999 > res.hist.max || res.hist.max > res.elapsed {
+			t.Fatalf("%s: percentiles out of order: p50 %v p90 %v p99 %v p999 %v max %v in %v", name, p50, p90, p99, p999, res.hist.max, res.elapsed)
+		}
+		if res.qps() <= 0 {
+			t.Fatalf("%s: QPS %v", name, res.qps())
+		}
+	}
+	var ops uint64
+	for _, st := range stats {
+		ops += st.hist.n
+	}
+	if ops != n || stats["put"].hist.n == 0 {
+		t.Fatalf("workload ran %d ops (%d puts), want %d", ops, stats["put"].hist.n, n)
+	}
+}
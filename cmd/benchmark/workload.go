@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"neurodb/pkg/client"
+	"neurodb/pkg/common"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The operations a workload mixes.
+var workloadOps = []string{"put", "get", "scan"}
+
+// workload describes a mixed run against the TCP server.
+type workload struct {
+	addr      string
+	ops       int            // total operations over all workers
+	workers   int            // concurrent clients
+	mix       map[string]int // op -> weight
+	dist      string         // sequential, random or zipf
+	keys      int64          // keys are drawn from [0, keys)
+	scanLen   int            // records per scan
+	valueSize int
+}
+
+// parseMix reads "put=70,get=25,scan=5" into weights per op.
+func parseMix(s string) (map[string]int, error) {
+	mix := make(map[string]int)
+	total := 0
+	for _, part := range strings.Split(s, ",") {
+		name, weight, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("mix entry %q: want op=weight", part)
+		}
+		known := false
+		for _, op := range workloadOps {
+			known = known || op == name
+		}
+		if !known {
+			return nil, fmt.Errorf("mix entry %q: op must be one of %s", part, strings.Join(workloadOps, ", "))
+		}
+		w, err := strconv.Atoi(weight)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("mix entry %q: weight must be a non-negative integer", part)
+		}
+		mix[name] += w
+		total += w
+	}
+	if total == 0 {
+		return nil, errors.New("mix has no weight")
+	}
+	return mix, nil
+}
+
+// keyGen draws keys for one worker.
+type keyGen func() int64
+
+func (wl *workload) keyGen(seq *atomic.Int64, r *rand.Rand) keyGen {
+	switch wl.dist {
+	case "random":
+		return func() int64 { return r.Int63n(wl.keys) }
+	case "zipf":
+		// Low keys are hot: key 0 is drawn most, then 1, and so on.
+		z := rand.NewZipf(r, 1.1, 1, uint64(wl.keys-1))
+		return func() int64 { return int64(z.Uint64()) }
+	default:
+		return func() int64 { return (seq.Add(1) - 1) % wl.keys }
+	}
+}
+
+// opStats are one operation's results.
+type opStats struct {
+	hist    *histogram
+	errors  int
+	misses  int // gets of a key with no value
+	records int // records returned by scans
+}
+
+func (s *opStats) merge(o *opStats) {
+	s.hist.merge(o.hist)
+	s.errors += o.errors
+	s.misses += o.misses
+	s.records += o.records
+}
+
+// run dials one client per worker and runs the workload. It returns the
+// whole run's result and each operation's.
+func (wl *workload) run() (runResult, map[string]*opStats, error) {
+	ops := make([]string, 0, 100)
+	for _, op := range workloadOps {
+		for i := 0; i < wl.mix[op]; i++ {
+			ops = append(ops, op)
+		}
+	}
+	value := []byte(strings.Repeat("x", wl.valueSize))
+
+	var seq atomic.Int64
+	clients := make([]*client.Client, wl.workers)
+	rands := make([]*rand.Rand, wl.workers)
+	keys := make([]keyGen, wl.workers)
+	stats := make([]map[string]*opStats, wl.workers)
+	defer func() {
+		for _, cli := range clients {
+			if cli != nil {
+				cli.Close()
+			}
+		}
+	}()
+	for w := range clients {
+		cli, err := client.Dial(wl.addr)
+		if err != nil {
+			return runResult{}, nil, err
+		}
+		clients[w] = cli
+		rands[w] = rand.New(rand.NewSource(time.Now().UnixNano() + int64(w)))
+		keys[w] = wl.keyGen(&seq, rands[w])
+		stats[w] = newOpStats()
+	}
+
+	res := runPool(wl.ops, wl.workers, func(w, _ int) error {
+		cli, st := clients[w], stats[w]
+		op := ops[rands[w].Intn(len(ops))]
+		key := keys[w]()
+		t := time.Now()
+		var err error
+		switch op {
+		case "put":
+			err = cli.Put(key, value)
+		case "get":
+			if _, err = cli.Get(key); errors.Is(err, client.ErrNotFound) {
+				st[op].misses++
+				err = nil
+			}
+		case "scan":
+			var page []common.Record
+			page, _, _, err = cli.ScanPage(key, key+int64(wl.scanLen)-1, wl.scanLen)
+			st[op].records += len(page)
+		}
+		st[op].hist.record(time.Since(t))
+		if err != nil {
+			st[op].errors++
+		}
+		return err
+	})
+
+	total := newOpStats()
+	for _, st := range stats {
+		for _, op := range workloadOps {
+			total[op].merge(st[op])
+		}
+	}
+	return res, total, nil
+}
+
+func newOpStats() map[string]*opStats {
+	stats := make(map[string]*opStats, len(workloadOps))
+	for _, op := range workloadOps {
+		stats[op] = &opStats{hist: newHistogram()}
+	}
+	return stats
+}
+
+// printWorkload reports a run of workload.run.
+func printWorkload(res runResult, stats map[string]*opStats) {
+	fmt.Printf("   Time: %v | QPS: %.0f | errors: %d\n\n", res.elapsed.Round(time.Millisecond), res.qps(), res.errors)
+	fmt.Printf("   %-5s %8s %8s %10s %10s %10s %10s %10s %7s\n", "op", "count", "QPS", "p50", "p90", "p99", "p999", "max", "errors")
+	for _, op := range workloadOps {
+		st := stats[op]
+		if st.hist.n == 0 {
+			continue
+		}
+		h := st.hist
+		fmt.Printf("   %-5s %8d %8.0f %10v %10v %10v %10v %10v %7d\n", op, h.n, float64(h.n)/res.elapsed.Seconds(),
+			h.percentile(0.50), h.percentile(0.90), h.percentile(0.99), h.percentile(0.999), h.max, st.errors)
+	}
+	if st := stats["get"]; st.hist.n > 0 {
+		fmt.Printf("\n   get hit rate: %.1f%%\n", 100*float64(int(st.hist.n)-st.misses-st.errors)/float64(st.hist.n))
+	}
+	if st := stats["scan"]; st.hist.n > 0 {
+		fmt.Printf("   scan records/op: %.1f\n", float64(st.records)/float64(st.hist.n))
+	}
+}
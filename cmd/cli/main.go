@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"neurodb/pkg/client"
+	"neurodb/pkg/common"
 	"os"
 	"strconv"
 	"strings"
@@ -52,6 +53,8 @@ func main() {
 			handleDel(cli, parts)
 		case "scan":
 			handleScan(cli, parts)
+		case "import":
+			handleImport(cli, parts)
 		case "help":
 			printHelp()
 		case "exit", "quit":
@@ -170,6 +173,50 @@ func handleScan(cli *client.Client, parts []string) {
 	}
 }
 
+// importProgressEvery is how many rows import writes between progress lines.
+const importProgressEvery = 10000
+
+func handleImport(cli *client.Client, parts []string) {
+	if len(parts) < 2 {
+		fmt.Println("Usage: import <file.csv>")
+		return
+	}
+
+	f, err := os.Open(parts[1])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer f.Close()
+
+	skipped := 0
+	rows := common.NewKeyValueCSVReader(f)
+	rows.OnBadRow = func(line int, err error) {
+		skipped++
+		if skipped <= 5 {
+			fmt.Printf("  skipping line %d: %v\n", line, err)
+		}
+	}
+
+	start := time.Now()
+	imported := 0
+	for rows.Next() {
+		if err := cli.Put(int64(rows.Key()), rows.Value()); err != nil {
+			fmt.Printf("Error after %d records: %v\n", imported, err)
+			return
+		}
+		imported++
+		if imported%importProgressEvery == 0 {
+			fmt.Printf("  %d records...\n", imported)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		fmt.Printf("Error after %d records: %v\n", imported, err)
+		return
+	}
+	fmt.Printf("Imported %d, skipped %d (%v)\n", imported, skipped, time.Since(start))
+}
+
 func printHelp() {
 	fmt.Println(`
 Commands:
@@ -177,6 +224,7 @@ Commands:
   get <key>              Retrieve record
   del <key>              Delete record
   scan <start> <end>     Range query (inclusive)
+  import <file.csv>      Load key,value rows from a CSV file
   exit                   Exit CLI
 	`)
 }
@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"log"
+	"net"
 	"net/http"
 	"neurodb/pkg/api"
 	"neurodb/pkg/config"
 	"neurodb/pkg/core"
+	"neurodb/pkg/logger"
 	"neurodb/pkg/network"
 	"os"
 	"os/signal"
@@ -17,6 +21,8 @@ import (
 
 func main() {
 	configPath := flag.String("config", "", "Path to config file (default: configs/neuro.yaml or neuro.yaml)")
+	verify := flag.Bool("verify", false, "Check the data directory's files, print a JSON report and exit (status 1 on problems)")
+	repair := flag.Bool("repair", false, "With -verify, quarantine corrupt SSTables and cut a damaged WAL back to its last good entry")
 	flag.Parse()
 
 	log.Println("[Main] Loading configuration...")
@@ -25,48 +31,175 @@ func main() {
 		log.Printf("[Warning] Failed to load config: %v. Using defaults.", err)
 	}
 
-	store := core.NewHybridStore(cfg)
-	log.Printf("[Main] NeuroDB Kernel initialized (Shards: %d)", cfg.System.ShardCount)
+	level, err := logger.ParseLevel(cfg.System.LogLevel)
+	if err != nil {
+		log.Printf("[Warning] %v. Logging at info.", err)
+	}
+	lg := logger.New(os.Stderr, level)
+
+	if *verify {
+		os.Exit(runVerify(core.LayoutOf(cfg.Storage), *repair))
+	}
+	if flag.Arg(0) == "reshard" {
+		os.Exit(runReshard(cfg, flag.Args()[1:], lg))
+	}
+
+	store, err := core.OpenHybridStore(cfg, core.WithLogger(lg))
+	if err != nil {
+		log.Fatalf("[Main] %v", err)
+	}
+	lg.Info("[Main] NeuroDB Kernel initialized (Shards: %d)", cfg.System.ShardCount)
 
 	apiServer := api.NewServer(store)
-	httpSrv := &http.Server{
-		Addr:         cfg.Server.Addr,
-		Handler:      nil,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  120 * time.Second,
+	apiServer.RegisterRoutes()
+	if cfg.Server.DebugEndpoints {
+		apiServer.EnableDebug()
+		lg.Warn("[HTTP] Debug endpoints enabled at /debug/pprof/ and /debug/vars")
+	}
+	httpLn, err := net.Listen("tcp", cfg.Server.Addr)
+	if err != nil {
+		log.Fatalf("[HTTP] Listen failed: %v", err)
 	}
+	useTLS := cfg.Server.TLSCertFile != "" || cfg.Server.TLSKeyFile != ""
 
 	go func() {
-		apiServer.RegisterRoutes()
-		log.Printf("[HTTP] Listening on %s (Dashboard & API)...", cfg.Server.Addr)
-		if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if useTLS {
+			lg.Info("[HTTP] Listening on %s (Dashboard & API, HTTPS)...", cfg.Server.Addr)
+			err = apiServer.ServeTLS(httpLn, cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile)
+		} else {
+			lg.Info("[HTTP] Listening on %s (Dashboard & API)...", cfg.Server.Addr)
+			err = apiServer.Serve(httpLn)
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("[HTTP] Server failed: %v", err)
 		}
 	}()
 
+	if useTLS && cfg.Server.HTTPRedirectAddr != "" {
+		_, httpsPort, err := net.SplitHostPort(cfg.Server.Addr)
+		if err != nil {
+			log.Fatalf("[HTTP] Bad addr %q: %v", cfg.Server.Addr, err)
+		}
+		redirectLn, err := net.Listen("tcp", cfg.Server.HTTPRedirectAddr)
+		if err != nil {
+			log.Fatalf("[HTTP] Redirect listen failed: %v", err)
+		}
+		go func() {
+			lg.Info("[HTTP] Redirecting %s to HTTPS", cfg.Server.HTTPRedirectAddr)
+			if err := apiServer.ServeRedirect(redirectLn, httpsPort); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("[HTTP] Redirect server failed: %v", err)
+			}
+		}()
+	}
+
 	// TCP Server
-	tcpServer := network.NewTCPServer(store)
+	tcpServer := network.NewTCPServer(store, cfg.Server.MaxValueSize)
+	if cfg.Server.TLSCertFile != "" || cfg.Server.TLSKeyFile != "" {
+		tlsConf, err := network.ServerTLSConfig(cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile, cfg.Server.TLSClientCAFile)
+		if err != nil {
+			log.Fatalf("[TCP] %v", err)
+		}
+		tcpServer.UseTLS(tlsConf)
+	}
 	go func() {
-		if err := tcpServer.Start(cfg.Server.TCPAddr); err != nil {
+		if err := tcpServer.Start(cfg.Server.TCPAddr); err != nil && err != network.ErrServerClosed {
 			log.Fatalf("[TCP] Server failed: %v", err)
 		}
 	}()
 
+	stopReplica := func() {}
+	if cfg.Server.ReplicaOf != "" {
+		var replicaTLS *tls.Config
+		if cfg.Server.TLSCertFile != "" || cfg.Server.ReplicaCAFile != "" {
+			caFile := cfg.Server.ReplicaCAFile
+			if caFile == "" {
+				caFile = cfg.Server.TLSClientCAFile
+			}
+			replicaTLS, err = network.ClientTLSConfig(cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile, caFile)
+			if err != nil {
+				log.Fatalf("[Replication] %v", err)
+			}
+		}
+		replica, err := network.NewReplica(store, cfg.Server.ReplicaOf, replicaTLS)
+		if err != nil {
+			log.Fatalf("[Replication] %v", err)
+		}
+		replicaCtx, cancelReplica := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			if err := replica.Run(replicaCtx); err != nil && replicaCtx.Err() == nil {
+				lg.Error("[Replication] Stopped following the primary: %v", err)
+			}
+			close(done)
+		}()
+		stopReplica = func() {
+			cancelReplica()
+			<-done
+		}
+	}
+
 	// Graceful Shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
 	<-quit
-	log.Println("\n[Main] Shutting down...")
+	lg.Info("[Main] Shutting down...")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := httpSrv.Shutdown(ctx); err != nil {
-		log.Printf("[HTTP] Shutdown error: %v", err)
+	if err := apiServer.Shutdown(ctx); err != nil {
+		lg.Error("[HTTP] Shutdown error: %v", err)
+	}
+	if err := tcpServer.Shutdown(ctx); err != nil {
+		lg.Error("[TCP] Shutdown error: %v", err)
 	}
 
-	store.Close()
-	log.Println("[Main] Storage closed. Bye.")
+	stopReplica()
+	// Flush and checkpoint so the next start has no WAL to replay.
+	if err := store.Shutdown(); err != nil {
+		lg.Error("[Main] Shutdown flush failed, the WAL will be replayed on restart: %v", err)
+	}
+	lg.Info("[Main] Storage closed. Bye.")
+}
+
+// runVerify checks the data directory without opening the store and returns
+// the process exit status.
+func runVerify(layout core.Layout, repair bool) int {
+	report, err := core.VerifyLayout(layout, repair)
+	if report != nil {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	}
+	if err != nil {
+		log.Printf("[Verify] %v", err)
+		return 2
+	}
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
+
+// runReshard implements "reshard --shards N": it rewrites the data directory
+// into N shards offline and returns the process exit status.
+func runReshard(cfg *config.Config, args []string, lg logger.Logger) int {
+	fs := flag.NewFlagSet("reshard", flag.ContinueOnError)
+	shards := fs.Int("shards", 0, "New shard count")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *shards <= 0 {
+		log.Printf("[Reshard] Usage: server [-config file] reshard --shards N")
+		return 2
+	}
+	lg.Info("[Reshard] Rewriting %s into %d shards...", cfg.Storage.Path, *shards)
+	if err := core.Reshard(cfg, *shards, core.WithLogger(lg)); err != nil {
+		log.Printf("[Reshard] %v", err)
+		return 1
+	}
+	lg.Info("[Reshard] Done. Set system.shard_count to %d before starting the server.", *shards)
+	return 0
 }
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"neurodb/pkg/common"
+	"neurodb/pkg/config"
+	"neurodb/pkg/core"
+)
+
+func newTestServer(t *testing.T) (*Server, *core.HybridStore) {
+	t.Helper()
+	store := core.NewHybridStore(&config.Config{
+		Storage: config.StorageConfig{
+			Path:                   t.TempDir(),
+			WalBufferSize:          64,
+			MemTableFlushThreshold: 1000,
+			CompactionThreshold:    4,
+			WalBatchSize:           4,
+		},
+		System: config.SystemConfig{
+			ShardCount:     1,
+			BloomSize:      512,
+			BloomFalseProb: 0.01,
+		},
+	})
+	t.Cleanup(store.Close)
+	return NewServer(store), store
+}
+
+func takeBackup(t *testing.T, s *Server) backupPayload {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.handleBackup(rec, httptest.NewRequest(http.MethodGet, "/api/backup", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("backup expected 200, got %d", rec.Code)
+	}
+	var p backupPayload
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+		t.Fatalf("decode backup: %v", err)
+	}
+	if p.Checksum == "" {
+		t.Fatalf("backup has no checksum")
+	}
+	return p
+}
+
+func restoreBackup(t *testing.T, s *Server, p backupPayload, mode string) int {
+	t.Helper()
+	body, err := json.Marshal(p)
+	if err != nil {
+		t.Fatalf("marshal backup: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	s.handleRestore(rec, httptest.NewRequest(http.MethodPost, "/api/restore?mode="+mode, bytes.NewReader(body)))
+	return rec.Code
+}
+
+func TestRestoreRejectsCorruptBackup(t *testing.T) {
+	src, srcStore := newTestServer(t)
+	srcStore.Put(1, []byte("one"))
+	srcStore.Put(2, []byte("two"))
+	srcStore.Put(3, []byte("three"))
+	backup := takeBackup(t, src)
+
+	dst, dstStore := newTestServer(t)
+	dstStore.Put(42, []byte("existing"))
+
+	tampered := backup
+	tampered.Records = append(tampered.Records[:0:0], backup.Records...)
+	tampered.Records[1].Value = []byte("TWO")
+
+	truncated := backup
+	truncated.Records = backup.Records[:2]
+
+	for name, p := range map[string]backupPayload{"tampered": tampered, "truncated": truncated} {
+		if code := restoreBackup(t, dst, p, ""); code != http.StatusUnprocessableEntity {
+			t.Fatalf("%s backup: expected 422, got %d", name, code)
+		}
+		if v, ok := dstStore.Get(42); !ok || string(v) != "existing" {
+			t.Fatalf("%s backup changed existing data: ok=%v val=%q", name, ok, v)
+		}
+		if _, ok := dstStore.Get(1); ok {
+			t.Fatalf("%s backup was partly applied", name)
+		}
+	}
+
+	if code := restoreBackup(t, dst, backup, ""); code != http.StatusOK {
+		t.Fatalf("intact backup: expected 200, got %d", code)
+	}
+	if v, ok := dstStore.Get(2); !ok || string(v) != "two" {
+		t.Fatalf("expected restored key=2='two', got ok=%v val=%q", ok, v)
+	}
+}
+
+func TestRestoreOverwriteAndReplaceModes(t *testing.T) {
+	src, srcStore := newTestServer(t)
+	srcStore.Put(1, []byte("backup-1"))
+	srcStore.Put(3, []byte("backup-3"))
+	backup := takeBackup(t, src)
+
+	populate := func() (*Server, *core.HybridStore) {
+		s, store := newTestServer(t)
+		store.Put(1, []byte("old-1"))
+		store.Put(2, []byte("old-2"))
+		store.Put(9, []byte("old-9"))
+		return s, store
+	}
+	contents := func(store *core.HybridStore) map[common.KeyType]string {
+		out := make(map[common.KeyType]string)
+		for _, rec := range store.Scan(0, 100) {
+			out[rec.Key] = string(rec.Value)
+		}
+		return out
+	}
+
+	tests := []struct {
+		mode string
+		want map[common.KeyType]string
+	}{
+		{"overwrite", map[common.KeyType]string{1: "backup-1", 2: "old-2", 3: "backup-3", 9: "old-9"}},
+		{"replace", map[common.KeyType]string{1: "backup-1", 3: "backup-3"}},
+	}
+	for _, tt := range tests {
+		s, store := populate()
+		// Restoring twice must give the same result as once.
+		for i := 0; i < 2; i++ {
+			if code := restoreBackup(t, s, backup, tt.mode); code != http.StatusOK {
+				t.Fatalf("%s restore #%d: expected 200, got %d", tt.mode, i+1, code)
+			}
+			if got := contents(store); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("%s restore #%d: got %v, want %v", tt.mode, i+1, got, tt.want)
+			}
+		}
+	}
+
+	s, _ := populate()
+	for _, mode := range []string{"upsert", "merge"} {
+		if code := restoreBackup(t, s, backup, mode); code != http.StatusBadRequest {
+			t.Fatalf("unknown mode %s: expected 400, got %d", mode, code)
+		}
+	}
+}
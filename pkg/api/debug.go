@@ -0,0 +1,47 @@
+package api
+
+import (
+	"expvar"
+	"net/http/pprof"
+	"neurodb/pkg/core"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	publishOnce sync.Once
+	// expvar names are process-wide, so the "neurodb" var reports the store
+	// of the server that enabled debugging last.
+	debugStore atomic.Pointer[core.HybridStore]
+)
+
+// EnableDebug serves net/http/pprof under /debug/pprof/ and expvar under
+// /debug/vars, where "neurodb" holds the store's runtime gauges. Call it
+// once, before serving.
+func (s *Server) EnableDebug() {
+	debugStore.Store(s.store)
+	publishOnce.Do(func() {
+		expvar.Publish("neurodb", expvar.Func(debugGauges))
+	})
+
+	s.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	s.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	s.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	s.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	s.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	s.mux.Handle("/debug/vars", expvar.Handler())
+}
+
+func debugGauges() interface{} {
+	gauges := map[string]interface{}{
+		"goroutines": runtime.NumGoroutine(),
+	}
+	if store := debugStore.Load(); store != nil {
+		stats := store.Stats()
+		for _, k := range []string{"pending_writes", "compaction_pending", "memtable_record_count", "l0_sstable_count", "wal_offset"} {
+			gauges[k] = stats[k]
+		}
+	}
+	return gauges
+}
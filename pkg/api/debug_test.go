@@ -0,0 +1,36 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugEndpointsOnlyWhenEnabled(t *testing.T) {
+	disabled, _ := newTestServer(t)
+	disabled.RegisterRoutes()
+	rec := httptest.NewRecorder()
+	disabled.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("pprof with debugging off: expected 404, got %d", rec.Code)
+	}
+
+	enabled, _ := newTestServer(t)
+	enabled.RegisterRoutes()
+	enabled.EnableDebug()
+	rec = httptest.NewRecorder()
+	enabled.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "goroutine") {
+		t.Fatalf("pprof index: expected 200 listing profiles, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	enabled.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	body := rec.Body.String()
+	for _, want := range []string{`"neurodb"`, `"goroutines"`, `"pending_writes"`, `"compaction_pending"`} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expvar output missing %s: %s", want, body)
+		}
+	}
+}
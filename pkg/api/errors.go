@@ -0,0 +1,38 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// apiError is the body of every error response:
+// {"error": {"code": "not_found", "message": "Key not found"}}.
+// Code is stable for clients to switch on; Message is for people.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Position is the byte offset of a SQL parse error.
+	Position *int `json:"position,omitempty"`
+	// Reason says why /api/get found no value: "deleted" or "absent".
+	Reason string `json:"reason,omitempty"`
+}
+
+// writeError answers with status and an error whose code is the status text
+// in snake case, e.g. "method_not_allowed".
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeAPIError(w, status, apiError{Code: statusCode(status), Message: message})
+}
+
+func writeAPIError(w http.ResponseWriter, status int, e apiError) {
+	h := w.Header()
+	h.Del("Content-Disposition")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]apiError{"error": e})
+}
+
+func statusCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
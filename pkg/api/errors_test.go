@@ -0,0 +1,96 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"neurodb/pkg/common"
+)
+
+func TestErrorsHaveStandardShape(t *testing.T) {
+	s, _ := newTestServer(t)
+	panics := s.recoverMiddleware(func(http.ResponseWriter, *http.Request) { panic("boom") })
+
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		target  string
+		body    string
+		status  int
+		code    string
+	}{
+		{"put wrong method", s.handlePut, http.MethodGet, "/api/put", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"health wrong method", s.handleHealth, http.MethodPost, "/api/health", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"put bad body", s.handlePut, http.MethodPost, "/api/put", "{", http.StatusBadRequest, "bad_request"},
+		{"get bad key", s.handleGet, http.MethodGet, "/api/get?key=x", "", http.StatusBadRequest, "bad_request"},
+		{"get missing key", s.handleGet, http.MethodGet, "/api/get?key=404", "", http.StatusNotFound, "not_found"},
+		{"del bad key", s.handleDel, http.MethodDelete, "/api/del?key=x", "", http.StatusBadRequest, "bad_request"},
+		{"scan bad limit", s.handleScan, http.MethodGet, "/api/scan?start=0&end=10&limit=-1", "", http.StatusBadRequest, "bad_request"},
+		{"export without index", s.handleExport, http.MethodGet, "/api/export", "", http.StatusBadRequest, "bad_request"},
+		{"benchmark bad shard", s.handleBenchmark, http.MethodGet, "/api/benchmark?shard=9", "", http.StatusBadRequest, "bad_request"},
+		{"restore bad mode", s.handleRestore, http.MethodPost, "/api/restore?mode=x", "{}", http.StatusBadRequest, "bad_request"},
+		{"sql bad body", s.handleSQL, http.MethodPost, "/api/sql", "{", http.StatusBadRequest, "bad_request"},
+		{"sql parse error", s.handleSQL, http.MethodPost, "/api/sql", `{"query":"SELEC 1"}`, http.StatusBadRequest, "parse_error"},
+		{"sql missing table", s.handleSQL, http.MethodPost, "/api/sql", `{"query":"CREATE INDEX ON nope(name)"}`, http.StatusBadRequest, "query_error"},
+		{"panic", panics, http.MethodGet, "/", "", http.StatusInternalServerError, "internal_server_error"},
+	} {
+		rec := httptest.NewRecorder()
+		tc.handler(rec, httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body)))
+		if rec.Code != tc.status {
+			t.Errorf("%s: status %d, want %d (%s)", tc.name, rec.Code, tc.status, rec.Body.String())
+			continue
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: Content-Type %q, want application/json", tc.name, ct)
+		}
+		var body struct {
+			Error *apiError `json:"error"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error == nil {
+			t.Errorf("%s: body %q is not an error object: %v", tc.name, rec.Body.String(), err)
+			continue
+		}
+		if body.Error.Code != tc.code || body.Error.Message == "" {
+			t.Errorf("%s: error %+v, want code %s with a message", tc.name, *body.Error, tc.code)
+		}
+	}
+}
+
+func TestGetNotFoundGivesReason(t *testing.T) {
+	s, store := newTestServer(t)
+	store.Put(common.KeyType(1), []byte("v"))
+	store.Put(common.KeyType(2), []byte("v"))
+	store.Delete(common.KeyType(2))
+
+	for _, tc := range []struct {
+		key    string
+		status int
+		reason string
+	}{
+		{"1", http.StatusOK, ""},
+		{"2", http.StatusNotFound, "deleted"},
+		{"3", http.StatusNotFound, "absent"},
+	} {
+		rec := httptest.NewRecorder()
+		s.handleGet(rec, httptest.NewRequest(http.MethodGet, "/api/get?key="+tc.key, nil))
+		if rec.Code != tc.status {
+			t.Fatalf("key %s: status %d, want %d", tc.key, rec.Code, tc.status)
+		}
+		if tc.status == http.StatusOK {
+			continue
+		}
+		var body struct {
+			Error apiError `json:"error"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("key %s: decode %q: %v", tc.key, rec.Body.String(), err)
+		}
+		if body.Error.Code != "not_found" || body.Error.Reason != tc.reason {
+			t.Fatalf("key %s: got %+v, want not_found with reason %q", tc.key, body.Error, tc.reason)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// weakETag is a weak entity tag over parts. Weak, because the bodies it tags
+// may differ in fields like latency that do not change what they report.
+func weakETag(parts ...[]byte) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(p)
+		h.Write([]byte{0})
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:12]) + `"`
+}
+
+// etagMatches reports whether the If-None-Match header names tag or is "*".
+// Entity tags compare weakly, ignoring their W/ prefix.
+func etagMatches(header, tag string) bool {
+	tag = strings.TrimPrefix(tag, "W/")
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSONETag writes v as JSON with ETag tag, or only 304 Not Modified when
+// the request already holds it. The caller sets the other headers.
+func writeJSONETag(w http.ResponseWriter, r *http.Request, tag string, v interface{}) {
+	w.Header().Set("ETag", tag)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"neurodb/pkg/common"
+)
+
+func TestReadEndpointsAnswerNotModified(t *testing.T) {
+	s, store := newTestServer(t)
+	store.Put(common.KeyType(7), []byte("seven"))
+	// Until the put is logged, pending_writes and the WAL counters in
+	// /api/stats change between the two requests.
+	if err := store.SyncWAL(); err != nil {
+		t.Fatalf("sync WAL: %v", err)
+	}
+
+	for _, tc := range []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"/api/get?key=7", s.handleGet},
+		{"/api/stats", s.handleStats},
+	} {
+		rec := httptest.NewRecorder()
+		tc.handler(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		tag := rec.Header().Get("ETag")
+		if rec.Code != http.StatusOK || tag == "" {
+			t.Fatalf("%s: expected 200 with an ETag, got %d %q", tc.path, rec.Code, tag)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.Header.Set("If-None-Match", tag)
+		rec = httptest.NewRecorder()
+		tc.handler(rec, req)
+		if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Fatalf("%s: expected an empty 304 for ETag %s, got %d %q", tc.path, tag, rec.Code, rec.Body.String())
+		}
+	}
+
+	// A changed value gets a new tag and the full body.
+	rec := httptest.NewRecorder()
+	s.handleGet(rec, httptest.NewRequest(http.MethodGet, "/api/get?key=7", nil))
+	tag := rec.Header().Get("ETag")
+	store.Put(common.KeyType(7), []byte("SEVEN"))
+	req := httptest.NewRequest(http.MethodGet, "/api/get?key=7", nil)
+	req.Header.Set("If-None-Match", tag)
+	rec = httptest.NewRecorder()
+	s.handleGet(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == tag {
+		t.Fatalf("expected 200 with a new ETag after the update, got %d %q", rec.Code, rec.Header().Get("ETag"))
+	}
+}
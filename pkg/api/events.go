@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"neurodb/pkg/core"
+	"sync"
+	"time"
+)
+
+// eventHub fans the store's flush and compaction events out to the
+// /api/events streams. A stream that falls behind misses events rather than
+// holding up the others.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan core.Event]struct{}
+
+	done     chan struct{} // closed when the server shuts down
+	stopOnce sync.Once
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan core.Event]struct{}), done: make(chan struct{})}
+}
+
+// stop ends every stream; http.Server.Shutdown would otherwise wait on them.
+func (h *eventHub) stop() {
+	h.stopOnce.Do(func() { close(h.done) })
+}
+
+func (h *eventHub) subscribe() chan core.Event {
+	ch := make(chan core.Event, 64)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan core.Event) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+func (h *eventHub) publish(ev core.Event) {
+	ev.Time = time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func (h *eventHub) OnFlush(shardID, records int) {
+	h.publish(core.Event{Kind: "flush", Shard: shardID, Records: records})
+}
+
+func (h *eventHub) OnCompaction(shardID, level, inputs int, outputBytes int64) {
+	h.publish(core.Event{Kind: "compaction", Shard: shardID, Level: level, Inputs: inputs, OutputBytes: outputBytes})
+}
+
+// eventKeepAlive is how often an idle stream gets a comment line, so proxies
+// do not close it.
+const eventKeepAlive = 15 * time.Second
+
+// handleEvents streams flushes and compactions as Server-Sent Events, each
+// named after its kind with the event as JSON data.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// The stream outlives the server's write timeout.
+	rc.SetWriteDeadline(time.Time{})
+
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ping := time.NewTicker(eventKeepAlive)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.events.done:
+			return
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case ev := <-ch:
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Kind, data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
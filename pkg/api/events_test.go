@@ -0,0 +1,66 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"neurodb/pkg/common"
+	"neurodb/pkg/core"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventsStreamsFlushes(t *testing.T) {
+	s, store := newTestServer(t)
+	ts := httptest.NewServer(http.HandlerFunc(s.handleEvents))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("GET /api/events: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected text/event-stream, got %q", ct)
+	}
+
+	// newTestServer flushes memtables at 1000 records.
+	for k := 0; k < 1000; k++ {
+		store.Put(common.KeyType(k), []byte("v"))
+	}
+
+	lines := make(chan string)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			lines <- sc.Text()
+		}
+		close(lines)
+	}()
+	var name string
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("stream ended before a flush event")
+			}
+			if v, ok := strings.CutPrefix(line, "event: "); ok {
+				name = v
+			}
+			if v, ok := strings.CutPrefix(line, "data: "); ok {
+				var ev core.Event
+				if err := json.Unmarshal([]byte(v), &ev); err != nil {
+					t.Fatalf("decode event %q: %v", v, err)
+				}
+				if name != "flush" || ev.Kind != "flush" || ev.Records != 1000 {
+					t.Fatalf("expected a flush of 1000 records, got %s %+v", name, ev)
+				}
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event within 5s")
+		}
+	}
+}
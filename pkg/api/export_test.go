@@ -0,0 +1,64 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"neurodb/pkg/common"
+)
+
+func TestFullExportStreamsAllRecords(t *testing.T) {
+	s, store := newTestServer(t)
+	want := make(map[int64]string)
+	// Enough to flush the memtable and cross several export flushes.
+	for i := int64(0); i < 3*exportFlushRows; i++ {
+		v := fmt.Sprintf("v%d", i)
+		if i%7 == 0 {
+			v = fmt.Sprintf("quoted \"%d\", with comma", i)
+		}
+		store.Put(common.KeyType(i), []byte(v))
+		want[i] = v
+	}
+	for i := int64(0); i < 3*exportFlushRows; i += 5 {
+		store.Delete(common.KeyType(i))
+		delete(want, i)
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleExportFull(rec, httptest.NewRequest(http.MethodGet, "/api/export/full", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("expected a 200 CSV, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !rec.Flushed {
+		t.Fatal("expected the export to flush while streaming")
+	}
+
+	rows, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("export is not valid CSV: %v", err)
+	}
+	if len(rows) == 0 || rows[0][0] != "key" || rows[0][1] != "value" {
+		t.Fatalf("expected a key,value header, got %v", rows[:1])
+	}
+	seen := make(map[int64]bool)
+	for _, row := range rows[1:] {
+		k, err := strconv.ParseInt(row[0], 10, 64)
+		if err != nil {
+			t.Fatalf("bad key %q: %v", row[0], err)
+		}
+		if seen[k] {
+			t.Fatalf("key %d exported twice", k)
+		}
+		seen[k] = true
+		if v, ok := want[k]; !ok || v != row[1] {
+			t.Fatalf("key %d: exported %q, want %q (live=%v)", k, row[1], v, ok)
+		}
+	}
+	if len(seen) != len(want) {
+		t.Fatalf("exported %d records, want %d", len(seen), len(want))
+	}
+}
@@ -1,40 +1,124 @@
 package api
 
 import (
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"math"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"neurodb/pkg/common"
 	"neurodb/pkg/core"
+	"neurodb/pkg/logger"
 	"neurodb/pkg/sql"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type Server struct {
 	store       *core.HybridStore
+	sql         *sql.Executor
 	ingestCount atomic.Int64 // use atomic.Int64 for correct alignment on 32-bit/ARM
+	// The running /api/ingest, if any (see stopIngestLocked).
+	ingestMu     sync.Mutex
+	ingestCancel context.CancelFunc
+	ingestDone   chan struct{}
+	// CSV import progress (see handleImport).
+	importing     atomic.Bool
+	importCount   atomic.Int64
+	importSkipped atomic.Int64
+
+	mux      *http.ServeMux
+	http     *http.Server
+	redirect *http.Server // HTTP->HTTPS redirect listener, if started
+	log      logger.Logger
+	events   *eventHub // feeds /api/events
 }
 
 func NewServer(store *core.HybridStore) *Server {
-	return &Server{store: store}
+	s := &Server{store: store, sql: sql.NewExecutor(store), mux: http.NewServeMux(), log: store.Logger(), events: newEventHub()}
+	s.http = newHTTPServer(s.mux)
+	s.http.RegisterOnShutdown(s.events.stop)
+	store.AddEventListener(s.events)
+	return s
+}
+
+// UseLogger replaces the store's logger for this server.
+func (s *Server) UseLogger(l logger.Logger) {
+	s.log = l
+}
+
+func newHTTPServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:      h,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  120 * time.Second,
+	}
+}
+
+// Serve serves the routes registered by RegisterRoutes on ln.
+func (s *Server) Serve(ln net.Listener) error {
+	return s.http.Serve(ln)
+}
+
+// ServeTLS is Serve over HTTPS with the given certificate and key files.
+func (s *Server) ServeTLS(ln net.Listener, certFile, keyFile string) error {
+	return s.http.ServeTLS(ln, certFile, keyFile)
+}
+
+// ServeRedirect answers plain HTTP on ln with redirects to HTTPS on httpsPort.
+func (s *Server) ServeRedirect(ln net.Listener, httpsPort string) error {
+	s.redirect = newHTTPServer(RedirectToHTTPS(httpsPort))
+	return s.redirect.Serve(ln)
+}
+
+// Shutdown stops the API (and redirect) listeners, letting in-flight
+// requests finish until ctx expires.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.ingestMu.Lock()
+	s.stopIngestLocked()
+	s.ingestMu.Unlock()
+	if s.redirect != nil {
+		if err := s.redirect.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	return s.http.Shutdown(ctx)
+}
+
+// RedirectToHTTPS permanently redirects every request to the same host, path
+// and query on httpsPort. 308 keeps the method, so API POSTs are not turned
+// into GETs.
+func RedirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.Trim(r.Host, "[]")
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	})
 }
 
 // recoverMiddleware recovers panics and returns 500 JSON so one handler panic does not kill the process.
-func recoverMiddleware(next http.HandlerFunc) http.HandlerFunc {
+func (s *Server) recoverMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
-				log.Printf("[API] panic recovered: %v", err)
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusInternalServerError)
-				json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+				s.log.Error("[API] panic recovered: %v", err)
+				writeError(w, http.StatusInternalServerError, "internal server error")
 			}
 		}()
 		next(w, r)
@@ -43,35 +127,65 @@ func recoverMiddleware(next http.HandlerFunc) http.HandlerFunc {
 
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet && r.Method != http.MethodHead {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	// Still alive while read-only: restarting would not free the disk.
+	if err := s.store.ReadOnly(); err != nil {
+		json.NewEncoder(w).Encode(map[string]string{"status": "read_only", "reason": err.Error()})
+		return
+	}
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
+// handleReady is the readiness probe: 503 while the store should not get
+// traffic, with the reasons in the body. /api/health stays a liveness check.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	ready := s.store.Readiness()
+	w.Header().Set("Content-Type", "application/json")
+	if !ready.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(ready)
+}
+
 func (s *Server) RegisterRoutes() {
-	http.HandleFunc("/api/health", recoverMiddleware(s.handleHealth))
-	http.HandleFunc("/metrics", recoverMiddleware(s.handleMetrics))
-	http.HandleFunc("/api/get", recoverMiddleware(s.handleGet))
-	http.HandleFunc("/api/put", recoverMiddleware(s.handlePut))
-	http.HandleFunc("/api/del", recoverMiddleware(s.handleDel))
-	http.HandleFunc("/api/stats", recoverMiddleware(s.handleStats))
-	http.HandleFunc("/api/export", recoverMiddleware(s.handleExport))
-	http.HandleFunc("/api/ingest", recoverMiddleware(s.handleIngest))
-	http.HandleFunc("/api/ingest/status", recoverMiddleware(s.handleIngestStatus))
-	http.HandleFunc("/api/benchmark", recoverMiddleware(s.handleBenchmark))
-	http.HandleFunc("/api/reset", recoverMiddleware(s.handleReset))
-	http.HandleFunc("/api/backup", recoverMiddleware(s.handleBackup))
-	http.HandleFunc("/api/restore", recoverMiddleware(s.handleRestore))
-	http.HandleFunc("/api/mocap/put", recoverMiddleware(s.handleMoCapPut))
-	http.HandleFunc("/api/scan", recoverMiddleware(s.handleScan))
-	http.HandleFunc("/api/heatmap", recoverMiddleware(s.handleHeatmap))
-	http.HandleFunc("/api/sql", recoverMiddleware(s.handleSQL))
+	s.mux.HandleFunc("/api/health", s.recoverMiddleware(s.handleHealth))
+	s.mux.HandleFunc("/api/ready", s.recoverMiddleware(s.handleReady))
+	s.mux.HandleFunc("/metrics", s.recoverMiddleware(s.handleMetrics))
+	s.mux.HandleFunc("/api/get", s.recoverMiddleware(s.handleGet))
+	s.mux.HandleFunc("/api/put", s.recoverMiddleware(s.handlePut))
+	s.mux.HandleFunc("/api/del", s.recoverMiddleware(s.handleDel))
+	s.mux.HandleFunc("/api/stats", s.recoverMiddleware(s.handleStats))
+	s.mux.HandleFunc("/api/shards", s.recoverMiddleware(s.handleShards))
+	s.mux.HandleFunc("/api/export", s.recoverMiddleware(s.handleExport))
+	s.mux.HandleFunc("/api/export/full", s.recoverMiddleware(s.handleExportFull))
+	s.mux.HandleFunc("/api/ingest", s.recoverMiddleware(s.handleIngest))
+	s.mux.HandleFunc("/api/ingest/status", s.recoverMiddleware(s.handleIngestStatus))
+	s.mux.HandleFunc("/api/import", s.recoverMiddleware(s.handleImport))
+	s.mux.HandleFunc("/api/import/status", s.recoverMiddleware(s.handleImportStatus))
+	s.mux.HandleFunc("/api/benchmark", s.recoverMiddleware(s.handleBenchmark))
+	s.mux.HandleFunc("/api/reset", s.recoverMiddleware(s.handleReset))
+	s.mux.HandleFunc("/api/backup", s.recoverMiddleware(s.handleBackup))
+	s.mux.HandleFunc("/api/restore", s.recoverMiddleware(s.handleRestore))
+	s.mux.HandleFunc("/api/digest", s.recoverMiddleware(s.handleDigest))
+	s.mux.HandleFunc("/api/compact", s.recoverMiddleware(s.handleCompact))
+	s.mux.HandleFunc("/api/mocap/put", s.recoverMiddleware(s.handleMoCapPut))
+	s.mux.HandleFunc("/api/scan", s.recoverMiddleware(s.handleScan))
+	s.mux.HandleFunc("/api/heatmap", s.recoverMiddleware(s.handleHeatmap))
+	s.mux.HandleFunc("/api/keydist", s.recoverMiddleware(s.handleKeyDist))
+	s.mux.HandleFunc("/api/keyspace", s.recoverMiddleware(s.handleKeyspace))
+	s.mux.HandleFunc("/api/sql", s.recoverMiddleware(s.handleSQL))
+	s.mux.HandleFunc("/api/events", s.recoverMiddleware(s.handleEvents))
 
 	staticDir := resolveStaticDir()
-	http.Handle("/", recoverMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	s.mux.Handle("/", s.recoverMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		http.FileServer(http.Dir(staticDir)).ServeHTTP(w, r)
 	}))
 }
@@ -79,6 +193,7 @@ func (s *Server) RegisterRoutes() {
 type backupPayload struct {
 	GeneratedAt time.Time       `json:"generated_at"`
 	RecordCount int             `json:"record_count"`
+	Checksum    string          `json:"checksum,omitempty"` // see backupChecksum
 	Records     []common.Record `json:"records"`
 }
 
@@ -99,7 +214,7 @@ func numberToFloat64(v interface{}) float64 {
 
 func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet && r.Method != http.MethodHead {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
@@ -146,16 +261,115 @@ func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "# TYPE neurodb_wal_size_bytes gauge")
 	fmt.Fprintf(w, "neurodb_wal_size_bytes %.0f\n", numberToFloat64(stats["wal_size_bytes"]))
 
+	fmt.Fprintln(w, "# HELP neurodb_reclaimable_bytes SSTable record bytes a full compaction would free.")
+	fmt.Fprintln(w, "# TYPE neurodb_reclaimable_bytes gauge")
+	fmt.Fprintf(w, "neurodb_reclaimable_bytes %.0f\n", numberToFloat64(stats["reclaimable_bytes"]))
+
+	fmt.Fprintln(w, "# HELP neurodb_space_amplification SSTable bytes per byte of live data.")
+	fmt.Fprintln(w, "# TYPE neurodb_space_amplification gauge")
+	fmt.Fprintf(w, "neurodb_space_amplification %g\n", numberToFloat64(stats["space_amplification"]))
+
+	fmt.Fprintln(w, "# HELP neurodb_wal_offset Log offset the next WAL entry will get; it only grows.")
+	fmt.Fprintln(w, "# TYPE neurodb_wal_offset counter")
+	fmt.Fprintf(w, "neurodb_wal_offset %.0f\n", numberToFloat64(stats["wal_offset"]))
+
+	fmt.Fprintln(w, "# HELP neurodb_wal_batch_flushes WAL batches written and synced.")
+	fmt.Fprintln(w, "# TYPE neurodb_wal_batch_flushes counter")
+	fmt.Fprintf(w, "neurodb_wal_batch_flushes %.0f\n", numberToFloat64(stats["wal_batch_flushes"]))
+
+	fmt.Fprintln(w, "# HELP neurodb_wal_avg_batch_size Mean records per WAL batch.")
+	fmt.Fprintln(w, "# TYPE neurodb_wal_avg_batch_size gauge")
+	fmt.Fprintf(w, "neurodb_wal_avg_batch_size %f\n", numberToFloat64(stats["wal_avg_batch_size"]))
+
+	fmt.Fprintln(w, "# HELP neurodb_wal_flushes_per_sec Mean WAL batch flushes per second since the store opened.")
+	fmt.Fprintln(w, "# TYPE neurodb_wal_flushes_per_sec gauge")
+	fmt.Fprintf(w, "neurodb_wal_flushes_per_sec %f\n", numberToFloat64(stats["wal_flushes_per_sec"]))
+
+	fmt.Fprintln(w, "# HELP neurodb_events_dropped Flush and compaction events dropped because listeners fell behind.")
+	fmt.Fprintln(w, "# TYPE neurodb_events_dropped counter")
+	fmt.Fprintf(w, "neurodb_events_dropped %.0f\n", numberToFloat64(stats["events_dropped"]))
+
 	fmt.Fprintln(w, "# HELP neurodb_rw_ratio Read/write ratio.")
 	fmt.Fprintln(w, "# TYPE neurodb_rw_ratio gauge")
 	fmt.Fprintf(w, "neurodb_rw_ratio %f\n", numberToFloat64(stats["rw_ratio"]))
+
+	fmt.Fprintln(w, "# HELP neurodb_bloom_fill_ratio Fraction of bloom filter bits set across shards.")
+	fmt.Fprintln(w, "# TYPE neurodb_bloom_fill_ratio gauge")
+	fmt.Fprintf(w, "neurodb_bloom_fill_ratio %f\n", numberToFloat64(stats["bloom_fill_ratio"]))
+
+	fmt.Fprintln(w, "# HELP neurodb_bloom_resizes Bloom filters rebuilt because they passed their design capacity.")
+	fmt.Fprintln(w, "# TYPE neurodb_bloom_resizes counter")
+	fmt.Fprintf(w, "neurodb_bloom_resizes %.0f\n", numberToFloat64(stats["bloom_resizes"]))
+
+	fmt.Fprintln(w, "# HELP neurodb_bloom_estimated_fp Estimated bloom filter false positive rate at the current fill.")
+	fmt.Fprintln(w, "# TYPE neurodb_bloom_estimated_fp gauge")
+	fmt.Fprintf(w, "neurodb_bloom_estimated_fp %g\n", numberToFloat64(stats["bloom_estimated_fp"]))
+
+	// Set once when the store opened.
+	st := s.store.Startup()
+	fmt.Fprintln(w, "# HELP neurodb_startup_seconds Time the last open spent in each recovery phase.")
+	fmt.Fprintln(w, "# TYPE neurodb_startup_seconds gauge")
+	for _, p := range []struct {
+		phase string
+		d     time.Duration
+	}{
+		{"sstable_restore", st.SSTableRestore},
+		{"index_restore", st.IndexRestore},
+		{"wal_replay", st.WALReplay},
+		{"checkpoint", st.Checkpoint},
+		{"total", st.Total},
+	} {
+		fmt.Fprintf(w, "neurodb_startup_seconds{phase=%q} %g\n", p.phase, p.d.Seconds())
+	}
+
+	fmt.Fprintln(w, "# HELP neurodb_startup_wal_records_replayed WAL records and range deletes the last open replayed.")
+	fmt.Fprintln(w, "# TYPE neurodb_startup_wal_records_replayed gauge")
+	fmt.Fprintf(w, "neurodb_startup_wal_records_replayed %d\n", st.WALRecords)
+
+	fmt.Fprintln(w, "# HELP neurodb_startup_sstables_restored SSTables the last open restored.")
+	fmt.Fprintln(w, "# TYPE neurodb_startup_sstables_restored gauge")
+	fmt.Fprintf(w, "neurodb_startup_sstables_restored %d\n", st.SSTablesRestored)
+
+	fmt.Fprintln(w, "# HELP neurodb_startup_indexes Learned indexes the last open loaded from disk or rebuilt.")
+	fmt.Fprintln(w, "# TYPE neurodb_startup_indexes gauge")
+	fmt.Fprintf(w, "neurodb_startup_indexes{source=\"loaded\"} %d\n", st.IndexesLoaded)
+	fmt.Fprintf(w, "neurodb_startup_indexes{source=\"rebuilt\"} %d\n", st.IndexesRebuilt)
+
+	models := s.store.ModelStats()
+	fmt.Fprintln(w, "# HELP neurodb_model_build_seconds Time each shard's last learned-index build took.")
+	fmt.Fprintln(w, "# TYPE neurodb_model_build_seconds gauge")
+	for _, m := range models {
+		fmt.Fprintf(w, "neurodb_model_build_seconds{shard=\"%d\"} %g\n", m.Shard, m.BuildMs/1000)
+	}
+	fmt.Fprintln(w, "# HELP neurodb_model_size_bytes Memory taken by each shard's learned-index models.")
+	fmt.Fprintln(w, "# TYPE neurodb_model_size_bytes gauge")
+	for _, m := range models {
+		fmt.Fprintf(w, "neurodb_model_size_bytes{shard=\"%d\"} %d\n", m.Shard, m.SizeBytes)
+	}
+	fmt.Fprintln(w, "# HELP neurodb_model_records Keys each shard's learned-index models were fit to.")
+	fmt.Fprintln(w, "# TYPE neurodb_model_records gauge")
+	for _, m := range models {
+		fmt.Fprintf(w, "neurodb_model_records{shard=\"%d\"} %d\n", m.Shard, m.RecordCount)
+	}
+
+	readOnly := 0
+	if stats["read_only"] == true {
+		readOnly = 1
+	}
+	fmt.Fprintln(w, "# HELP neurodb_read_only 1 while the disk refuses writes and the store rejects them.")
+	fmt.Fprintln(w, "# TYPE neurodb_read_only gauge")
+	fmt.Fprintf(w, "neurodb_read_only %d\n", readOnly)
+
+	fmt.Fprintln(w, "# HELP neurodb_shard_imbalance Max/mean records per shard.")
+	fmt.Fprintln(w, "# TYPE neurodb_shard_imbalance gauge")
+	fmt.Fprintf(w, "neurodb_shard_imbalance %f\n", numberToFloat64(stats["shard_imbalance"]))
 }
 
 func (s *Server) handleDel(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	if r.Method != http.MethodDelete && r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed (Use DELETE or POST)", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed (Use DELETE or POST)")
 		return
 	}
 
@@ -170,18 +384,21 @@ func (s *Server) handleDel(w http.ResponseWriter, r *http.Request) {
 			Key int `json:"key"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Missing key in Query or Body", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, "Missing key in Query or Body")
 			return
 		}
 		keyInt = req.Key
 	}
 
 	if err != nil {
-		http.Error(w, "Invalid key format", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "Invalid key format")
 		return
 	}
 
-	s.store.Delete(common.KeyType(keyInt))
+	if err := s.store.DeleteContext(r.Context(), common.KeyType(keyInt)); err != nil {
+		writeError(w, writeErrorStatus(err), err.Error())
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Deleted"))
@@ -219,21 +436,86 @@ func (s *Server) handleHeatmap(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+const (
+	defaultKeyDistBuckets = 100
+	maxKeyDistBuckets     = 1000
+)
+
+// handleKeyDist accepts ?buckets=N and ?shard=K|all and returns the
+// histogram of the learned indexes' keys (core.KeyDistribution).
+func (s *Server) handleKeyDist(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	q := r.URL.Query()
+	buckets := defaultKeyDistBuckets
+	if v := q.Get("buckets"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxKeyDistBuckets {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("buckets must be between 1 and %d", maxKeyDistBuckets))
+			return
+		}
+		buckets = n
+	}
+	shard := -1
+	if v := q.Get("shard"); v != "" && v != "all" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "shard must be a shard number or 'all'")
+			return
+		}
+		shard = n
+	}
+
+	hist, err := s.store.KeyDistribution(buckets, shard)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(hist)
+}
+
+// handleKeyspace returns the key bounds, live key count and density of the
+// store and of each shard (core.KeyspaceStats).
+func (s *Server) handleKeyspace(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	ks, err := s.store.KeyspaceStatsContext(r.Context())
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ks)
+}
+
 func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	keyStr := r.URL.Query().Get("key")
 	keyInt, err := strconv.Atoi(keyStr)
 	if err != nil {
-		http.Error(w, "Invalid key", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "Invalid key")
+		return
+	}
+
+	if r.URL.Query().Get("explain") == "true" {
+		s.explainGet(w, common.KeyType(keyInt))
 		return
 	}
 
 	start := time.Now()
-	val, found := s.store.Get(common.KeyType(keyInt))
+	val, st, err := s.store.GetWithStatusContext(r.Context(), common.KeyType(keyInt))
 	duration := time.Since(start)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
 
-	if !found {
-		http.Error(w, "Key not found", http.StatusNotFound)
+	if st != common.KeyFound {
+		writeAPIError(w, http.StatusNotFound, apiError{Code: statusCode(http.StatusNotFound), Message: "Key not found", Reason: st.String()})
 		return
 	}
 
@@ -244,14 +526,38 @@ func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
 		"latency_ns": duration.Nanoseconds(),
 	}
 
+	// The tag follows the value, so polling an unchanged key gets a 304.
+	w.Header().Set("Content-Type", "application/json")
+	writeJSONETag(w, r, weakETag([]byte(strconv.Itoa(keyInt)), val), resp)
+}
+
+// explainGet answers /api/get?explain=true: the usual fields plus the
+// store's trace of the lookup. A missing key is still a 404, with the trace.
+func (s *Server) explainGet(w http.ResponseWriter, key common.KeyType) {
+	start := time.Now()
+	val, trace := s.store.GetExplain(key)
+	duration := time.Since(start)
+
+	resp := map[string]interface{}{
+		"key":        key,
+		"found":      trace.Found,
+		"latency_ns": duration.Nanoseconds(),
+		"trace":      trace,
+	}
+	if trace.Found {
+		resp["value"] = string(val)
+	}
 	w.Header().Set("Content-Type", "application/json")
+	if !trace.Found {
+		w.WriteHeader(http.StatusNotFound)
+	}
 	json.NewEncoder(w).Encode(resp)
 }
 
 func (s *Server) handlePut(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
@@ -261,27 +567,59 @@ func (s *Server) handlePut(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid body", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "Invalid body")
 		return
 	}
 
-	s.store.Put(common.KeyType(req.Key), []byte(req.Value))
+	if err := s.store.PutContext(r.Context(), common.KeyType(req.Key), []byte(req.Value)); err != nil {
+		writeError(w, writeErrorStatus(err), err.Error())
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
 
+// writeErrorStatus is the HTTP status for a failed store write: 413 for a
+// value over the size limit, 503 for a request given up on or a store that
+// cannot write right now, else 500.
+func writeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, core.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, core.ErrFlushFailed), errors.Is(err, core.ErrReadOnly), errors.Is(err, core.ErrClosed),
+		errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 	stats := s.store.Stats()
-	json.NewEncoder(w).Encode(stats)
+	// wal_flushes_per_sec drifts with time alone; the tag covers the rest.
+	tagged := make(map[string]interface{}, len(stats))
+	for k, v := range stats {
+		if k != "wal_flushes_per_sec" {
+			tagged[k] = v
+		}
+	}
+	body, _ := json.Marshal(tagged)
+	writeJSONETag(w, r, weakETag(body), stats)
+}
+
+func (s *Server) handleShards(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.store.ShardStats())
 }
 
 func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	data, err := s.store.ExportModelData()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 	w.Header().Set("Content-Type", "text/csv")
@@ -293,12 +631,87 @@ func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// exportFlushRows is how many CSV rows /api/export/full writes between
+// flushes to the client.
+const exportFlushRows = 1000
+
+// handleExportFull streams every live record as a key,value CSV. Rows are
+// written as the scan produces them and flushed every exportFlushRows, so
+// the client starts receiving at once and nothing is held in memory.
+func (s *Server) handleExportFull(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment;filename=neurodb_export.csv")
+	rc := http.NewResponseController(w)
+	// A large export outlasts the server's write timeout.
+	rc.SetWriteDeadline(time.Time{})
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"key", "value"})
+	rows := 0
+	start, end := s.store.FullRange()
+	err := s.store.ScanFunc(r.Context(), start, end, func(rec common.Record) error {
+		if err := cw.Write([]string{strconv.FormatInt(int64(rec.Key), 10), string(rec.Value)}); err != nil {
+			return err
+		}
+		if rows++; rows%exportFlushRows == 0 {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+			rc.Flush()
+		}
+		return nil
+	})
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	if err != nil {
+		// The status is sent; the client sees a truncated file.
+		s.log.Warn("[API] Full export stopped after %d records: %v", rows, err)
+	}
+}
+
+// stopIngestLocked cancels the running ingest, if any, and waits for it to
+// stop writing. The caller holds s.ingestMu.
+func (s *Server) stopIngestLocked() {
+	if s.ingestCancel == nil {
+		return
+	}
+	s.ingestCancel()
+	<-s.ingestDone
+	s.ingestCancel, s.ingestDone = nil, nil
+}
+
+// handleIngest writes 100k random records in the background. It replaces
+// an ingest already running; a reset or shutdown cancels it.
 func (s *Server) handleIngest(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.ingestMu.Lock()
+	defer s.ingestMu.Unlock()
+	s.stopIngestLocked()
 	s.ingestCount.Store(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	s.ingestCancel, s.ingestDone = cancel, done
 
 	go func() {
-		log.Println("[API] Starting randomized auto-ingestion...")
+		defer func() {
+			cancel()
+			close(done)
+			// Forget this ingest unless a newer one replaced it.
+			s.ingestMu.Lock()
+			if s.ingestDone == done {
+				s.ingestCancel, s.ingestDone = nil, nil
+			}
+			s.ingestMu.Unlock()
+		}()
+		s.log.Info("[API] Starting randomized auto-ingestion...")
 		currentKey := rand.Intn(1000000)
 		count := 100000
 
@@ -306,14 +719,21 @@ func (s *Server) handleIngest(w http.ResponseWriter, r *http.Request) {
 			step := rand.Intn(5) + 1
 			currentKey += step
 			val := fmt.Sprintf("neuro-data-%d", currentKey)
-			s.store.Put(common.KeyType(currentKey), []byte(val))
+			if err := s.store.PutContext(ctx, common.KeyType(currentKey), []byte(val)); err != nil {
+				if ctx.Err() != nil {
+					s.log.Info("[API] Ingest cancelled after %d writes", i)
+				} else {
+					s.log.Error("[API] Ingest stopped at key %d: %v", currentKey, err)
+				}
+				return
+			}
 
 			s.ingestCount.Add(1)
 			if i%1000 == 0 {
 				time.Sleep(1 * time.Millisecond)
 			}
 		}
-		log.Printf("[API] Ingest complete. Last Key: %d", currentKey)
+		s.log.Info("[API] Ingest complete. Last Key: %d", currentKey)
 	}()
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Ingestion Started"))
@@ -325,83 +745,180 @@ func (s *Server) handleIngestStatus(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]int64{"ingested": count})
 }
 
+const (
+	defaultBenchmarkIterations = 50000
+	maxBenchmarkIterations     = 1000000
+)
+
+// handleBenchmark accepts ?iterations=N and ?shard=K|all. The top-level
+// numbers aggregate every benchmarked shard, weighted by lookups.
 func (s *Server) handleBenchmark(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
-	bTime, aiTime, err := s.store.BenchmarkAlgo(50000)
+
+	q := r.URL.Query()
+	iterations := defaultBenchmarkIterations
+	if v := q.Get("iterations"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxBenchmarkIterations {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("iterations must be between 1 and %d", maxBenchmarkIterations))
+			return
+		}
+		iterations = n
+	}
+	target, shard := "all", -1
+	if v := q.Get("shard"); v != "" && v != "all" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "shard must be a shard number or 'all'")
+			return
+		}
+		target, shard = v, n
+	}
+
+	results, err := s.store.BenchmarkAlgo(iterations, shard)
 	if err != nil {
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+
+	type shardResult struct {
+		core.BenchmarkResult
+		Speedup float64 `json:"speedup"`
+	}
+	perShard := make([]shardResult, len(results))
+	var bTime, aiTime float64
+	datasetSize := 0
+	for i, res := range results {
+		perShard[i] = shardResult{BenchmarkResult: res}
+		if res.LearnedAvgNs > 0 {
+			perShard[i].Speedup = res.BinaryAvgNs / res.LearnedAvgNs
+		}
+		bTime += res.BinaryAvgNs
+		aiTime += res.LearnedAvgNs
+		datasetSize += res.Keys
+	}
+	bTime /= float64(len(results))
+	aiTime /= float64(len(results))
+
 	result := map[string]interface{}{
-		"iterations":   50000,
+		"iterations":   iterations,
+		"target":       target,
+		"dataset_size": datasetSize,
 		"btree_avg_ns": fmt.Sprintf("%.2f ns", bTime),
 		"ai_avg_ns":    fmt.Sprintf("%.2f ns", aiTime),
 		"speedup":      fmt.Sprintf("%.2fx", bTime/aiTime),
+		"shards":       perShard,
 	}
 	json.NewEncoder(w).Encode(result)
 }
 
 func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
+	// An ingest would go on writing into the emptied store.
+	s.ingestMu.Lock()
+	defer s.ingestMu.Unlock()
+	s.stopIngestLocked()
 	if err := s.store.Reset(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Database Reset Successful"))
 }
 
+func (s *Server) handleCompact(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := s.store.Compact(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	stats := s.store.Stats()
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":            "compacted",
+		"sstable_bytes":     stats["sstable_bytes"],
+		"reclaimable_bytes": stats["reclaimable_bytes"],
+	})
+}
+
 func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
-	records := s.store.Scan(common.KeyType(math.MinInt64), common.KeyType(math.MaxInt64))
+	start, end := s.store.FullRange()
+	records, err := s.store.ScanContext(r.Context(), start, end)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
 	resp := backupPayload{
 		GeneratedAt: time.Now().UTC(),
 		RecordCount: len(records),
+		Checksum:    backupChecksum(records),
 		Records:     records,
 	}
 	json.NewEncoder(w).Encode(resp)
 }
 
+// handleRestore applies a backup. ?mode=replace (the default) makes the
+// database match the backup; ?mode=overwrite writes the backup's records over
+// the current data and keeps keys the backup lacks. The store keeps no
+// per-key versions to compare, so in both modes the backup's value wins over
+// a newer one. Both are idempotent.
 func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = restoreReplace
+	}
+	if mode != restoreReplace && mode != restoreOverwrite {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid mode %q (want replace or overwrite)", mode))
 		return
 	}
 
 	var req backupPayload
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid body", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "Invalid body")
 		return
 	}
-
-	if err := s.store.Reset(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// Checked before anything is touched, so a bad backup changes nothing.
+	if err := req.verify(); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
 		return
 	}
 
-	for _, rec := range req.Records {
-		s.store.Put(rec.Key, rec.Value)
+	deleted, err := s.applyBackup(r.Context(), req.Records, mode == restoreReplace)
+	if err != nil {
+		writeError(w, writeErrorStatus(err), err.Error())
+		return
 	}
 
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status":         "ok",
+		"mode":           mode,
 		"restored_count": len(req.Records),
+		"deleted_count":  deleted,
 	})
 }
 
 func (s *Server) handleMoCapPut(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 	var req struct {
@@ -411,29 +928,90 @@ func (s *Server) handleMoCapPut(w http.ResponseWriter, r *http.Request) {
 		D string `json:"data"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid body", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "Invalid body")
 		return
 	}
 	zKey, err := common.Encode3D(req.X, req.Y, req.Z)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.store.PutContext(r.Context(), common.KeyType(zKey), []byte(req.D)); err != nil {
+		writeError(w, writeErrorStatus(err), err.Error())
 		return
 	}
-	s.store.Put(common.KeyType(zKey), []byte(req.D))
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "spatial_key": zKey})
 }
 
 func (s *Server) handleScan(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	start, _ := strconv.Atoi(r.URL.Query().Get("start"))
-	end, _ := strconv.Atoi(r.URL.Query().Get("end"))
+	q := r.URL.Query()
+	start, _ := strconv.Atoi(q.Get("start"))
+	end, _ := strconv.Atoi(q.Get("end"))
+	// A cursor from a previous page replaces start.
+	if c := q.Get("cursor"); c != "" {
+		cursor, err := strconv.ParseInt(c, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+		start = int(cursor)
+	}
+	limit := 0
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
 
-	records := s.store.Scan(common.KeyType(start), common.KeyType(end))
+	// keys_only skips the values and reports each key with its value size.
+	var data interface{}
+	var count int
+	var truncated bool
+	var next common.KeyType
+	if q.Get("keys_only") == "true" {
+		// One key past the limit tells a cut-off range from an exact fit.
+		fetch := limit
+		if limit > 0 {
+			fetch = limit + 1
+		}
+		sizes, err := s.store.ScanKeySizesContext(r.Context(), common.KeyType(start), common.KeyType(end), fetch)
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		if limit > 0 && len(sizes) > limit {
+			truncated, next, sizes = true, sizes[limit].Key, sizes[:limit]
+		}
+		count, data = len(sizes), sizes
+	} else {
+		page, err := s.store.ScanPageContext(r.Context(), common.KeyType(start), common.KeyType(end), limit)
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		truncated, next = page.Truncated, page.NextKey
+		count, data = len(page.Records), page.Records
+		if fields := parseFields(q.Get("fields")); len(fields) > 0 {
+			data = projectRecords(page.Records, fields)
+		}
+	}
 
 	resp := map[string]interface{}{
-		"count": len(records),
-		"data":  records,
+		"count":     count,
+		"data":      data,
+		"truncated": truncated,
+	}
+	if limit > 0 {
+		var cursor interface{}
+		if truncated {
+			cursor = int64(next)
+		}
+		resp["next_cursor"] = cursor
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
@@ -443,41 +1021,37 @@ func (s *Server) handleSQL(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 	var req struct {
 		Query string `json:"query"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{"error": "invalid body"})
+		writeError(w, http.StatusBadRequest, "Invalid body")
 		return
 	}
-	stmt, err := sql.Parse(req.Query)
+	res, err := s.sql.Execute(req.Query)
 	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		writeSQLError(w, err)
 		return
 	}
-	start, end := stmt.TableKeyRange()
-	records := s.store.Scan(common.KeyType(start), common.KeyType(end))
-	rows := make([]map[string]interface{}, 0, len(records))
-	for _, rec := range records {
-		if !stmt.MatchID(int64(rec.Key)) {
-			continue
-		}
-		rows = append(rows, map[string]interface{}{
-			"id":   rec.Key,
-			"data": string(rec.Value),
-		})
-		if stmt.Limit >= 0 && len(rows) >= stmt.Limit {
-			break
-		}
+	json.NewEncoder(w).Encode(res)
+}
+
+// writeSQLError answers a failed statement: 400 parse_error with the
+// position for a syntax error, the store's status for a failed write, and
+// 400 query_error for a statement that cannot run, e.g. on a missing table.
+func writeSQLError(w http.ResponseWriter, err error) {
+	var perr *sql.ParseError
+	switch {
+	case errors.As(err, &perr):
+		writeAPIError(w, http.StatusBadRequest, apiError{Code: "parse_error", Message: err.Error(), Position: &perr.Pos})
+	case writeErrorStatus(err) != http.StatusInternalServerError:
+		writeError(w, writeErrorStatus(err), err.Error())
+	default:
+		writeAPIError(w, http.StatusBadRequest, apiError{Code: "query_error", Message: err.Error()})
 	}
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"table": stmt.Table,
-		"count": len(rows),
-		"rows":  rows,
-	})
 }
 
 func resolveStaticDir() string {
@@ -57,6 +57,14 @@ func TestHandleMetricsExposesPrometheusFormat(t *testing.T) {
 		"neurodb_l1_sstable_files",
 		"neurodb_wal_size_bytes",
 		"neurodb_rw_ratio",
+		"neurodb_bloom_fill_ratio",
+		"neurodb_bloom_estimated_fp",
+		"neurodb_shard_imbalance",
+		"neurodb_startup_seconds{phase=\"total\"}",
+		"neurodb_startup_wal_records_replayed",
+		"neurodb_model_build_seconds{shard=\"0\"}",
+		"neurodb_model_size_bytes{shard=\"0\"}",
+		"neurodb_model_records{shard=\"0\"}",
 	}
 	for _, m := range want {
 		if !strings.Contains(body, m) {
@@ -202,3 +210,276 @@ func TestHandleSQLWhereAndLimit(t *testing.T) {
 		t.Fatalf("expected second row id=%d got %d", k3, id1)
 	}
 }
+
+func TestHandleSQLTypedColumns(t *testing.T) {
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			Path:                   t.TempDir(),
+			WalBufferSize:          8,
+			MemTableFlushThreshold: 1000,
+			CompactionThreshold:    4,
+			WalBatchSize:           4,
+		},
+		System: config.SystemConfig{
+			ShardCount:     1,
+			BloomSize:      512,
+			BloomFalseProb: 0.01,
+		},
+	}
+	store := core.NewHybridStore(cfg)
+	defer store.Close()
+	s := NewServer(store)
+
+	exec := func(query string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"query":%q}`, query)
+		req := httptest.NewRequest(http.MethodPost, "/api/sql", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		s.handleSQL(rec, req)
+		return rec
+	}
+
+	exec("CREATE TABLE users (id INT, name TEXT, age INT)")
+	exec("INSERT INTO users VALUES (1, 'alice', 31)")
+	rec := exec("SELECT * FROM users")
+
+	var resp struct {
+		Error   string                   `json:"error"`
+		Columns []string                 `json:"columns"`
+		Count   int                      `json:"count"`
+		Rows    []map[string]interface{} `json:"rows"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode sql response: %v", err)
+	}
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if resp.Count != 1 || strings.Join(resp.Columns, ",") != "id,name,age" {
+		t.Fatalf("unexpected typed result: %+v", resp)
+	}
+	if resp.Rows[0]["name"] != "alice" || resp.Rows[0]["age"] != float64(31) {
+		t.Fatalf("unexpected typed row: %#v", resp.Rows[0])
+	}
+}
+
+func TestHandleSQLParseErrorPosition(t *testing.T) {
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			Path:                   t.TempDir(),
+			WalBufferSize:          8,
+			MemTableFlushThreshold: 1000,
+			CompactionThreshold:    4,
+			WalBatchSize:           4,
+		},
+		System: config.SystemConfig{
+			ShardCount:     1,
+			BloomSize:      512,
+			BloomFalseProb: 0.01,
+		},
+	}
+	store := core.NewHybridStore(cfg)
+	defer store.Close()
+	s := NewServer(store)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/sql", strings.NewReader(`{"query":"SELECT * FORM users"}`))
+	rec := httptest.NewRecorder()
+	s.handleSQL(rec, req)
+
+	var resp struct {
+		Error apiError `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode sql response: %v", err)
+	}
+	if rec.Code != http.StatusBadRequest || resp.Error.Code != "parse_error" || resp.Error.Position == nil || *resp.Error.Position != 9 {
+		t.Fatalf("expected 400 parse_error with position 9, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandleSQLExplain(t *testing.T) {
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			Path:                   t.TempDir(),
+			WalBufferSize:          8,
+			MemTableFlushThreshold: 1000,
+			CompactionThreshold:    4,
+			WalBatchSize:           4,
+		},
+		System: config.SystemConfig{
+			ShardCount:     1,
+			BloomSize:      512,
+			BloomFalseProb: 0.01,
+		},
+	}
+	store := core.NewHybridStore(cfg)
+	defer store.Close()
+	s := NewServer(store)
+
+	start, _ := sql.TableKeyRange("events")
+	for i := int64(1); i <= 5; i++ {
+		store.Put(common.KeyType(start+i), []byte("v"))
+	}
+
+	query := fmt.Sprintf("EXPLAIN SELECT * FROM events WHERE id <= %d", start+3)
+	body := fmt.Sprintf(`{"query":%q}`, query)
+	req := httptest.NewRequest(http.MethodPost, "/api/sql", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	s.handleSQL(rec, req)
+
+	var resp struct {
+		Plan *struct {
+			Access        string `json:"access"`
+			EndKey        int64  `json:"end_key"`
+			KeyLookup     string `json:"key_lookup"`
+			EstimatedRows int    `json:"estimated_rows"`
+		} `json:"plan"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode sql response: %v", err)
+	}
+	if resp.Plan == nil || resp.Plan.Access != "range_scan" || resp.Plan.EndKey != start+3 {
+		t.Fatalf("unexpected plan: %s", rec.Body.String())
+	}
+	if resp.Plan.KeyLookup != "binary_search" || resp.Plan.EstimatedRows != 3 {
+		t.Fatalf("expected memtable estimate of 3 rows, got %s", rec.Body.String())
+	}
+}
+
+func TestHandleBenchmarkPerShard(t *testing.T) {
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			Path:                   t.TempDir(),
+			WalBufferSize:          1024,
+			MemTableFlushThreshold: 1000,
+			CompactionThreshold:    4,
+			WalBatchSize:           4,
+		},
+		System: config.SystemConfig{
+			ShardCount:     2,
+			BloomSize:      512,
+			BloomFalseProb: 0.01,
+		},
+	}
+	store := core.NewHybridStore(cfg)
+	for i := 1; i <= 400; i++ {
+		store.Put(common.KeyType(i), []byte("v"))
+	}
+	store.Close()
+
+	// Reopening checkpoints the WAL and builds a learned index per shard.
+	store = core.NewHybridStore(cfg)
+	defer store.Close()
+	s := NewServer(store)
+
+	type benchResponse struct {
+		Iterations  int    `json:"iterations"`
+		Target      string `json:"target"`
+		DatasetSize int    `json:"dataset_size"`
+		BTreeAvg    string `json:"btree_avg_ns"`
+		AIAvg       string `json:"ai_avg_ns"`
+		Speedup     string `json:"speedup"`
+		Shards      []struct {
+			Shard   int     `json:"shard"`
+			Keys    int     `json:"keys"`
+			BTree   float64 `json:"btree_avg_ns"`
+			AI      float64 `json:"ai_avg_ns"`
+			Speedup float64 `json:"speedup"`
+		} `json:"shards"`
+	}
+	run := func(query string) (int, benchResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/api/benchmark?"+query, nil)
+		rec := httptest.NewRecorder()
+		s.handleBenchmark(rec, req)
+		var resp benchResponse
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decode benchmark response: %v body=%s", err, rec.Body.String())
+			}
+		}
+		return rec.Code, resp
+	}
+
+	_, all := run("iterations=200")
+	if all.Iterations != 200 || all.Target != "all" || all.DatasetSize != 400 || len(all.Shards) != 2 {
+		t.Fatalf("unexpected aggregate response: %+v", all)
+	}
+	if all.BTreeAvg == "" || all.AIAvg == "" || all.Speedup == "" {
+		t.Fatalf("expected aggregate timings, got %+v", all)
+	}
+	keys := 0
+	for _, sh := range all.Shards {
+		if sh.Keys == 0 {
+			t.Fatalf("expected keys in shard %d", sh.Shard)
+		}
+		keys += sh.Keys
+	}
+	if keys != all.DatasetSize {
+		t.Fatalf("per-shard keys %d do not add up to dataset size %d", keys, all.DatasetSize)
+	}
+
+	_, one := run("iterations=50&shard=1")
+	if one.Target != "1" || len(one.Shards) != 1 || one.Shards[0].Shard != 1 || one.DatasetSize != one.Shards[0].Keys {
+		t.Fatalf("unexpected single-shard response: %+v", one)
+	}
+
+	for _, bad := range []string{"iterations=0", "iterations=abc", "shard=-1", "shard=x"} {
+		if code, _ := run(bad); code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", bad, code)
+		}
+	}
+}
+
+func TestHandleShardsReportsEveryShard(t *testing.T) {
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			Path:                   t.TempDir(),
+			WalBufferSize:          8,
+			MemTableFlushThreshold: 1000,
+			CompactionThreshold:    4,
+			WalBatchSize:           4,
+		},
+		System: config.SystemConfig{
+			ShardCount:     4,
+			BloomSize:      512,
+			BloomFalseProb: 0.01,
+		},
+	}
+	store := core.NewHybridStore(cfg)
+	defer store.Close()
+	for i := 0; i < 40; i++ {
+		store.Put(common.KeyType(i), []byte("v"))
+	}
+
+	s := NewServer(store)
+	req := httptest.NewRequest(http.MethodGet, "/api/shards", nil)
+	rec := httptest.NewRecorder()
+	s.handleShards(rec, req)
+
+	var shards []struct {
+		Shard        int     `json:"shard"`
+		MemRecords   int     `json:"memtable_record_count"`
+		L0           *int    `json:"l0_sstable_count"`
+		L1           *int    `json:"l1_sstable_count"`
+		BloomFill    float64 `json:"bloom_fill_ratio"`
+		FlushPending *bool   `json:"flush_pending"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &shards); err != nil {
+		t.Fatalf("decode shards response: %v body=%s", err, rec.Body.String())
+	}
+	if len(shards) != cfg.System.ShardCount {
+		t.Fatalf("expected %d shards, got %d", cfg.System.ShardCount, len(shards))
+	}
+	total := 0
+	for i, sh := range shards {
+		if sh.Shard != i || sh.L0 == nil || sh.L1 == nil || sh.FlushPending == nil {
+			t.Fatalf("shard %d: missing fields in %s", i, rec.Body.String())
+		}
+		if sh.MemRecords > 0 && sh.BloomFill == 0 {
+			t.Fatalf("shard %d holds records but reports an empty bloom filter", i)
+		}
+		total += sh.MemRecords
+	}
+	if total != 40 {
+		t.Fatalf("expected 40 memtable records across shards, got %d", total)
+	}
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"neurodb/pkg/common"
+	"neurodb/pkg/core"
+	"strings"
+)
+
+// maxImportProblems caps how many bad rows an import describes.
+const maxImportProblems = 10
+
+// countingIterator counts the rows handed to BulkLoad.
+type countingIterator struct {
+	*common.KeyValueCSVReader
+	s *Server
+}
+
+func (it countingIterator) Next() bool {
+	if !it.KeyValueCSVReader.Next() {
+		return false
+	}
+	it.s.importCount.Add(1)
+	return true
+}
+
+// handleImport loads a key,value CSV, sent as the body or as the "file" field
+// of a multipart form. Rows stream through Put; with ?mode=bulk they go through
+// BulkLoad instead, which needs an empty store and sorted keys and imports
+// nothing otherwise. Progress is at /api/import/status.
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	bulk := r.URL.Query().Get("mode") == "bulk"
+
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Missing file field")
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	if !s.importing.CompareAndSwap(false, true) {
+		writeError(w, http.StatusConflict, "An import is already running")
+		return
+	}
+	defer s.importing.Store(false)
+	s.importCount.Store(0)
+	s.importSkipped.Store(0)
+
+	var problems []string
+	rows := common.NewKeyValueCSVReader(body)
+	rows.OnBadRow = func(line int, err error) {
+		s.importSkipped.Add(1)
+		if len(problems) < maxImportProblems {
+			problems = append(problems, fmt.Sprintf("line %d: %v", line, err))
+		}
+	}
+
+	if bulk {
+		if _, err := s.store.BulkLoad(countingIterator{rows, s}); err != nil {
+			s.importCount.Store(0)
+			status := http.StatusUnprocessableEntity
+			if errors.Is(err, core.ErrNotEmpty) {
+				status = http.StatusConflict
+			}
+			writeError(w, status, err.Error())
+			return
+		}
+	} else {
+		for rows.Next() {
+			if err := s.store.PutContext(r.Context(), rows.Key(), rows.Value()); err != nil {
+				writeError(w, writeErrorStatus(err), err.Error())
+				return
+			}
+			s.importCount.Add(1)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("read failed after %d rows: %v", s.importCount.Load(), err))
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "ok",
+		"imported": s.importCount.Load(),
+		"skipped":  s.importSkipped.Load(),
+		"problems": problems,
+	})
+}
+
+func (s *Server) handleImportStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"running":  s.importing.Load(),
+		"imported": s.importCount.Load(),
+		"skipped":  s.importSkipped.Load(),
+	})
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"neurodb/pkg/common"
+)
+
+const importCSV = `key,value
+3,three
+1,"one, quoted"
+x,not a key
+2,two,extra
+2,two
+`
+
+func postImport(t *testing.T, s *Server, query, body string) (int, map[string]interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/import"+query, strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/csv")
+	s.handleImport(rec, req)
+	var resp map[string]interface{}
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode import response: %v", err)
+		}
+	}
+	return rec.Code, resp
+}
+
+func TestImportCSV(t *testing.T) {
+	s, store := newTestServer(t)
+
+	code, resp := postImport(t, s, "", importCSV)
+	if code != http.StatusOK {
+		t.Fatalf("import: expected 200, got %d", code)
+	}
+	if resp["imported"] != float64(3) || resp["skipped"] != float64(2) {
+		t.Fatalf("expected 3 imported and 2 skipped, got %v", resp)
+	}
+	if problems := resp["problems"].([]interface{}); len(problems) != 2 || !strings.HasPrefix(problems[0].(string), "line 4:") {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+	for k, want := range map[int64]string{1: "one, quoted", 2: "two", 3: "three"} {
+		if v, ok := store.Get(common.KeyType(k)); !ok || string(v) != want {
+			t.Fatalf("key %d: got ok=%v val=%q, want %q", k, ok, v, want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleImportStatus(rec, httptest.NewRequest(http.MethodGet, "/api/import/status", nil))
+	var status map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &status)
+	if status["running"] != false || status["imported"] != float64(3) || status["skipped"] != float64(2) {
+		t.Fatalf("unexpected import status: %v", status)
+	}
+
+	// The store is no longer empty, so a bulk import is refused outright.
+	if code, _ := postImport(t, s, "?mode=bulk", "10,ten\n"); code != http.StatusConflict {
+		t.Fatalf("bulk import into a non-empty store: expected 409, got %d", code)
+	}
+}
+
+func TestImportCSVBulk(t *testing.T) {
+	s, store := newTestServer(t)
+	if code, _ := postImport(t, s, "?mode=bulk", "2,b\n1,a\n"); code != http.StatusUnprocessableEntity {
+		t.Fatalf("unsorted bulk import: expected 422, got %d", code)
+	}
+	code, resp := postImport(t, s, "?mode=bulk", "1,a\n2,b\nbad\n5,e\n")
+	if code != http.StatusOK || resp["imported"] != float64(3) || resp["skipped"] != float64(1) {
+		t.Fatalf("bulk import: code=%d resp=%v", code, resp)
+	}
+	if v, ok := store.Get(5); !ok || string(v) != "e" {
+		t.Fatalf("key 5: got ok=%v val=%q", ok, v)
+	}
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResetStopsRunningIngest(t *testing.T) {
+	s, store := newTestServer(t)
+
+	rec := httptest.NewRecorder()
+	s.handleIngest(rec, httptest.NewRequest(http.MethodPost, "/api/ingest", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ingest expected 200, got %d", rec.Code)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.ingestCount.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("ingest never started writing")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleReset(rec, httptest.NewRequest(http.MethodPost, "/api/reset", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("reset expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// The ingest is gone once reset returns, so the store stays empty.
+	stopped := s.ingestCount.Load()
+	time.Sleep(20 * time.Millisecond)
+	if got := s.ingestCount.Load(); got != stopped {
+		t.Fatalf("ingest kept writing after reset: %d -> %d", stopped, got)
+	}
+	if recs := store.Scan(0, 1<<62); len(recs) != 0 {
+		t.Fatalf("expected an empty store after reset, found %d records", len(recs))
+	}
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"neurodb/pkg/common"
+	"neurodb/pkg/core"
+)
+
+func TestKeyDistSumsToIndexedRecords(t *testing.T) {
+	s, store := newTestServer(t)
+	// Dense keys at the bottom of the range, sparse ones above.
+	for i := 0; i < 2000; i++ {
+		store.Put(common.KeyType(i), []byte("v"))
+	}
+	for i := 1; i <= 1000; i++ {
+		store.Put(common.KeyType(i*1000000), []byte("v"))
+	}
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleKeyDist(rec, httptest.NewRequest(http.MethodGet, "/api/keydist?buckets=10", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var h core.KeyHistogram
+	if err := json.Unmarshal(rec.Body.Bytes(), &h); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(h.Counts) != 10 || h.Min != 0 || h.Max != 1000000000 {
+		t.Fatalf("unexpected histogram shape: %+v", h)
+	}
+	sum := 0
+	for _, c := range h.Counts {
+		sum += c
+	}
+	if sum != 3000 || h.Records != 3000 {
+		t.Fatalf("histogram holds %d keys (records %d), want 3000", sum, h.Records)
+	}
+	// The 2000 dense keys share bucket 0 with the sparse keys up to 1e8.
+	if h.Counts[0] != 2100 {
+		t.Fatalf("expected 2100 keys in the first bucket, got %v", h.Counts)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleKeyDist(rec, httptest.NewRequest(http.MethodGet, "/api/keydist?buckets=100000", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 above the bucket cap, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"encoding/json"
+	"neurodb/pkg/common"
+	"strings"
+)
+
+// projectedRecord is a scan row whose Value is either the requested fields
+// of a JSON object or, for any other value, the raw bytes as in an
+// unprojected scan.
+type projectedRecord struct {
+	Key   common.KeyType
+	Value interface{}
+}
+
+// parseFields splits a ?fields= list, dropping empty names.
+func parseFields(list string) []string {
+	var fields []string
+	for _, f := range strings.Split(list, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// projectRecords keeps only fields of every value that is a JSON object.
+// Fields a value lacks are left out rather than returned as null.
+func projectRecords(records []common.Record, fields []string) []projectedRecord {
+	out := make([]projectedRecord, len(records))
+	for i, rec := range records {
+		out[i] = projectedRecord{Key: rec.Key, Value: rec.Value}
+		var doc map[string]json.RawMessage
+		if json.Unmarshal(rec.Value, &doc) != nil || doc == nil {
+			continue
+		}
+		picked := make(map[string]json.RawMessage, len(fields))
+		for _, f := range fields {
+			if v, ok := doc[f]; ok {
+				picked[f] = v
+			}
+		}
+		out[i].Value = picked
+	}
+	return out
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScanProjectsJSONFields(t *testing.T) {
+	s, store := newTestServer(t)
+	store.Put(1, []byte(`{"name":"ann","age":31,"city":"oslo"}`))
+	store.Put(2, []byte(`{"name":"bob","tags":["x"]}`))
+	store.Put(3, []byte(`plain text`))
+	store.Put(4, []byte(`[1,2,3]`))
+
+	rec := httptest.NewRecorder()
+	s.handleScan(rec, httptest.NewRequest(http.MethodGet, "/api/scan?start=1&end=4&fields=name,%20age", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("scan: expected 200, got %d", rec.Code)
+	}
+	var resp struct {
+		Count int
+		Data  []struct {
+			Key   int64
+			Value json.RawMessage
+		}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode scan response: %v", err)
+	}
+	if resp.Count != 4 || len(resp.Data) != 4 {
+		t.Fatalf("expected 4 rows, got count=%d rows=%d", resp.Count, len(resp.Data))
+	}
+
+	want := []string{
+		`{"age":31,"name":"ann"}`,
+		`{"name":"bob"}`,
+		`"cGxhaW4gdGV4dA=="`, // non-JSON: raw bytes, as without fields
+		`"WzEsMiwzXQ=="`,     // JSON but not an object: also passed through
+	}
+	for i, row := range resp.Data {
+		if string(row.Value) != want[i] {
+			t.Errorf("key %d: got %s, want %s", row.Key, row.Value, want[i])
+		}
+	}
+}
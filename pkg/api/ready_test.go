@@ -0,0 +1,70 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"neurodb/pkg/common"
+	"neurodb/pkg/config"
+	"neurodb/pkg/core"
+	"neurodb/pkg/logger"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReadyReportsFailingFlush(t *testing.T) {
+	dir := t.TempDir()
+	store := core.NewHybridStore(&config.Config{
+		Storage: config.StorageConfig{
+			Path:                   dir,
+			WalBufferSize:          8192,
+			MemTableFlushThreshold: 100,
+			CompactionThreshold:    4,
+			WalBatchSize:           4,
+		},
+		System: config.SystemConfig{
+			ShardCount:     1,
+			BloomSize:      512,
+			BloomFalseProb: 0.01,
+		},
+	}, core.WithLogger(logger.New(io.Discard, logger.LevelError)))
+	t.Cleanup(store.Close)
+	s := NewServer(store)
+	s.RegisterRoutes()
+	probe := func() (int, core.Readiness) {
+		rec := httptest.NewRecorder()
+		s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/ready", nil))
+		var body core.Readiness
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decode readiness: %v", err)
+		}
+		return rec.Code, body
+	}
+
+	if code, body := probe(); code != http.StatusOK || !body.Ready {
+		t.Fatalf("fresh store: got %d %+v, want 200 and ready", code, body)
+	}
+
+	// With its directory gone the store can no longer flush the memtable.
+	os.RemoveAll(dir)
+	os.WriteFile(dir, nil, 0644)
+	for i := 0; i < 100; i++ {
+		store.Put(common.KeyType(i), []byte("v"))
+	}
+	code, body := probe()
+	if code != http.StatusServiceUnavailable || body.Ready {
+		t.Fatalf("failing flush: got %d %+v, want 503 and not ready", code, body)
+	}
+	if len(body.Problems) != 1 || !strings.Contains(body.Problems[0], "flush failing") {
+		t.Fatalf("expected the flush failure as the problem, got %q", body.Problems)
+	}
+
+	// Liveness is unaffected.
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/health", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("health: expected 200, got %d", rec.Code)
+	}
+}
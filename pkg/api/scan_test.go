@@ -0,0 +1,147 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"neurodb/pkg/common"
+	"testing"
+)
+
+func TestScanPagesWithCursor(t *testing.T) {
+	s, store := newTestServer(t)
+	for k := 0; k < 60; k++ {
+		store.Put(common.KeyType(k), []byte(fmt.Sprintf("v%d", k)))
+	}
+	// Deleted keys must neither show up nor cut a page short.
+	for k := 10; k < 20; k++ {
+		store.Delete(common.KeyType(k))
+	}
+
+	var got []int64
+	url := "/api/scan?start=5&end=50&limit=7"
+	pages := 0
+	for {
+		rec := httptest.NewRecorder()
+		s.handleScan(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("scan %s: expected 200, got %d", url, rec.Code)
+		}
+		var resp struct {
+			Count int
+			Data  []struct{ Key int64 }
+			Next  *int64 `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode scan response: %v", err)
+		}
+		if resp.Count > 7 || resp.Count != len(resp.Data) {
+			t.Fatalf("page %d: count=%d rows=%d with limit 7", pages, resp.Count, len(resp.Data))
+		}
+		for _, row := range resp.Data {
+			got = append(got, row.Key)
+		}
+		pages++
+		if resp.Next == nil {
+			break
+		}
+		if pages > 10 {
+			t.Fatalf("paging did not end")
+		}
+		url = fmt.Sprintf("/api/scan?start=5&end=50&limit=7&cursor=%d", *resp.Next)
+	}
+
+	var want []int64
+	for k := int64(5); k <= 50; k++ {
+		if k < 10 || k >= 20 {
+			want = append(want, k)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("paged keys:\n got %v\nwant %v", got, want)
+	}
+	if pages != 6 {
+		t.Fatalf("expected 36 keys in 6 pages of 7, got %d pages", pages)
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleScan(rec, httptest.NewRequest(http.MethodGet, "/api/scan?start=0&end=10&limit=0", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("limit=0: expected 400, got %d", rec.Code)
+	}
+}
+
+func TestScanKeysOnly(t *testing.T) {
+	s, store := newTestServer(t)
+	for k := 0; k < 20; k++ {
+		store.Put(common.KeyType(k), bytes.Repeat([]byte("v"), k+1))
+	}
+	store.Delete(7)
+
+	rec := httptest.NewRecorder()
+	s.handleScan(rec, httptest.NewRequest(http.MethodGet, "/api/scan?start=5&end=9&keys_only=true", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var resp struct {
+		Count int
+		Data  []map[string]interface{}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode scan response: %v", err)
+	}
+	var got []string
+	for _, row := range resp.Data {
+		if _, ok := row["Value"]; ok {
+			t.Fatalf("keys_only row carries a value: %v", row)
+		}
+		got = append(got, fmt.Sprintf("%v:%v", row["Key"], row["Size"]))
+	}
+	if want := "[5:6 6:7 8:9 9:10]"; fmt.Sprint(got) != want || resp.Count != 4 {
+		t.Fatalf("keys_only scan = %v (count %d), want %s", got, resp.Count, want)
+	}
+}
+
+func TestScanTruncatedFlag(t *testing.T) {
+	s, store := newTestServer(t)
+	for k := 0; k < 10; k++ {
+		store.Put(common.KeyType(k), []byte("v"))
+	}
+
+	for _, tc := range []struct {
+		query     string
+		count     int
+		truncated bool
+		next      int64 // -1: no next_cursor
+	}{
+		{"start=0&end=9", 10, false, -1},
+		{"start=0&end=9&limit=10", 10, false, -1},
+		{"start=0&end=9&limit=4", 4, true, 4},
+		{"start=0&end=9&limit=10&keys_only=true", 10, false, -1},
+		{"start=0&end=9&limit=9&keys_only=true", 9, true, 9},
+	} {
+		rec := httptest.NewRecorder()
+		s.handleScan(rec, httptest.NewRequest(http.MethodGet, "/api/scan?"+tc.query, nil))
+		var resp struct {
+			Count     int
+			Truncated *bool
+			Next      *int64 `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: decode scan response: %v", tc.query, err)
+		}
+		if resp.Truncated == nil {
+			t.Fatalf("%s: response has no truncated flag: %s", tc.query, rec.Body)
+		}
+		next := int64(-1)
+		if resp.Next != nil {
+			next = *resp.Next
+		}
+		if resp.Count != tc.count || *resp.Truncated != tc.truncated || next != tc.next {
+			t.Fatalf("%s: count=%d truncated=%v next=%d, want %d, %v, %d", tc.query,
+				resp.Count, *resp.Truncated, next, tc.count, tc.truncated, tc.next)
+		}
+	}
+}
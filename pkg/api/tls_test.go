@@ -0,0 +1,130 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"neurodb/pkg/config"
+	"neurodb/pkg/core"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and returns
+// the cert and key file paths.
+func writeTestCert(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "neurodb-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestServeTLSHealth(t *testing.T) {
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			Path:                   t.TempDir(),
+			WalBufferSize:          8,
+			MemTableFlushThreshold: 1000,
+			CompactionThreshold:    4,
+			WalBatchSize:           4,
+		},
+		System: config.SystemConfig{
+			ShardCount:     1,
+			BloomSize:      512,
+			BloomFalseProb: 0.01,
+		},
+	}
+	store := core.NewHybridStore(cfg)
+	defer store.Close()
+
+	certFile, keyFile := writeTestCert(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := NewServer(store)
+	s.RegisterRoutes()
+	go s.ServeTLS(ln, certFile, keyFile)
+	defer s.Shutdown(context.Background())
+
+	pemBytes, _ := os.ReadFile(certFile)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pemBytes)
+	httpClient := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+	}
+
+	resp, err := httpClient.Get("https://" + ln.Addr().String() + "/api/health")
+	if err != nil {
+		t.Fatalf("GET /api/health over https: %v", err)
+	}
+	defer resp.Body.Close()
+	var body map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || resp.StatusCode != http.StatusOK || body["status"] != "ok" {
+		t.Fatalf("health over https: status=%d body=%v err=%v", resp.StatusCode, body, err)
+	}
+	if resp.TLS == nil {
+		t.Fatal("expected the response to arrive over TLS")
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	cases := []struct {
+		host, port, want string
+	}{
+		{"db.example.com:8080", "8443", "https://db.example.com:8443/api/scan?start=1&end=2"},
+		{"db.example.com", "443", "https://db.example.com/api/scan?start=1&end=2"},
+		{"[::1]:8080", "8443", "https://[::1]:8443/api/scan?start=1&end=2"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPost, "http://"+c.host+"/api/scan?start=1&end=2", nil)
+		rec := httptest.NewRecorder()
+		RedirectToHTTPS(c.port).ServeHTTP(rec, req)
+		if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != c.want {
+			t.Errorf("host %s: got %d %q, want 308 %q", c.host, rec.Code, rec.Header().Get("Location"), c.want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"neurodb/pkg/protocol"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyServer hangs up on its first dropped requests, answers the next busy
+// ones with RespBusy and everything after that with RespOK.
+func flakyServer(t *testing.T, dropped, busy int) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var n atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					if _, err := protocol.Decode(conn); err != nil {
+						return
+					}
+					switch i := int(n.Add(1)); {
+					case i <= dropped:
+						return
+					case i <= dropped+busy:
+						protocol.Encode(conn, protocol.RespBusy, nil, []byte("flush failed"))
+					default:
+						protocol.Encode(conn, protocol.RespOK, nil, nil)
+					}
+				}
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func dialRecording(t *testing.T, addr string, opts ...DialOption) (*Client, *[]time.Duration) {
+	cli, err := Dial(addr, opts...)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	var delays []time.Duration
+	cli.sleep = func(d time.Duration) { delays = append(delays, d) }
+	return cli, &delays
+}
+
+func TestBackoffSchedule(t *testing.T) {
+	addr := flakyServer(t, 2, 3)
+	base, limit := 10*time.Millisecond, 40*time.Millisecond
+	cli, delays := dialRecording(t, addr, WithBackoff(base, limit), WithMaxRetries(5))
+
+	if err := cli.Put(1, []byte("v")); err != nil {
+		t.Fatalf("Put through two dropped connections and three busy answers: %v", err)
+	}
+	// 10, 20, 40, then capped at 40, each jittered into [d/2, d].
+	want := []time.Duration{10, 20, 40, 40, 40}
+	if len(*delays) != len(want) {
+		t.Fatalf("slept %d times (%v), want %d", len(*delays), *delays, len(want))
+	}
+	for i, d := range *delays {
+		hi := want[i] * time.Millisecond
+		if d < hi/2 || d > hi {
+			t.Fatalf("delay %d = %v, want within [%v, %v]", i, d, hi/2, hi)
+		}
+	}
+}
+
+func TestBackoffGivesUpWhenServerStaysBusy(t *testing.T) {
+	addr := flakyServer(t, 0, 100)
+	cli, delays := dialRecording(t, addr, WithMaxRetries(2))
+
+	err := cli.Put(1, []byte("v"))
+	if !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("expected ErrUnavailable, got %v", err)
+	}
+	if len(*delays) != 2 {
+		t.Fatalf("slept %d times, want 2", len(*delays))
+	}
+
+	cli, delays = dialRecording(t, addr, WithMaxRetries(0))
+	if err := cli.Delete(1); !errors.Is(err, ErrUnavailable) || len(*delays) != 0 {
+		t.Fatalf("with retries disabled: err %v after %d sleeps", err, len(*delays))
+	}
+}
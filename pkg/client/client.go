@@ -2,64 +2,164 @@ package client
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"io"
+	"math/rand"
 	"net"
 	"neurodb/pkg/common"
 	"neurodb/pkg/protocol"
 	"time"
 )
 
+// ServerError is a request the server answered with an error, such as a
+// write it could not apply.
+type ServerError struct {
+	Message string
+	// Unavailable is set when the server answered RespBusy on every attempt.
+	Unavailable bool
+}
+
+func (e *ServerError) Error() string {
+	if e.Unavailable {
+		return "server unavailable: " + e.Message
+	}
+	return "server error: " + e.Message
+}
+
+// Is reports ErrUnavailable for a ServerError that ran out of retries.
+func (e *ServerError) Is(target error) bool {
+	return target == ErrUnavailable && e.Unavailable
+}
+
+// ErrUnavailable matches, via errors.Is, a request the server kept turning
+// away as busy until the client's retries ran out.
+var ErrUnavailable = errors.New("server unavailable")
+
+// ErrNotFound is returned by Get for a key with no value.
+var ErrNotFound = errors.New("key not found")
+
+const (
+	DefaultBaseDelay  = 50 * time.Millisecond
+	DefaultMaxDelay   = 2 * time.Second
+	DefaultMaxRetries = 3
+)
+
 type Client struct {
-	conn net.Conn
-	addr string
+	conn      net.Conn
+	addr      string
+	tlsConfig *tls.Config
+
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+	maxRetries int
+	sleep      func(time.Duration)
 }
 
-func Dial(addr string) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+// DialOption configures a Client in Dial and DialTLS.
+type DialOption func(*Client)
+
+// WithBackoff sets the delay before the first retry and the cap the delay
+// doubles up to. Each delay is jittered to between half and all of it.
+func WithBackoff(base, max time.Duration) DialOption {
+	return func(c *Client) {
+		c.baseDelay = base
+		c.maxDelay = max
+	}
+}
+
+// WithMaxRetries sets how many times a request is retried after a busy
+// response or a connection error; 0 disables retries.
+func WithMaxRetries(n int) DialOption {
+	return func(c *Client) {
+		c.maxRetries = max(n, 0)
+	}
+}
+
+// Dial connects to addr, a TCP host:port or a unix:///path socket.
+func Dial(addr string, opts ...DialOption) (*Client, error) {
+	return DialTLS(addr, nil, opts...)
+}
+
+// DialTLS connects over TLS using conf (a nil conf dials plaintext TCP).
+// For mutual TLS, set conf.Certificates to the client certificate.
+func DialTLS(addr string, conf *tls.Config, opts ...DialOption) (*Client, error) {
+	c := &Client{
+		addr:       addr,
+		tlsConfig:  conf,
+		baseDelay:  DefaultBaseDelay,
+		maxDelay:   DefaultMaxDelay,
+		maxRetries: DefaultMaxRetries,
+		sleep:      time.Sleep,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	conn, err := c.dial()
 	if err != nil {
 		return nil, err
 	}
-	return &Client{
-		conn: conn,
-		addr: addr,
-	}, nil
+	c.conn = conn
+	return c, nil
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	network, address := protocol.SplitAddr(c.addr)
+	if c.tlsConfig == nil {
+		return dialer.Dial(network, address)
+	}
+	conn, err := tls.DialWithDialer(dialer, network, address, c.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
 }
 
 func (c *Client) Put(key int64, value []byte) error {
 	keyBuf := make([]byte, 8)
 	binary.BigEndian.PutUint64(keyBuf, uint64(key))
 
-	if err := protocol.Encode(c.conn, protocol.OpPut, keyBuf, value); err != nil {
-		return c.reconnectAndRetry(protocol.OpPut, keyBuf, value)
+	pkg, err := c.roundTrip(protocol.OpPut, keyBuf, value)
+	if err != nil {
+		return err
 	}
-
-	return c.expectOK()
+	return expectOK(pkg)
 }
 
 func (c *Client) Get(key int64) ([]byte, error) {
+	val, st, err := c.GetWithStatus(key)
+	if err == nil && st != common.KeyFound {
+		return nil, ErrNotFound
+	}
+	return val, err
+}
+
+// GetWithStatus is Get that, for a key without a value, tells a deleted key
+// (common.KeyDeleted) from one never written (common.KeyAbsent) instead of
+// returning ErrNotFound.
+func (c *Client) GetWithStatus(key int64) ([]byte, common.KeyStatus, error) {
 	keyBuf := make([]byte, 8)
 	binary.BigEndian.PutUint64(keyBuf, uint64(key))
 
-	if err := protocol.Encode(c.conn, protocol.OpGet, keyBuf, nil); err != nil {
-		val, err := c.reconnectAndRetryValues(protocol.OpGet, keyBuf, nil)
-		return val, err
-	}
-
-	pkg, err := protocol.Decode(c.conn)
+	pkg, err := c.roundTrip(protocol.OpGet, keyBuf, nil)
 	if err != nil {
-		val, err := c.reconnectAndRetryValues(protocol.OpGet, keyBuf, nil)
-		return val, err
+		return nil, common.KeyAbsent, err
 	}
 
 	switch pkg.Op {
 	case protocol.RespVal:
-		return pkg.Value, nil
+		return pkg.Value, common.KeyFound, nil
 	case protocol.RespErr:
-		return nil, errors.New("key not found")
+		switch msg := string(pkg.Value); msg {
+		case "deleted", "absent", "Not Found":
+			return nil, common.ParseKeyStatus(msg), nil
+		default:
+			return nil, common.KeyAbsent, &ServerError{Message: msg}
+		}
 	default:
-		return nil, errors.New("unknown response")
+		return nil, common.KeyAbsent, errors.New("unknown response")
 	}
 }
 
@@ -67,94 +167,142 @@ func (c *Client) Delete(key int64) error {
 	keyBuf := make([]byte, 8)
 	binary.BigEndian.PutUint64(keyBuf, uint64(key))
 
-	if err := protocol.Encode(c.conn, protocol.OpDel, keyBuf, nil); err != nil {
-		return c.reconnectAndRetry(protocol.OpDel, keyBuf, nil)
+	pkg, err := c.roundTrip(protocol.OpDel, keyBuf, nil)
+	if err != nil {
+		return err
 	}
-
-	return c.expectOK()
+	return expectOK(pkg)
 }
 
-func (c *Client) Scan(start, end int64) ([]common.Record, error) {
-	startBuf := make([]byte, 8)
-	endBuf := make([]byte, 8)
-	binary.BigEndian.PutUint64(startBuf, uint64(start))
-	binary.BigEndian.PutUint64(endBuf, uint64(end))
-
-	if err := protocol.Encode(c.conn, protocol.OpScan, startBuf, endBuf); err != nil {
-		data, err := c.reconnectAndRetryValues(protocol.OpScan, startBuf, endBuf)
-		if err != nil {
-			return nil, err
-		}
-		return decodeRecords(data)
-	}
+// DeleteExisting deletes key and reports whether it held a value. If the
+// answer is lost and the request retried, the retry finds the key already
+// gone and reports false.
+func (c *Client) DeleteExisting(key int64) (bool, error) {
+	keyBuf := make([]byte, 8)
+	binary.BigEndian.PutUint64(keyBuf, uint64(key))
 
-	pkg, err := protocol.Decode(c.conn)
+	pkg, err := c.roundTrip(protocol.OpDelExisting, keyBuf, nil)
 	if err != nil {
-		data, err := c.reconnectAndRetryValues(protocol.OpScan, startBuf, endBuf)
-		if err != nil {
-			return nil, err
+		return false, err
+	}
+	switch pkg.Op {
+	case protocol.RespVal:
+		if len(pkg.Value) != 1 {
+			return false, errors.New("malformed delete response")
 		}
-		return decodeRecords(data)
+		return pkg.Value[0] == 1, nil
+	case protocol.RespErr:
+		return false, &ServerError{Message: string(pkg.Value)}
+	default:
+		return false, errors.New("unknown response")
 	}
+}
 
-	if pkg.Op == protocol.RespVal {
-		return decodeRecords(pkg.Value)
-	}
-	return nil, errors.New("scan failed")
+func (c *Client) Scan(start, end int64) ([]common.Record, error) {
+	records, _, _, err := c.scan(protocol.ScanRequest{Start: start, End: end})
+	return records, err
 }
 
-func (c *Client) Close() error {
-	return c.conn.Close()
+// ScanPage returns up to limit records of [start, end] and, when the limit
+// left records out, the key to pass as start for the next page. more is true
+// exactly then: false means the page holds the rest of the range. Each page
+// is a separate request, so a large range is never buffered whole.
+func (c *Client) ScanPage(start, end int64, limit int) (records []common.Record, next int64, more bool, err error) {
+	if limit <= 0 {
+		return nil, 0, false, errors.New("scan page limit must be positive")
+	}
+	return c.scan(protocol.ScanRequest{Start: start, End: end, Limit: limit})
 }
 
-func (c *Client) expectOK() error {
-	pkg, err := protocol.Decode(c.conn)
+func (c *Client) scan(req protocol.ScanRequest) ([]common.Record, int64, bool, error) {
+	key, val := req.Encode()
+	pkg, err := c.roundTrip(protocol.OpScan, key, val)
 	if err != nil {
-		return err
+		return nil, 0, false, err
+	}
+	if pkg.Op != protocol.RespVal {
+		return nil, 0, false, errors.New("scan failed")
 	}
-	if pkg.Op != protocol.RespOK {
-		return errors.New("operation failed")
+	records, err := decodeRecords(pkg.Value)
+	if err != nil || len(pkg.Key) != 8 {
+		return records, 0, false, err
 	}
-	return nil
+	return records, int64(binary.BigEndian.Uint64(pkg.Key)), true, nil
 }
 
-func (c *Client) reconnectAndRetry(op byte, key, val []byte) error {
-	c.conn.Close()
-	conn, err := net.DialTimeout("tcp", c.addr, 5*time.Second)
-	if err != nil {
-		return err
+func (c *Client) Close() error {
+	if c.conn == nil {
+		return nil
 	}
-	c.conn = conn
+	return c.conn.Close()
+}
 
-	// Re-send
-	if err := protocol.Encode(c.conn, op, key, val); err != nil {
-		return err
+func expectOK(pkg *protocol.Packet) error {
+	switch pkg.Op {
+	case protocol.RespOK:
+		return nil
+	case protocol.RespErr:
+		return &ServerError{Message: string(pkg.Value)}
+	default:
+		return errors.New("unknown response")
 	}
-	// Re-read
-	return c.expectOK()
 }
 
-func (c *Client) reconnectAndRetryValues(op byte, key, val []byte) ([]byte, error) {
-	c.conn.Close()
-	conn, err := net.DialTimeout("tcp", c.addr, 5*time.Second)
+// roundTrip sends one request and reads its response. A connection error
+// drops the connection and a RespBusy answer keeps it; either way the
+// request is sent again after a backoff, up to maxRetries times. All
+// requests are idempotent, so resending one whose answer was lost is safe.
+func (c *Client) roundTrip(op byte, key, val []byte) (*protocol.Packet, error) {
+	var pkg *protocol.Packet
+	var err error
+	for attempt := 0; ; attempt++ {
+		pkg, err = c.exchange(op, key, val)
+		if err != nil && c.conn != nil {
+			c.conn.Close()
+			c.conn = nil
+		}
+		if err == nil && pkg.Op != protocol.RespBusy {
+			return pkg, nil
+		}
+		if attempt == c.maxRetries {
+			break
+		}
+		c.sleep(c.backoff(attempt))
+	}
 	if err != nil {
 		return nil, err
 	}
-	c.conn = conn
+	return nil, &ServerError{Message: string(pkg.Value), Unavailable: true}
+}
 
+func (c *Client) exchange(op byte, key, val []byte) (*protocol.Packet, error) {
+	if c.conn == nil {
+		conn, err := c.dial()
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	}
 	if err := protocol.Encode(c.conn, op, key, val); err != nil {
 		return nil, err
 	}
+	return protocol.Decode(c.conn)
+}
 
-	pkg, err := protocol.Decode(c.conn)
-	if err != nil {
-		return nil, err
+// backoff is the delay before retry attempt+1: baseDelay doubled per
+// attempt up to maxDelay, then jittered down by up to half so clients that
+// failed together do not all come back together.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.baseDelay
+	for i := 0; i < attempt && d < c.maxDelay; i++ {
+		d *= 2
 	}
-
-	if pkg.Op == protocol.RespVal {
-		return pkg.Value, nil
+	d = min(d, c.maxDelay)
+	if d <= 0 {
+		return 0
 	}
-	return nil, errors.New("operation failed or key not found")
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
 }
 
 func decodeRecords(data []byte) ([]common.Record, error) {
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"neurodb/pkg/protocol"
+	"neurodb/pkg/storage"
+)
+
+// WALStream receives a primary's WAL entries in log order; see StreamWAL.
+type WALStream struct {
+	conn   net.Conn
+	offset int64
+}
+
+// StreamWAL asks the server to stream its WAL from fromOffset (0 for the
+// start of the log). Entries are as the store logged them: values in its
+// encoding, keys in its key order (see core.HybridStore.ApplyWAL). The
+// stream takes over the client's connection: close the stream, not the
+// client, when done.
+func (c *Client) StreamWAL(fromOffset int64) (*WALStream, error) {
+	keyBuf := make([]byte, 8)
+	binary.BigEndian.PutUint64(keyBuf, uint64(fromOffset))
+	if c.conn == nil {
+		conn, err := c.dial()
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	}
+	if err := protocol.Encode(c.conn, protocol.OpReplicate, keyBuf, nil); err != nil {
+		return nil, err
+	}
+	return &WALStream{conn: c.conn, offset: fromOffset}, nil
+}
+
+// Next blocks until the next entry arrives. The stream is over once it
+// returns an error: storage.ErrOffsetTruncated or storage.ErrOffsetOutOfRange
+// if the primary cannot stream from the requested offset.
+func (s *WALStream) Next() (storage.WALEntry, error) {
+	pkg, err := protocol.Decode(s.conn)
+	if err != nil {
+		return storage.WALEntry{}, err
+	}
+	switch pkg.Op {
+	case protocol.RespVal:
+	case protocol.RespErr:
+		return storage.WALEntry{}, streamError(string(pkg.Value))
+	default:
+		return storage.WALEntry{}, errors.New("unknown response")
+	}
+	if len(pkg.Key) != 8 {
+		return storage.WALEntry{}, errors.New("replication: bad offset")
+	}
+	entry, err := storage.DecodeWALEntry(pkg.Value)
+	if err != nil {
+		return storage.WALEntry{}, err
+	}
+	s.offset = int64(binary.BigEndian.Uint64(pkg.Key))
+	return entry, nil
+}
+
+// Offset is the primary's WAL position after the last entry Next returned;
+// streaming from it resumes with the following entry.
+func (s *WALStream) Offset() int64 {
+	return s.offset
+}
+
+func (s *WALStream) Close() error {
+	return s.conn.Close()
+}
+
+// streamError turns the primary's error text back into the storage error it
+// came from, where there is one.
+func streamError(msg string) error {
+	for _, err := range []error{storage.ErrOffsetTruncated, storage.ErrOffsetOutOfRange} {
+		if msg == err.Error() {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// KeyValueCSVReader reads "key,value" rows, the key a decimal integer. A
+// first row whose key is "key" is taken as a header. Malformed rows are
+// skipped and reported to OnBadRow, if set, with their line number.
+type KeyValueCSVReader struct {
+	OnBadRow func(line int, err error)
+
+	r     *csv.Reader
+	rec   Record
+	err   error
+	first bool
+}
+
+func NewKeyValueCSVReader(r io.Reader) *KeyValueCSVReader {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	return &KeyValueCSVReader{r: cr, first: true}
+}
+
+// Next advances to the next well-formed row. It returns false at the end of
+// the input or on a read error; see Err.
+func (kr *KeyValueCSVReader) Next() bool {
+	for kr.err == nil {
+		fields, err := kr.r.Read()
+		if err == io.EOF {
+			return false
+		}
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			kr.bad(perr.Line, perr.Err)
+			continue
+		}
+		if err != nil {
+			kr.err = err
+			return false
+		}
+		line, _ := kr.r.FieldPos(0)
+		if kr.first {
+			kr.first = false
+			if strings.EqualFold(strings.TrimSpace(fields[0]), "key") {
+				continue
+			}
+		}
+		if len(fields) != 2 {
+			kr.bad(line, fmt.Errorf("want 2 fields, got %d", len(fields)))
+			continue
+		}
+		key, err := strconv.ParseInt(strings.TrimSpace(fields[0]), 10, 64)
+		if err != nil {
+			kr.bad(line, fmt.Errorf("key %q is not an integer", fields[0]))
+			continue
+		}
+		kr.rec = Record{Key: KeyType(key), Value: []byte(fields[1])}
+		return true
+	}
+	return false
+}
+
+func (kr *KeyValueCSVReader) bad(line int, err error) {
+	if kr.OnBadRow != nil {
+		kr.OnBadRow(line, err)
+	}
+}
+
+func (kr *KeyValueCSVReader) Key() KeyType { return kr.rec.Key }
+
+func (kr *KeyValueCSVReader) Value() ValueType { return kr.rec.Value }
+
+// Err is the read error that stopped Next, if any.
+func (kr *KeyValueCSVReader) Err() error { return kr.err }
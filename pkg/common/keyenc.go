@@ -0,0 +1,249 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Order-preserving key encodings on top of the int64 key space. A KeyBuilder
+// packs fields most significant first, so keys sort by the first field, then
+// the second, and so on, and a range scan over keys follows the logical
+// order of the fields. Keys are 64 bits, so wide fields are kept by prefix:
+// two values that differ only past what fits map to the same key, and an
+// application with such values keeps the full one in the record's value.
+//
+// The fields pack into an unsigned value; how that becomes a key depends on
+// the KeyOrder of the store it is for, and only keys built for the store's
+// order sort in field order there. The package-level functions and a zero
+// KeyBuilder are for SignedOrder, the default; for a store with
+// key_order: unsigned use the UnsignedOrder methods (or the order the store
+// reports).
+
+// ErrKeyOverflow is returned by KeyBuilder.Key when the fields take more
+// than 64 bits or a value does not fit its field.
+var ErrKeyOverflow = errors.New("common: key fields do not fit in 64 bits")
+
+// StringKeyBytes is how many leading bytes of a string StringKey keeps.
+// Strings of at most this many bytes map to distinct keys.
+const StringKeyBytes = 7
+
+const signBit = uint64(1) << 63
+
+// KeyOrder is how a store sorts keys (system.key_order).
+type KeyOrder uint8
+
+const (
+	// SignedOrder sorts keys as int64. Packed values get their top bit
+	// flipped so that their signed order is their unsigned one.
+	SignedOrder KeyOrder = iota
+	// UnsignedOrder sorts keys as uint64; packed values are used as they are.
+	UnsignedOrder
+)
+
+// flip is XORed into a packed value to make a key under o, and back.
+func (o KeyOrder) flip() uint64 {
+	if o == UnsignedOrder {
+		return 0
+	}
+	return signBit
+}
+
+// Builder returns an empty KeyBuilder for keys under o.
+func (o KeyOrder) Builder() *KeyBuilder {
+	return &KeyBuilder{order: o}
+}
+
+// Reader reads back the fields of a key built for o.
+func (o KeyOrder) Reader(key KeyType) *KeyReader {
+	return &KeyReader{v: uint64(key) ^ o.flip()}
+}
+
+// KeyBuilder packs fixed-width fields into a KeyType. The zero value is an
+// empty key for SignedOrder; see KeyOrder.Builder for others.
+type KeyBuilder struct {
+	v     uint64
+	bits  int
+	err   error
+	order KeyOrder
+}
+
+func (b *KeyBuilder) push(v uint64, bits int) *KeyBuilder {
+	if b.err != nil {
+		return b
+	}
+	if bits <= 0 || b.bits+bits > 64 {
+		b.err = fmt.Errorf("%w: %d bits after %d", ErrKeyOverflow, bits, b.bits)
+		return b
+	}
+	if bits < 64 && v>>bits != 0 {
+		b.err = fmt.Errorf("%w: %d does not fit in %d bits", ErrKeyOverflow, v, bits)
+		return b
+	}
+	b.bits += bits
+	b.v |= v << (64 - b.bits)
+	return b
+}
+
+// Uint adds v as a bits-wide unsigned field.
+func (b *KeyBuilder) Uint(v uint64, bits int) *KeyBuilder {
+	return b.push(v, bits)
+}
+
+// Int adds v as a bits-wide signed field; negative values sort first.
+func (b *KeyBuilder) Int(v int64, bits int) *KeyBuilder {
+	if bits <= 0 || bits > 64 {
+		return b.push(0, bits)
+	}
+	half := int64(1) << (bits - 1)
+	if bits < 64 && (v < -half || v >= half) {
+		if b.err == nil {
+			b.err = fmt.Errorf("%w: %d does not fit in %d signed bits", ErrKeyOverflow, v, bits)
+		}
+		return b
+	}
+	// Offset binary: adding 2^(bits-1) turns signed order into unsigned.
+	return b.push((uint64(v)^(uint64(1)<<(bits-1)))&(^uint64(0)>>(64-bits)), bits)
+}
+
+// String adds the first n bytes of s, zero-padded, as a byte-wise ordered
+// field of n*8 bits. Longer strings are cut to n bytes.
+func (b *KeyBuilder) String(s string, n int) *KeyBuilder {
+	var v uint64
+	for i := 0; i < n && i < 8; i++ {
+		v <<= 8
+		if i < len(s) {
+			v |= uint64(s[i])
+		}
+	}
+	return b.push(v, n*8)
+}
+
+// Key returns the packed fields. Bits after the last field are zero.
+func (b *KeyBuilder) Key() (KeyType, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	return KeyType(b.v ^ b.order.flip()), nil
+}
+
+// Bits is how many bits the fields added so far take.
+func (b *KeyBuilder) Bits() int {
+	return b.bits
+}
+
+// KeyReader reads back the fields of a key built by a KeyBuilder, in the
+// same order and widths.
+type KeyReader struct {
+	v    uint64
+	bits int
+}
+
+// NewKeyReader reads a key built for SignedOrder.
+func NewKeyReader(key KeyType) *KeyReader {
+	return SignedOrder.Reader(key)
+}
+
+func (r *KeyReader) pop(bits int) uint64 {
+	if bits <= 0 || r.bits+bits > 64 {
+		return 0
+	}
+	r.bits += bits
+	v := r.v >> (64 - r.bits)
+	if bits < 64 {
+		v &= (uint64(1) << bits) - 1
+	}
+	return v
+}
+
+// Uint reads a bits-wide unsigned field.
+func (r *KeyReader) Uint(bits int) uint64 {
+	return r.pop(bits)
+}
+
+// Int reads a bits-wide signed field.
+func (r *KeyReader) Int(bits int) int64 {
+	u := r.pop(bits) ^ (uint64(1) << (bits - 1))
+	// Sign-extend from bits to 64.
+	shift := 64 - bits
+	return int64(u<<shift) >> shift
+}
+
+// String reads an n-byte string field, dropping the zero padding.
+func (r *KeyReader) String(n int) string {
+	v := r.pop(n * 8)
+	buf := make([]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		buf[i] = byte(v)
+		v >>= 8
+	}
+	end := n
+	for end > 0 && buf[end-1] == 0 {
+		end--
+	}
+	return string(buf[:end])
+}
+
+// StringKey maps s to a key that sorts like s does byte-wise. The first
+// StringKeyBytes bytes are kept, followed by the length (capped at 8), so
+// "ab" < "ab\x00" < "abc" still hold; strings that share their first
+// StringKeyBytes bytes and are longer than that map to the same key.
+func StringKey(s string) KeyType {
+	return SignedOrder.StringKey(s)
+}
+
+// StringKey is the package-level StringKey for keys under o.
+func (o KeyOrder) StringKey(s string) KeyType {
+	k, _ := o.Builder().String(s, StringKeyBytes).Uint(uint64(min(len(s), StringKeyBytes+1)), 8).Key()
+	return k
+}
+
+// KeyString is the string a StringKey was built from, cut to
+// StringKeyBytes bytes.
+func KeyString(key KeyType) string {
+	return SignedOrder.KeyString(key)
+}
+
+// KeyString is the package-level KeyString for keys under o.
+func (o KeyOrder) KeyString(key KeyType) string {
+	r := o.Reader(key)
+	s := r.String(StringKeyBytes)
+	// Trailing zero bytes are part of the string; the length says how many.
+	if n := int(r.Uint(8)); n > len(s) && n <= StringKeyBytes {
+		s += string(make([]byte, n-len(s)))
+	}
+	return s
+}
+
+// PrefixRange is the inclusive range of keys whose first bits bits equal
+// key's, for scanning every key that starts with the same fields.
+func PrefixRange(key KeyType, bits int) (start, end KeyType) {
+	return SignedOrder.PrefixRange(key, bits)
+}
+
+// PrefixRange is the package-level PrefixRange for keys under o.
+func (o KeyOrder) PrefixRange(key KeyType, bits int) (start, end KeyType) {
+	if bits >= 64 {
+		return key, key
+	}
+	low := ^uint64(0)
+	if bits > 0 {
+		low >>= bits
+	}
+	v := uint64(key) ^ o.flip()
+	return KeyType((v &^ low) ^ o.flip()), KeyType((v | low) ^ o.flip())
+}
+
+// StringPrefixRange is the inclusive range of StringKeys of the strings
+// starting with prefix. A prefix longer than StringKeyBytes is cut, so the
+// range can also hold strings that only share its first StringKeyBytes
+// bytes.
+func StringPrefixRange(prefix string) (start, end KeyType) {
+	return SignedOrder.StringPrefixRange(prefix)
+}
+
+// StringPrefixRange is the package-level StringPrefixRange for keys under o.
+func (o KeyOrder) StringPrefixRange(prefix string) (start, end KeyType) {
+	n := min(len(prefix), StringKeyBytes)
+	k, _ := o.Builder().String(prefix[:n], n).Key()
+	return o.PrefixRange(k, n*8)
+}
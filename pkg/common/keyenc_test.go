@@ -0,0 +1,130 @@
+package common
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestStringKeyRoundTripAndOrder(t *testing.T) {
+	words := []string{"", "\x00", "a", "a\x00", "a\x00\x00", "ab", "abc", "abcdefg", "b", "zz", "\xff", "\xff\xff\xff\xff\xff\xff\xff"}
+	for _, w := range words {
+		if got := KeyString(StringKey(w)); got != w {
+			t.Fatalf("KeyString(StringKey(%q)) = %q", w, got)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		b := make([]byte, rng.Intn(12))
+		for j := range b {
+			b[j] = "\x00ab\xff"[rng.Intn(4)]
+		}
+		words = append(words, string(b))
+	}
+	sort.Strings(words)
+	for i := 1; i < len(words); i++ {
+		a, b := StringKey(words[i-1]), StringKey(words[i])
+		if a > b {
+			t.Fatalf("%q < %q but their keys are %d > %d", words[i-1], words[i], a, b)
+		}
+		// Only strings past StringKeyBytes may share a key.
+		if a == b && words[i-1] != words[i] && (len(words[i-1]) <= StringKeyBytes || len(words[i]) <= StringKeyBytes) {
+			t.Fatalf("%q and %q share key %d", words[i-1], words[i], a)
+		}
+	}
+}
+
+func TestCompositeKeyRoundTripAndOrder(t *testing.T) {
+	type row struct {
+		tenant string
+		day    int64
+		seq    uint64
+	}
+	build := func(r row) KeyType {
+		var b KeyBuilder
+		k, err := b.String(r.tenant, 3).Int(r.day, 20).Uint(r.seq, 20).Key()
+		if err != nil {
+			t.Fatalf("build %+v: %v", r, err)
+		}
+		return k
+	}
+
+	rng := rand.New(rand.NewSource(2))
+	rows := make([]row, 3000)
+	for i := range rows {
+		rows[i] = row{
+			tenant: []string{"acm", "bob", "b", "zed"}[rng.Intn(4)],
+			day:    rng.Int63n(1<<20) - 1<<19,
+			seq:    uint64(rng.Intn(1 << 20)),
+		}
+	}
+	for _, r := range rows {
+		rd := NewKeyReader(build(r))
+		if got := (row{rd.String(3), rd.Int(20), rd.Uint(20)}); got != r {
+			t.Fatalf("round trip of %+v gave %+v", r, got)
+		}
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.tenant != b.tenant {
+			return a.tenant < b.tenant
+		}
+		if a.day != b.day {
+			return a.day < b.day
+		}
+		return a.seq < b.seq
+	})
+	for i := 1; i < len(rows); i++ {
+		if build(rows[i-1]) > build(rows[i]) && rows[i-1] != rows[i] {
+			t.Fatalf("%+v sorts before %+v but its key is larger", rows[i-1], rows[i])
+		}
+	}
+
+	// A prefix range over the first field holds exactly that tenant's rows.
+	var b KeyBuilder
+	prefix, _ := b.String("bob", 3).Key()
+	start, end := PrefixRange(prefix, 24)
+	for _, r := range rows {
+		k := build(r)
+		if in := k >= start && k <= end; in != (r.tenant == "bob") {
+			t.Fatalf("row %+v: in range %v", r, in)
+		}
+	}
+}
+
+func TestStringPrefixRange(t *testing.T) {
+	start, end := StringPrefixRange("ab")
+	for _, s := range []string{"a", "aa", "ab", "ab\x00", "abzzzzzzzz", "ac", "b", ""} {
+		k := StringKey(s)
+		if in := k >= start && k <= end; in != strings.HasPrefix(s, "ab") {
+			t.Fatalf("%q: in range %v", s, in)
+		}
+	}
+	if start, end := StringPrefixRange(""); start != math.MinInt64 || end != math.MaxInt64 {
+		t.Fatalf("empty prefix: [%d, %d]", start, end)
+	}
+}
+
+func TestKeyBuilderOverflow(t *testing.T) {
+	var b KeyBuilder
+	if _, err := b.Uint(1, 40).Uint(1, 30).Key(); !errors.Is(err, ErrKeyOverflow) {
+		t.Fatalf("70 bits: expected ErrKeyOverflow, got %v", err)
+	}
+	var c KeyBuilder
+	if _, err := c.Uint(16, 4).Key(); !errors.Is(err, ErrKeyOverflow) {
+		t.Fatalf("16 in 4 bits: expected ErrKeyOverflow, got %v", err)
+	}
+	var d KeyBuilder
+	if _, err := d.Int(-9, 4).Key(); !errors.Is(err, ErrKeyOverflow) {
+		t.Fatalf("-9 in 4 signed bits: expected ErrKeyOverflow, got %v", err)
+	}
+	var e KeyBuilder
+	if k, err := e.Int(math.MinInt64, 64).Key(); err != nil || NewKeyReader(k).Int(64) != math.MinInt64 {
+		t.Fatalf("64-bit int: key %d, err %v", k, err)
+	}
+}
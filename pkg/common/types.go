@@ -2,7 +2,7 @@ package common
 
 import (
 	"fmt"
-	"sync"
+	"sort"
 )
 
 type KeyType int64
@@ -13,22 +13,90 @@ type Record struct {
 	Value ValueType
 }
 
+// KeySize is a key and the length of its stored value, for scans that leave
+// the values out.
+type KeySize struct {
+	Key  KeyType
+	Size int
+}
+
+// KeyStatus is what a read found for a key: a value, a tombstone, or
+// nothing. A deleted key reads as KeyAbsent once a compaction with nothing
+// older below it drops the tombstone.
+type KeyStatus int
+
+const (
+	KeyAbsent  KeyStatus = iota // never written, or its tombstone is gone
+	KeyFound                    // holds a value
+	KeyDeleted                  // deleted by Delete or DeleteRange
+)
+
+func (s KeyStatus) String() string {
+	switch s {
+	case KeyFound:
+		return "found"
+	case KeyDeleted:
+		return "deleted"
+	default:
+		return "absent"
+	}
+}
+
+// ParseKeyStatus is the inverse of KeyStatus.String; anything else is
+// KeyAbsent.
+func ParseKeyStatus(s string) KeyStatus {
+	switch s {
+	case "found":
+		return KeyFound
+	case "deleted":
+		return KeyDeleted
+	default:
+		return KeyAbsent
+	}
+}
+
 func (r *Record) String() string {
 	return fmt.Sprintf("Record{Key: %d, ValLen: %d}", r.Key, len(r.Value))
 }
 
-var RecordPool = sync.Pool{
-	New: func() interface{} {
-		return &Record{}
-	},
+// RangeTombstone deletes every key in [Start, End) written before it.
+type RangeTombstone struct {
+	Start KeyType
+	End   KeyType
+}
+
+func (t RangeTombstone) Covers(key KeyType) bool {
+	return key >= t.Start && key < t.End
 }
 
-func NewRecord() *Record {
-	return RecordPool.Get().(*Record)
+// Covered reports whether any of ts covers key.
+func Covered(ts []RangeTombstone, key KeyType) bool {
+	for _, t := range ts {
+		if t.Covers(key) {
+			return true
+		}
+	}
+	return false
 }
 
-func ReleaseRecord(r *Record) {
-	r.Key = 0
-	r.Value = nil
-	RecordPool.Put(r)
+// CoalesceTombstones merges overlapping and adjacent ranges into a sorted,
+// disjoint set.
+func CoalesceTombstones(ts []RangeTombstone) []RangeTombstone {
+	if len(ts) == 0 {
+		return nil
+	}
+	sorted := append([]RangeTombstone(nil), ts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+	out := sorted[:1]
+	for _, t := range sorted[1:] {
+		last := &out[len(out)-1]
+		if t.Start <= last.End {
+			if t.End > last.End {
+				last.End = t.End
+			}
+			continue
+		}
+		out = append(out, t)
+	}
+	return out
 }
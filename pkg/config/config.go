@@ -1,7 +1,9 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -13,8 +15,28 @@ type Config struct {
 }
 
 type ServerConfig struct {
-	Addr    string `yaml:"addr"`     // HTTP Listen Address (e.g. :8080)
-	TCPAddr string `yaml:"tcp_addr"` // TCP Listen Address (e.g. :9090)
+	Addr         string `yaml:"addr"`           // HTTP Listen Address (e.g. :8080)
+	TCPAddr      string `yaml:"tcp_addr"`       // TCP Listen Address (e.g. :9090)
+	MaxValueSize int    `yaml:"max_value_size"` // Largest value accepted in a TCP frame (bytes)
+
+	// TLS (HTTPS for the API, TLS for the TCP protocol) is enabled when both
+	// files are set. With TLSClientCAFile, TCP clients must present a
+	// certificate signed by it.
+	TLSCertFile     string `yaml:"tls_cert_file"`
+	TLSKeyFile      string `yaml:"tls_key_file"`
+	TLSClientCAFile string `yaml:"tls_client_ca_file"`
+	// HTTPRedirectAddr, with TLS on, serves plain HTTP redirecting to HTTPS.
+	HTTPRedirectAddr string `yaml:"http_redirect_addr"`
+	// ReplicaOf makes this server a read replica of the primary at this TCP
+	// address, applying its WAL stream. The stream is read over TLS when this
+	// server has TLS on or ReplicaCAFile is set: the primary's certificate is
+	// checked against ReplicaCAFile (else TLSClientCAFile, else the system
+	// roots) and TLSCertFile is presented as the client certificate.
+	ReplicaOf     string `yaml:"replica_of"`
+	ReplicaCAFile string `yaml:"replica_ca_file"`
+	// DebugEndpoints serves /debug/pprof/ and /debug/vars (expvar) on the
+	// HTTP API. Off by default: profiles expose internals and cost CPU.
+	DebugEndpoints bool `yaml:"debug_endpoints"`
 }
 
 type StorageConfig struct {
@@ -22,20 +44,81 @@ type StorageConfig struct {
 	WalBufferSize          int    `yaml:"wal_buffer_size"`
 	MemTableFlushThreshold int `yaml:"memtable_flush_threshold"`
 	CompactionThreshold    int `yaml:"compaction_threshold"`
+	// L0CompactionBytes also triggers a shard's L0 compaction once its L0
+	// tables add up to this many bytes, whichever of it and
+	// CompactionThreshold is reached first. 0 counts files only.
+	L0CompactionBytes int64 `yaml:"l0_compaction_bytes"`
 	WalBatchSize           int `yaml:"wal_batch_size"`
+	// WalFlushInterval is the longest a write waits in the WAL batch buffer
+	// before the buffer is written and synced, even if it holds fewer than
+	// WalBatchSize records. 0 means 100ms.
+	WalFlushInterval time.Duration `yaml:"wal_flush_interval"`
+	// CompactionInterval, when set, fully compacts every shard left with more
+	// than one SSTable this often, so a store that stopped writing still
+	// ends up with one table per shard. 0 (the default) compacts on
+	// compaction_threshold and l0_compaction_bytes only.
+	CompactionInterval time.Duration `yaml:"compaction_interval"`
+	// MaxValueSize caps the bytes of a stored value; Put rejects larger ones.
+	// 0 (and anything above it) means sstable.MaxValueSize, 64MB.
+	MaxValueSize int `yaml:"max_value_size"`
+	// WALPath and SSTablePath put the WAL and the SSTables in their own
+	// directories, e.g. the WAL on a fast disk; L0Path does the same for
+	// freshly flushed tables. Empty means Path (L0Path: SSTablePath). The
+	// manifest and learned-index files always stay in Path.
+	WALPath     string `yaml:"wal_path"`
+	SSTablePath string `yaml:"sstable_path"`
+	L0Path      string `yaml:"l0_path"`
 }
 
 type SystemConfig struct {
 	ShardCount     int     `yaml:"shard_count"`
+	ShardStrategy  string  `yaml:"shard_strategy"` // "hash" (default) or "range"
 	BloomSize      uint    `yaml:"bloom_size"`
 	BloomFalseProb float64 `yaml:"bloom_false_prob"`
+	LogLevel       string  `yaml:"log_level"` // debug, info (default), warn or error
+	// KeyOrder is how keys sort in scans and range deletes: "signed"
+	// (default) int64 order, or "unsigned", for keys such as Z-order codes
+	// or unsigned IDs with the high bit set. It cannot change once a store
+	// holds data.
+	KeyOrder string `yaml:"key_order"`
+	// AdaptiveReadWriteThreshold is the reads/writes ratio below which
+	// compactions defer training learned indexes: under write-heavy load the
+	// tables are soon compacted again. Lookups then use the SSTables' sparse
+	// indexes until reads reach the ratio. 0 always trains.
+	AdaptiveReadWriteThreshold float64 `yaml:"adaptive_rw_threshold"`
+	// ReshardOnOpen lets the store open data written with another shard_count
+	// by re-routing every table into the configured shards. Without it such
+	// data is refused, so a mistyped shard_count cannot rewrite the store.
+	ReshardOnOpen bool `yaml:"reshard_on_open"`
+	// LearnedIndexEnabled false runs the store as a plain LSM: no learned
+	// indexes are trained or persisted and lookups use the SSTables' sparse
+	// indexes. Unset means enabled.
+	LearnedIndexEnabled *bool `yaml:"learned_index_enabled"`
+	// LearnedIndexMinKeys is the fewest keys a learned index fits a model
+	// to; smaller indexes binary-search their sorted keys instead.
+	LearnedIndexMinKeys int `yaml:"learned_index_min_keys"`
 }
 
-func Load(configPath string) (*Config, error) {
-	cfg := &Config{
+// UseLearnedIndex reports whether learned indexes are enabled.
+func (s SystemConfig) UseLearnedIndex() bool {
+	return s.LearnedIndexEnabled == nil || *s.LearnedIndexEnabled
+}
+
+const (
+	ShardStrategyHash  = "hash"
+	ShardStrategyRange = "range"
+
+	KeyOrderSigned   = "signed"
+	KeyOrderUnsigned = "unsigned"
+)
+
+// Default returns the configuration used where no file sets a value.
+func Default() *Config {
+	return &Config{
 		Server: ServerConfig{
-			Addr:    ":8080",
-			TCPAddr: ":9090",
+			Addr:         ":8080",
+			TCPAddr:      ":9090",
+			MaxValueSize: 64 << 20,
 		},
 		Storage: StorageConfig{
 			Path:                   "neuro_data",
@@ -43,13 +126,24 @@ func Load(configPath string) (*Config, error) {
 			MemTableFlushThreshold: 2000,
 			CompactionThreshold:    4,
 			WalBatchSize:           500,
+			WalFlushInterval:       100 * time.Millisecond,
 		},
 		System: SystemConfig{
 			ShardCount:     16,
+			ShardStrategy:  ShardStrategyHash,
+			KeyOrder:       KeyOrderSigned,
 			BloomSize:      100000,
 			BloomFalseProb: 0.01,
+			LogLevel:       "info",
+
+			AdaptiveReadWriteThreshold: 1.0,
+			LearnedIndexMinKeys:        64,
 		},
 	}
+}
+
+func Load(configPath string) (*Config, error) {
+	cfg := Default()
 
 	if configPath == "" {
 		for _, p := range []string{"configs/neuro.yaml", "neuro.yaml"} {
@@ -58,12 +152,10 @@ func Load(configPath string) (*Config, error) {
 				if err := yaml.Unmarshal(data, cfg); err != nil {
 					return cfg, err
 				}
-				applyStorageDefaults(cfg)
-				return cfg, nil
+				return cfg, applyStorageDefaults(cfg)
 			}
 		}
-		applyStorageDefaults(cfg)
-		return cfg, nil // no file found: use defaults
+		return cfg, applyStorageDefaults(cfg) // no file found: use defaults
 	}
 
 	data, err := os.ReadFile(configPath)
@@ -75,11 +167,15 @@ func Load(configPath string) (*Config, error) {
 		return cfg, err
 	}
 
-	applyStorageDefaults(cfg)
-	return cfg, nil
+	return cfg, applyStorageDefaults(cfg)
 }
 
-func applyStorageDefaults(cfg *Config) {
+// applyStorageDefaults fills in unset values and rejects settings that name
+// an unknown mode, rather than silently running another one.
+func applyStorageDefaults(cfg *Config) error {
+	if cfg.Server.MaxValueSize <= 0 {
+		cfg.Server.MaxValueSize = 64 << 20
+	}
 	if cfg.Storage.MemTableFlushThreshold <= 0 {
 		cfg.Storage.MemTableFlushThreshold = 2000
 	}
@@ -92,10 +188,31 @@ func applyStorageDefaults(cfg *Config) {
 	if cfg.System.ShardCount <= 0 {
 		cfg.System.ShardCount = 16
 	}
+	switch cfg.System.ShardStrategy {
+	case "":
+		cfg.System.ShardStrategy = ShardStrategyHash
+	case ShardStrategyHash, ShardStrategyRange:
+	default:
+		return fmt.Errorf("config: unknown shard_strategy %q (want %q or %q)", cfg.System.ShardStrategy, ShardStrategyHash, ShardStrategyRange)
+	}
+	switch cfg.System.KeyOrder {
+	case "":
+		cfg.System.KeyOrder = KeyOrderSigned
+	case KeyOrderSigned, KeyOrderUnsigned:
+	default:
+		return fmt.Errorf("config: unknown key_order %q (want %q or %q)", cfg.System.KeyOrder, KeyOrderSigned, KeyOrderUnsigned)
+	}
 	if cfg.System.BloomSize == 0 {
 		cfg.System.BloomSize = 100000
 	}
 	if cfg.System.BloomFalseProb <= 0 || cfg.System.BloomFalseProb >= 1 {
 		cfg.System.BloomFalseProb = 0.01
 	}
+	if cfg.System.LearnedIndexMinKeys <= 0 {
+		cfg.System.LearnedIndexMinKeys = 64
+	}
+	if cfg.System.LogLevel == "" {
+		cfg.System.LogLevel = "info"
+	}
+	return nil
 }
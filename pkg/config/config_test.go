@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestLoadDefaults(t *testing.T) {
@@ -25,6 +26,24 @@ func TestLoadDefaults(t *testing.T) {
 	if cfg.Storage.MemTableFlushThreshold != 2000 {
 		t.Errorf("default memtable_flush_threshold: got %d", cfg.Storage.MemTableFlushThreshold)
 	}
+	if cfg.System.ShardStrategy != ShardStrategyHash {
+		t.Errorf("default shard_strategy: got %q", cfg.System.ShardStrategy)
+	}
+	if cfg.Server.MaxValueSize != 64<<20 {
+		t.Errorf("default max_value_size: got %d", cfg.Server.MaxValueSize)
+	}
+	if cfg.System.LogLevel != "info" {
+		t.Errorf("default log_level: got %q", cfg.System.LogLevel)
+	}
+	if cfg.System.AdaptiveReadWriteThreshold != 1.0 {
+		t.Errorf("default adaptive_rw_threshold: got %v", cfg.System.AdaptiveReadWriteThreshold)
+	}
+	if !cfg.System.UseLearnedIndex() {
+		t.Errorf("default learned_index_enabled: disabled")
+	}
+	if cfg.System.LearnedIndexMinKeys != 64 {
+		t.Errorf("default learned_index_min_keys: got %d", cfg.System.LearnedIndexMinKeys)
+	}
 }
 
 func TestLoadFromFile(t *testing.T) {
@@ -38,10 +57,17 @@ storage:
   path: "test_data"
   memtable_flush_threshold: 1000
   compaction_threshold: 3
+  l0_compaction_bytes: 8388608
   wal_batch_size: 200
+  wal_flush_interval: 5ms
+  compaction_interval: 10m
 system:
   shard_count: 8
   bloom_size: 50000
+  adaptive_rw_threshold: 4
+  reshard_on_open: true
+  learned_index_enabled: false
+  learned_index_min_keys: 500
 `
 	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
 		t.Fatalf("write config: %v", err)
@@ -62,7 +88,55 @@ system:
 	if cfg.Storage.CompactionThreshold != 3 {
 		t.Errorf("compaction_threshold: got %d", cfg.Storage.CompactionThreshold)
 	}
+	if cfg.Storage.L0CompactionBytes != 8<<20 {
+		t.Errorf("l0_compaction_bytes: got %d", cfg.Storage.L0CompactionBytes)
+	}
 	if cfg.Storage.WalBatchSize != 200 {
 		t.Errorf("wal_batch_size: got %d", cfg.Storage.WalBatchSize)
 	}
+	if cfg.Storage.WalFlushInterval != 5*time.Millisecond {
+		t.Errorf("wal_flush_interval: got %v", cfg.Storage.WalFlushInterval)
+	}
+	if cfg.Storage.CompactionInterval != 10*time.Minute {
+		t.Errorf("compaction_interval: got %v", cfg.Storage.CompactionInterval)
+	}
+	if cfg.System.AdaptiveReadWriteThreshold != 4 {
+		t.Errorf("adaptive_rw_threshold: got %v", cfg.System.AdaptiveReadWriteThreshold)
+	}
+	if !cfg.System.ReshardOnOpen {
+		t.Errorf("reshard_on_open: not set")
+	}
+	if cfg.System.UseLearnedIndex() {
+		t.Errorf("learned_index_enabled: still enabled")
+	}
+	if cfg.System.LearnedIndexMinKeys != 500 {
+		t.Errorf("learned_index_min_keys: got %d", cfg.System.LearnedIndexMinKeys)
+	}
+}
+
+func TestLoadRejectsUnknownModes(t *testing.T) {
+	for _, content := range []string{
+		"system:\n  key_order: unsigend\n",
+		"system:\n  shard_strategy: ranged\n",
+	} {
+		path := filepath.Join(t.TempDir(), "test.yaml")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Errorf("Load accepted %q", content)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "test.yaml")
+	if err := os.WriteFile(path, []byte("system:\n  key_order: unsigned\n  shard_strategy: range\n"), 0644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.System.KeyOrder != KeyOrderUnsigned || cfg.System.ShardStrategy != ShardStrategyRange {
+		t.Errorf("got key_order %q, shard_strategy %q", cfg.System.KeyOrder, cfg.System.ShardStrategy)
+	}
 }
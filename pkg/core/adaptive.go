@@ -0,0 +1,29 @@
+package core
+
+// trainIndexes reports whether compactions should train learned indexes: the
+// read/write ratio is at least system.adaptive_rw_threshold (always with a
+// threshold of 0). Under write-heavy load the tables are soon compacted again,
+// so training on each compaction is mostly wasted and is deferred instead.
+// With learned indexes disabled it is always false.
+func (hs *HybridStore) trainIndexes() bool {
+	if !hs.conf.System.UseLearnedIndex() {
+		return false
+	}
+	threshold := hs.conf.System.AdaptiveReadWriteThreshold
+	return threshold <= 0 || hs.stats.GetReadWriteRatio() >= threshold
+}
+
+// trainDeferredIndex trains the learned index a compaction deferred on the
+// shard once reads have caught up, in the background. Until then lookups
+// use the SSTables' own indexes.
+func (hs *HybridStore) trainDeferredIndex(shard *Shard) {
+	if !shard.indexDeferred.Load() || !hs.trainIndexes() || !shard.indexDeferred.CompareAndSwap(true, false) {
+		return
+	}
+	hs.goCompaction(func() {
+		shard.compactionLock.Lock()
+		defer shard.compactionLock.Unlock()
+		hs.rebuildLearnedIndexFromSSTables(shard)
+		hs.log.Debug("[LearnedIndex] Shard %d: trained deferred index", shard.id)
+	})
+}
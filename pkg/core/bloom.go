@@ -0,0 +1,87 @@
+package core
+
+import (
+	"slices"
+
+	"neurodb/pkg/common"
+	"neurodb/pkg/core/learned"
+	"neurodb/pkg/core/structure"
+	"neurodb/pkg/storage/sstable"
+)
+
+// bloomHeadroom is how many times a shard's current key count a rebuilt
+// bloom filter is designed for, so it does not fill up again right away.
+const bloomHeadroom = 2
+
+// bloomSaturatedLocked reports whether the shard's filter has taken more
+// elements than it was designed for. The caller holds shard.mutex.
+func (shard *Shard) bloomSaturatedLocked() bool {
+	st := shard.bloom.Snapshot()
+	return st.Elements > st.Capacity
+}
+
+// rebuildBloom replaces the shard's bloom filter with one holding only the
+// keys the shard stores now, designed for bloomHeadroom times as many (at
+// least bloom_size). Keys deleted or compacted away since the old filter was
+// built drop out of it. The keys are collected without the
+// shard lock; what was written or flushed meanwhile is added under it before
+// the swap, so the new filter never rules out a stored key. The caller holds
+// shard.compactionLock, or is opening the store, so no table it reads is
+// closed underneath it.
+func (hs *HybridStore) rebuildBloom(shard *Shard) {
+	shard.mutex.RLock()
+	old := shard.bloom
+	tables := append([]*sstable.SSTable(nil), shard.sstables...)
+	indexes := append([]*learned.LearnedIndex(nil), shard.learnedIndexes...)
+	shard.mutex.RUnlock()
+
+	var keys []common.KeyType
+	for _, li := range indexes {
+		keys = append(keys, li.Keys...)
+	}
+	for _, sst := range tables {
+		keys = appendTableKeys(keys, sst)
+	}
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+
+	capacity := max(uint(len(keys))*bloomHeadroom, hs.conf.System.BloomSize)
+	bf := structure.NewBloomFilter(capacity, hs.conf.System.BloomFalseProb)
+	for _, k := range keys {
+		bf.Add(k)
+	}
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if shard.bloom != old {
+		return // reset meanwhile
+	}
+	for _, sst := range shard.sstables {
+		if !slices.Contains(tables, sst) {
+			for _, k := range appendTableKeys(nil, sst) {
+				bf.Add(k)
+			}
+		}
+	}
+	shard.mutableMem.Iterator(func(key common.KeyType, _ common.ValueType) bool {
+		bf.Add(key)
+		return true
+	})
+	shard.bloom = bf
+	shard.publishLocked()
+	if st := old.Snapshot(); st.Elements > st.Capacity {
+		hs.bloomResizes.Add(1)
+		hs.log.Info("[Bloom] Shard %d: filter held %d elements, designed for %d; resized for %d keys", shard.id, st.Elements, st.Capacity, capacity)
+	} else {
+		hs.log.Debug("[Bloom] Shard %d: rebuilt filter with %d live keys (was %d elements)", shard.id, len(keys), st.Elements)
+	}
+}
+
+func appendTableKeys(keys []common.KeyType, sst *sstable.SSTable) []common.KeyType {
+	it := sst.NewKeyIterator()
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	it.Close()
+	return keys
+}
@@ -0,0 +1,148 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"neurodb/pkg/common"
+	"neurodb/pkg/storage"
+	"neurodb/pkg/storage/sstable"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrNotEmpty is returned by BulkLoad for a store that already holds data.
+var ErrNotEmpty = errors.New("core: bulk load needs an empty store")
+
+// RecordIterator yields records in strictly ascending key order, under the
+// store's key order.
+// sstable.NewSliceIterator adapts a sorted slice.
+type RecordIterator interface {
+	Next() bool
+	Key() common.KeyType
+	Value() common.ValueType
+}
+
+// BulkLoad seeds an empty store from sorted records, writing one SSTable per
+// shard directly and training each shard's learned index once, instead of
+// going through the memtable, flushes and compactions. It returns the number
+// of records loaded.
+//
+// The records are not written to the WAL: they are durable once BulkLoad
+// returns, because the tables are synced and recorded in the manifest, but
+// replicas following the WAL never see them. If it fails nothing is loaded.
+// Writes made while it runs are newer than the loaded records.
+func (hs *HybridStore) BulkLoad(iter RecordIterator) (int, error) {
+	for _, shard := range hs.shards {
+		shard.mutex.RLock()
+		empty := len(shard.sstables) == 0 && shard.mutableMem.Count() == 0
+		shard.mutex.RUnlock()
+		if !empty {
+			return 0, ErrNotEmpty
+		}
+	}
+
+	stamp := time.Now().UnixNano()
+	builders := make([]*sstable.Builder, len(hs.shards))
+	keys := make([][]common.KeyType, len(hs.shards))
+	abort := func() {
+		for _, b := range builders {
+			if b != nil {
+				b.Abort()
+			}
+		}
+	}
+
+	count := 0
+	var prev common.KeyType
+	for iter.Next() {
+		k := hs.orderKey(iter.Key())
+		if count > 0 && k <= prev {
+			abort()
+			return 0, fmt.Errorf("core: bulk load keys out of order: %d after %d", iter.Key(), hs.orderKey(prev))
+		}
+		prev = k
+		count++
+
+		i := hs.route(k)
+		if builders[i] == nil {
+			b, err := sstable.NewBuilder(hs.bulkLoadPath(i, stamp))
+			if err != nil {
+				abort()
+				return 0, err
+			}
+			builders[i] = b
+		}
+		val, err := hs.encode(iter.Value())
+		if err == nil {
+			err = hs.checkValueSize(iter.Key(), val)
+		}
+		if err != nil {
+			abort()
+			return 0, fmt.Errorf("core: bulk load key %d: %w", iter.Key(), err)
+		}
+		if err := builders[i].Add(k, val); err != nil {
+			abort()
+			return 0, err
+		}
+		keys[i] = append(keys[i], k)
+	}
+
+	tables := make([]*sstable.SSTable, len(hs.shards))
+	cleanup := func() {
+		for i, t := range tables {
+			if t != nil {
+				t.Close()
+				os.Remove(hs.bulkLoadPath(i, stamp))
+			}
+		}
+	}
+	var edit storage.VersionEdit
+	for i, b := range builders {
+		if b == nil {
+			continue
+		}
+		builders[i] = nil
+		err := b.Close()
+		if err == nil {
+			tables[i], err = sstable.Open(hs.bulkLoadPath(i, stamp))
+		}
+		if err != nil {
+			os.Remove(hs.bulkLoadPath(i, stamp))
+			abort()
+			cleanup()
+			return 0, err
+		}
+		edit.Add = append(edit.Add, storage.FileMeta{Name: filepath.Base(hs.bulkLoadPath(i, stamp)), Shard: i, Level: 1})
+	}
+	if len(edit.Add) == 0 {
+		return 0, nil
+	}
+	// One edit, so either every shard's table is live or none is.
+	if err := hs.manifest.Apply(edit); err != nil {
+		cleanup()
+		return 0, err
+	}
+
+	for i, shard := range hs.shards {
+		if tables[i] == nil {
+			continue
+		}
+		shard.mutex.Lock()
+		// Oldest of all, below anything flushed while the load ran.
+		shard.l1SSTables = append([]*sstable.SSTable{tables[i]}, shard.l1SSTables...)
+		shard.rebuildSSTableViewLocked()
+		for _, k := range keys[i] {
+			shard.bloom.Add(k)
+		}
+		shard.publishLocked()
+		shard.mutex.Unlock()
+		hs.rebuildLearnedIndexFromSSTables(shard)
+	}
+	hs.log.Info("[BulkLoad] Loaded %d records into %d SSTables.", count, len(edit.Add))
+	return count, nil
+}
+
+func (hs *HybridStore) bulkLoadPath(shardID int, stamp int64) string {
+	return filepath.Join(hs.layout.TableDir(1), fmt.Sprintf("shard-%d-l1-%d-bulk.sst", shardID, stamp))
+}
@@ -0,0 +1,104 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"neurodb/pkg/common"
+	"neurodb/pkg/storage/sstable"
+)
+
+func sortedRecords(n int) []common.Record {
+	records := make([]common.Record, n)
+	for i := range records {
+		records[i] = common.Record{Key: common.KeyType(i * 3), Value: []byte(fmt.Sprintf("v%d", i))}
+	}
+	return records
+}
+
+func TestBulkLoadServesReadsAndSurvivesRestart(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 4
+	records := sortedRecords(5000)
+
+	hs := NewHybridStore(cfg)
+	n, err := hs.BulkLoad(sstable.NewSliceIterator(records))
+	if err != nil || n != len(records) {
+		hs.Close()
+		t.Fatalf("bulk load: n=%d err=%v", n, err)
+	}
+	if l0 := hs.Stats()["l0_sstable_count"].(int); l0 != 0 {
+		hs.Close()
+		t.Fatalf("bulk load went through flushes: %d L0 tables", l0)
+	}
+	// Later writes win over loaded records.
+	hs.Put(3, []byte("updated"))
+	hs.Close()
+
+	hs = NewHybridStore(cfg)
+	defer hs.Close()
+	if v, ok := hs.Get(3); !ok || string(v) != "updated" {
+		t.Fatalf("key 3: got ok=%v val=%q, want updated", ok, v)
+	}
+	if v, ok := hs.Get(3 * 4999); !ok || string(v) != "v4999" {
+		t.Fatalf("last key: got ok=%v val=%q", ok, v)
+	}
+	if _, ok := hs.Get(4); ok {
+		t.Fatalf("key 4 was never loaded")
+	}
+	got := hs.Scan(300, 599)
+	if len(got) != 100 || got[0].Key != 300 || string(got[99].Value) != "v199" {
+		t.Fatalf("scan [300, 599]: got %d records", len(got))
+	}
+
+	if _, err := hs.BulkLoad(sstable.NewSliceIterator(records)); !errors.Is(err, ErrNotEmpty) {
+		t.Fatalf("bulk load into a non-empty store: expected ErrNotEmpty, got %v", err)
+	}
+}
+
+func TestBulkLoadRejectsUnsortedInputAtomically(t *testing.T) {
+	cfg := testConfig(t)
+	hs := NewHybridStore(cfg)
+	defer hs.Close()
+
+	records := sortedRecords(100)
+	records[50], records[51] = records[51], records[50]
+	if _, err := hs.BulkLoad(sstable.NewSliceIterator(records)); err == nil {
+		t.Fatalf("expected an error for out-of-order keys")
+	}
+	if _, ok := hs.Get(0); ok {
+		t.Fatalf("a failed bulk load left records behind")
+	}
+	if n, err := hs.BulkLoad(sstable.NewSliceIterator(sortedRecords(100))); err != nil || n != 100 {
+		t.Fatalf("bulk load after a failed one: n=%d err=%v", n, err)
+	}
+}
+
+func BenchmarkBulkLoad(b *testing.B) {
+	records := sortedRecords(20000)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		hs := NewHybridStore(testConfig(b))
+		b.StartTimer()
+		if _, err := hs.BulkLoad(sstable.NewSliceIterator(records)); err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		hs.Close()
+	}
+}
+
+func BenchmarkPutLoad(b *testing.B) {
+	records := sortedRecords(20000)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		hs := NewHybridStore(testConfig(b))
+		b.StartTimer()
+		for _, r := range records {
+			hs.Put(r.Key, r.Value)
+		}
+		b.StopTimer()
+		hs.Close()
+	}
+}
@@ -0,0 +1,31 @@
+package core
+
+import "neurodb/pkg/common"
+
+// ValueCodec converts between the values callers pass in and get back and
+// the bytes the store keeps in its memtable, WAL and SSTables. Empty values
+// are delete markers and never pass through a codec.
+type ValueCodec interface {
+	Encode(val common.ValueType) (common.ValueType, error)
+	Decode(stored common.ValueType) (common.ValueType, error)
+}
+
+// WithValueCodec stores values in c's encoding. Without it values are kept
+// as given. A store must always be opened with the codec it was written with.
+func WithValueCodec(c ValueCodec) Option {
+	return func(hs *HybridStore) { hs.codec = c }
+}
+
+func (hs *HybridStore) encode(val common.ValueType) (common.ValueType, error) {
+	if hs.codec == nil || len(val) == 0 {
+		return val, nil
+	}
+	return hs.codec.Encode(val)
+}
+
+func (hs *HybridStore) decode(stored common.ValueType) (common.ValueType, error) {
+	if hs.codec == nil || len(stored) == 0 {
+		return stored, nil
+	}
+	return hs.codec.Decode(stored)
+}
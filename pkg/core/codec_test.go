@@ -0,0 +1,68 @@
+package core
+
+import (
+	"encoding/base64"
+	"fmt"
+	"neurodb/pkg/common"
+	"testing"
+)
+
+type base64Codec struct{}
+
+func (base64Codec) Encode(val common.ValueType) (common.ValueType, error) {
+	return []byte(base64.StdEncoding.EncodeToString(val)), nil
+}
+
+func (base64Codec) Decode(stored common.ValueType) (common.ValueType, error) {
+	return base64.StdEncoding.DecodeString(string(stored))
+}
+
+func TestValueCodecRoundTrip(t *testing.T) {
+	cfg := testConfig(t)
+	store := NewHybridStore(cfg, WithValueCodec(base64Codec{}))
+
+	// Enough keys to flush some of them to SSTables.
+	for i := 0; i < 300; i++ {
+		store.Put(common.KeyType(i), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	store.Delete(7)
+
+	shard := store.getShard(299)
+	shard.mutex.RLock()
+	stored, _ := shard.mutableMem.Get(299)
+	shard.mutex.RUnlock()
+	if string(stored) != base64.StdEncoding.EncodeToString([]byte("value-299")) {
+		t.Fatalf("memtable holds %q, want the encoded value", stored)
+	}
+
+	check := func(s *HybridStore) {
+		t.Helper()
+		if v, ok := s.Get(42); !ok || string(v) != "value-42" {
+			t.Fatalf("Get(42) = %q, %v", v, ok)
+		}
+		if _, ok := s.Get(7); ok {
+			t.Fatalf("deleted key 7 still readable")
+		}
+		recs := s.Scan(0, 299)
+		if len(recs) != 299 {
+			t.Fatalf("scan returned %d records, want 299", len(recs))
+		}
+		for _, r := range recs {
+			if want := fmt.Sprintf("value-%d", r.Key); string(r.Value) != want {
+				t.Fatalf("scan key %d = %q, want %q", r.Key, r.Value, want)
+			}
+		}
+	}
+	check(store)
+	store.Close()
+
+	reopened := NewHybridStore(cfg, WithValueCodec(base64Codec{}))
+	defer reopened.Close()
+	check(reopened)
+
+	// A value that is not valid base64 surfaces the codec's error.
+	reopened.PutRaw(1000, []byte("!!"))
+	if _, _, err := reopened.GetContext(t.Context(), 1000); err == nil {
+		t.Fatalf("expected a decode error for a corrupt stored value")
+	}
+}
@@ -0,0 +1,87 @@
+package core
+
+import "time"
+
+// EventListener is told about the store's flushes and compactions. Calls
+// come from a single goroutine in the order the events happened, never from
+// the flush or compaction itself, so a slow listener cannot stall them.
+type EventListener interface {
+	// OnFlush reports a memtable of records written to a new L0 table.
+	OnFlush(shardID, records int)
+	// OnCompaction reports inputs tables merged into one table of
+	// outputBytes at level.
+	OnCompaction(shardID, level, inputs int, outputBytes int64)
+}
+
+// Event is a flush or compaction as queued for the listeners.
+type Event struct {
+	Kind        string    `json:"kind"` // "flush" or "compaction"
+	Shard       int       `json:"shard"`
+	Level       int       `json:"level"`
+	Records     int       `json:"records,omitempty"`
+	Inputs      int       `json:"inputs,omitempty"`
+	OutputBytes int64     `json:"output_bytes,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// eventQueueSize bounds the events waiting for slow listeners; further
+// events are dropped and counted in the events_dropped stat.
+const eventQueueSize = 256
+
+// WithEventListener registers l before the store opens, so it also hears
+// about the flushes of WAL recovery.
+func WithEventListener(l EventListener) Option {
+	return func(hs *HybridStore) { hs.listeners = append(hs.listeners, l) }
+}
+
+// AddEventListener registers l for the events from now on.
+func (hs *HybridStore) AddEventListener(l EventListener) {
+	hs.listenersMu.Lock()
+	defer hs.listenersMu.Unlock()
+	hs.listeners = append(hs.listeners, l)
+}
+
+// emit queues ev for the listeners without waiting.
+func (hs *HybridStore) emit(ev Event) {
+	ev.Time = time.Now()
+	select {
+	case hs.events <- ev:
+	default:
+		hs.eventsDropped.Add(1)
+	}
+}
+
+// dispatchEvents hands queued events to the listeners until the store
+// closes, then delivers what is still queued.
+func (hs *HybridStore) dispatchEvents() {
+	defer hs.wg.Done()
+	for {
+		select {
+		case ev := <-hs.events:
+			hs.deliver(ev)
+		case <-hs.closeCh:
+			for {
+				select {
+				case ev := <-hs.events:
+					hs.deliver(ev)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (hs *HybridStore) deliver(ev Event) {
+	hs.listenersMu.RLock()
+	listeners := hs.listeners
+	hs.listenersMu.RUnlock()
+	for _, l := range listeners {
+		switch ev.Kind {
+		case "flush":
+			l.OnFlush(ev.Shard, ev.Records)
+		case "compaction":
+			l.OnCompaction(ev.Shard, ev.Level, ev.Inputs, ev.OutputBytes)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"neurodb/pkg/common"
+)
+
+type recordingListener struct {
+	events  chan Event
+	release chan struct{} // when set, each call waits for it to close
+}
+
+func (l *recordingListener) OnFlush(shardID, records int) {
+	if l.release != nil {
+		<-l.release
+	}
+	l.events <- Event{Kind: "flush", Shard: shardID, Records: records}
+}
+
+func (l *recordingListener) OnCompaction(shardID, level, inputs int, outputBytes int64) {
+	if l.release != nil {
+		<-l.release
+	}
+	l.events <- Event{Kind: "compaction", Shard: shardID, Level: level, Inputs: inputs, OutputBytes: outputBytes}
+}
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event within 5s")
+		return Event{}
+	}
+}
+
+func TestEventListenerHearsFlushesAndCompactions(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	l := &recordingListener{events: make(chan Event, 16)}
+	hs := NewHybridStore(cfg, WithEventListener(l))
+	defer hs.Close()
+
+	for i := 0; i < 100; i++ {
+		hs.Put(common.KeyType(i), []byte("v"))
+	}
+	if ev := nextEvent(t, l.events); ev.Kind != "flush" || ev.Shard != 0 || ev.Records != 100 {
+		t.Fatalf("expected a flush of 100 records on shard 0, got %+v", ev)
+	}
+
+	if err := hs.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	ev := nextEvent(t, l.events)
+	if ev.Kind != "compaction" || ev.Level != 1 || ev.Inputs != 1 || ev.OutputBytes <= 0 {
+		t.Fatalf("expected a compaction of 1 table into L1, got %+v", ev)
+	}
+}
+
+func TestSlowEventListenerDoesNotStallFlushes(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	l := &recordingListener{events: make(chan Event, eventQueueSize+16), release: make(chan struct{})}
+	hs := NewHybridStore(cfg, WithEventListener(l))
+	defer hs.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			hs.Put(common.KeyType(i), []byte("v"))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Puts stalled behind a blocked listener")
+	}
+
+	close(l.release)
+	// Compactions started by the flushes are reported among them.
+	for flushes := 0; flushes < 10; {
+		if ev := nextEvent(t, l.events); ev.Kind == "flush" {
+			flushes++
+		}
+	}
+}
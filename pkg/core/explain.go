@@ -0,0 +1,66 @@
+package core
+
+import (
+	"path/filepath"
+
+	"neurodb/pkg/common"
+)
+
+// Sources a GetTrace can report.
+const (
+	SourceBloomFilter  = "bloom_filter" // the filter ruled the key out
+	SourceMemTable     = "memtable"
+	SourceSSTable      = "sstable"
+	SourceLearnedIndex = "learned_index"
+	SourceNone         = "none" // every layer was searched without a match
+)
+
+// GetTrace records how a Get was served. A tombstone also ends the search,
+// so Source can name a layer while Found is false.
+//
+// The learned-index fields describe the last learned index probed
+// (LearnedIndex is -1 when none was): the model's predicted position, the
+// key's actual position (-1 if not in that index) and how many keys the
+// correction search covered. They are kept when a later SSTable served the
+// key, to show what the model missed.
+type GetTrace struct {
+	Key          common.KeyType `json:"key"`
+	Shard        int            `json:"shard"`
+	Source       string         `json:"source"`
+	Table        string         `json:"table,omitempty"`
+	Found        bool           `json:"found"`
+	LearnedIndex int            `json:"learned_index"`
+	PredictedPos int            `json:"predicted_pos"`
+	ActualPos    int            `json:"actual_pos"`
+	SearchWindow int            `json:"search_window"`
+	Error        string         `json:"error,omitempty"`
+}
+
+func (t *GetTrace) servedBy(source, table string) {
+	if t == nil {
+		return
+	}
+	t.Source = source
+	if table != "" {
+		t.Table = filepath.Base(table)
+	}
+}
+
+// GetExplain is Get that also reports which layer served key and, for the
+// learned index, how far off the model's prediction was. It is meant for
+// debugging and evaluating models; it costs about as much as Get.
+func (hs *HybridStore) GetExplain(key common.KeyType) (common.ValueType, GetTrace) {
+	trace := GetTrace{Key: key}
+	hs.stats.RecordRead()
+	stored, st := hs.lookup(hs.orderKey(key), &trace)
+	if st != common.KeyFound {
+		return nil, trace
+	}
+	val, err := hs.decode(stored)
+	if err != nil {
+		trace.Error = err.Error()
+		return nil, trace
+	}
+	trace.Found = true
+	return val, trace
+}
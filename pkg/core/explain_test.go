@@ -0,0 +1,51 @@
+package core
+
+import "testing"
+
+func TestGetExplainTracesLearnedIndex(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	hs := NewHybridStore(cfg)
+	defer hs.Close()
+
+	for _, rec := range sortedRecords(500) {
+		hs.Put(rec.Key, rec.Value)
+	}
+	if err := hs.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	hs.Put(1, []byte("fresh"))
+
+	// Keys are i*3, so key 300 is at position 100 of the compacted index.
+	val, trace := hs.GetExplain(300)
+	if string(val) != "v100" || !trace.Found {
+		t.Fatalf("GetExplain(300) = %q, found=%v", val, trace.Found)
+	}
+	if trace.Source != SourceLearnedIndex || trace.LearnedIndex != 0 {
+		t.Fatalf("expected learned index 0 to serve key 300, got %+v", trace)
+	}
+	if trace.ActualPos != 100 {
+		t.Fatalf("actual position %d, want 100", trace.ActualPos)
+	}
+	if trace.SearchWindow <= 0 {
+		t.Fatalf("expected a positive search window, got %d", trace.SearchWindow)
+	}
+	if d := trace.ActualPos - trace.PredictedPos; d < -trace.SearchWindow || d > trace.SearchWindow {
+		t.Fatalf("prediction %d is further than the window %d from %d", trace.PredictedPos, trace.SearchWindow, trace.ActualPos)
+	}
+
+	if _, trace := hs.GetExplain(1); trace.Source != SourceMemTable || !trace.Found {
+		t.Fatalf("expected key 1 from the memtable, got %+v", trace)
+	}
+	// 301 falls between indexed keys. Unless the bloom filter rules it out,
+	// the index is probed and misses.
+	_, trace = hs.GetExplain(301)
+	switch {
+	case trace.Found:
+		t.Fatalf("GetExplain(301) found a key that was never written")
+	case trace.Source == SourceNone && trace.ActualPos != -1:
+		t.Fatalf("a miss in the index reported position %d", trace.ActualPos)
+	case trace.Source != SourceNone && trace.Source != SourceBloomFilter:
+		t.Fatalf("unexpected source %q for a missing key", trace.Source)
+	}
+}
@@ -1,6 +1,8 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"log"
@@ -10,15 +12,18 @@ import (
 	"neurodb/pkg/core/learned"
 	"neurodb/pkg/core/memory"
 	"neurodb/pkg/core/structure"
+	"neurodb/pkg/logger"
 	"neurodb/pkg/monitor"
 	"neurodb/pkg/storage"
 	"neurodb/pkg/storage/sstable"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,15 +32,31 @@ type Shard struct {
 	mutex          sync.RWMutex
 	mutableMem     *memory.MemTable
 	learnedIndexes []*learned.LearnedIndex
+	// indexed holds the tables whose contents learnedIndexes already reflect.
+	// Tables flushed since then are newer than the index and read before it.
+	indexed        map[*sstable.SSTable]bool
 	l0SSTables     []*sstable.SSTable
 	l1SSTables     []*sstable.SSTable
 	sstables       []*sstable.SSTable
 	bloom          *structure.BloomFilter
 	compactionLock sync.Mutex
+	space          atomic.Pointer[spaceUsage]
+	flushErr       error // last memtable flush failure, cleared by a successful retry
+	// indexDeferred is set while a compaction has left the shard without a
+	// learned index under write-heavy load (see trainIndexes).
+	indexDeferred atomic.Bool
+	// lastCompaction is when a compaction last installed its output, in
+	// UnixNano; 0 if none has since open.
+	lastCompaction atomic.Int64
+	// modelBuild is how long the shard's last learned-index build took, in
+	// nanoseconds; 0 if none has run since open.
+	modelBuild atomic.Int64
+	// view is what Stats reads instead of taking mutex (see publishLocked).
+	view atomic.Pointer[shardView]
 }
 
 func NewShard(id int, bloomSize uint, bloomP float64) *Shard {
-	return &Shard{
+	shard := &Shard{
 		id:             id,
 		mutableMem:     memory.NewMemTable(32),
 		learnedIndexes: make([]*learned.LearnedIndex, 0),
@@ -44,6 +65,15 @@ func NewShard(id int, bloomSize uint, bloomP float64) *Shard {
 		sstables:       make([]*sstable.SSTable, 0),
 		bloom:          structure.NewBloomFilter(bloomSize, bloomP),
 	}
+	shard.publishLocked()
+	return shard
+}
+
+func (shard *Shard) setIndexedLocked(tables []*sstable.SSTable) {
+	shard.indexed = make(map[*sstable.SSTable]bool, len(tables))
+	for _, t := range tables {
+		shard.indexed[t] = true
+	}
 }
 
 func (shard *Shard) rebuildSSTableViewLocked() {
@@ -53,204 +83,940 @@ func (shard *Shard) rebuildSSTableViewLocked() {
 	shard.sstables = combined
 }
 
+// walEntry is a queued WAL write: a record, a merge operand when merge is
+// set, or a range delete when del is set. An entry with done set logs batch
+// as one synced write after everything queued before it, and reports the
+// outcome on done.
+type walEntry struct {
+	rec   common.Record
+	merge bool
+	del   *common.RangeTombstone
+	batch []common.Record
+	done  chan error
+}
+
+// queueWrite hands entry to backgroundPersist without blocking. Entries
+// reach it in the order they were queued: once writeCh is full, later
+// entries wait behind the earlier ones in hs.overflow rather than racing
+// them for room, so two writes of a key are logged in the order they were
+// made and replay keeps the newer value. It fails with ErrClosed once the
+// store is closing: every entry it accepted is still logged.
+func (hs *HybridStore) queueWrite(entry walEntry) error {
+	hs.closeMu.RLock()
+	defer hs.closeMu.RUnlock()
+	if hs.closed {
+		return ErrClosed
+	}
+	if !hs.overflowing.Load() {
+		select {
+		case hs.writeCh <- entry:
+			return nil
+		default:
+		}
+	}
+	hs.overflowMu.Lock()
+	defer hs.overflowMu.Unlock()
+	if !hs.overflowing.Load() {
+		select {
+		case hs.writeCh <- entry:
+			return nil
+		default:
+		}
+		hs.overflowing.Store(true)
+		go hs.drainOverflow()
+	}
+	hs.overflow = append(hs.overflow, entry)
+	return nil
+}
+
+// markClosed makes queueWrite refuse new entries and then signals the
+// background goroutines to stop. A queueWrite already under way finishes
+// first, so backgroundPersist's last drain sees its entry.
+func (hs *HybridStore) markClosed() {
+	hs.closeMu.Lock()
+	hs.closed = true
+	close(hs.closeCh)
+	hs.closeMu.Unlock()
+}
+
+// goCompaction runs f in the background as a compaction, which Close and
+// Shutdown wait for before closing the tables. Once the store is closing it
+// does nothing: checking under closeMu means no compaction is added after
+// markClosed, while Close waits.
+func (hs *HybridStore) goCompaction(f func()) {
+	hs.closeMu.RLock()
+	defer hs.closeMu.RUnlock()
+	if hs.closed {
+		return
+	}
+	hs.compactions.Add(1)
+	go func() {
+		defer hs.compactions.Done()
+		f()
+	}()
+}
+
+// drainOverflow moves hs.overflow into writeCh as room frees up, one entry
+// at a time, and stops once it is empty. Until then queueWrite puts every
+// entry behind the ones still waiting. After Close it keeps going:
+// backgroundPersist takes entries until it has stopped.
+func (hs *HybridStore) drainOverflow() {
+	for {
+		hs.overflowMu.Lock()
+		hs.sending = 0
+		if len(hs.overflow) == 0 {
+			hs.overflowing.Store(false)
+			hs.overflowMu.Unlock()
+			return
+		}
+		entry := hs.overflow[0]
+		hs.overflow[0] = walEntry{}
+		hs.overflow = hs.overflow[1:]
+		hs.sending = 1
+		hs.overflowMu.Unlock()
+
+		hs.writeCh <- entry
+	}
+}
+
+// drainQueue passes every queued entry to f, those still in the overflow
+// included, and returns once drainOverflow has stopped. The caller has
+// stopped new entries from being queued.
+func (hs *HybridStore) drainQueue(f func(walEntry)) {
+	for {
+		// Read first: once drainOverflow has stopped, all it sent is in
+		// writeCh.
+		drained := !hs.overflowing.Load()
+	Drain:
+		for {
+			select {
+			case entry := <-hs.writeCh:
+				f(entry)
+			default:
+				break Drain
+			}
+		}
+		if drained {
+			return
+		}
+		select {
+		case entry := <-hs.writeCh:
+			f(entry)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// persistPause is a request for backgroundPersist to log its batch, close
+// paused and wait for resume to be closed.
+type persistPause struct {
+	paused, resume chan struct{}
+}
+
+// pausePersist stops backgroundPersist once it has logged what it took from
+// writeCh, until the returned resume is called. It fails with ErrClosed if
+// the store is closing.
+func (hs *HybridStore) pausePersist() (resume func(), err error) {
+	p := persistPause{paused: make(chan struct{}), resume: make(chan struct{})}
+	select {
+	case hs.pauseCh <- p:
+	case <-hs.closeCh:
+		return nil, ErrClosed
+	}
+	<-p.paused
+	return func() { close(p.resume) }, nil
+}
+
+// pendingWrites is how many writes wait to be logged.
+func (hs *HybridStore) pendingWrites() int {
+	hs.overflowMu.Lock()
+	defer hs.overflowMu.Unlock()
+	return len(hs.writeCh) + len(hs.overflow) + hs.sending
+}
+
 type HybridStore struct {
-	shards  []*Shard
-	backend storage.Backend
-	stats   *monitor.WorkloadStats
-	writeCh chan common.Record
-	closeCh chan struct{}
-	wg      sync.WaitGroup
-	conf    *config.Config
+	shards   []*Shard
+	backend  storage.Backend
+	stats    *monitor.WorkloadStats
+	writeCh  chan walEntry
+	closeCh  chan struct{}
+	wg       sync.WaitGroup
+	conf     *config.Config
+	layout   Layout // where the WAL and each level's SSTables live
+	manifest *storage.Manifest
+
+	// Writes waiting for room in writeCh, oldest first (see queueWrite).
+	// overflowing is set while drainOverflow runs; sending counts the entry
+	// it holds.
+	overflowMu  sync.Mutex
+	overflow    []walEntry
+	sending     int
+	overflowing atomic.Bool
+	// closed is set, under closeMu, when Close or Shutdown starts; queueWrite
+	// holds closeMu for reading.
+	closeMu sync.RWMutex
+	closed  bool
+	// pauseCh stops backgroundPersist for a Reset (see pausePersist).
+	pauseCh chan persistPause
+	// persistStopped is set once backgroundPersist has logged its last entry.
+	persistStopped atomic.Bool
+	// keyFlip is XORed into every key entering or leaving the store (see
+	// orderKey).
+	keyFlip common.KeyType
+
+	// compactions counts background compactions, which Close waits for
+	// before it closes their tables.
+	compactions sync.WaitGroup
+
+	imbalanced atomic.Bool // last reported imbalance state, to log transitions once
+
+	// WAL batches written by backgroundPersist since opened, and the records
+	// in them, for the batch size and flush rate in Stats.
+	walFlushes        atomic.Uint64
+	walFlushedRecords atomic.Uint64
+	opened            time.Time
+	startup           StartupStats // set once by OpenHybridStore
+
+	// Flush and compaction events queued for the listeners (see events.go).
+	events        chan Event
+	eventsDropped atomic.Uint64
+	listeners     []EventListener
+	listenersMu   sync.RWMutex
+
+	bloomResizes   atomic.Uint64 // saturated filters rebuilt; see rebuildBloom
+	indexDeferrals atomic.Uint64 // compactions that left training for later
+
+	// Set while the disk refuses writes (see readonly.go).
+	readOnly atomic.Bool
+	ro       readOnlyState
+
+	// splits[i] is the first key of shard i+1 when range sharding is
+	// configured (nil for hash sharding). Fixed once restore has chosen them.
+	splits []common.KeyType
+
+	log          logger.Logger
+	codec        ValueCodec // nil stores values as given
+	merge        MergeFunc  // nil rejects Merge
+	maxValueSize int        // bytes; see config.StorageConfig.MaxValueSize
 }
 
-func NewHybridStore(cfg *config.Config) *HybridStore {
-	if err := os.MkdirAll(cfg.Storage.Path, 0755); err != nil {
-		log.Fatalf("Failed to create data dir: %v", err)
+// ErrFlushFailed is returned by writes to a shard whose memtable could not be
+// flushed to an SSTable.
+var ErrFlushFailed = errors.New("core: memtable flush failed")
+
+// ErrClosed is returned by writes to a store that is closed or closing.
+var ErrClosed = errors.New("core: store is closed")
+
+// ErrValueTooLarge is returned by Put for a value over the store's
+// max_value_size.
+var ErrValueTooLarge = errors.New("core: value too large")
+
+// backendName is the base name of the store's WAL in its WAL directory.
+const backendName = "neuro.db"
+
+// Option customizes a HybridStore at construction.
+type Option func(*HybridStore)
+
+// WithLogger sends the store's logs (including WAL replay and compaction) to
+// l instead of the stdlib logger at cfg.System.LogLevel.
+func WithLogger(l logger.Logger) Option {
+	return func(hs *HybridStore) { hs.log = l }
+}
+
+func NewHybridStore(cfg *config.Config, opts ...Option) *HybridStore {
+	hs, err := OpenHybridStore(cfg, opts...)
+	if err != nil {
+		log.Fatalf("Failed to open store: %v", err)
+	}
+	return hs
+}
+
+// OpenHybridStore is NewHybridStore returning an error when the data
+// directory cannot be opened, e.g. its WAL cannot be opened for writing, it
+// holds data in a newer format (storage.ErrDataFormat) or written with
+// another shard count (ErrShardCount) or key order (ErrKeyOrder), or its WAL
+// holds merges and no merge operator is registered (ErrNoMergeOperator),
+// instead of exiting.
+func OpenHybridStore(cfg *config.Config, opts ...Option) (*HybridStore, error) {
+	layout := LayoutOf(cfg.Storage)
+	for _, dir := range layout.Dirs() {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("create data dir: %w", err)
+		}
 	}
 
-	walPath := filepath.Join(cfg.Storage.Path, "neuro.db")
 	hs := &HybridStore{
-		backend: storage.NewDiskBackend(walPath),
 		stats:   monitor.NewWorkloadStats(),
-		writeCh: make(chan common.Record, cfg.Storage.WalBufferSize),
+		writeCh: make(chan walEntry, cfg.Storage.WalBufferSize),
 		closeCh: make(chan struct{}),
+		pauseCh: make(chan persistPause),
 		shards:  make([]*Shard, cfg.System.ShardCount),
 		conf:    cfg,
+		layout:  layout,
+		opened:  time.Now(),
+		events:  make(chan Event, eventQueueSize),
+	}
+	hs.maxValueSize = cfg.Storage.MaxValueSize
+	if hs.maxValueSize <= 0 || hs.maxValueSize > sstable.MaxValueSize {
+		hs.maxValueSize = sstable.MaxValueSize
+	}
+	for _, opt := range opts {
+		opt(hs)
+	}
+	if hs.log == nil {
+		level, err := logger.ParseLevel(cfg.System.LogLevel)
+		hs.log = logger.New(os.Stderr, level)
+		if err != nil {
+			hs.log.Warn("[NeuroDB] %v; using info", err)
+		}
 	}
 
+	// The manifest is checked before anything else touches the directory.
+	manifest, existed, err := storage.OpenManifest(filepath.Join(cfg.Storage.Path, storage.ManifestName))
+	if err != nil {
+		return nil, fmt.Errorf("open manifest: %w", err)
+	}
+	hs.manifest = manifest
+	if err := hs.checkShardCount(); err != nil {
+		manifest.Close()
+		return nil, err
+	}
+	if err := hs.checkKeyOrder(); err != nil {
+		manifest.Close()
+		return nil, err
+	}
+	if err := hs.routeTables(existed); err != nil {
+		manifest.Close()
+		return nil, err
+	}
+
+	backend, err := storage.NewDiskBackend(filepath.Join(layout.WAL, backendName), hs.log)
+	if err != nil {
+		manifest.Close()
+		return nil, fmt.Errorf("open WAL: %w", err)
+	}
+	hs.backend = backend
+	hs.wg.Add(1)
+	go hs.dispatchEvents()
+
 	for i := 0; i < cfg.System.ShardCount; i++ {
 		hs.shards[i] = NewShard(i, cfg.System.BloomSize, cfg.System.BloomFalseProb)
 	}
 
-	hs.restoreSSTables()
-	hs.restoreLearnedIndexes()
-	recovered := hs.recoverFromWAL()
-	if recovered > 0 {
+	st := &hs.startup
+	phase := time.Now()
+	st.SSTablesRestored = hs.restoreSSTables()
+	st.SSTableRestore = time.Since(phase)
+
+	phase = time.Now()
+	st.IndexesLoaded, st.IndexesRebuilt = hs.restoreLearnedIndexes()
+	st.IndexRestore = time.Since(phase)
+
+	phase = time.Now()
+	st.WALBytes, _ = hs.backend.Size()
+	st.WALRecords, err = hs.recoverFromWAL()
+	if err != nil {
+		hs.Close()
+		return nil, err
+	}
+	st.WALReplay = time.Since(phase)
+	if st.WALRecords > 0 {
+		phase = time.Now()
 		if err := hs.checkpointAndTruncateWAL(); err != nil {
-			log.Printf("[Checkpoint] startup checkpoint failed: %v", err)
+			hs.log.Error("[Checkpoint] startup checkpoint failed: %v", err)
+		}
+		st.Checkpoint = time.Since(phase)
+	}
+	hs.collectGarbage()
+	for _, shard := range hs.shards {
+		// Restore fills the filters with every key on disk, which may be
+		// far more than bloom_size.
+		if shard.bloomSaturatedLocked() {
+			hs.rebuildBloom(shard)
 		}
 	}
 
+	st.Total = time.Since(hs.opened)
+	hs.log.Info("[NeuroDB] Opened in %v: %d SSTables (%v), %d learned indexes loaded and %d rebuilt (%v), %d WAL records replayed (%v)",
+		st.Total.Round(time.Millisecond), st.SSTablesRestored, st.SSTableRestore.Round(time.Millisecond),
+		st.IndexesLoaded, st.IndexesRebuilt, st.IndexRestore.Round(time.Millisecond),
+		st.WALRecords, st.WALReplay.Round(time.Millisecond))
+
 	hs.wg.Add(1)
 	go hs.backgroundPersist()
+	if cfg.Storage.CompactionInterval > 0 {
+		hs.wg.Add(1)
+		go hs.periodicCompaction(cfg.Storage.CompactionInterval)
+	}
 
-	return hs
+	return hs, nil
+}
+
+// Logger is the store's logger, which servers built on the store share.
+func (hs *HybridStore) Logger() logger.Logger {
+	return hs.log
+}
+
+// Layout returns where the store keeps its files.
+func (hs *HybridStore) Layout() Layout {
+	return hs.layout
+}
+
+// WALFrom reads the write-ahead log from offset, a position reported by a
+// previous iterator's Offset. Entries appear once the background writer has
+// logged them. Offsets keep growing when the store checkpoints on open or is
+// reset, but the entries before that are gone (storage.ErrOffsetTruncated).
+func (hs *HybridStore) WALFrom(offset int64) (*storage.WALIterator, error) {
+	return hs.backend.IterateFrom(offset)
+}
+
+// SyncWAL returns once every write made before the call is logged and
+// synced.
+func (hs *HybridStore) SyncWAL() error {
+	return hs.logDurably(nil)
+}
+
+// WALOffset is the offset the next logged write will get.
+func (hs *HybridStore) WALOffset() int64 {
+	return hs.backend.CurrentOffset()
 }
 
 func (hs *HybridStore) getShard(key common.KeyType) *Shard {
-	return hs.shards[int(key)%hs.conf.System.ShardCount]
+	return hs.shards[hs.route(key)]
 }
 
-func (hs *HybridStore) Put(key common.KeyType, val common.ValueType) {
-	hs.stats.RecordWrite()
-	rec := common.Record{Key: key, Value: val}
+// PutContext is Put that gives up if ctx is already done.
+func (hs *HybridStore) PutContext(ctx context.Context, key common.KeyType, val common.ValueType) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stored, err := hs.encode(val)
+	if err != nil {
+		return err
+	}
+	if err := hs.checkValueSize(key, stored); err != nil {
+		return err
+	}
+	return hs.PutRaw(key, stored)
+}
+
+// checkValueSize rejects a stored (encoded) value over the size limit.
+func (hs *HybridStore) checkValueSize(key common.KeyType, stored common.ValueType) error {
+	if len(stored) > hs.maxValueSize {
+		return fmt.Errorf("%w: key %d has %d bytes, limit is %d", ErrValueTooLarge, key, len(stored), hs.maxValueSize)
+	}
+	return nil
+}
+
+// Put writes key. It is visible to every Get that starts after Put returns,
+// including across memtable flushes and compactions; it reaches the WAL
+// asynchronously. It fails, writing nothing, for a value over the size limit
+// (ErrValueTooLarge), one the codec cannot encode, while the shard cannot
+// flush its memtable (ErrFlushFailed) or while the disk refuses writes
+// (ErrReadOnly).
+func (hs *HybridStore) Put(key common.KeyType, val common.ValueType) error {
+	return hs.PutContext(context.Background(), key, val)
+}
+
+// PutRaw stores val as it is, skipping the value codec. It is for values
+// already in the store's encoding; see ApplyWAL for a primary's WAL entries.
+func (hs *HybridStore) PutRaw(key common.KeyType, val common.ValueType) error {
+	return hs.putRaw(hs.orderKey(key), val)
+}
+
+// ApplyWAL applies an entry of a primary's WAL as it was logged: its key
+// is already in the store's key order (see orderKey) and its value in the
+// store's encoding.
+func (hs *HybridStore) ApplyWAL(entry storage.WALEntry) error {
+	switch entry.Op {
+	case storage.WALRangeDelete:
+		return hs.deleteRange(entry.Key, entry.End)
+	case storage.WALMerge:
+		if hs.merge == nil {
+			return ErrNoMergeOperator
+		}
+		return hs.mergeRaw(entry.Key, entry.Value)
+	}
+	return hs.putRaw(entry.Key, entry.Value)
+}
+
+// putRaw is PutRaw for a key in the store's order.
+func (hs *HybridStore) putRaw(key common.KeyType, val common.ValueType) error {
+	shard := hs.getShard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	return hs.putLocked(shard, key, val)
+}
+
+// putLocked is PutRaw for a caller that holds shard.mutex.
+func (hs *HybridStore) putLocked(shard *Shard, key common.KeyType, val common.ValueType) error {
+	return hs.writeLocked(shard, walEntry{rec: common.Record{Key: key, Value: val}})
+}
+
+// writeLocked logs and applies a put or merge. The caller holds shard.mutex.
+func (hs *HybridStore) writeLocked(shard *Shard, entry walEntry) error {
 	select {
-	case hs.writeCh <- rec:
+	case <-hs.closeCh:
+		return ErrClosed
 	default:
-		go func() { hs.writeCh <- rec }()
+	}
+	if err := hs.checkWritable(); err != nil {
+		return err
+	}
+	// After a failed flush the shard takes no more writes until a retry
+	// succeeds, so an error always means nothing was written.
+	if shard.flushErr != nil {
+		if shard.flushErr = hs.adaptiveFlush(shard); shard.flushErr != nil {
+			return fmt.Errorf("%w: %v", ErrFlushFailed, shard.flushErr)
+		}
 	}
 
+	if err := hs.queueWrite(entry); err != nil {
+		return err
+	}
+	hs.stats.RecordWrite()
+
+	shard.bloom.Add(entry.rec.Key)
+	if entry.merge {
+		shard.mutableMem.Merge(entry.rec.Key, entry.rec.Value)
+	} else {
+		shard.mutableMem.Put(entry.rec.Key, entry.rec.Value)
+	}
+
+	if shard.memEntriesLocked() >= hs.conf.Storage.MemTableFlushThreshold {
+		// This write is in the memtable and queued for the WAL either way.
+		shard.flushErr = hs.adaptiveFlush(shard)
+	}
+	return nil
+}
+
+func (hs *HybridStore) DeleteContext(ctx context.Context, key common.KeyType) error {
+	return hs.PutContext(ctx, key, []byte{})
+}
+
+func (hs *HybridStore) Delete(key common.KeyType) error {
+	return hs.Put(key, []byte{})
+}
+
+// DeleteExisting deletes key and reports whether it held a live value. The
+// check and the delete happen under the shard lock, so of two concurrent
+// calls for a key only one reports it existed. An absent key is left as it
+// is: nothing is logged for it.
+func (hs *HybridStore) DeleteExisting(key common.KeyType) (bool, error) {
+	return hs.DeleteExistingContext(context.Background(), key)
+}
+
+// DeleteExistingContext is DeleteExisting that gives up if ctx is already
+// done.
+func (hs *HybridStore) DeleteExistingContext(ctx context.Context, key common.KeyType) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	key = hs.orderKey(key)
 	shard := hs.getShard(key)
 	shard.mutex.Lock()
 	defer shard.mutex.Unlock()
+	if _, st := hs.lookupLocked(shard, key, nil); st != common.KeyFound {
+		return false, nil
+	}
+	if err := hs.putLocked(shard, key, []byte{}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-	shard.bloom.Add(key)
-	shard.mutableMem.Put(key, val)
+// DeleteRange deletes every key in [start, end) with one range tombstone per
+// shard rather than a tombstone per key. Keys written afterwards are visible.
+func (hs *HybridStore) DeleteRange(start, end common.KeyType) error {
+	return hs.DeleteRangeContext(context.Background(), start, end)
+}
 
-	if shard.mutableMem.Count() >= hs.conf.Storage.MemTableFlushThreshold {
-		hs.adaptiveFlush(shard)
+// DeleteRangeContext is DeleteRange that does nothing once ctx is done.
+// Nothing is deleted if it returns an error.
+func (hs *HybridStore) DeleteRangeContext(ctx context.Context, start, end common.KeyType) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
+	return hs.deleteRange(hs.orderKey(start), hs.orderKey(end))
 }
 
-func (hs *HybridStore) Delete(key common.KeyType) {
-	hs.Put(key, []byte{})
+// deleteRange is DeleteRange for keys in the store's order.
+func (hs *HybridStore) deleteRange(start, end common.KeyType) error {
+	if end <= start {
+		return nil
+	}
+	if err := hs.checkWritable(); err != nil {
+		return err
+	}
+	// Queued and applied under the shard locks, like a Put, so a Reset
+	// sees all of it or none.
+	var locked []*Shard
+	for i, shard := range hs.shards {
+		if lo, hi, ok := hs.shardBounds(i); ok && (end <= lo || start > hi) {
+			continue
+		}
+		shard.mutex.Lock()
+		locked = append(locked, shard)
+	}
+	defer func() {
+		for _, shard := range locked {
+			shard.mutex.Unlock()
+		}
+	}()
+	// Logged after every write already queued.
+	if err := hs.queueWrite(walEntry{del: &common.RangeTombstone{Start: start, End: end}}); err != nil {
+		return err
+	}
+	hs.stats.RecordWrite()
+	for _, shard := range locked {
+		shard.mutableMem.DeleteRange(start, end)
+	}
+	return nil
+}
+
+// GetContext is Get that returns ctx's error instead of reading once ctx is
+// done.
+func (hs *HybridStore) GetContext(ctx context.Context, key common.KeyType) (common.ValueType, bool, error) {
+	val, st, err := hs.GetWithStatusContext(ctx, key)
+	return val, st == common.KeyFound, err
+}
+
+// GetWithStatus is Get that tells a deleted key (common.KeyDeleted) from
+// one never written (common.KeyAbsent), for audits and cache invalidation.
+// A value the codec cannot decode is logged and reads as absent.
+func (hs *HybridStore) GetWithStatus(key common.KeyType) (common.ValueType, common.KeyStatus) {
+	val, st, err := hs.GetWithStatusContext(context.Background(), key)
+	if err != nil {
+		hs.log.Error("[Codec] Cannot decode key %d: %v", key, err)
+		return nil, common.KeyAbsent
+	}
+	return val, st
+}
+
+// GetWithStatusContext is GetWithStatus that returns ctx's error instead of
+// reading once ctx is done, and a decode error instead of logging it.
+func (hs *HybridStore) GetWithStatusContext(ctx context.Context, key common.KeyType) (common.ValueType, common.KeyStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, common.KeyAbsent, err
+	}
+	stored, st := hs.get(hs.orderKey(key))
+	if st != common.KeyFound {
+		return nil, st, nil
+	}
+	val, err := hs.decode(stored)
+	if err != nil {
+		return nil, common.KeyAbsent, err
+	}
+	return val, common.KeyFound, nil
 }
 
+// Get reads key. A value the codec cannot decode is logged and reads as
+// missing; GetContext returns the error instead.
 func (hs *HybridStore) Get(key common.KeyType) (common.ValueType, bool) {
+	val, ok, err := hs.GetContext(context.Background(), key)
+	if err != nil {
+		hs.log.Error("[Codec] Cannot decode key %d: %v", key, err)
+		return nil, false
+	}
+	return val, ok
+}
+
+func (hs *HybridStore) get(key common.KeyType) (common.ValueType, common.KeyStatus) {
 	hs.stats.RecordRead()
+	return hs.lookup(key, nil)
+}
+
+// lookup reads key, noting in trace (when not nil) what served it.
+func (hs *HybridStore) lookup(key common.KeyType, trace *GetTrace) (common.ValueType, common.KeyStatus) {
 	shard := hs.getShard(key)
+	hs.trainDeferredIndex(shard)
 	shard.mutex.RLock()
 	defer shard.mutex.RUnlock()
+	return hs.lookupLocked(shard, key, trace)
+}
+
+// lookupLocked is lookup for a caller that holds shard.mutex.
+func (hs *HybridStore) lookupLocked(shard *Shard, key common.KeyType, trace *GetTrace) (common.ValueType, common.KeyStatus) {
+	if trace != nil {
+		trace.Shard = shard.id
+		trace.LearnedIndex = -1
+	}
 
 	if !shard.bloom.Contains(key) {
-		return nil, false
+		trace.servedBy(SourceBloomFilter, "")
+		return nil, common.KeyAbsent
+	}
+
+	if item, ok := shard.mutableMem.GetItem(key); ok {
+		trace.servedBy(SourceMemTable, "")
+		val, st := tableValue(hs.memValueLocked(shard, item, nil))
+		if st == common.KeyFound {
+			hs.stats.RecordHit()
+		}
+		return val, st
 	}
+	if shard.mutableMem.Covers(key) {
+		trace.servedBy(SourceMemTable, "")
+		return nil, common.KeyDeleted
+	}
+	return hs.lookupTablesLocked(shard, key, trace)
+}
 
-	if val, ok := shard.mutableMem.Get(key); ok {
-		if len(val) == 0 {
-			return nil, false
+// lookupTablesLocked is lookupLocked below the memtable.
+func (hs *HybridStore) lookupTablesLocked(shard *Shard, key common.KeyType, trace *GetTrace) (common.ValueType, common.KeyStatus) {
+	// SSTables flushed after the learned index was built are newer than it.
+	for i := len(shard.sstables) - 1; i >= 0; i-- {
+		sst := shard.sstables[i]
+		if shard.indexed[sst] {
+			continue
+		}
+		if val, ok := getFromTable(sst, key); ok {
+			trace.servedBy(SourceSSTable, sst.Filename)
+			return tableValue(val)
 		}
-		hs.stats.RecordHit()
-		return val, true
 	}
 
 	// Check Learned Indexes (Recent Immutable)
 	for i := len(shard.learnedIndexes) - 1; i >= 0; i-- {
-		if val, ok := shard.learnedIndexes[i].Get(key); ok {
-			if len(val) == 0 {
-				return nil, false
-			}
-			return val, true
+		li := shard.learnedIndexes[i]
+		val, ok, probe := li.GetProbe(key)
+		if trace != nil {
+			trace.LearnedIndex = i
+			trace.PredictedPos = probe.Predicted
+			trace.ActualPos = probe.Found
+			trace.SearchWindow = probe.Window()
+		}
+		if ok {
+			trace.servedBy(SourceLearnedIndex, "")
+			return tableValue(val)
+		}
+		if common.Covered(li.Tombstones, key) {
+			trace.servedBy(SourceLearnedIndex, "")
+			return nil, common.KeyDeleted
 		}
 	}
 
 	// Check SSTables (Disk Persistence)
 	for i := len(shard.sstables) - 1; i >= 0; i-- {
-		if val, ok := shard.sstables[i].Get(key); ok {
-			if len(val) == 0 {
-				return nil, false
-			}
-			return val, true
+		if !shard.indexed[shard.sstables[i]] {
+			continue
+		}
+		if val, ok := getFromTable(shard.sstables[i], key); ok {
+			trace.servedBy(SourceSSTable, shard.sstables[i].Filename)
+			return tableValue(val)
 		}
 	}
 
+	trace.servedBy(SourceNone, "")
+	return nil, common.KeyAbsent
+}
+
+// tableValue is the status of a stored value: an empty one is a tombstone.
+func tableValue(val common.ValueType) (common.ValueType, common.KeyStatus) {
+	if len(val) == 0 {
+		return nil, common.KeyDeleted
+	}
+	return val, common.KeyFound
+}
+
+// getFromTable looks key up in one table. A key the table's range tombstones
+// cover, with no newer point in the same table, reads as a tombstone.
+func getFromTable(sst *sstable.SSTable, key common.KeyType) (common.ValueType, bool) {
+	if sst.Overlaps(key, key) {
+		if val, ok := sst.Get(key); ok {
+			return val, true
+		}
+	}
+	if common.Covered(sst.RangeTombstones(), key) {
+		return common.ValueType{}, true
+	}
 	return nil, false
 }
 
-func (hs *HybridStore) adaptiveFlush(shard *Shard) {
-	count := shard.mutableMem.Count()
+func (hs *HybridStore) adaptiveFlush(shard *Shard) error {
+	count := shard.memEntriesLocked()
 	if count < 100 {
-		return
+		return nil
 	}
+	return hs.flushMemTable(shard)
+}
 
+// flushMemTable writes the shard's memtable to a new L0 SSTable and starts an
+// empty one. The caller holds shard.mutex.
+func (hs *HybridStore) flushMemTable(shard *Shard) error {
+	if err := hs.collapseMergesLocked(shard); err != nil {
+		hs.log.Error("[Flush] Failed to log merged values: %v", err)
+		return err
+	}
 	var data []common.Record
 	shard.mutableMem.Iterator(func(key common.KeyType, val common.ValueType) bool {
 		data = append(data, common.Record{Key: key, Value: val})
 		return true
 	})
+	// The memtable iterates its internal shards one after another, but an
+	// SSTable's sparse index, Seek and key bounds need sorted records.
+	sort.Slice(data, func(i, j int) bool { return data[i].Key < data[j].Key })
 
 	fileName := fmt.Sprintf("shard-%d-l0-%d.sst", shard.id, time.Now().UnixNano())
-	fullPath := filepath.Join(hs.conf.Storage.Path, fileName)
+	fullPath := filepath.Join(hs.layout.TableDir(0), fileName)
 
-	builder, err := sstable.NewBuilder(fullPath)
-	if err == nil {
-		for _, r := range data {
-			builder.Add(r.Key, r.Value)
-		}
-		builder.Close()
-
-		sst, err := sstable.Open(fullPath)
-		if err == nil {
-			shard.l0SSTables = append(shard.l0SSTables, sst)
-			shard.rebuildSSTableViewLocked()
-		}
-	} else {
-		log.Printf("[Error] Failed to create SSTable: %v", err)
+	// On failure the memtable is kept, so its records stay readable, and the
+	// flush is retried on the next write.
+	if err := buildSSTable(fullPath, data, shard.mutableMem.RangeTombstones()); err != nil {
+		hs.log.Error("[Flush] Failed to create SSTable: %v", err)
+		hs.noteWriteError("flush", err)
+		return err
 	}
+	sst, err := sstable.Open(fullPath)
+	if err != nil {
+		hs.log.Error("[Flush] Failed to open %s: %v", fileName, err)
+		os.Remove(fullPath)
+		return err
+	}
+	edit := storage.VersionEdit{Add: []storage.FileMeta{{Name: fileName, Shard: shard.id, Level: 0}}}
+	if err := hs.manifest.Apply(edit); err != nil {
+		hs.log.Error("[Manifest] Failed to record flush of %s: %v", fileName, err)
+		hs.noteWriteError("flush", err)
+		sst.Close()
+		os.Remove(fullPath)
+		return err
+	}
+	// The table becomes readable in the same critical section that empties
+	// the memtable, so no Get sees the records in neither.
+	shard.l0SSTables = append(shard.l0SSTables, sst)
+	shard.rebuildSSTableViewLocked()
+	hs.emit(Event{Kind: "flush", Shard: shard.id, Records: len(data)})
 
-	if len(shard.l0SSTables) >= hs.conf.Storage.CompactionThreshold {
-		go hs.compactShard(shard)
+	if hs.l0CompactionDue(shard.l0SSTables) {
+		hs.goCompaction(func() { hs.compactShard(shard) })
 	}
 
 	shard.mutableMem = memory.NewMemTable(32)
+	shard.publishLocked()
+	return nil
 }
 
-func (hs *HybridStore) rebuildLearnedIndexFromSSTables(shard *Shard) {
-	shard.mutex.RLock()
-	tables := make([]*sstable.SSTable, len(shard.sstables))
-	copy(tables, shard.sstables)
-	shard.mutex.RUnlock()
-
-	if len(tables) == 0 {
-		shard.mutex.Lock()
-		shard.learnedIndexes = make([]*learned.LearnedIndex, 0)
-		shard.mutex.Unlock()
-		return
+// buildSSTable writes sorted records and range tombstones older than them to
+// path. The table only appears under path once it is complete (see
+// sstable.Builder).
+func buildSSTable(path string, records []common.Record, tombstones []common.RangeTombstone) error {
+	builder, err := newTableBuilder(path)
+	if err != nil {
+		return err
+	}
+	for _, t := range common.CoalesceTombstones(tombstones) {
+		builder.AddRangeTombstone(t.Start, t.End)
+	}
+	for _, r := range records {
+		if err := builder.Add(r.Key, r.Value); err != nil {
+			builder.Abort()
+			return err
+		}
 	}
+	return builder.Close()
+}
 
-	latestByKey := make(map[common.KeyType]common.ValueType)
+// latestSSTableLocations finds the newest version of every key in tables
+// (ordered oldest first) and where its value is stored, sorted by key. Keys
+// deleted by a range tombstone in a newer table are left out.
+func latestSSTableLocations(tables []*sstable.SSTable) ([]common.KeyType, []learned.Location, []learned.ValueReader) {
+	latestByKey := make(map[common.KeyType]learned.Location)
+	var newerTombstones []common.RangeTombstone
 	for i := len(tables) - 1; i >= 0; i-- {
 		it := tables[i].NewIterator()
 		for it.Next() {
 			k := it.Key()
-			if _, exists := latestByKey[k]; exists {
+			if _, exists := latestByKey[k]; exists || common.Covered(newerTombstones, k) {
 				continue
 			}
-			latestByKey[k] = append([]byte(nil), it.Value()...)
+			latestByKey[k] = learned.Location{Source: int32(i), Offset: it.Offset()}
 		}
 		it.Close()
+		newerTombstones = append(newerTombstones, tables[i].RangeTombstones()...)
+	}
+
+	keys := make([]common.KeyType, 0, len(latestByKey))
+	for k := range latestByKey {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	locs := make([]learned.Location, len(keys))
+	for i, k := range keys {
+		locs[i] = latestByKey[k]
+	}
+	sources := make([]learned.ValueReader, len(tables))
+	for i, t := range tables {
+		sources[i] = t
+	}
+	return keys, locs, sources
+}
+
+func (hs *HybridStore) rebuildLearnedIndexFromSSTables(shard *Shard) {
+	if !hs.conf.System.UseLearnedIndex() {
+		return
+	}
+	// A compaction that finishes while the index is built closes tables it
+	// would point into, so it is built again from the new set. Tables only
+	// added meanwhile are newer and stay unindexed.
+	for !hs.tryRebuildLearnedIndex(shard) {
 	}
+}
 
-	if len(latestByKey) == 0 {
-		shard.mutex.Lock()
-		shard.learnedIndexes = make([]*learned.LearnedIndex, 0)
-		shard.mutex.Unlock()
-		return
+func (hs *HybridStore) tryRebuildLearnedIndex(shard *Shard) bool {
+	shard.mutex.RLock()
+	tables := make([]*sstable.SSTable, len(shard.sstables))
+	copy(tables, shard.sstables)
+	for _, sst := range tables {
+		sst.Ref()
 	}
+	shard.mutex.RUnlock()
+	defer func() {
+		for _, sst := range tables {
+			sst.Close()
+		}
+	}()
 
-	records := make([]common.Record, 0, len(latestByKey))
-	for key, val := range latestByKey {
-		records = append(records, common.Record{Key: key, Value: val})
+	var rebuilt *learned.LearnedIndex
+	if keys, locs, sources := latestSSTableLocations(tables); len(keys) > 0 {
+		rebuilt = hs.buildIndex(shard, keys, locs, sources)
 	}
 
-	rebuilt := learned.Build(records)
 	shard.mutex.Lock()
-	shard.learnedIndexes = []*learned.LearnedIndex{rebuilt}
+	if !shard.hasTablesLocked(tables) {
+		shard.mutex.Unlock()
+		return false
+	}
+	if rebuilt != nil {
+		shard.learnedIndexes = []*learned.LearnedIndex{rebuilt}
+		shard.setIndexedLocked(tables)
+	} else {
+		shard.learnedIndexes = make([]*learned.LearnedIndex, 0)
+		shard.indexed = nil
+	}
+	shard.publishLocked()
 	shard.mutex.Unlock()
-	hs.persistLearnedIndex(shard, rebuilt)
+	hs.persistLearnedIndex(shard, rebuilt, tableSetSignature(tables))
+	return true
+}
+
+// hasTablesLocked reports whether every one of tables is still live in the
+// shard. The caller holds shard.mutex.
+func (shard *Shard) hasTablesLocked(tables []*sstable.SSTable) bool {
+	for _, t := range tables {
+		if !slices.Contains(shard.sstables, t) {
+			return false
+		}
+	}
+	return true
 }
 
-func (hs *HybridStore) restoreLearnedIndexes() {
+// restoreLearnedIndexes gives every shard with SSTables a learned index,
+// from its persisted file if it is current, and reports how many were loaded
+// and how many rebuilt.
+func (hs *HybridStore) restoreLearnedIndexes() (loaded, rebuilt int) {
+	if !hs.conf.System.UseLearnedIndex() {
+		return 0, 0
+	}
 	for _, shard := range hs.shards {
 		shard.mutex.RLock()
 		hasSST := len(shard.sstables) > 0
@@ -259,28 +1025,32 @@ func (hs *HybridStore) restoreLearnedIndexes() {
 			continue
 		}
 		if hs.tryLoadPersistedLearnedIndex(shard) {
+			loaded++
 			continue
 		}
 		hs.rebuildLearnedIndexFromSSTables(shard)
+		rebuilt++
 	}
+	return loaded, rebuilt
 }
 
+// learnedIndexSignature identifies the shard's current table set. It uses only
+// immutable properties captured when each table was opened (name, size, index
+// entries), read under the shard lock, so a concurrent compaction deleting a
+// file cannot make it fail or disagree with the set it was taken from.
 func (hs *HybridStore) learnedIndexSignature(shard *Shard) string {
 	shard.mutex.RLock()
-	tables := make([]*sstable.SSTable, len(shard.sstables))
-	copy(tables, shard.sstables)
-	shard.mutex.RUnlock()
+	defer shard.mutex.RUnlock()
+	return tableSetSignature(shard.sstables)
+}
+
+func tableSetSignature(tables []*sstable.SSTable) string {
 	if len(tables) == 0 {
 		return ""
 	}
-
 	h := fnv.New64a()
 	for _, t := range tables {
-		st, err := os.Stat(t.Filename)
-		if err != nil {
-			return ""
-		}
-		fmt.Fprintf(h, "%s|%d|%d;", filepath.Base(t.Filename), st.Size(), st.ModTime().UnixNano())
+		fmt.Fprintf(h, "%s|%d|%d;", filepath.Base(t.Filename), t.Size(), t.IndexEntries())
 	}
 	return fmt.Sprintf("%x", h.Sum64())
 }
@@ -289,14 +1059,15 @@ func (hs *HybridStore) learnedIndexPath(shardID int, sig string) string {
 	return filepath.Join(hs.conf.Storage.Path, fmt.Sprintf("shard-%d-%s.li", shardID, sig))
 }
 
-func (hs *HybridStore) persistLearnedIndex(shard *Shard, li *learned.LearnedIndex) {
-	sig := hs.learnedIndexSignature(shard)
+// persistLearnedIndex saves li under sig, the signature of the table set li
+// was built from.
+func (hs *HybridStore) persistLearnedIndex(shard *Shard, li *learned.LearnedIndex, sig string) {
 	if sig == "" || li == nil {
 		return
 	}
 	path := hs.learnedIndexPath(shard.id, sig)
 	if err := li.Save(path); err != nil {
-		log.Printf("[LearnedIndex] persist failed: %v", err)
+		hs.log.Warn("[LearnedIndex] persist failed: %v", err)
 		return
 	}
 	pattern := filepath.Join(hs.conf.Storage.Path, fmt.Sprintf("shard-%d-*.li", shard.id))
@@ -308,22 +1079,65 @@ func (hs *HybridStore) persistLearnedIndex(shard *Shard, li *learned.LearnedInde
 	}
 }
 
+// tryLoadPersistedLearnedIndex loads the saved model for the shard's current
+// table set, skipping training. The records it indexes are read back from the
+// SSTables.
 func (hs *HybridStore) tryLoadPersistedLearnedIndex(shard *Shard) bool {
-	sig := hs.learnedIndexSignature(shard)
+	shard.mutex.RLock()
+	tables := make([]*sstable.SSTable, len(shard.sstables))
+	copy(tables, shard.sstables)
+	shard.mutex.RUnlock()
+	sig := tableSetSignature(tables)
 	if sig == "" {
 		return false
 	}
 	path := hs.learnedIndexPath(shard.id, sig)
 	li, err := learned.Load(path)
 	if err != nil {
+		if errors.Is(err, learned.ErrFormatVersion) {
+			hs.log.Warn("[LearnedIndex] %s: %v; rebuilding", filepath.Base(path), err)
+		}
+		return false
+	}
+	if err := li.Attach(latestSSTableLocations(tables)); err != nil {
+		hs.log.Warn("[LearnedIndex] %s: %v; rebuilding", filepath.Base(path), err)
 		return false
 	}
+	li.MinModelKeys = hs.conf.System.LearnedIndexMinKeys
 	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	// As in tryRebuildLearnedIndex: a compaction meanwhile closed tables the
+	// model points into, and tables flushed meanwhile stay unindexed.
+	if !shard.hasTablesLocked(tables) {
+		return false
+	}
 	shard.learnedIndexes = []*learned.LearnedIndex{li}
-	shard.mutex.Unlock()
+	shard.setIndexedLocked(tables)
+	shard.publishLocked()
 	return true
 }
 
+// l0CompactionDue reports whether a shard with these L0 tables should compact
+// them: there are compaction_threshold of them or, with l0_compaction_bytes
+// set, they hold that many bytes, whichever comes first. Counting files alone
+// would compact a few huge tables as late as many tiny ones.
+func (hs *HybridStore) l0CompactionDue(l0 []*sstable.SSTable) bool {
+	var total int64
+	for _, sst := range l0 {
+		total += sst.Size()
+	}
+	return hs.l0CompactionDueFor(len(l0), total)
+}
+
+// l0CompactionDueFor is l0CompactionDue for n L0 tables of bytes in total.
+func (hs *HybridStore) l0CompactionDueFor(n int, bytes int64) bool {
+	if n == 0 {
+		return false
+	}
+	limit := hs.conf.Storage.L0CompactionBytes
+	return n >= hs.conf.Storage.CompactionThreshold || (limit > 0 && bytes >= limit)
+}
+
 func (hs *HybridStore) compactShard(shard *Shard) {
 	if !shard.compactionLock.TryLock() {
 		return
@@ -333,155 +1147,496 @@ func (hs *HybridStore) compactShard(shard *Shard) {
 	shard.mutex.RLock()
 	inputTables := make([]*sstable.SSTable, len(shard.l0SSTables))
 	copy(inputTables, shard.l0SSTables)
+	hasOlder := len(shard.l1SSTables) > 0
 	shard.mutex.RUnlock()
 
-	if len(inputTables) < hs.conf.Storage.CompactionThreshold {
+	if !hs.l0CompactionDue(inputTables) {
 		return
 	}
 
-	var iters []*sstable.Iterator
-	for _, t := range inputTables {
-		iter := t.NewIterator()
-		if iter.Next() {
-			iters = append(iters, iter)
-		} else {
-			iter.Close()
-		}
-	}
-
-	outFileName := fmt.Sprintf("shard-%d-l1-%d-compacted.sst", shard.id, time.Now().UnixNano())
-	outPath := filepath.Join(hs.conf.Storage.Path, outFileName)
-	builder, err := sstable.NewBuilder(outPath)
+	newSST, err := hs.mergeTables(shard, inputTables, !hasOlder)
 	if err != nil {
-		log.Printf("[Compaction] Failed to create output: %v", err)
+		hs.log.Error("[Compaction] Shard %d: %v", shard.id, err)
+		hs.noteWriteError("compaction", err)
 		return
 	}
 
-	for len(iters) > 0 {
-		minKey := common.KeyType(math.MaxInt64)
-		bestIterIdx := -1
+	hs.installCompaction(shard, inputTables, newSST, !hasOlder)
+	hs.emit(Event{Kind: "compaction", Shard: shard.id, Level: 1, Inputs: len(inputTables), OutputBytes: newSST.Size()})
 
-		for i, it := range iters {
-			k := it.Key()
-			if k < minKey {
-				minKey = k
-				bestIterIdx = i
-			} else if k == minKey {
-				bestIterIdx = i
-			}
-		}
+	hs.log.Debug("[Compaction] Shard %d: Merged %d -> 1 files. Disk cleaned.", shard.id, len(inputTables))
+	// Scans still reading an input keep its file until they finish.
+	for _, old := range inputTables {
+		old.Remove()
+	}
+}
 
-		winner := iters[bestIterIdx]
-		builder.Add(winner.Key(), winner.Value())
+// Compact merges all of each shard's SSTables into one L1 table. Nothing is
+// left below the output, so deleted keys and range tombstones are dropped
+// instead of carried over and their space is reclaimed (see the
+// reclaimable_bytes stat). It waits for any compaction already running.
+func (hs *HybridStore) Compact() error {
+	for _, shard := range hs.shards {
+		if err := hs.compactShardFully(shard); err != nil {
+			return fmt.Errorf("shard %d: %w", shard.id, err)
+		}
+	}
+	return nil
+}
 
-		if !winner.Next() {
-			winner.Close()
-			iters = append(iters[:bestIterIdx], iters[bestIterIdx+1:]...)
-		} else {
-			for i := 0; i < len(iters); {
-				if i == bestIterIdx {
-					i++
-					continue
-				}
-				if iters[i].Key() == minKey {
-					if !iters[i].Next() {
-						iters[i].Close()
-						iters = append(iters[:i], iters[i+1:]...)
-						if bestIterIdx > i {
-							bestIterIdx--
-						}
-						continue
-					}
-				}
-				i++
+// periodicCompaction fully compacts, every interval, each shard holding more
+// than one SSTable. Compactions otherwise only follow flushes, so without it
+// a store that stopped writing keeps the L0 tables it had and reads keep
+// checking all of them. Shards already compacting are left for the next tick.
+func (hs *HybridStore) periodicCompaction(interval time.Duration) {
+	defer hs.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hs.closeCh:
+			return
+		case <-ticker.C:
+		}
+		for _, shard := range hs.shards {
+			if v := shard.view.Load(); len(v.tables) < 2 || !shard.compactionLock.TryLock() {
+				continue
+			}
+			err := hs.compactShardFullyLocked(shard)
+			shard.compactionLock.Unlock()
+			if err != nil {
+				hs.log.Error("[Compaction] Shard %d: periodic compaction: %v", shard.id, err)
 			}
 		}
 	}
+}
 
-	builder.Close()
+func (hs *HybridStore) compactShardFully(shard *Shard) error {
+	shard.compactionLock.Lock()
+	defer shard.compactionLock.Unlock()
+	return hs.compactShardFullyLocked(shard)
+}
 
-	newSST, err := sstable.Open(outPath)
+// compactShardFullyLocked is compactShardFully for a caller holding
+// shard.compactionLock.
+func (hs *HybridStore) compactShardFullyLocked(shard *Shard) error {
+	shard.mutex.RLock()
+	inputTables := make([]*sstable.SSTable, 0, len(shard.sstables))
+	inputTables = append(inputTables, shard.l1SSTables...)
+	inputTables = append(inputTables, shard.l0SSTables...)
+	shard.mutex.RUnlock()
+
+	if len(inputTables) == 0 {
+		return nil
+	}
+	newSST, err := hs.mergeTables(shard, inputTables, true)
 	if err != nil {
-		return
+		hs.noteWriteError("compaction", err)
+		return err
+	}
+	hs.installCompaction(shard, inputTables, newSST, true)
+	hs.emit(Event{Kind: "compaction", Shard: shard.id, Level: 1, Inputs: len(inputTables), OutputBytes: newSST.Size()})
+
+	hs.log.Info("[Compaction] Shard %d: Fully compacted %d -> 1 files.", shard.id, len(inputTables))
+	// Scans still reading an input keep its file until they finish.
+	for _, old := range inputTables {
+		old.Remove()
+	}
+	return nil
+}
+
+// installCompaction replaces the compacted inputs with out. The learned
+// index over the resulting tables is built first and goes live in the same
+// critical section as the swap, so a Get sees either the inputs with the
+// index pointing into them or out with its own index. Tables flushed while
+// the index was built stay unindexed and are read before it, as the newest
+// data always is. The inputs are closed only once nothing can reach them.
+// Under write-heavy load no index is built (see trainIndexes) and every
+// table is read through its own sparse index until trainDeferredIndex runs.
+// bottom is mergeTables': deleted keys were dropped from out.
+func (hs *HybridStore) installCompaction(shard *Shard, inputs []*sstable.SSTable, out *sstable.SSTable, bottom bool) {
+	shard.mutex.RLock()
+	l1, l0 := shard.compactedLevelsLocked(inputs, out)
+	shard.mutex.RUnlock()
+	tables := append(l1, l0...)
+
+	var li *learned.LearnedIndex
+	train := hs.trainIndexes()
+	// Nothing is deferred while learned indexes are disabled.
+	deferred := !train && hs.conf.System.UseLearnedIndex()
+	if deferred {
+		hs.indexDeferrals.Add(1)
+	}
+	if train {
+		if keys, locs, sources := latestSSTableLocations(tables); len(keys) > 0 {
+			li = hs.buildIndex(shard, keys, locs, sources)
+		}
 	}
 
 	shard.mutex.Lock()
-	currentLen := len(shard.l0SSTables)
-	compactedCount := len(inputTables)
-	newlyFlushed := make([]*sstable.SSTable, 0)
-	if currentLen > compactedCount {
-		newlyFlushed = shard.l0SSTables[compactedCount:]
-	}
-	shard.l1SSTables = append(shard.l1SSTables, newSST)
-	shard.l0SSTables = newlyFlushed
+	shard.indexDeferred.Store(deferred)
+	shard.l1SSTables, shard.l0SSTables = shard.compactedLevelsLocked(inputs, out)
 	shard.rebuildSSTableViewLocked()
+	if li != nil {
+		shard.learnedIndexes = []*learned.LearnedIndex{li}
+		shard.setIndexedLocked(tables)
+	} else {
+		shard.learnedIndexes = make([]*learned.LearnedIndex, 0)
+		shard.indexed = nil
+	}
+	shard.publishLocked()
+	saturated := shard.bloomSaturatedLocked()
 	shard.mutex.Unlock()
+	shard.lastCompaction.Store(time.Now().UnixNano())
+	hs.persistLearnedIndex(shard, li, tableSetSignature(tables))
+	// The filter only ever gains keys. A bottom compaction has dropped the
+	// deleted ones, and a filter past its design capacity lets most absent
+	// keys through; either way it is rebuilt from the keys stored now.
+	if bottom || saturated {
+		hs.rebuildBloom(shard)
+	}
+}
+
+// compactedLevelsLocked is the shard's L1 and L0 with inputs removed and out
+// added as the newest L1 table. The caller holds shard.mutex.
+func (shard *Shard) compactedLevelsLocked(inputs []*sstable.SSTable, out *sstable.SSTable) (l1, l0 []*sstable.SSTable) {
+	l1 = append(withoutTables(shard.l1SSTables, inputs), out)
+	l0 = withoutTables(shard.l0SSTables, inputs)
+	return l1, l0
+}
 
-	hs.rebuildLearnedIndexFromSSTables(shard)
+// mergeTables merges tables, oldest first, into a new L1 table and records in
+// the manifest that it replaces them. bottom means no older table lies below
+// the inputs: deletes then have nothing left to hide, so deleted keys and
+// range tombstones are dropped rather than written out.
+func (hs *HybridStore) mergeTables(shard *Shard, tables []*sstable.SSTable, bottom bool) (*sstable.SSTable, error) {
+	outFileName := fmt.Sprintf("shard-%d-l1-%d-compacted.sst", shard.id, time.Now().UnixNano())
+	outPath := filepath.Join(hs.layout.TableDir(1), outFileName)
+	builder, err := newTableBuilder(outPath)
+	if err != nil {
+		return nil, fmt.Errorf("create output: %w", err)
+	}
 
-	log.Printf("[Compaction] Shard %d: Merged %d -> 1 files. Disk cleaned.", shard.id, len(inputTables))
-	for _, old := range inputTables {
-		old.Close()
-		os.Remove(old.Filename)
+	// Later inputs win on equal keys.
+	inputs := make([]sstable.KVIterator, len(tables))
+	var tombstones [][]common.RangeTombstone
+	for i, t := range tables {
+		inputs[i] = t.NewIterator()
+		tombstones = append(tombstones, t.RangeTombstones())
+	}
+	// The range tombstones are collapsed into the output, where they still
+	// hide older data.
+	if !bottom {
+		for _, t := range common.CoalesceTombstones(flattenTombstones(tombstones)) {
+			builder.AddRangeTombstone(t.Start, t.End)
+		}
+	}
+	merged := sstable.NewMergingIterator(inputs, sstable.NewerFirst)
+	for merged.Next() {
+		if deletedByNewer(tombstones, merged.Source(), merged.Key()) {
+			continue
+		}
+		if bottom && len(merged.Value()) == 0 {
+			continue
+		}
+		if err := builder.Add(merged.Key(), merged.Value()); err != nil {
+			merged.Close()
+			builder.Abort()
+			return nil, fmt.Errorf("write output: %w", err)
+		}
+	}
+	merged.Close()
+
+	if err := builder.Close(); err != nil {
+		return nil, fmt.Errorf("publish output: %w", err)
+	}
+
+	newSST, err := sstable.Open(outPath)
+	if err != nil {
+		os.Remove(outPath)
+		return nil, fmt.Errorf("open output: %w", err)
+	}
+
+	// The output and the removal of its inputs become live in one edit.
+	edit := storage.VersionEdit{Add: []storage.FileMeta{{Name: outFileName, Shard: shard.id, Level: 1}}}
+	for _, t := range tables {
+		edit.Remove = append(edit.Remove, filepath.Base(t.Filename))
+	}
+	if err := hs.manifest.Apply(edit); err != nil {
+		newSST.Close()
+		os.Remove(outPath)
+		return nil, fmt.Errorf("record output: %w", err)
+	}
+	return newSST, nil
+}
+
+// deletedByNewer reports whether key, read from input src, is covered by a
+// range tombstone of a newer input. tombstones[i] belongs to input i, and
+// inputs are ordered oldest first.
+func deletedByNewer(tombstones [][]common.RangeTombstone, src int, key common.KeyType) bool {
+	for _, ts := range tombstones[src+1:] {
+		if common.Covered(ts, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func flattenTombstones(tombstones [][]common.RangeTombstone) []common.RangeTombstone {
+	var all []common.RangeTombstone
+	for _, ts := range tombstones {
+		all = append(all, ts...)
 	}
+	return all
 }
 
 func (hs *HybridStore) backgroundPersist() {
 	defer hs.wg.Done()
+	defer hs.persistStopped.Store(true)
 	batchSize := hs.conf.Storage.WalBatchSize
 	if batchSize <= 0 {
 		batchSize = 500
 	}
-	buffer := make([]common.Record, 0, batchSize)
-	ticker := time.NewTicker(100 * time.Millisecond)
+	interval := hs.conf.Storage.WalFlushInterval
+	if interval <= 0 {
+		interval = 100 * time.Millisecond
+	}
+	buffer := make([]storage.WALEntry, 0, batchSize)
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	flush := func() {
+	flush := func() error {
 		if len(buffer) == 0 {
-			return
+			return nil
 		}
-		if err := hs.backend.BatchWrite(buffer); err != nil {
-			log.Printf("Batch write error: %v", err)
+		err := hs.backend.BatchWriteEntries(buffer)
+		if err != nil {
+			hs.log.Error("[WAL] Batch write error: %v", err)
+			hs.noteWriteError("WAL write", err)
 		}
+		hs.walFlushes.Add(1)
+		hs.walFlushedRecords.Add(uint64(len(buffer)))
 		buffer = buffer[:0]
+		return err
+	}
+
+	add := func(entry walEntry) {
+		if entry.done != nil {
+			err := flush()
+			if len(entry.batch) > 0 {
+				for _, r := range entry.batch {
+					buffer = append(buffer, walRecord(r, false))
+				}
+				err = flush()
+			}
+			entry.done <- err
+			return
+		}
+		if entry.del != nil {
+			// Records queued before the range delete are logged before it.
+			flush()
+			if err := hs.backend.DeleteRange(entry.del.Start, entry.del.End); err != nil {
+				hs.log.Error("[WAL] Range delete write error: %v", err)
+				hs.noteWriteError("WAL write", err)
+			}
+			return
+		}
+		buffer = append(buffer, walRecord(entry.rec, entry.merge))
+		if len(buffer) >= batchSize {
+			flush()
+		}
 	}
 
 	for {
 		select {
-		case rec := <-hs.writeCh:
-			buffer = append(buffer, rec)
-			if len(buffer) >= batchSize {
-				flush()
-			}
+		case entry := <-hs.writeCh:
+			add(entry)
 		case <-ticker.C:
 			flush()
+		case p := <-hs.pauseCh:
+			flush()
+			close(p.paused)
+			<-p.resume
 		case <-hs.closeCh:
-			for {
-				select {
-				case rec := <-hs.writeCh:
-					buffer = append(buffer, rec)
-					if len(buffer) >= batchSize {
-						flush()
-					}
-				default:
-					flush()
-					return
-				}
+			// Nothing is queued from now on (see markClosed). What is in
+			// writeCh, and in the overflow until drainOverflow stops, is
+			// logged before returning.
+			hs.drainQueue(add)
+			flush()
+			return
+		}
+	}
+}
+
+// walRecord is the WAL entry for a put of r, or a merge of its operand.
+func walRecord(r common.Record, merge bool) storage.WALEntry {
+	switch {
+	case merge:
+		return storage.WALEntry{Record: r, Op: storage.WALMerge}
+	case len(r.Value) == 0:
+		return storage.WALEntry{Record: r, Op: storage.WALDelete}
+	}
+	return storage.WALEntry{Record: r, Op: storage.WALPut}
+}
+
+// routeTables brings the manifest's tables under the configured routing,
+// re-routing them if they were written with another one. It only needs the
+// manifest, so it runs before the shards are opened; a failure leaves the
+// tables as they were.
+func (hs *HybridStore) routeTables(manifestExisted bool) error {
+	hs.log.Debug("[NeuroDB] Scanning for SSTables...")
+	// A .tmp table was being built when the process stopped; it was never published.
+	for _, f := range hs.layout.globTables("*.sst" + sstable.TempSuffix) {
+		hs.log.Warn("[NeuroDB] Removing unpublished SSTable %s", filepath.Base(f))
+		os.Remove(f)
+	}
+
+	if !manifestExisted {
+		// Data directory from before the manifest: adopt whatever is on disk once.
+		if legacy := hs.discoverSSTables(); len(legacy) > 0 {
+			if err := hs.manifest.Apply(storage.VersionEdit{Add: legacy}); err != nil {
+				hs.log.Error("[Manifest] Failed to record existing SSTables: %v", err)
 			}
 		}
 	}
+
+	if hs.conf.System.ShardStrategy == config.ShardStrategyRange {
+		hs.chooseRangeSplits()
+	}
+	if scheme := hs.shardingScheme(); hs.manifest.Sharding() != scheme {
+		// Tables left under the old routing would be read from the wrong
+		// shards, so the store does not open without this.
+		if err := hs.reshard(scheme); err != nil {
+			return fmt.Errorf("re-route SSTables to sharding %s: %w", scheme, err)
+		}
+	}
+	return nil
 }
 
-func (hs *HybridStore) restoreSSTables() {
-	log.Println("[NeuroDB] Scanning for SSTables...")
-	pattern := filepath.Join(hs.conf.Storage.Path, "*.sst")
-	files, err := filepath.Glob(pattern)
-	if err != nil {
-		return
+func (hs *HybridStore) restoreSSTables() int {
+	count := 0
+	for _, meta := range hs.manifest.Live() {
+		if meta.Shard < 0 || meta.Shard >= len(hs.shards) {
+			continue
+		}
+		sst, err := sstable.Open(hs.layout.TablePath(meta))
+		if err != nil {
+			if errors.Is(err, sstable.ErrBadFooter) || errors.Is(err, sstable.ErrFileTooSmall) {
+				// Most likely a write that stopped partway; -verify -repair quarantines it.
+				hs.log.Error("[Manifest] Skipping live SSTable %s, its write looks incomplete: %v", meta.Name, err)
+			} else {
+				hs.log.Error("[Manifest] Skipping live SSTable %s: %v", meta.Name, err)
+			}
+			continue
+		}
+		shard := hs.shards[meta.Shard]
+		if meta.Level == 0 {
+			shard.l0SSTables = append(shard.l0SSTables, sst)
+		} else {
+			shard.l1SSTables = append(shard.l1SSTables, sst)
+		}
+		shard.rebuildSSTableViewLocked()
+		shard.publishLocked()
+		it := sst.NewIterator()
+		for it.Next() {
+			shard.bloom.Add(it.Key())
+		}
+		it.Close()
+		count++
+	}
+	hs.log.Info("[NeuroDB] Restored %d SSTables from disk.", count)
+	return count
+}
+
+// reshard rewrites every live SSTable into one L1 table per shard under the
+// current routing. Each key is routed by its own value, so the result does
+// not depend on how the inputs were placed. The old files are left for
+// collectGarbage once the manifest no longer lists them.
+func (hs *HybridStore) reshard(scheme string) error {
+	live := hs.manifest.Live()
+	if len(live) == 0 {
+		return hs.manifest.Apply(storage.VersionEdit{Sharding: scheme})
+	}
+	hs.log.Info("[NeuroDB] Re-routing %d SSTables to sharding %s...", len(live), scheme)
+
+	// Oldest first as Shard.sstables orders them: L1 before L0.
+	sort.SliceStable(live, func(i, j int) bool { return live[i].Level > live[j].Level })
+	inputs := make([]sstable.KVIterator, 0, len(live))
+	var tombstones [][]common.RangeTombstone
+	var tables []*sstable.SSTable
+	defer func() {
+		for _, t := range tables {
+			t.Close()
+		}
+	}()
+	for _, meta := range live {
+		sst, err := sstable.Open(hs.layout.TablePath(meta))
+		if err != nil {
+			return fmt.Errorf("open %s: %w", meta.Name, err)
+		}
+		tables = append(tables, sst)
+		inputs = append(inputs, sst.NewIterator())
+		tombstones = append(tombstones, sst.RangeTombstones())
+	}
+
+	builders := make([]*sstable.Builder, len(hs.shards))
+	names := make([]string, len(hs.shards))
+	abort := func() {
+		for _, b := range builders {
+			if b != nil {
+				b.Abort()
+			}
+		}
+	}
+	// Every table is an input, so range tombstones are applied here and not
+	// carried over: there is no older data left for them to hide.
+	merged := sstable.NewMergingIterator(inputs, sstable.NewerFirst)
+	defer merged.Close()
+	for merged.Next() {
+		if deletedByNewer(tombstones, merged.Source(), merged.Key()) {
+			continue
+		}
+		idx := hs.route(merged.Key())
+		if builders[idx] == nil {
+			names[idx] = fmt.Sprintf("shard-%d-l1-%d-resharded.sst", idx, time.Now().UnixNano())
+			b, err := sstable.NewBuilder(filepath.Join(hs.layout.TableDir(1), names[idx]))
+			if err != nil {
+				abort()
+				return err
+			}
+			builders[idx] = b
+		}
+		if err := builders[idx].Add(merged.Key(), merged.Value()); err != nil {
+			abort()
+			return err
+		}
+	}
+
+	edit := storage.VersionEdit{Sharding: scheme}
+	for idx, b := range builders {
+		if b == nil {
+			continue
+		}
+		builders[idx] = nil
+		if err := b.Close(); err != nil {
+			abort()
+			return err
+		}
+		edit.Add = append(edit.Add, storage.FileMeta{Name: names[idx], Shard: idx, Level: 1})
 	}
+	for _, meta := range live {
+		edit.Remove = append(edit.Remove, meta.Name)
+	}
+	return hs.manifest.Apply(edit)
+}
+
+// discoverSSTables infers the table set from file names, oldest first within
+// each shard and level. Only used to migrate directories without a manifest.
+func (hs *HybridStore) discoverSSTables() []storage.FileMeta {
+	files := hs.layout.globTables("*.sst")
 
 	type sstEntry struct {
-		path    string
+		name    string
 		shardID int
 		ts      int64
 		level   int
@@ -493,8 +1648,10 @@ func (hs *HybridStore) restoreSSTables() {
 		if len(parts) < 3 {
 			continue
 		}
-		shardID, _ := strconv.Atoi(parts[1])
-		if shardID < 0 || shardID >= len(hs.shards) {
+		// Shards beyond the current ShardCount stay recorded (and so are not
+		// garbage collected); restore skips them.
+		shardID, err := strconv.Atoi(parts[1])
+		if err != nil || shardID < 0 {
 			continue
 		}
 		level := 1
@@ -516,7 +1673,7 @@ func (hs *HybridStore) restoreSSTables() {
 		if err != nil {
 			continue
 		}
-		entries = append(entries, sstEntry{path: file, shardID: shardID, ts: ts, level: level})
+		entries = append(entries, sstEntry{name: baseName, shardID: shardID, ts: ts, level: level})
 	}
 	sort.Slice(entries, func(i, j int) bool {
 		if entries[i].shardID != entries[j].shardID {
@@ -528,77 +1685,183 @@ func (hs *HybridStore) restoreSSTables() {
 		return entries[i].ts < entries[j].ts
 	})
 
-	count := 0
-	for _, e := range entries {
-		sst, err := sstable.Open(e.path)
-		if err == nil {
-			shard := hs.shards[e.shardID]
-			if e.level == 0 {
-				shard.l0SSTables = append(shard.l0SSTables, sst)
-			} else {
-				shard.l1SSTables = append(shard.l1SSTables, sst)
+	metas := make([]storage.FileMeta, len(entries))
+	for i, e := range entries {
+		metas[i] = storage.FileMeta{Name: e.name, Shard: e.shardID, Level: e.level}
+	}
+	return metas
+}
+
+// collectGarbage deletes SSTables the manifest does not list as live (inputs
+// of a compaction that finished before their removal) and learned-index files
+// whose signature no longer matches their shard's table set. If the manifest
+// dropped a torn record the unlisted SSTables are moved to QuarantineDir
+// instead: the live set is then only as good as the records before it.
+func (hs *HybridStore) collectGarbage() {
+	live := make(map[string]bool)
+	for _, meta := range hs.manifest.Live() {
+		live[meta.Name] = true
+	}
+	clean := hs.manifest.Clean()
+	removed, quarantined := 0, 0
+	for _, f := range hs.layout.globTables("shard-*.sst") {
+		if live[filepath.Base(f)] {
+			continue
+		}
+		if !clean {
+			if err := quarantine(filepath.Dir(f), filepath.Base(f), true); err != nil {
+				hs.log.Error("[NeuroDB] Cannot quarantine unlisted SSTable %s: %v", filepath.Base(f), err)
+				continue
 			}
-			shard.rebuildSSTableViewLocked()
-			it := sst.NewIterator()
-			for it.Next() {
-				shard.bloom.Add(it.Key())
+			quarantined++
+		} else if err := os.Remove(f); err == nil {
+			removed++
+		}
+	}
+	if quarantined > 0 {
+		hs.log.Warn("[Manifest] Dropped a torn record; moved %d unlisted SSTables to %s.", quarantined, QuarantineDir)
+	}
+	for _, shard := range hs.shards {
+		keep := ""
+		if sig := hs.learnedIndexSignature(shard); sig != "" {
+			keep = hs.learnedIndexPath(shard.id, sig)
+		}
+		liFiles, _ := filepath.Glob(filepath.Join(hs.conf.Storage.Path, fmt.Sprintf("shard-%d-*.li", shard.id)))
+		for _, f := range liFiles {
+			if f != keep {
+				if err := os.Remove(f); err == nil {
+					removed++
+				}
 			}
-			it.Close()
-			count++
 		}
 	}
-	log.Printf("[NeuroDB] Restored %d SSTables from disk.", count)
+	if removed > 0 {
+		hs.log.Info("[NeuroDB] Removed %d orphaned SSTable/learned index files.", removed)
+	}
 }
 
-func (hs *HybridStore) recoverFromWAL() int {
-	log.Println("[NeuroDB] Replaying WAL...")
-	records, err := hs.backend.LoadAll()
+func (hs *HybridStore) recoverFromWAL() (int, error) {
+	hs.log.Debug("[NeuroDB] Replaying WAL...")
+	records, tombstones, merges, err := hs.backend.LoadAll()
 	if err != nil {
-		return 0
+		return 0, nil
 	}
+	folded, err := hs.foldReplayedMerges(merges)
+	if err != nil {
+		return 0, err
+	}
+	records = append(records, folded...)
 
 	shardData := make([][]common.Record, hs.conf.System.ShardCount)
 	for _, r := range records {
-		idx := int(r.Key) % hs.conf.System.ShardCount
+		idx := hs.route(r.Key)
 		shardData[idx] = append(shardData[idx], r)
 		hs.shards[idx].bloom.Add(r.Key)
 	}
+	shardTombstones := make([][]common.RangeTombstone, hs.conf.System.ShardCount)
+	for i := range shardTombstones {
+		if lo, hi, ok := hs.shardBounds(i); ok {
+			for _, t := range tombstones {
+				if t.End > lo && t.Start <= hi {
+					shardTombstones[i] = append(shardTombstones[i], t)
+				}
+			}
+		} else {
+			shardTombstones[i] = tombstones
+		}
+	}
 
 	var wg sync.WaitGroup
 	for i := 0; i < hs.conf.System.ShardCount; i++ {
-		if len(shardData[i]) == 0 {
+		if len(shardData[i]) == 0 && len(shardTombstones[i]) == 0 {
 			continue
 		}
 		wg.Add(1)
 		go func(idx int, data []common.Record) {
 			defer wg.Done()
-			li := learned.Build(data)
-			hs.shards[idx].learnedIndexes = append(hs.shards[idx].learnedIndexes, li)
+			// The index holds the replayed records until the checkpoint
+			// writes them out; without learned indexes it only searches them.
+			shard := hs.shards[idx]
+			start := time.Now()
+			var li *learned.LearnedIndex
+			if hs.conf.System.UseLearnedIndex() {
+				li = learned.Build(data, hs.indexOptions())
+			} else {
+				li = learned.BuildUntrained(data)
+			}
+			shard.modelBuild.Store(int64(time.Since(start)))
+			// The replayed records were written after the range deletes.
+			li.Tombstones = shardTombstones[idx]
+			shard.mutex.Lock()
+			shard.learnedIndexes = append(shard.learnedIndexes, li)
+			// WAL records are newer than every table on disk.
+			shard.setIndexedLocked(shard.sstables)
+			shard.publishLocked()
+			shard.mutex.Unlock()
 		}(i, shardData[i])
 	}
 	wg.Wait()
-	return len(records)
+	return len(records) + len(tombstones), nil
+}
+
+// syncPath fsyncs a file or directory. Tests replace it to observe or fail
+// the syncs that must precede a WAL truncation.
+var syncPath = func(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
 }
 
+// checkpointAndTruncateWAL writes each shard's replayed records to a
+// checkpoint table and then truncates the WAL. Every table is synced, named
+// durably and recorded in the manifest before the truncation, so a crash at
+// any point leaves the records in the WAL, the checkpoint, or both.
 func (hs *HybridStore) checkpointAndTruncateWAL() error {
 	checkpointed := 0
 
 	for _, shard := range hs.shards {
 		latestByKey := make(map[common.KeyType]common.ValueType)
+		var tombstones []common.RangeTombstone
+		// Each source's range deletes are older than its own records.
+		applyTombstones := func(ts []common.RangeTombstone) {
+			for k := range latestByKey {
+				if common.Covered(ts, k) {
+					delete(latestByKey, k)
+				}
+			}
+			tombstones = append(tombstones, ts...)
+		}
 
 		shard.mutex.RLock()
 		for _, li := range shard.learnedIndexes {
+			applyTombstones(li.Tombstones)
 			for _, rec := range li.GetAllRecords() {
 				latestByKey[rec.Key] = append([]byte(nil), rec.Value...)
 			}
 		}
+		applyTombstones(shard.mutableMem.RangeTombstones())
 		memItems := shard.mutableMem.Scan(common.KeyType(math.MinInt64), common.KeyType(math.MaxInt64))
 		for _, item := range memItems {
-			latestByKey[item.Key] = append([]byte(nil), item.Val...)
+			latestByKey[item.Key] = append([]byte(nil), hs.memValueLocked(shard, item, nil)...)
+		}
+		// The learned indexes already reflect the tables they cover, so the
+		// checkpoint replaces those tables. Range tombstones are only kept
+		// for tables it does not replace.
+		var replaced []*sstable.SSTable
+		for _, sst := range shard.sstables {
+			if shard.indexed[sst] {
+				replaced = append(replaced, sst)
+			}
+		}
+		if len(replaced) == len(shard.sstables) {
+			tombstones = nil
 		}
 		shard.mutex.RUnlock()
 
-		if len(latestByKey) == 0 {
+		if len(latestByKey) == 0 && len(tombstones) == 0 {
 			continue
 		}
 
@@ -611,33 +1874,60 @@ func (hs *HybridStore) checkpointAndTruncateWAL() error {
 		})
 
 		fileName := fmt.Sprintf("shard-%d-l1-%d-checkpoint.sst", shard.id, time.Now().UnixNano())
-		fullPath := filepath.Join(hs.conf.Storage.Path, fileName)
-		builder, err := sstable.NewBuilder(fullPath)
+		fullPath := filepath.Join(hs.layout.TableDir(1), fileName)
+		if err := buildSSTable(fullPath, records, tombstones); err != nil {
+			return err
+		}
+
+		// The builder synced the table's contents; its name only survives a
+		// crash once the directory is synced too. Until then neither the
+		// manifest nor the WAL truncation may depend on it.
+		if err := syncPath(hs.layout.TableDir(1)); err != nil {
+			os.Remove(fullPath)
+			return fmt.Errorf("sync data directory: %w", err)
+		}
+		newSST, err := sstable.Open(fullPath)
 		if err != nil {
 			return err
 		}
-		for _, rec := range records {
-			if err := builder.Add(rec.Key, rec.Value); err != nil {
-				builder.Close()
-				return err
-			}
+		edit := storage.VersionEdit{Add: []storage.FileMeta{{Name: fileName, Shard: shard.id, Level: 1}}}
+		for _, t := range replaced {
+			edit.Remove = append(edit.Remove, filepath.Base(t.Filename))
 		}
-		if err := builder.Close(); err != nil {
+		if err := hs.manifest.Apply(edit); err != nil {
+			newSST.Close()
+			os.Remove(fullPath)
 			return err
 		}
 
-		newSST, err := sstable.Open(fullPath)
-		if err != nil {
-			return err
+		// The checkpoint table holds the latest version of every key, so the
+		// new index can point into it alone.
+		var li *learned.LearnedIndex
+		if hs.conf.System.UseLearnedIndex() {
+			keys, locs, sources := latestSSTableLocations([]*sstable.SSTable{newSST})
+			li = hs.buildIndex(shard, keys, locs, sources)
 		}
 
 		shard.mutex.Lock()
-		shard.l1SSTables = append(shard.l1SSTables, newSST)
+		shard.l0SSTables = withoutTables(shard.l0SSTables, replaced)
+		shard.l1SSTables = append(withoutTables(shard.l1SSTables, replaced), newSST)
 		shard.rebuildSSTableViewLocked()
-		li := learned.Build(records)
-		shard.learnedIndexes = []*learned.LearnedIndex{li}
+		if li != nil {
+			shard.learnedIndexes = []*learned.LearnedIndex{li}
+			// The checkpoint holds the latest version of every key in the shard.
+			shard.setIndexedLocked(shard.sstables)
+		} else {
+			shard.learnedIndexes = make([]*learned.LearnedIndex, 0)
+			shard.indexed = nil
+		}
+		shard.publishLocked()
+		sig := tableSetSignature(shard.sstables)
 		shard.mutex.Unlock()
-		hs.persistLearnedIndex(shard, li)
+		hs.persistLearnedIndex(shard, li, sig)
+		// The files go once the manifest no longer lists them (collectGarbage).
+		for _, t := range replaced {
+			t.Close()
+		}
 		checkpointed++
 	}
 
@@ -648,80 +1938,430 @@ func (hs *HybridStore) checkpointAndTruncateWAL() error {
 	if err := hs.backend.Truncate(); err != nil {
 		return err
 	}
-	log.Printf("[Checkpoint] Completed for %d shards; WAL truncated.", checkpointed)
+	hs.log.Info("[Checkpoint] Completed for %d shards; WAL truncated.", checkpointed)
 	return nil
 }
 
+func withoutTables(tables, drop []*sstable.SSTable) []*sstable.SSTable {
+	out := make([]*sstable.SSTable, 0, len(tables))
+	for _, t := range tables {
+		if !slices.Contains(drop, t) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
 func (hs *HybridStore) Scan(start, end common.KeyType) []common.Record {
-	mergedMap := make(map[common.KeyType]common.ValueType)
+	results, err := hs.ScanContext(context.Background(), start, end)
+	if err != nil {
+		hs.log.Error("[Codec] Scan [%d, %d] failed: %v", start, end, err)
+	}
+	return results
+}
 
-	for _, shard := range hs.shards {
-		shard.mutex.RLock()
+// scanCheckInterval is how many merged keys a scan reads between checks of
+// its context.
+const scanCheckInterval = 256
 
-		//Scan SSTables (Disk)
-		for _, sst := range shard.sstables {
-			it := sst.NewIterator()
-			for it.Next() {
-				k := it.Key()
-				if k >= start && k <= end {
-					mergedMap[k] = it.Value()
-				}
-				if k > end {
-					break
-				}
-			}
-			it.Close()
-		}
+// ScanContext is Scan that stops once ctx is done, checking between shards
+// and every scanCheckInterval keys. It then returns ctx's error and no records.
+func (hs *HybridStore) ScanContext(ctx context.Context, start, end common.KeyType) ([]common.Record, error) {
+	return hs.ScanLimitContext(ctx, start, end, 0)
+}
 
-		//Scan Learned Indexes
-		for _, li := range shard.learnedIndexes {
-			res := li.Scan(start, end)
-			for _, rec := range res {
-				mergedMap[rec.Key] = rec.Value
+// ScanLimitContext is ScanContext returning only the first limit records of
+// the range (all of them when limit <= 0). Each shard's merge stops after
+// limit live keys, so a page of a wide range costs about limit records per
+// shard rather than the whole range.
+func (hs *HybridStore) ScanLimitContext(ctx context.Context, start, end common.KeyType, limit int) ([]common.Record, error) {
+	results := make([]common.Record, 0)
+	err := hs.scanShards(ctx, hs.orderKey(start), hs.orderKey(end), limit, false, func(k common.KeyType, val common.ValueType, _ int) {
+		results = append(results, common.Record{Key: k, Value: val})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Key < results[j].Key
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	hs.orderRecords(results)
+
+	if hs.codec != nil {
+		for i := range results {
+			val, err := hs.decode(results[i].Value)
+			if err != nil {
+				return nil, fmt.Errorf("key %d: %w", results[i].Key, err)
 			}
+			results[i].Value = val
 		}
+	}
+	return results, nil
+}
 
-		//Scan MemTable
-		memItems := shard.mutableMem.Scan(start, end)
-		for _, item := range memItems {
-			mergedMap[item.Key] = item.Val
-		}
+// ScanResult is one page of a scan. Truncated means the range holds more
+// records after Records, the first of which is NextKey: passing it as start
+// gets the next page.
+type ScanResult struct {
+	Records   []common.Record
+	Truncated bool
+	NextKey   common.KeyType
+}
 
-		shard.mutex.RUnlock()
+// ScanPageContext is ScanLimitContext that reports whether the limit cut
+// the range short. It reads one record past limit, so a range that holds
+// exactly limit records is not reported as truncated.
+func (hs *HybridStore) ScanPageContext(ctx context.Context, start, end common.KeyType, limit int) (ScanResult, error) {
+	fetch := limit
+	if limit > 0 {
+		fetch = limit + 1
+	}
+	records, err := hs.ScanLimitContext(ctx, start, end, fetch)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	res := ScanResult{Records: records}
+	if limit > 0 && len(records) > limit {
+		res.Records, res.Truncated, res.NextKey = records[:limit], true, records[limit].Key
 	}
+	return res, nil
+}
 
-	results := make([]common.Record, 0, len(mergedMap))
-	for k, v := range mergedMap {
-		// Filter Tombstones (empty values)
-		if len(v) > 0 {
-			results = append(results, common.Record{Key: k, Value: v})
-		}
+// ScanKeys returns the live keys in [start, end] without reading any values.
+func (hs *HybridStore) ScanKeys(start, end common.KeyType) []common.KeyType {
+	sizes, err := hs.ScanKeySizesContext(context.Background(), start, end, 0)
+	if err != nil {
+		hs.log.Error("[Scan] Key scan [%d, %d] failed: %v", start, end, err)
+	}
+	keys := make([]common.KeyType, len(sizes))
+	for i, ks := range sizes {
+		keys[i] = ks.Key
+	}
+	return keys
+}
+
+// ScanKeySizesContext is ScanLimitContext returning each key with the length
+// of its value instead of the value. SSTable values are skipped rather than
+// read, so the cost is in keys, not payload bytes. Sizes are of the value as
+// stored, i.e. after the store's codec.
+func (hs *HybridStore) ScanKeySizesContext(ctx context.Context, start, end common.KeyType, limit int) ([]common.KeySize, error) {
+	results := make([]common.KeySize, 0)
+	err := hs.scanShards(ctx, hs.orderKey(start), hs.orderKey(end), limit, true, func(k common.KeyType, _ common.ValueType, size int) {
+		results = append(results, common.KeySize{Key: k, Size: size})
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	sort.Slice(results, func(i, j int) bool {
 		return results[i].Key < results[j].Key
 	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	for i := range results {
+		results[i].Key = hs.orderKey(results[i].Key)
+	}
+	return results, nil
+}
 
-	return results
+// ScanFunc calls fn for every live record in [start, end] without collecting
+// them, so memory stays bounded however wide the range. Records come shard by
+// shard, in key order within each shard (and overall with range sharding).
+// It stops at the first error from fn, or once ctx is done, and returns it.
+func (hs *HybridStore) ScanFunc(ctx context.Context, start, end common.KeyType, fn func(common.Record) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var fnErr error
+	err := hs.scanShards(ctx, hs.orderKey(start), hs.orderKey(end), 0, false, func(k common.KeyType, val common.ValueType, _ int) {
+		if fnErr != nil {
+			return
+		}
+		if val, fnErr = hs.decode(val); fnErr == nil {
+			fnErr = fn(common.Record{Key: hs.orderKey(k), Value: val})
+		}
+		if fnErr != nil {
+			cancel() // the scan stops at its next context check
+		}
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+// scanShards merges each shard overlapping [start, end] and calls emit for
+// its first limit live keys (all of them when limit <= 0), in key order per
+// shard. With keysOnly, emit gets a nil value and only the size is read.
+func (hs *HybridStore) scanShards(ctx context.Context, start, end common.KeyType, limit int, keysOnly bool, emit func(k common.KeyType, val common.ValueType, size int)) error {
+	for i, shard := range hs.shards {
+		if lo, hi, ok := hs.shardBounds(i); ok && (end < lo || start > hi) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := hs.scanShard(ctx, shard, start, end, limit, keysOnly, emit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanShard is scanShards for one shard. Only the table list, the indexes
+// and the memtable's matching records are taken under the shard lock; the
+// tables are read after it is released, each held open by a reference, so
+// a long scan holds up no flush or compaction and none holds up the scan.
+func (hs *HybridStore) scanShard(ctx context.Context, shard *Shard, start, end common.KeyType, limit int, keysOnly bool, emit func(k common.KeyType, val common.ValueType, size int)) error {
+	shard.mutex.RLock()
+	tables := make([]*sstable.SSTable, len(shard.sstables))
+	copy(tables, shard.sstables)
+	indexed := make([]bool, len(tables))
+	for i, sst := range tables {
+		indexed[i] = shard.indexed[sst]
+		// A live table is open until it is dropped under the write lock.
+		sst.Ref()
+	}
+	indexes := append([]*learned.LearnedIndex(nil), shard.learnedIndexes...)
+	memItems := shard.mutableMem.Scan(start, end)
+	// Merge operands are folded while the shard's tables are held.
+	for i, item := range memItems {
+		if len(item.Operands) > 0 {
+			memItems[i] = memory.Item{Key: item.Key, Val: hs.memValueLocked(shard, item, nil)}
+		}
+	}
+	memTombstones := shard.mutableMem.RangeTombstones()
+	shard.mutex.RUnlock()
+	defer func() {
+		for _, sst := range tables {
+			sst.Close()
+		}
+	}()
+
+	// Inputs oldest to newest: indexed SSTables (L1 then L0), learned
+	// indexes, SSTables flushed since the index was built, memtable.
+	// tombstones[i] holds the range deletes of inputs[i].
+	var inputs []sstable.KVIterator
+	var tombstones [][]common.RangeTombstone
+	addTables := func(wantIndexed bool) {
+		for i, sst := range tables {
+			if indexed[i] != wantIndexed {
+				continue
+			}
+			if !sst.Overlaps(start, end) {
+				// Its range deletes may still hide keys in older inputs.
+				if len(sst.RangeTombstones()) > 0 {
+					inputs = append(inputs, sstable.NewSliceIterator(nil))
+					tombstones = append(tombstones, sst.RangeTombstones())
+				}
+				continue
+			}
+			it := sst.NewIterator()
+			if keysOnly {
+				it = sst.NewKeyIterator()
+			}
+			it.Seek(start)
+			inputs = append(inputs, it)
+			tombstones = append(tombstones, sst.RangeTombstones())
+		}
+	}
+	addTables(true)
+	for _, li := range indexes {
+		if keysOnly {
+			inputs = append(inputs, sstable.NewKeySizeIterator(li.ScanSizes(start, end)))
+		} else {
+			inputs = append(inputs, sstable.NewSliceIterator(li.Scan(start, end)))
+		}
+		tombstones = append(tombstones, li.Tombstones)
+	}
+	addTables(false)
+	memRecs := make([]common.Record, len(memItems))
+	for i, item := range memItems {
+		memRecs[i] = common.Record{Key: item.Key, Value: item.Val}
+	}
+	// The memtable is internally sharded, so its scan is not globally ordered.
+	sort.Slice(memRecs, func(i, j int) bool { return memRecs[i].Key < memRecs[j].Key })
+	inputs = append(inputs, sstable.NewSliceIterator(memRecs))
+	tombstones = append(tombstones, memTombstones)
+
+	merged := sstable.NewMergingIterator(inputs, sstable.NewerFirst)
+	defer merged.Close()
+	found := 0
+	for n := 1; merged.Next(); n++ {
+		if n%scanCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		k := merged.Key()
+		if k > end {
+			break
+		}
+		// Filter Tombstones (empty values)
+		if k >= start && merged.ValueLen() > 0 && !deletedByNewer(tombstones, merged.Source(), k) {
+			val := merged.Value()
+			if keysOnly {
+				val = nil
+			}
+			emit(k, val, merged.ValueLen())
+			if found++; found == limit {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// PlanRange reports how a scan of [start, end] would locate its keys and a
+// rough row estimate. Learned indexes give an exact position per model; shards
+// served only by SSTables fall back to the sparse index, so the estimate is an
+// upper bound there.
+func (hs *HybridStore) PlanRange(start, end common.KeyType) (string, int) {
+	start, end = hs.orderKey(start), hs.orderKey(end)
+	method := "binary_search"
+	estimate := 0
+	usesModel := false
+	usesSST := false
+	for i, shard := range hs.shards {
+		if lo, hi, ok := hs.shardBounds(i); ok && (end < lo || start > hi) {
+			continue
+		}
+		shard.mutex.RLock()
+		if n := len(shard.learnedIndexes); n > 0 {
+			keys := shard.learnedIndexes[n-1].Keys
+			lo := sort.Search(len(keys), func(i int) bool { return keys[i] >= start })
+			hi := sort.Search(len(keys), func(i int) bool { return keys[i] > end })
+			if hi > lo {
+				estimate += hi - lo
+				usesModel = true
+			}
+		} else {
+			for _, sst := range shard.sstables {
+				if n := sst.EstimateRange(start, end); n > 0 {
+					estimate += n
+					usesSST = true
+				}
+			}
+		}
+		estimate += len(shard.mutableMem.Scan(start, end))
+		shard.mutex.RUnlock()
+	}
+	if usesModel && !usesSST {
+		method = "learned_index"
+	}
+	return method, estimate
+}
+
+// EstimateRangeCount approximates the number of keys in [start, end] without
+// reading them. Learned indexes answer from their model's predictions, to
+// within their error windows; unindexed SSTables from their sparse index, to
+// within two index blocks; memtables exactly. bound adds those up, so count
+// is within bound of the records stored in the range. A key overwritten or
+// deleted in a newer layer is counted once per layer it is in.
+func (hs *HybridStore) EstimateRangeCount(start, end common.KeyType) (count, bound int) {
+	start, end = hs.orderKey(start), hs.orderKey(end)
+	if end < start {
+		return 0, 0
+	}
+	for i, shard := range hs.shards {
+		if lo, hi, ok := hs.shardBounds(i); ok && (end < lo || start > hi) {
+			continue
+		}
+		shard.mutex.RLock()
+		for _, li := range shard.learnedIndexes {
+			n, b := li.EstimateCount(start, end)
+			count += n
+			bound += b
+		}
+		for _, sst := range shard.sstables {
+			if shard.indexed[sst] {
+				continue
+			}
+			if n := sst.EstimateRange(start, end); n > 0 {
+				count += n
+				bound += 2 * sstable.IndexRate
+			}
+		}
+		count += len(shard.mutableMem.Scan(start, end))
+		shard.mutex.RUnlock()
+	}
+	return count, bound
 }
 
 func (hs *HybridStore) ScanBox(minX, minY, minZ, maxX, maxY, maxZ uint32) []common.Record {
+	results, _ := hs.ScanBoxContext(context.Background(), minX, minY, minZ, maxX, maxY, maxZ)
+	return results
+}
+
+func (hs *HybridStore) ScanBoxContext(ctx context.Context, minX, minY, minZ, maxX, maxY, maxZ uint32) ([]common.Record, error) {
 	ranges, _ := common.GetZRanges(minX, minY, minZ, maxX, maxY, maxZ)
 	var results []common.Record
 	for _, r := range ranges {
-		candidates := hs.Scan(common.KeyType(r.Min), common.KeyType(r.Max))
+		candidates, err := hs.ScanContext(ctx, common.KeyType(r.Min), common.KeyType(r.Max))
+		if err != nil {
+			return nil, err
+		}
 		for _, rec := range candidates {
 			if common.InRange(int64(rec.Key), minX, minY, minZ, maxX, maxY, maxZ) {
 				results = append(results, rec)
 			}
 		}
 	}
-	return results
+	return results, nil
 }
 
 func (hs *HybridStore) Close() {
-	close(hs.closeCh)
+	hs.markClosed()
+	hs.wg.Wait()
+	hs.compactions.Wait()
+	hs.closeFiles()
+}
+
+// Shutdown closes the store after persisting everything it holds: the WAL
+// writer logs the queued writes and stops, every memtable is flushed to an
+// SSTable and the WAL is truncated, so the next open has nothing to replay.
+// If a flush fails the WAL is kept for the next open to replay. The store is
+// closed either way; call Shutdown instead of Close, not after it.
+func (hs *HybridStore) Shutdown() error {
+	hs.markClosed()
 	hs.wg.Wait()
+
+	var errs []error
+	for _, shard := range hs.shards {
+		// Held for good: a compaction that starts now would read closed tables.
+		shard.compactionLock.Lock()
+		shard.mutex.Lock()
+		if shard.mutableMem.Count() > 0 || len(shard.mutableMem.RangeTombstones()) > 0 {
+			if err := hs.flushMemTable(shard); err != nil {
+				errs = append(errs, fmt.Errorf("shard %d: %w", shard.id, err))
+			}
+		}
+		shard.mutex.Unlock()
+	}
+	// Compactions started before markClosed; the flushes above start none.
+	hs.compactions.Wait()
+	if len(errs) == 0 {
+		// The flushed tables' names must be durable before the WAL goes.
+		if err := syncPath(hs.layout.TableDir(0)); err != nil {
+			errs = append(errs, fmt.Errorf("sync data directory: %w", err))
+		}
+	}
+	if len(errs) == 0 {
+		if err := hs.backend.Truncate(); err != nil {
+			errs = append(errs, fmt.Errorf("truncate WAL: %w", err))
+		} else {
+			hs.log.Info("[Checkpoint] Memtables flushed; WAL truncated.")
+		}
+	}
+	hs.closeFiles()
+	return errors.Join(errs...)
+}
+
+func (hs *HybridStore) closeFiles() {
 	hs.backend.Close()
 	for _, shard := range hs.shards {
 		shard.mutex.Lock()
@@ -730,6 +2370,7 @@ func (hs *HybridStore) Close() {
 		}
 		shard.mutex.Unlock()
 	}
+	hs.manifest.Close()
 }
 
 func (hs *HybridStore) Stats() map[string]interface{} {
@@ -738,20 +2379,83 @@ func (hs *HybridStore) Stats() map[string]interface{} {
 	totalSST := 0
 	totalL0 := 0
 	totalL1 := 0
+	var bloomBits, bloomSet, bloomElements, bloomCapacity uint
+	bloomFP := 0.0
+	maxRecords, totalRecords := 0, 0
+	compactionQueue := 0
+	// The shards' published views, so a flush or compaction holding a shard
+	// lock does not hold up stats.
 	for _, s := range hs.shards {
-		s.mutex.RLock()
-		totalMem += s.mutableMem.Count()
-		totalIndex += len(s.learnedIndexes)
-		totalL0 += len(s.l0SSTables)
-		totalL1 += len(s.l1SSTables)
-		totalSST += len(s.sstables)
-		s.mutex.RUnlock()
+		v := s.view.Load()
+		n := v.records()
+		totalRecords += n
+		if n > maxRecords {
+			maxRecords = n
+		}
+		bs := v.bloom.Snapshot()
+		bloomBits += bs.Bits
+		bloomSet += bs.SetBits
+		bloomElements += bs.Elements
+		bloomCapacity += bs.Capacity
+		bloomFP += bs.EstimatedFP
+		totalMem += v.mem.Count()
+		totalIndex += v.indexes
+		totalL0 += v.l0
+		totalL1 += v.l1
+		if hs.l0CompactionDueFor(v.l0, v.l0Bytes) {
+			compactionQueue++
+		}
+		totalSST += len(v.tables)
 	}
+	// A lookup probes one shard's filter, so the store-wide false positive
+	// rate is the mean of the shards'.
+	bloomFill := 0.0
+	if bloomBits > 0 {
+		bloomFill = float64(bloomSet) / float64(bloomBits)
+	}
+	if len(hs.shards) > 0 {
+		bloomFP /= float64(len(hs.shards))
+	}
+	var sstBytes, dataBytes, liveBytes int64
+	for _, s := range hs.shards {
+		u := hs.shardSpace(s)
+		sstBytes += u.total
+		dataBytes += u.data
+		liveBytes += u.live
+	}
+	// Disk used per byte of live data; 0 while nothing live is on disk.
+	spaceAmp := 0.0
+	if liveBytes > 0 {
+		spaceAmp = float64(sstBytes) / float64(liveBytes)
+	}
+	imbalance := hs.checkImbalance(maxRecords, totalRecords)
 	reads, writes, hits := hs.stats.Snapshot()
 	walSize, err := hs.backend.Size()
 	if err != nil {
 		walSize = 0
 	}
+	walFlushes := hs.walFlushes.Load()
+	walAvgBatch := 0.0
+	if walFlushes > 0 {
+		walAvgBatch = float64(hs.walFlushedRecords.Load()) / float64(walFlushes)
+	}
+	// What the next compaction would do about the learned index.
+	indexDecision := "train"
+	if !hs.conf.System.UseLearnedIndex() {
+		indexDecision = "disabled"
+	} else if !hs.trainIndexes() {
+		indexDecision = "defer"
+	}
+	deferredShards := 0
+	for _, s := range hs.shards {
+		if s.indexDeferred.Load() {
+			deferredShards++
+		}
+	}
+	readOnlyReason := ""
+	if err := hs.ReadOnly(); err != nil {
+		readOnlyReason = err.Error()
+	}
 	return map[string]interface{}{
 		"memtable_record_count": totalMem,
 		"learned_indexes_count": totalIndex,
@@ -762,13 +2466,173 @@ func (hs *HybridStore) Stats() map[string]interface{} {
 		"write_count":           writes,
 		"hit_count":             hits,
 		"shards_active":         hs.conf.System.ShardCount,
-		"pending_writes":        len(hs.writeCh),
+		"pending_writes":        hs.pendingWrites(),
 		"wal_size_bytes":        walSize,
+		"wal_offset":            hs.backend.CurrentOffset(),
+		"wal_batch_flushes":     walFlushes,
+		"wal_avg_batch_size":    walAvgBatch,
+		"wal_flushes_per_sec":   float64(walFlushes) / time.Since(hs.opened).Seconds(),
+		"events_dropped":        hs.eventsDropped.Load(),
+		"compaction_pending":    compactionQueue,
+		"sstable_bytes":         sstBytes,
+		"reclaimable_bytes":     dataBytes - liveBytes,
+		"space_amplification":   spaceAmp,
 		"rw_ratio":              hs.stats.GetReadWriteRatio(),
+		"adaptive_rw_threshold": hs.conf.System.AdaptiveReadWriteThreshold,
+		"index_decision":        indexDecision,
+		"index_deferred_shards": deferredShards,
+		"index_deferrals":       hs.indexDeferrals.Load(),
+		"learned_models":        hs.ModelStats(),
+		"bloom_bits_total":      bloomBits,
+		"bloom_elements":        bloomElements,
+		"bloom_capacity":        bloomCapacity,
+		"bloom_resizes":         hs.bloomResizes.Load(),
+		"bloom_fill_ratio":      bloomFill,
+		"bloom_estimated_fp":    bloomFP,
+		"shard_imbalance":       imbalance,
+		"read_only":             readOnlyReason != "",
+		"read_only_reason":      readOnlyReason,
+		"startup":               hs.startup.fields(),
 		"mode":                  "Hybrid (LSM-Tree + AI)",
 	}
 }
 
+const (
+	// shardImbalanceWarn is the max/mean records-per-shard ratio above which
+	// Stats logs a hot-shard warning. Smaller stores are skewed by chance, so
+	// the check waits for minImbalanceRecords.
+	shardImbalanceWarn  = 2.0
+	minImbalanceRecords = 1000
+)
+
+// buildIndex is learned.BuildFromSources timing the build for the shard's
+// ModelStats.
+func (hs *HybridStore) buildIndex(shard *Shard, keys []common.KeyType, locs []learned.Location, sources []learned.ValueReader) *learned.LearnedIndex {
+	start := time.Now()
+	li := learned.BuildFromSources(keys, locs, sources, hs.indexOptions())
+	shard.modelBuild.Store(int64(time.Since(start)))
+	return li
+}
+
+// indexOptions are the learned.Options the configuration asks for.
+func (hs *HybridStore) indexOptions() learned.Options {
+	return learned.Options{MinModelKeys: hs.conf.System.LearnedIndexMinKeys}
+}
+
+// ModelStats is the cost of a shard's learned indexes: how long the last
+// build took (sorting and training, rebuilt on every compaction) and the
+// size of the models and the keys they were fit to.
+type ModelStats struct {
+	Shard       int     `json:"shard"`
+	BuildMs     float64 `json:"model_build_ms"`
+	SizeBytes   int     `json:"model_size_bytes"`
+	RecordCount int     `json:"model_record_count"`
+}
+
+// ModelStats reports each shard's learned-index models. It reads the
+// published shard views, so it does not wait for shard locks.
+func (hs *HybridStore) ModelStats() []ModelStats {
+	out := make([]ModelStats, len(hs.shards))
+	for i, s := range hs.shards {
+		v := s.view.Load()
+		out[i] = ModelStats{
+			Shard:       s.id,
+			BuildMs:     float64(s.modelBuild.Load()) / float64(time.Millisecond),
+			SizeBytes:   v.modelBytes,
+			RecordCount: v.modelRecords,
+		}
+	}
+	return out
+}
+
+func (shard *Shard) indexedCountLocked() int {
+	if n := len(shard.learnedIndexes); n > 0 {
+		return shard.learnedIndexes[n-1].Size()
+	}
+	return 0
+}
+
+// memEntriesLocked is what the memtable holds towards a flush: its keys and
+// their pending merge operands.
+func (shard *Shard) memEntriesLocked() int {
+	return shard.mutableMem.Count() + shard.mutableMem.Operands()
+}
+
+// recordCountLocked approximates the records a shard holds: its memtable
+// plus its newest learned index, which covers the SSTables.
+func (shard *Shard) recordCountLocked() int {
+	return shard.mutableMem.Count() + shard.indexedCountLocked()
+}
+
+// checkImbalance returns max/mean records per shard (1 when empty) and logs
+// when the store becomes, or stops being, imbalanced.
+func (hs *HybridStore) checkImbalance(maxRecords, totalRecords int) float64 {
+	if totalRecords == 0 {
+		return 1
+	}
+	ratio := float64(maxRecords) / (float64(totalRecords) / float64(len(hs.shards)))
+	hot := totalRecords >= minImbalanceRecords && ratio > shardImbalanceWarn
+	if hs.imbalanced.Swap(hot) != hot {
+		if hot {
+			hs.log.Warn("[Shard] Imbalance %.2f (max/mean records per shard) exceeds %.1f", ratio, shardImbalanceWarn)
+		} else {
+			hs.log.Info("[Shard] Imbalance back to %.2f", ratio)
+		}
+	}
+	return ratio
+}
+
+// ShardStats reports each shard separately so skew between shards is visible.
+// indexed_record_count is the size of the shard's newest learned index, which
+// covers its SSTables as of the last flush or compaction.
+func (hs *HybridStore) ShardStats() []map[string]interface{} {
+	models := hs.ModelStats()
+	out := make([]map[string]interface{}, len(hs.shards))
+	for i, s := range hs.shards {
+		s.mutex.RLock()
+		indexed := s.indexedCountLocked()
+		var sstBytes, l0Bytes int64
+		for _, sst := range s.sstables {
+			sstBytes += sst.Size()
+		}
+		for _, sst := range s.l0SSTables {
+			l0Bytes += sst.Size()
+		}
+		mem := s.mutableMem.Count()
+		bs := s.bloom.Snapshot()
+		out[i] = map[string]interface{}{
+			"shard":                 s.id,
+			"memtable_record_count": mem,
+			"indexed_record_count":  indexed,
+			"l0_sstable_count":      len(s.l0SSTables),
+			"l1_sstable_count":      len(s.l1SSTables),
+			"sstable_bytes":         sstBytes,
+			"l0_bytes":              l0Bytes,
+			"bloom_elements":        bs.Elements,
+			"bloom_capacity":        bs.Capacity,
+			"bloom_fill_ratio":      bs.FillRatio,
+			"flush_pending":         mem >= hs.conf.Storage.MemTableFlushThreshold,
+		}
+		// The keys a lookup in the newest learned index may have to search.
+		if n := len(s.learnedIndexes); n > 0 {
+			out[i]["learned_error_window"] = s.learnedIndexes[n-1].Window()
+		}
+		ms := models[i]
+		out[i]["model_build_ms"] = ms.BuildMs
+		out[i]["model_size_bytes"] = ms.SizeBytes
+		out[i]["model_record_count"] = ms.RecordCount
+		if at := s.lastCompaction.Load(); at != 0 {
+			out[i]["last_compaction_at"] = time.Unix(0, at)
+		}
+		if lo, hi, ok := hs.shardBounds(i); ok {
+			out[i]["range_start"] = lo
+			out[i]["range_end"] = hi
+		}
+		s.mutex.RUnlock()
+	}
+	return out
+}
+
 func (hs *HybridStore) ExportModelData() ([]learned.DiagnosticPoint, error) {
 	var allPoints []learned.DiagnosticPoint
 
@@ -792,13 +2656,39 @@ func (hs *HybridStore) ExportModelData() ([]learned.DiagnosticPoint, error) {
 	return allPoints, nil
 }
 
+// Reset deletes every record, on disk and in memory. It is atomic with
+// respect to writes: those that return before it are gone, those that start
+// during it wait for it and land in the empty store.
 func (hs *HybridStore) Reset() error {
+	// Every write is queued under its shard's lock, so holding them all
+	// stops new ones; the compaction locks keep compactions from installing
+	// tables afterwards.
+	for _, shard := range hs.shards {
+		shard.compactionLock.Lock()
+		shard.mutex.Lock()
+	}
+	defer func() {
+		for _, shard := range hs.shards {
+			shard.mutex.Unlock()
+			shard.compactionLock.Unlock()
+		}
+	}()
+	resume, err := hs.pausePersist()
+	if err != nil {
+		return err
+	}
+	defer resume()
+	// The queued writes are about to be truncated anyway.
+	hs.drainQueue(func(walEntry) {})
+
 	if err := hs.backend.Truncate(); err != nil {
 		return err
 	}
+	if err := hs.manifest.Reset(); err != nil {
+		return err
+	}
 
-	files, _ := filepath.Glob(filepath.Join(hs.conf.Storage.Path, "*.sst"))
-	for _, f := range files {
+	for _, f := range hs.layout.globTables("*.sst") {
 		os.Remove(f)
 	}
 	liFiles, _ := filepath.Glob(filepath.Join(hs.conf.Storage.Path, "*.li"))
@@ -807,42 +2697,64 @@ func (hs *HybridStore) Reset() error {
 	}
 
 	for _, shard := range hs.shards {
-		shard.mutex.Lock()
-
 		for _, sst := range shard.sstables {
 			sst.Close()
 		}
 
 		shard.mutableMem = memory.NewMemTable(32)
 		shard.learnedIndexes = make([]*learned.LearnedIndex, 0)
+		shard.indexed = nil
 		shard.l0SSTables = make([]*sstable.SSTable, 0)
 		shard.l1SSTables = make([]*sstable.SSTable, 0)
 		shard.sstables = make([]*sstable.SSTable, 0)
 		shard.bloom = structure.NewBloomFilter(hs.conf.System.BloomSize, hs.conf.System.BloomFalseProb)
-
-		shard.mutex.Unlock()
+		shard.flushErr = nil
+		shard.publishLocked()
 	}
 
-	hs.stats = monitor.NewWorkloadStats()
-
-Loop:
-	for {
-		select {
-		case <-hs.writeCh:
-		default:
-			break Loop
-		}
-	}
+	// Reads and Stats use hs.stats without the shard locks.
+	hs.stats.Reset()
 
-	log.Println("[NeuroDB] Database Reset Complete (Deep Clean).")
+	hs.log.Info("[NeuroDB] Database Reset Complete (Deep Clean).")
 	return nil
 }
 
-func (hs *HybridStore) BenchmarkAlgo(iterations int) (float64, float64, error) {
-	hs.shards[0].mutex.RLock()
-	defer hs.shards[0].mutex.RUnlock()
-	if len(hs.shards[0].learnedIndexes) == 0 {
-		return 0, 0, fmt.Errorf("no learned index data available (insert more data)")
+// BenchmarkResult compares binary search against the learned index over one
+// shard's latest index, averaged per lookup.
+type BenchmarkResult struct {
+	Shard        int     `json:"shard"`
+	Keys         int     `json:"keys"`
+	BinaryAvgNs  float64 `json:"btree_avg_ns"`
+	LearnedAvgNs float64 `json:"ai_avg_ns"`
+}
+
+// BenchmarkAlgo runs iterations lookups against the latest learned index of
+// shard, or of every shard that has one when shard is negative.
+func (hs *HybridStore) BenchmarkAlgo(iterations, shard int) ([]BenchmarkResult, error) {
+	if shard >= len(hs.shards) {
+		return nil, fmt.Errorf("shard %d out of range (0-%d)", shard, len(hs.shards)-1)
+	}
+	var results []BenchmarkResult
+	for i, s := range hs.shards {
+		if shard >= 0 && i != shard {
+			continue
+		}
+		s.mutex.RLock()
+		if len(s.learnedIndexes) == 0 {
+			s.mutex.RUnlock()
+			continue
+		}
+		li := s.learnedIndexes[len(s.learnedIndexes)-1]
+		bTime, aiTime, err := li.BenchmarkInternal(iterations)
+		keys := li.Size()
+		s.mutex.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, BenchmarkResult{Shard: i, Keys: keys, BinaryAvgNs: bTime, LearnedAvgNs: aiTime})
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no learned index data available (insert more data)")
 	}
-	return hs.shards[0].learnedIndexes[len(hs.shards[0].learnedIndexes)-1].BenchmarkInternal(iterations)
+	return results, nil
 }
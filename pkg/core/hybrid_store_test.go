@@ -2,15 +2,45 @@ package core
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"neurodb/pkg/common"
 	"neurodb/pkg/config"
+	"neurodb/pkg/logger"
+	"neurodb/pkg/model"
+	"neurodb/pkg/storage"
 	"neurodb/pkg/storage/sstable"
 )
 
+// testConfig is a small two-shard store in a fresh directory that flushes
+// every 100 writes. Tests change the fields they depend on.
+func testConfig(t testing.TB) *config.Config {
+	return &config.Config{
+		Storage: config.StorageConfig{
+			Path:                   t.TempDir(),
+			WalBufferSize:          8192,
+			MemTableFlushThreshold: 100,
+			CompactionThreshold:    4,
+			WalBatchSize:           64,
+		},
+		System: config.SystemConfig{
+			ShardCount:     2,
+			BloomSize:      10000,
+			BloomFalseProb: 0.01,
+		},
+	}
+}
+
 func writeTestSST(t *testing.T, path string, records []common.Record) {
 	t.Helper()
 
@@ -230,3 +260,2254 @@ func TestRecoveryPreservesLatestAndTombstoneAcrossRestarts(t *testing.T) {
 		t.Fatalf("expected restored leveled files (l0=0,l1>0), got l0=%d l1=%d", l0Count, l1Count)
 	}
 }
+
+func TestUnpublishedSSTableIgnoredAfterCrash(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			Path:                   tmpDir,
+			WalBufferSize:          16,
+			MemTableFlushThreshold: 1000,
+			CompactionThreshold:    4,
+			WalBatchSize:           8,
+		},
+		System: config.SystemConfig{
+			ShardCount:     1,
+			BloomSize:      1024,
+			BloomFalseProb: 0.01,
+		},
+	}
+
+	// A builder that has not closed must not be visible under its final name.
+	finalPath := filepath.Join(tmpDir, "shard-0-l0-100.sst")
+	builder, err := sstable.NewBuilder(finalPath)
+	if err != nil {
+		t.Fatalf("create sstable builder: %v", err)
+	}
+	if err := builder.Add(7, []byte("partial")); err != nil {
+		t.Fatalf("add record: %v", err)
+	}
+	if _, err := os.Stat(finalPath); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be unpublished while building, stat err=%v", finalPath, err)
+	}
+	builder.Abort()
+
+	// Crash after the table was fully written but before the rename.
+	donePath := filepath.Join(tmpDir, "shard-0-l0-200.sst")
+	writeTestSST(t, donePath, []common.Record{{Key: 9, Value: []byte("unpublished")}})
+	if err := os.Rename(donePath, donePath+sstable.TempSuffix); err != nil {
+		t.Fatalf("simulate crash before rename: %v", err)
+	}
+	// And a crash mid-write, leaving a truncated temp file.
+	if err := os.WriteFile(filepath.Join(tmpDir, "shard-0-l0-300.sst"+sstable.TempSuffix), []byte("trunc"), 0644); err != nil {
+		t.Fatalf("write truncated temp file: %v", err)
+	}
+
+	hs := NewHybridStore(cfg)
+	defer hs.Close()
+	if _, ok := hs.Get(9); ok {
+		t.Fatalf("expected unpublished table not to be served")
+	}
+	leftovers, err := filepath.Glob(filepath.Join(tmpDir, "*"+sstable.TempSuffix))
+	if err != nil {
+		t.Fatalf("glob temp files: %v", err)
+	}
+	if len(leftovers) != 0 {
+		t.Fatalf("expected temp files removed on startup, got %v", leftovers)
+	}
+
+	// Tables built normally are published and restored.
+	for i := 0; i < 150; i++ {
+		hs.Put(common.KeyType(i), []byte("v"))
+	}
+	shard := hs.shards[0]
+	shard.mutex.Lock()
+	hs.adaptiveFlush(shard)
+	shard.mutex.Unlock()
+	published, _ := filepath.Glob(filepath.Join(tmpDir, "*.sst"))
+	if len(published) != 1 {
+		t.Fatalf("expected one published sstable after flush, got %v", published)
+	}
+}
+
+func TestManifestIgnoresOrphanSSTable(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			Path:                   tmpDir,
+			WalBufferSize:          16,
+			MemTableFlushThreshold: 1000,
+			CompactionThreshold:    4,
+			WalBatchSize:           8,
+		},
+		System: config.SystemConfig{
+			ShardCount:     1,
+			BloomSize:      1024,
+			BloomFalseProb: 0.01,
+		},
+	}
+
+	hs := NewHybridStore(cfg)
+	for i := 0; i < 150; i++ {
+		hs.Put(common.KeyType(i), []byte("live"))
+	}
+	shard := hs.shards[0]
+	shard.mutex.Lock()
+	hs.adaptiveFlush(shard)
+	shard.mutex.Unlock()
+	hs.Close()
+
+	// A compacted-away input whose delete never happened, holding older data.
+	writeTestSST(t, filepath.Join(tmpDir, "shard-0-l0-1.sst"), []common.Record{
+		{Key: 5, Value: []byte("stale")},
+		{Key: 500, Value: []byte("resurrected")},
+	})
+
+	hs2 := NewHybridStore(cfg)
+	defer hs2.Close()
+	if v, ok := hs2.Get(5); !ok || !bytes.Equal(v, []byte("live")) {
+		t.Fatalf("expected key=5 'live' from manifest-tracked table, got ok=%v val=%q", ok, string(v))
+	}
+	if _, ok := hs2.Get(500); ok {
+		t.Fatalf("expected orphan sstable not to be served")
+	}
+	shard2 := hs2.shards[0]
+	shard2.mutex.RLock()
+	defer shard2.mutex.RUnlock()
+	for _, sst := range shard2.sstables {
+		if filepath.Base(sst.Filename) == "shard-0-l0-1.sst" {
+			t.Fatalf("expected orphan sstable not to be loaded")
+		}
+	}
+}
+
+func TestStartupRemovesOrphanFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			Path:                   tmpDir,
+			WalBufferSize:          16,
+			MemTableFlushThreshold: 1000,
+			CompactionThreshold:    4,
+			WalBatchSize:           8,
+		},
+		System: config.SystemConfig{
+			ShardCount:     1,
+			BloomSize:      1024,
+			BloomFalseProb: 0.01,
+		},
+	}
+
+	hs := NewHybridStore(cfg)
+	hs.Put(1, []byte("v1"))
+	hs.Close()
+	hs = NewHybridStore(cfg) // checkpoints the WAL into a live table
+	hs.Close()
+
+	orphanSST := filepath.Join(tmpDir, "shard-0-l0-1.sst")
+	writeTestSST(t, orphanSST, []common.Record{{Key: 1, Value: []byte("old")}, {Key: 2, Value: []byte("gone")}})
+	staleLI := filepath.Join(tmpDir, "shard-0-deadbeef.li")
+	if err := os.WriteFile(staleLI, []byte("stale"), 0644); err != nil {
+		t.Fatalf("write stale li: %v", err)
+	}
+
+	hs2 := NewHybridStore(cfg)
+	defer hs2.Close()
+	for _, f := range []string{orphanSST, staleLI} {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Fatalf("expected %s removed on startup, stat err=%v", filepath.Base(f), err)
+		}
+	}
+	if v, ok := hs2.Get(1); !ok || !bytes.Equal(v, []byte("v1")) {
+		t.Fatalf("expected key=1 'v1', got ok=%v val=%q", ok, string(v))
+	}
+	if _, ok := hs2.Get(2); ok {
+		t.Fatalf("expected orphan data not served")
+	}
+	liFiles, _ := filepath.Glob(filepath.Join(tmpDir, "*.li"))
+	if len(liFiles) != 1 {
+		t.Fatalf("expected exactly the current learned index to remain, got %v", liFiles)
+	}
+}
+
+func TestDamagedManifestKeepsTables(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	quiet := WithLogger(logger.New(io.Discard, logger.LevelError))
+	hs, err := OpenHybridStore(cfg, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 250; i++ {
+		hs.Put(common.KeyType(i), []byte("v"))
+	}
+	if err := hs.Shutdown(); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	tables, _ := filepath.Glob(filepath.Join(cfg.Storage.Path, "shard-*.sst"))
+	if len(tables) == 0 {
+		t.Fatal("expected SSTables on disk")
+	}
+	manifestPath := filepath.Join(cfg.Storage.Path, storage.ManifestName)
+	good, _ := os.ReadFile(manifestPath)
+
+	t.Run("torn last record", func(t *testing.T) {
+		orphan := filepath.Join(cfg.Storage.Path, "shard-0-l0-1.sst")
+		writeTestSST(t, orphan, []common.Record{{Key: 1, Value: []byte("old")}})
+		f, _ := os.OpenFile(manifestPath, os.O_WRONLY|os.O_APPEND, 0644)
+		f.Write([]byte{0xde, 0xad, 0xbe, 0xef, 0x40, 0, 0, 0, '{'})
+		f.Close()
+
+		hs, err := OpenHybridStore(cfg, quiet)
+		if err != nil {
+			t.Fatalf("open with a torn manifest record: %v", err)
+		}
+		defer hs.Close()
+		for _, f := range tables {
+			if _, err := os.Stat(f); err != nil {
+				t.Fatalf("live table %s gone: %v", filepath.Base(f), err)
+			}
+		}
+		// Unlisted tables are kept aside rather than deleted.
+		if _, err := os.Stat(filepath.Join(cfg.Storage.Path, QuarantineDir, filepath.Base(orphan))); err != nil {
+			t.Fatalf("unlisted table not quarantined: %v", err)
+		}
+		if v, ok := hs.Get(1); !ok || string(v) != "v" {
+			t.Fatalf("Get(1) = %q, %v", v, ok)
+		}
+	})
+
+	t.Run("corrupt record", func(t *testing.T) {
+		bad := append([]byte(nil), good...)
+		bad[10] ^= 0xff
+		os.WriteFile(manifestPath, bad, 0644)
+
+		if _, err := OpenHybridStore(cfg, quiet); !errors.Is(err, storage.ErrManifestCorrupt) {
+			t.Fatalf("expected ErrManifestCorrupt, got %v", err)
+		}
+		for _, f := range tables {
+			if _, err := os.Stat(f); err != nil {
+				t.Fatalf("table %s gone after a failed open: %v", filepath.Base(f), err)
+			}
+		}
+
+		// Repair drops the whole live set, so the tables go to quarantine
+		// and survive the next open's garbage collection.
+		if _, err := Verify(cfg.Storage.Path, true); err != nil {
+			t.Fatalf("repair: %v", err)
+		}
+		hs, err := OpenHybridStore(cfg, quiet)
+		if err != nil {
+			t.Fatalf("open after repair: %v", err)
+		}
+		hs.Close()
+		for _, f := range tables {
+			if _, err := os.Stat(filepath.Join(cfg.Storage.Path, QuarantineDir, filepath.Base(f))); err != nil {
+				t.Fatalf("table %s not kept in quarantine: %v", filepath.Base(f), err)
+			}
+		}
+	})
+}
+
+func TestLearnedIndexSignatureStableUnderCompaction(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			Path:                   tmpDir,
+			WalBufferSize:          16,
+			MemTableFlushThreshold: 1000,
+			CompactionThreshold:    2,
+			WalBatchSize:           8,
+		},
+		System: config.SystemConfig{
+			ShardCount:     1,
+			BloomSize:      1024,
+			BloomFalseProb: 0.01,
+		},
+	}
+	hs := NewHybridStore(cfg)
+	defer hs.Close()
+	shard := hs.shards[0]
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for round := 0; round < 8; round++ {
+			for i := 0; i < 120; i++ {
+				hs.Put(common.KeyType(round*1000+i), []byte("v"))
+			}
+			shard.mutex.Lock()
+			hs.adaptiveFlush(shard)
+			shard.mutex.Unlock()
+			hs.compactShard(shard)
+		}
+	}()
+
+	// Once the shard has tables it never loses them here (compaction swaps L0
+	// for L1), so the signature must never go back to empty.
+	signed := false
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		sig := hs.learnedIndexSignature(shard)
+		if signed && sig == "" {
+			t.Fatalf("signature became empty during compaction")
+		}
+		signed = signed || sig != ""
+		hs.tryLoadPersistedLearnedIndex(shard)
+	}
+
+	// Wait out any compaction adaptiveFlush started in the background.
+	shard.compactionLock.Lock()
+	shard.compactionLock.Unlock()
+
+	hs.rebuildLearnedIndexFromSSTables(shard)
+	sig1 := hs.learnedIndexSignature(shard)
+	sig2 := hs.learnedIndexSignature(shard)
+	if sig1 == "" || sig1 != sig2 {
+		t.Fatalf("expected a stable signature, got %q then %q", sig1, sig2)
+	}
+	if !hs.tryLoadPersistedLearnedIndex(shard) {
+		t.Fatalf("expected persisted learned index for the final table set to load")
+	}
+	if v, ok := hs.Get(7005); !ok || !bytes.Equal(v, []byte("v")) {
+		t.Fatalf("expected key=7005 readable after compaction, got ok=%v", ok)
+	}
+}
+
+func TestStatsReportsBloomSaturation(t *testing.T) {
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			Path:                   t.TempDir(),
+			WalBufferSize:          16,
+			MemTableFlushThreshold: 1000,
+			CompactionThreshold:    4,
+			WalBatchSize:           8,
+		},
+		System: config.SystemConfig{
+			ShardCount:     2,
+			BloomSize:      64,
+			BloomFalseProb: 0.01,
+		},
+	}
+	hs := NewHybridStore(cfg)
+	t.Cleanup(hs.Close)
+
+	stats := hs.Stats()
+	if fill := stats["bloom_fill_ratio"].(float64); fill != 0 {
+		t.Fatalf("expected empty filters, got fill ratio %f", fill)
+	}
+
+	for i := 0; i < 200; i++ {
+		hs.Put(common.KeyType(i), []byte("v"))
+	}
+	stats = hs.Stats()
+	if bits := stats["bloom_bits_total"].(uint); bits == 0 {
+		t.Fatalf("expected bloom bits, got %v", stats["bloom_bits_total"])
+	}
+	if n := stats["bloom_elements"].(uint); n != 200 {
+		t.Fatalf("expected 200 bloom elements, got %d", n)
+	}
+	fill := stats["bloom_fill_ratio"].(float64)
+	fp := stats["bloom_estimated_fp"].(float64)
+	// 200 keys in filters sized for 2x64 are well past capacity.
+	if fill <= 0 || fill > 1 || fp <= cfg.System.BloomFalseProb {
+		t.Fatalf("expected saturated filters, got fill=%f fp=%f", fill, fp)
+	}
+}
+
+func TestShardHashSpreadsMultiplesOfShardCount(t *testing.T) {
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			Path:                   t.TempDir(),
+			WalBufferSize:          16,
+			MemTableFlushThreshold: 100000,
+			CompactionThreshold:    4,
+			WalBatchSize:           8,
+		},
+		System: config.SystemConfig{
+			ShardCount:     4,
+			BloomSize:      1024,
+			BloomFalseProb: 0.01,
+		},
+	}
+	hs := NewHybridStore(cfg)
+	t.Cleanup(hs.Close)
+
+	// SQL table bases are multiples of 1,000,000; with key%4 every one of
+	// these would land in shard 0.
+	for i := 1; i <= 2000; i++ {
+		hs.Put(common.KeyType(i*1000000), []byte("v"))
+	}
+
+	for _, sh := range hs.ShardStats() {
+		if n := sh["memtable_record_count"].(int); n < 2000/4/2 {
+			t.Fatalf("shard %v holds only %d of 2000 keys", sh["shard"], n)
+		}
+	}
+	if ratio := hs.Stats()["shard_imbalance"].(float64); ratio > 1.2 {
+		t.Fatalf("expected near-uniform shards, imbalance %.2f", ratio)
+	}
+	if v, ok := hs.Get(common.KeyType(1234 * 1000000)); !ok || string(v) != "v" {
+		t.Fatalf("expected routed key to be readable")
+	}
+}
+
+func TestShardIndexUniformForAdversarialKeys(t *testing.T) {
+	const shards, n = 16, 16000
+	patterns := map[string]func(i int) common.KeyType{
+		"sequential":    func(i int) common.KeyType { return common.KeyType(i) },
+		"multiple of n": func(i int) common.KeyType { return common.KeyType(i * shards) },
+		"table bases":   func(i int) common.KeyType { return common.KeyType(i * 1000000) },
+		"power-of-two":  func(i int) common.KeyType { return common.KeyType(i) << 20 },
+		"negative":      func(i int) common.KeyType { return common.KeyType(-i * shards) },
+		"z-order z=0": func(i int) common.KeyType {
+			k, _ := common.Encode3D(uint32(i%1024), uint32(i/1024), 0)
+			return common.KeyType(k)
+		},
+	}
+	for name, key := range patterns {
+		counts := make([]int, shards)
+		for i := 0; i < n; i++ {
+			idx := shardIndex(key(i), shards)
+			if idx < 0 || idx >= shards {
+				t.Fatalf("%s: key %d routed to shard %d", name, key(i), idx)
+			}
+			counts[idx]++
+		}
+		// Expect n/shards = 1000 per shard; allow a generous ±15%.
+		for s, c := range counts {
+			if c < 850 || c > 1150 {
+				t.Fatalf("%s: shard %d got %d keys, counts=%v", name, s, c, counts)
+			}
+		}
+	}
+}
+
+func TestRestartReroutesTablesFromOldSharding(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			Path:                   tmpDir,
+			WalBufferSize:          16,
+			MemTableFlushThreshold: 1000,
+			CompactionThreshold:    4,
+			WalBatchSize:           8,
+		},
+		System: config.SystemConfig{
+			ShardCount:     4,
+			BloomSize:      1024,
+			BloomFalseProb: 0.01,
+		},
+	}
+
+	// A pre-manifest directory laid out with key%4 routing.
+	for s := 0; s < 4; s++ {
+		var recs []common.Record
+		for k := s; k < 400; k += 4 {
+			recs = append(recs, common.Record{Key: common.KeyType(k), Value: []byte("v")})
+		}
+		writeTestSST(t, filepath.Join(tmpDir, fmt.Sprintf("shard-%d-l1-1.sst", s)), recs)
+	}
+
+	check := func(hs *HybridStore) {
+		t.Helper()
+		for k := 0; k < 400; k++ {
+			if v, ok := hs.Get(common.KeyType(k)); !ok || string(v) != "v" {
+				t.Fatalf("key %d not found after re-routing", k)
+			}
+		}
+	}
+	hs := NewHybridStore(cfg)
+	check(hs)
+	if got := hs.manifest.Sharding(); got != "splitmix64/4" {
+		t.Fatalf("expected sharding recorded in manifest, got %q", got)
+	}
+	live := hs.manifest.Live()
+	hs.Close()
+	if _, err := os.Stat(filepath.Join(tmpDir, "shard-0-l1-1.sst")); !os.IsNotExist(err) {
+		t.Fatalf("expected old-routing table removed, stat err=%v", err)
+	}
+
+	// Same routing on the next open: nothing is rewritten.
+	hs = NewHybridStore(cfg)
+	t.Cleanup(hs.Close)
+	check(hs)
+	if again := hs.manifest.Live(); fmt.Sprint(again) != fmt.Sprint(live) {
+		t.Fatalf("tables rewritten on reopen: %v -> %v", live, again)
+	}
+}
+
+func TestScanPrunesToOverlappingTables(t *testing.T) {
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			Path:                   t.TempDir(),
+			WalBufferSize:          1024,
+			MemTableFlushThreshold: 200,
+			CompactionThreshold:    1000,
+			WalBatchSize:           64,
+		},
+		System: config.SystemConfig{
+			ShardCount:     1,
+			BloomSize:      10000,
+			BloomFalseProb: 0.01,
+		},
+	}
+	hs := NewHybridStore(cfg)
+	t.Cleanup(hs.Close)
+	for i := 0; i < 1000; i++ {
+		hs.Put(common.KeyType(i), []byte(fmt.Sprintf("v%d", i)))
+	}
+	hs.Put(500, []byte{}) // tombstone in the memtable over a flushed key
+
+	shard := hs.shards[0]
+	if n := len(shard.l0SSTables); n != 5 {
+		t.Fatalf("expected 5 flushed tables, got %d", n)
+	}
+	overlapping := 0
+	for _, sst := range shard.sstables {
+		if sst.Overlaps(450, 520) {
+			overlapping++
+		}
+	}
+	if overlapping != 1 {
+		t.Fatalf("expected one table to cover [450, 520], got %d", overlapping)
+	}
+
+	got := hs.Scan(450, 520)
+	if len(got) != 70 {
+		t.Fatalf("expected 70 records (500 deleted), got %d", len(got))
+	}
+	for i, r := range got {
+		want := common.KeyType(450 + i)
+		if want >= 500 {
+			want++
+		}
+		if r.Key != want || string(r.Value) != fmt.Sprintf("v%d", want) {
+			t.Fatalf("record %d: got %d=%q, want key %d", i, r.Key, r.Value, want)
+		}
+	}
+}
+
+// BenchmarkScanNarrow scans ten keys out of fifty disjoint L0 tables; only
+// the table holding them needs to be opened and read.
+func BenchmarkScanNarrow(b *testing.B) {
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			Path:                   b.TempDir(),
+			WalBufferSize:          1024,
+			MemTableFlushThreshold: 1000,
+			CompactionThreshold:    1000,
+			WalBatchSize:           500,
+		},
+		System: config.SystemConfig{
+			ShardCount:     1,
+			BloomSize:      100000,
+			BloomFalseProb: 0.01,
+		},
+	}
+	hs := NewHybridStore(cfg)
+	b.Cleanup(hs.Close)
+	for i := 0; i < 50000; i++ {
+		hs.Put(common.KeyType(i), []byte("value"))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := common.KeyType((i * 997) % 49990)
+		if got := hs.Scan(start, start+9); len(got) != 10 {
+			b.Fatalf("scan [%d, %d]: got %d records", start, start+9, len(got))
+		}
+	}
+}
+
+// BenchmarkScanManyTables scans 200 keys spread over fifty overlapping L0
+// tables, so every scan reads from all of them.
+func BenchmarkScanManyTables(b *testing.B) {
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			Path:                   b.TempDir(),
+			WalBufferSize:          1024,
+			MemTableFlushThreshold: 1000,
+			CompactionThreshold:    1000,
+			WalBatchSize:           500,
+		},
+		System: config.SystemConfig{
+			ShardCount:     1,
+			BloomSize:      100000,
+			BloomFalseProb: 0.01,
+		},
+	}
+	hs := NewHybridStore(cfg)
+	b.Cleanup(hs.Close)
+	for table := 0; table < 50; table++ {
+		for i := 0; i < 1000; i++ {
+			hs.Put(common.KeyType(i*50+table), []byte("value"))
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := common.KeyType((i * 997) % 49800)
+		if got := hs.Scan(start, start+199); len(got) != 200 {
+			b.Fatalf("scan [%d, %d]: got %d records", start, start+199, len(got))
+		}
+	}
+}
+
+func TestShardStrategiesReturnSameResults(t *testing.T) {
+	newConfig := func(strategy string) *config.Config {
+		return &config.Config{
+			Storage: config.StorageConfig{
+				Path:                   t.TempDir(),
+				WalBufferSize:          8192,
+				MemTableFlushThreshold: 200,
+				CompactionThreshold:    4,
+				WalBatchSize:           64,
+			},
+			System: config.SystemConfig{
+				ShardCount:     4,
+				ShardStrategy:  strategy,
+				BloomSize:      10000,
+				BloomFalseProb: 0.01,
+			},
+		}
+	}
+	hashCfg, rangeCfg := newConfig(config.ShardStrategyHash), newConfig(config.ShardStrategyRange)
+	stores := []*HybridStore{NewHybridStore(hashCfg), NewHybridStore(rangeCfg)}
+
+	for _, hs := range stores {
+		for i := 0; i < 3000; i++ {
+			hs.Put(common.KeyType(i*7), []byte(fmt.Sprintf("v%d", i)))
+		}
+		for i := 0; i < 3000; i += 10 {
+			hs.Delete(common.KeyType(i * 7))
+		}
+	}
+
+	compare := func(stage string) {
+		t.Helper()
+		for _, r := range [][2]common.KeyType{{0, 100}, {5000, 5600}, {-50, 20999}, {20990, 30000}} {
+			a, b := stores[0].Scan(r[0], r[1]), stores[1].Scan(r[0], r[1])
+			if fmt.Sprint(a) != fmt.Sprint(b) {
+				t.Fatalf("%s: scan %v differs: hash=%d records, range=%d records", stage, r, len(a), len(b))
+			}
+		}
+		for _, k := range []common.KeyType{0, 7, 70, 14000, 20993, 3} {
+			va, oka := stores[0].Get(k)
+			vb, okb := stores[1].Get(k)
+			if oka != okb || string(va) != string(vb) {
+				t.Fatalf("%s: get %d differs: hash=%q/%v range=%q/%v", stage, k, va, oka, vb, okb)
+			}
+		}
+	}
+	compare("before restart")
+
+	for _, hs := range stores {
+		hs.Close()
+	}
+	stores = []*HybridStore{NewHybridStore(hashCfg), NewHybridStore(rangeCfg)}
+	t.Cleanup(func() {
+		for _, hs := range stores {
+			hs.Close()
+		}
+	})
+	compare("after restart")
+
+	// With data on disk the range splits follow the key distribution, so the
+	// shards are balanced and each owns a contiguous range.
+	rs := stores[1]
+	if ratio := rs.Stats()["shard_imbalance"].(float64); ratio > 1.5 {
+		t.Fatalf("range shards imbalanced after restart: %.2f (%s)", ratio, rs.manifest.Sharding())
+	}
+	overlapping := 0
+	for i := range rs.shards {
+		if lo, hi, _ := rs.shardBounds(i); 5000 <= hi && 5100 >= lo {
+			overlapping++
+		}
+	}
+	if overlapping != 1 {
+		t.Fatalf("expected a narrow range to fall in one range shard, got %d", overlapping)
+	}
+}
+
+func TestDeleteRangeSpansMemtableAndSSTables(t *testing.T) {
+	cfg := testConfig(t)
+	hs := NewHybridStore(cfg)
+
+	// Keys below 1000 are flushed to SSTables; 1000-1049 stay in memtables.
+	for i := 0; i < 1050; i++ {
+		hs.Put(common.KeyType(i), []byte(fmt.Sprintf("v%d", i)))
+	}
+	if err := hs.DeleteRange(500, 1025); err != nil {
+		t.Fatalf("delete range: %v", err)
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		for _, k := range []common.KeyType{0, 499, 1025, 1049} {
+			if val, ok := hs.Get(k); !ok || string(val) != fmt.Sprintf("v%d", k) {
+				t.Fatalf("%s: get %d = %q/%v, want it kept", stage, k, val, ok)
+			}
+		}
+		for _, k := range []common.KeyType{500, 750, 999, 1000, 1024} {
+			if val, ok := hs.Get(k); ok {
+				t.Fatalf("%s: get %d = %q, want it deleted", stage, k, val)
+			}
+		}
+		recs := hs.Scan(0, 2000)
+		if len(recs) != 525 {
+			t.Fatalf("%s: scan returned %d records, want 525", stage, len(recs))
+		}
+		for _, r := range recs {
+			if r.Key >= 500 && r.Key < 1025 {
+				t.Fatalf("%s: scan returned deleted key %d", stage, r.Key)
+			}
+		}
+	}
+	check("memtable tombstone")
+
+	// Push the tombstones through flushes and L0 compaction.
+	for i := 5000; i < 6000; i++ {
+		hs.Put(common.KeyType(i), []byte("filler"))
+	}
+	for i := range hs.shards {
+		hs.compactShard(hs.shards[i])
+	}
+	check("after flush and compaction")
+
+	hs.Close()
+	hs = NewHybridStore(cfg)
+	defer func() { hs.Close() }()
+	check("after restart")
+}
+
+func TestReinsertAfterDeleteRangeWins(t *testing.T) {
+	cfg := testConfig(t)
+	hs := NewHybridStore(cfg)
+
+	for i := 0; i < 400; i++ {
+		hs.Put(common.KeyType(i), []byte("old"))
+	}
+	if err := hs.DeleteRange(0, 400); err != nil {
+		t.Fatalf("delete range: %v", err)
+	}
+	hs.Put(42, []byte("new"))
+
+	check := func(stage string) {
+		t.Helper()
+		if val, ok := hs.Get(42); !ok || string(val) != "new" {
+			t.Fatalf("%s: get 42 = %q/%v, want the re-inserted value", stage, val, ok)
+		}
+		if _, ok := hs.Get(41); ok {
+			t.Fatalf("%s: key 41 resurrected", stage)
+		}
+		recs := hs.Scan(0, 399)
+		if len(recs) != 1 || recs[0].Key != 42 || string(recs[0].Value) != "new" {
+			t.Fatalf("%s: scan = %v, want only the re-inserted key", stage, recs)
+		}
+	}
+	check("in memtable")
+
+	// The re-insert shares a table with the tombstone once flushed.
+	for i := 1000; i < 1400; i++ {
+		hs.Put(common.KeyType(i), []byte("filler"))
+	}
+	check("after flush")
+
+	hs.Close()
+	hs = NewHybridStore(cfg)
+	check("after restart")
+
+	// A second range delete covers the re-insert too.
+	if err := hs.DeleteRange(40, 50); err != nil {
+		t.Fatalf("delete range: %v", err)
+	}
+	if _, ok := hs.Get(42); ok {
+		t.Fatal("re-inserted key survived a later range delete")
+	}
+	hs.Close()
+	hs = NewHybridStore(cfg)
+	defer hs.Close()
+	if _, ok := hs.Get(42); ok {
+		t.Fatal("re-inserted key resurrected by restart after a later range delete")
+	}
+}
+
+// cancelOnCheck cancels itself on the n-th call to Err, i.e. partway through
+// whatever is polling it.
+type cancelOnCheck struct {
+	context.Context
+	cancel context.CancelFunc
+	n      int
+	checks int
+}
+
+func (c *cancelOnCheck) Err() error {
+	c.checks++
+	if c.checks == c.n {
+		c.cancel()
+	}
+	return c.Context.Err()
+}
+
+func TestScanContextStopsWhenCanceled(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	hs := NewHybridStore(cfg)
+	defer hs.Close()
+	for i := 0; i < 2000; i++ {
+		hs.Put(common.KeyType(i), []byte("v"))
+	}
+
+	all, err := hs.ScanContext(context.Background(), 0, 1999)
+	if err != nil || len(all) != 2000 {
+		t.Fatalf("uncanceled scan: got %d records, err=%v", len(all), err)
+	}
+
+	// The first check is before the shard; the second is inside the merge.
+	base, cancel := context.WithCancel(context.Background())
+	ctx := &cancelOnCheck{Context: base, cancel: cancel, n: 2}
+	recs, err := hs.ScanContext(ctx, 0, 1999)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if recs != nil {
+		t.Fatalf("expected no records from a canceled scan, got %d", len(recs))
+	}
+	if ctx.checks != 2 {
+		t.Fatalf("scan kept going after cancellation: %d context checks", ctx.checks)
+	}
+
+	if _, _, err := hs.GetContext(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected GetContext to report cancellation, got %v", err)
+	}
+}
+
+func TestCompactDropsDeletedKeysAndReclaimsSpace(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	hs := NewHybridStore(cfg)
+
+	// Multiples of the flush threshold, so every write reaches an SSTable.
+	for i := 0; i < 1000; i++ {
+		hs.Put(common.KeyType(i), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	for i := 0; i < 800; i++ {
+		hs.Delete(common.KeyType(i))
+	}
+	if n := hs.Stats()["reclaimable_bytes"].(int64); n <= 0 {
+		t.Fatalf("expected reclaimable bytes after deletes, got %d", n)
+	}
+
+	if err := hs.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	stats := hs.Stats()
+	if n := stats["reclaimable_bytes"].(int64); n != 0 {
+		t.Fatalf("expected nothing reclaimable after a full compaction, got %d", n)
+	}
+	if n := stats["sstable_count"].(int); n != 1 {
+		t.Fatalf("expected one SSTable after a full compaction, got %d", n)
+	}
+
+	shard := hs.shards[0]
+	shard.mutex.RLock()
+	it := shard.sstables[0].NewIterator()
+	count := 0
+	for it.Next() {
+		if it.Key() < 800 || len(it.Value()) == 0 {
+			t.Errorf("compacted table still holds key %d (value %q)", it.Key(), it.Value())
+		}
+		count++
+	}
+	it.Close()
+	shard.mutex.RUnlock()
+	if count != 200 {
+		t.Fatalf("compacted table holds %d records, want 200", count)
+	}
+
+	hs.Close()
+	reopened := NewHybridStore(cfg)
+	defer reopened.Close()
+	if _, ok := reopened.Get(10); ok {
+		t.Fatalf("deleted key 10 readable after reopen")
+	}
+	if v, ok := reopened.Get(900); !ok || string(v) != "value-900" {
+		t.Fatalf("Get(900) = %q, %v after reopen", v, ok)
+	}
+}
+
+func TestReadYourWritesAcrossFlushes(t *testing.T) {
+	hs := NewHybridStore(testConfig(t))
+	defer hs.Close()
+
+	// Overwriting a few hundred keys per writer flushes every 100 writes and
+	// keeps compactions running alongside.
+	const writers, rounds = 4, 5000
+	errs := make(chan error, writers)
+	for g := 0; g < writers; g++ {
+		go func(g int) {
+			for i := 0; i < rounds; i++ {
+				key := common.KeyType(g*1_000_000 + i%700)
+				want := fmt.Sprintf("%d-%d", g, i)
+				hs.Put(key, []byte(want))
+				if v, ok := hs.Get(key); !ok || string(v) != want {
+					errs <- fmt.Errorf("writer %d round %d: Get(%d) = %q, %v; want %q", g, i, key, v, ok, want)
+					return
+				}
+			}
+			errs <- nil
+		}(g)
+	}
+	for g := 0; g < writers; g++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFailedFlushKeepsRecordsReadable(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	hs := NewHybridStore(cfg, WithLogger(logger.New(io.Discard, logger.LevelError)))
+	defer hs.Close()
+
+	// With a file where the data directory was, no SSTable can be created.
+	if err := os.RemoveAll(cfg.Storage.Path); err != nil {
+		t.Fatalf("remove data dir: %v", err)
+	}
+	if err := os.WriteFile(cfg.Storage.Path, nil, 0644); err != nil {
+		t.Fatalf("replace data dir: %v", err)
+	}
+	// The 100th write fills the memtable; its flush fails but the write
+	// itself went through.
+	for i := 0; i < 100; i++ {
+		if err := hs.Put(common.KeyType(i), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatalf("Put(%d): %v", i, err)
+		}
+	}
+	if err := hs.Put(100, []byte("v100")); !errors.Is(err, ErrFlushFailed) {
+		t.Fatalf("Put after a failed flush: got %v, want ErrFlushFailed", err)
+	}
+	if err := hs.Delete(0); !errors.Is(err, ErrFlushFailed) {
+		t.Fatalf("Delete after a failed flush: got %v, want ErrFlushFailed", err)
+	}
+	if _, ok := hs.Get(100); ok {
+		t.Fatalf("rejected Put(100) is readable")
+	}
+	for i := 0; i < 100; i++ {
+		if v, ok := hs.Get(common.KeyType(i)); !ok || string(v) != fmt.Sprintf("v%d", i) {
+			t.Fatalf("Get(%d) = %q, %v after failed flushes", i, v, ok)
+		}
+	}
+
+	// Once the directory is back, the next write retries the flush.
+	os.Remove(cfg.Storage.Path)
+	if err := os.MkdirAll(cfg.Storage.Path, 0755); err != nil {
+		t.Fatalf("restore data dir: %v", err)
+	}
+	if err := hs.Put(100, []byte("v100")); err != nil {
+		t.Fatalf("Put after the directory returned: %v", err)
+	}
+	if n := hs.Stats()["sstable_count"].(int); n != 1 {
+		t.Fatalf("expected the retried flush to write one SSTable, got %d", n)
+	}
+}
+
+func TestPutRejectsValuesOverMaxValueSize(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Storage.MaxValueSize = 1024
+	hs := NewHybridStore(cfg)
+	defer hs.Close()
+
+	atLimit := bytes.Repeat([]byte("a"), 1024)
+	if err := hs.Put(1, atLimit); err != nil {
+		t.Fatalf("Put at the limit: %v", err)
+	}
+	if err := hs.Put(1, append(atLimit, 'b')); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Put over the limit: got %v, want ErrValueTooLarge", err)
+	}
+	if v, ok := hs.Get(1); !ok || !bytes.Equal(v, atLimit) {
+		t.Fatalf("rejected Put changed key 1: got %d bytes, %v", len(v), ok)
+	}
+
+	// The limit applies to the stored form, after the codec.
+	codedCfg := testConfig(t)
+	codedCfg.Storage.MaxValueSize = 1024
+	coded := NewHybridStore(codedCfg, WithValueCodec(base64Codec{}))
+	defer coded.Close()
+	if err := coded.Put(2, atLimit[:800]); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Put encoding past the limit: got %v, want ErrValueTooLarge", err)
+	}
+}
+
+func TestShutdownFlushesMemtables(t *testing.T) {
+	cfg := testConfig(t)
+	hs := NewHybridStore(cfg)
+	// Too few writes for an adaptive flush: everything is in the memtables.
+	for i := 0; i < 60; i++ {
+		hs.Put(common.KeyType(i), []byte(fmt.Sprintf("v%d", i)))
+	}
+	hs.Delete(3)
+	if err := hs.DeleteRange(40, 50); err != nil {
+		t.Fatalf("delete range: %v", err)
+	}
+	if n := hs.Stats()["sstable_count"].(int); n != 0 {
+		t.Fatalf("expected no SSTables before shutdown, got %d", n)
+	}
+
+	if err := hs.Shutdown(); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	files, err := storage.ReadManifest(filepath.Join(cfg.Storage.Path, storage.ManifestName))
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	if len(files) != cfg.System.ShardCount {
+		t.Fatalf("expected one flushed SSTable per shard, manifest lists %d", len(files))
+	}
+	if size := fileSize(t, filepath.Join(cfg.Storage.Path, backendName+".wal")); size != 0 {
+		t.Fatalf("expected an empty WAL after shutdown, got %d bytes", size)
+	}
+
+	reopened := NewHybridStore(cfg)
+	defer reopened.Close()
+	if n := reopened.Stats()["memtable_record_count"].(int); n != 0 {
+		t.Fatalf("reopen replayed %d records into memtables", n)
+	}
+	for i := 0; i < 60; i++ {
+		v, ok := reopened.Get(common.KeyType(i))
+		deleted := i == 3 || (i >= 40 && i < 50)
+		if ok == deleted || (ok && string(v) != fmt.Sprintf("v%d", i)) {
+			t.Fatalf("Get(%d) after reopen = %q, %v", i, v, ok)
+		}
+	}
+}
+
+func TestScanKeySizesMatchesScan(t *testing.T) {
+	cfg := testConfig(t)
+	hs := NewHybridStore(cfg)
+	defer hs.Close()
+
+	for _, rec := range sortedRecords(500) {
+		hs.Put(rec.Key, rec.Value)
+	}
+	if err := hs.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	// Overwrites land in new SSTables and the memtable; deletes hide keys
+	// still held by the learned index.
+	for k := 0; k < 300; k += 2 {
+		hs.Put(common.KeyType(k), bytes.Repeat([]byte("x"), k%17+1))
+	}
+	for k := 30; k < 60; k += 3 {
+		hs.Delete(common.KeyType(k))
+	}
+	if err := hs.DeleteRange(900, 950); err != nil {
+		t.Fatalf("delete range: %v", err)
+	}
+
+	want, err := hs.ScanContext(context.Background(), 10, 1200)
+	if err != nil {
+		t.Fatalf("ScanContext: %v", err)
+	}
+	got, err := hs.ScanKeySizesContext(context.Background(), 10, 1200, 0)
+	if err != nil {
+		t.Fatalf("ScanKeySizesContext: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("key scan returned %d keys, scan returned %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Key != want[i].Key || got[i].Size != len(want[i].Value) {
+			t.Fatalf("entry %d: got %+v, want key %d size %d", i, got[i], want[i].Key, len(want[i].Value))
+		}
+	}
+
+	keys := hs.ScanKeys(10, 1200)
+	if len(keys) != len(want) || keys[0] != want[0].Key || keys[len(keys)-1] != want[len(want)-1].Key {
+		t.Fatalf("ScanKeys returned %d keys, want %d", len(keys), len(want))
+	}
+	page, _ := hs.ScanKeySizesContext(context.Background(), 10, 1200, 5)
+	if len(page) != 5 || page[4].Key != want[4].Key {
+		t.Fatalf("limited key scan = %+v", page)
+	}
+}
+
+func TestGetsDuringCompactionNeverMiss(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	hs := NewHybridStore(cfg)
+	defer hs.Close()
+
+	records := sortedRecords(600)
+	for _, rec := range records {
+		hs.Put(rec.Key, rec.Value)
+	}
+	if err := hs.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+
+	stop := make(chan struct{})
+	var misses atomic.Int64
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := r; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				rec := records[i%len(records)]
+				if v, ok := hs.Get(rec.Key); !ok || string(v) != string(rec.Value) {
+					if misses.Add(1) == 1 {
+						t.Errorf("Get(%d) = %q, %v during compaction; want %q", rec.Key, v, ok, rec.Value)
+					}
+				}
+			}
+		}(r)
+	}
+
+	// Rewrites of the read keys with the same values and writes of other
+	// keys flush a table every 100 writes, so background compactions run
+	// alongside the full ones.
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 150; i++ {
+			rec := records[(round*150+i)%len(records)]
+			hs.Put(rec.Key, rec.Value)
+			hs.Put(rec.Key+1, []byte("other"))
+		}
+		if err := hs.Compact(); err != nil {
+			t.Errorf("Compact round %d: %v", round, err)
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if n := misses.Load(); n > 0 {
+		t.Fatalf("%d reads missed or returned a stale value while compacting", n)
+	}
+}
+
+func TestCheckpointSyncsDirectoryBeforeTruncatingWAL(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	quiet := WithLogger(logger.New(io.Discard, logger.LevelError))
+	walPath := filepath.Join(cfg.Storage.Path, backendName+".wal")
+
+	hs := NewHybridStore(cfg, quiet)
+	for _, rec := range sortedRecords(50) {
+		hs.Put(rec.Key, rec.Value)
+	}
+	hs.Close()
+	logged := fileSize(t, walPath)
+	if logged == 0 {
+		t.Fatalf("expected the writes in the WAL")
+	}
+
+	orig := syncPath
+	defer func() { syncPath = orig }()
+
+	// A directory sync that fails leaves the checkpoint unpublished, so the
+	// WAL must be kept.
+	syncPath = func(path string) error {
+		if path == cfg.Storage.Path {
+			return errors.New("injected sync failure")
+		}
+		return orig(path)
+	}
+	hs = NewHybridStore(cfg, quiet)
+	if got := fileSize(t, walPath); got != logged {
+		t.Fatalf("WAL is %d bytes after a failed checkpoint, want %d", got, logged)
+	}
+	if val, ok := hs.Get(30); !ok || string(val) != "v10" {
+		t.Fatalf("Get(30) = %q, %v after a failed checkpoint", val, ok)
+	}
+	hs.Close()
+
+	var syncs int
+	syncPath = func(path string) error {
+		if path == cfg.Storage.Path {
+			syncs++
+			tables, _ := filepath.Glob(filepath.Join(cfg.Storage.Path, "*-checkpoint.sst"))
+			if len(tables) == 0 {
+				t.Errorf("directory synced before the checkpoint table was published")
+			}
+			if got := fileSize(t, walPath); got != logged {
+				t.Errorf("WAL was %d bytes when the directory was synced, want %d", got, logged)
+			}
+		}
+		return orig(path)
+	}
+	hs = NewHybridStore(cfg, quiet)
+	defer hs.Close()
+	if syncs == 0 {
+		t.Fatalf("checkpoint never synced the data directory")
+	}
+	if got := fileSize(t, walPath); got != 0 {
+		t.Fatalf("WAL is %d bytes after the checkpoint, want 0", got)
+	}
+	if val, ok := hs.Get(30); !ok || string(val) != "v10" {
+		t.Fatalf("Get(30) = %q, %v after the checkpoint", val, ok)
+	}
+}
+
+func TestWALFlushIntervalFlushesSmallBatches(t *testing.T) {
+	open := func(interval time.Duration) *HybridStore {
+		cfg := testConfig(t)
+		cfg.Storage.WalBatchSize = 1000
+		cfg.Storage.WalFlushInterval = interval
+		hs := NewHybridStore(cfg)
+		t.Cleanup(hs.Close)
+		for k := 0; k < 3; k++ {
+			hs.Put(common.KeyType(k), []byte("v"))
+		}
+		return hs
+	}
+	slow, fast := open(time.Hour), open(5*time.Millisecond)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for fast.WALOffset() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("3 writes not in the WAL after 2s with a 5ms flush interval")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stats := fast.Stats()
+	if stats["wal_batch_flushes"].(uint64) == 0 || stats["wal_avg_batch_size"].(float64) > 3 {
+		t.Fatalf("unexpected WAL batch stats: flushes=%v avg=%v", stats["wal_batch_flushes"], stats["wal_avg_batch_size"])
+	}
+	// A part-filled batch waits for the interval.
+	time.Sleep(50 * time.Millisecond)
+	if off := slow.WALOffset(); off != 0 {
+		t.Fatalf("a 3-record batch reached the WAL (offset %d) long before a 1h interval", off)
+	}
+}
+
+func TestEstimateRangeCountAcrossShards(t *testing.T) {
+	cfg := testConfig(t)
+	hs := NewHybridStore(cfg)
+	defer hs.Close()
+
+	// Indexed tables after Compact, plus a few keys still in memtables.
+	for i := 0; i < 3000; i++ {
+		hs.Put(common.KeyType(i*i%100000), []byte("v"))
+	}
+	if err := hs.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		hs.Put(common.KeyType(200000+i), []byte("v"))
+	}
+
+	for _, r := range [][2]common.KeyType{{0, 100000}, {1000, 5000}, {40000, 40100}, {99000, 200020}, {300000, 400000}} {
+		want := len(hs.Scan(r[0], r[1]))
+		got, bound := hs.EstimateRangeCount(r[0], r[1])
+		if diff := got - want; diff > bound || -diff > bound {
+			t.Fatalf("[%d, %d]: estimate %d, true count %d, bound %d", r[0], r[1], got, want, bound)
+		}
+	}
+}
+
+func TestBloomFilterResizesPastDesignCapacity(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	cfg.System.BloomSize = 200
+	cfg.Storage.CompactionThreshold = 1000
+	hs := NewHybridStore(cfg, WithLogger(logger.New(io.Discard, logger.LevelError)))
+	defer hs.Close()
+
+	absentFP := func() float64 {
+		hs.shards[0].mutex.RLock()
+		bf := hs.shards[0].bloom
+		hs.shards[0].mutex.RUnlock()
+		passed := 0
+		for k := 0; k < 10000; k++ {
+			if bf.Contains(common.KeyType(1_000_000 + k)) {
+				passed++
+			}
+		}
+		return float64(passed) / 10000
+	}
+
+	// 10x the design count, flushed to L0 tables but not compacted yet.
+	for i := 0; i < 2000; i++ {
+		hs.Put(common.KeyType(i), []byte("v"))
+	}
+	if fp := absentFP(); fp < 0.5 {
+		t.Fatalf("test data too easy: 10x overfilled filter passes only %.3f of absent keys", fp)
+	}
+
+	if err := hs.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+
+	stats := hs.Stats()
+	if n := stats["bloom_resizes"].(uint64); n == 0 {
+		t.Fatalf("expected the filter to be resized")
+	}
+	if c := stats["bloom_capacity"].(uint); c < 2000 {
+		t.Fatalf("expected capacity for at least 2000 keys, got %d", c)
+	}
+	if e, c := stats["bloom_elements"].(uint), stats["bloom_capacity"].(uint); e > c {
+		t.Fatalf("resized filter already holds %d elements, designed for %d", e, c)
+	}
+	if fp := absentFP(); fp > 3*cfg.System.BloomFalseProb {
+		t.Fatalf("false positive rate %.3f after the resize, configured %.3f", fp, cfg.System.BloomFalseProb)
+	}
+	for i := 0; i < 2000; i++ {
+		if _, ok := hs.Get(common.KeyType(i)); !ok {
+			t.Fatalf("key %d lost after the resize", i)
+		}
+	}
+}
+
+func TestBottomCompactionDropsDeletedKeysFromBloom(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	hs := NewHybridStore(cfg)
+	defer hs.Close()
+
+	for i := 0; i < 2000; i++ {
+		hs.Put(common.KeyType(i), []byte("v"))
+	}
+	// Flushed with the deletes after it; a tombstone still in the memtable
+	// would not have removed anything from the tables yet.
+	if err := hs.DeleteRange(0, 100); err != nil {
+		t.Fatalf("delete range: %v", err)
+	}
+	for i := 500; i < 2000; i++ {
+		hs.Delete(common.KeyType(i))
+	}
+
+	passed := func() int {
+		hs.shards[0].mutex.RLock()
+		bf := hs.shards[0].bloom
+		hs.shards[0].mutex.RUnlock()
+		n := 0
+		for i := 0; i < 2000; i++ {
+			if (i < 100 || i >= 500) && bf.Contains(common.KeyType(i)) {
+				n++
+			}
+		}
+		return n
+	}
+	if n := passed(); n != 1600 {
+		t.Fatalf("expected every deleted key in the filter before compacting, got %d of 1600", n)
+	}
+
+	if err := hs.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	// 1600 deleted keys at a 1% false positive rate.
+	if n := passed(); n > 48 {
+		t.Fatalf("%d of 1600 deleted keys still pass the filter", n)
+	}
+	if e := hs.Stats()["bloom_elements"].(uint); e != 400 {
+		t.Fatalf("expected the 400 live keys in the filter, got %d elements", e)
+	}
+	for i := 100; i < 500; i++ {
+		if _, ok := hs.Get(common.KeyType(i)); !ok {
+			t.Fatalf("live key %d missing after the rebuild", i)
+		}
+	}
+}
+
+func TestWriteHeavyLoadDefersIndexTraining(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	cfg.System.AdaptiveReadWriteThreshold = 2
+	hs := NewHybridStore(cfg)
+	defer hs.Close()
+
+	hasIndex := func() bool {
+		hs.shards[0].mutex.RLock()
+		defer hs.shards[0].mutex.RUnlock()
+		return len(hs.shards[0].learnedIndexes) > 0
+	}
+
+	// Writes only: every compaction leaves the index for later.
+	for i := 0; i < 1000; i++ {
+		hs.Put(common.KeyType(i), []byte(fmt.Sprintf("v%d", i)))
+	}
+	if err := hs.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	stats := hs.Stats()
+	if hasIndex() || stats["index_decision"] != "defer" || stats["index_deferred_shards"] != 1 {
+		t.Fatalf("expected training deferred, got index=%v decision=%v deferred=%v", hasIndex(), stats["index_decision"], stats["index_deferred_shards"])
+	}
+	if n := stats["index_deferrals"].(uint64); n == 0 {
+		t.Fatalf("expected deferrals to be counted")
+	}
+
+	// Reads still find everything, and once they reach twice the writes
+	// the deferred index is trained.
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 1000; i++ {
+			if v, ok := hs.Get(common.KeyType(i)); !ok || string(v) != fmt.Sprintf("v%d", i) {
+				t.Fatalf("Get(%d) = %q, %v", i, v, ok)
+			}
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !hasIndex() {
+		if time.Now().After(deadline) {
+			t.Fatalf("deferred index not trained at rw_ratio %v", hs.Stats()["rw_ratio"])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d := hs.Stats()["index_decision"]; d != "train" {
+		t.Fatalf("expected decision train after the reads, got %v", d)
+	}
+	if _, ok := hs.Get(500); !ok {
+		t.Fatalf("Get(500) missing after training")
+	}
+}
+
+func TestL0BytesTriggerCompactionBeforeFileCount(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	cfg.Storage.CompactionThreshold = 100
+	cfg.Storage.L0CompactionBytes = 64 << 10
+	l := &recordingListener{events: make(chan Event, 16)}
+	hs := NewHybridStore(cfg, WithEventListener(l))
+	defer hs.Close()
+
+	// Each flush writes 100 values of 400 bytes, about 40KB: the second one
+	// crosses 64KB with 2 of 100 files.
+	value := bytes.Repeat([]byte("x"), 400)
+	for i := 0; i < 200; i++ {
+		hs.Put(common.KeyType(i), value)
+	}
+	for i := 0; i < 2; i++ {
+		if ev := nextEvent(t, l.events); ev.Kind != "flush" {
+			t.Fatalf("expected flush %d, got %+v", i+1, ev)
+		}
+	}
+	ev := nextEvent(t, l.events)
+	if ev.Kind != "compaction" || ev.Inputs != 2 {
+		t.Fatalf("expected a compaction of 2 L0 tables, got %+v", ev)
+	}
+	if st := hs.ShardStats()[0]; st["l0_sstable_count"] != 0 || st["l1_sstable_count"] != 1 {
+		t.Fatalf("expected L0 compacted into one L1 table, got %v", st)
+	}
+}
+
+func TestPeriodicCompactionCompactsIdleShards(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	cfg.Storage.CompactionInterval = 50 * time.Millisecond
+	l := &recordingListener{events: make(chan Event, 16)}
+	hs := NewHybridStore(cfg, WithEventListener(l))
+	defer hs.Close()
+
+	// Two flushes stay below compaction_threshold (4), then writes stop.
+	for i := 0; i < 200; i++ {
+		hs.Put(common.KeyType(i), []byte(fmt.Sprintf("v%d", i)))
+	}
+	if _, ok := hs.ShardStats()[0]["last_compaction_at"]; ok {
+		t.Fatal("expected no compaction before the timer")
+	}
+	for i := 0; i < 2; i++ {
+		if ev := nextEvent(t, l.events); ev.Kind != "flush" {
+			t.Fatalf("expected flush %d, got %+v", i+1, ev)
+		}
+	}
+	ev := nextEvent(t, l.events)
+	if ev.Kind != "compaction" || ev.Inputs != 2 {
+		t.Fatalf("expected the timer to compact 2 L0 tables, got %+v", ev)
+	}
+	st := hs.ShardStats()[0]
+	if st["l0_sstable_count"] != 0 || st["l1_sstable_count"] != 1 {
+		t.Fatalf("expected L0 compacted into one L1 table, got %v", st)
+	}
+	if at, ok := st["last_compaction_at"].(time.Time); !ok || time.Since(at) > time.Minute {
+		t.Fatalf("expected a recent last_compaction_at, got %v", st["last_compaction_at"])
+	}
+	for i := 0; i < 200; i++ {
+		if v, ok := hs.Get(common.KeyType(i)); !ok || string(v) != fmt.Sprintf("v%d", i) {
+			t.Fatalf("key %d after periodic compaction: %q, %v", i, v, ok)
+		}
+	}
+
+	// One table per shard is as compact as it gets: later ticks leave it.
+	time.Sleep(4 * cfg.Storage.CompactionInterval)
+	select {
+	case ev := <-l.events:
+		t.Fatalf("expected no further compaction, got %+v", ev)
+	default:
+	}
+}
+
+func TestGetPrefersUpdateFlushedAfterIndexBuilt(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	cfg.Storage.CompactionThreshold = 100
+	hs := NewHybridStore(cfg)
+	defer hs.Close()
+
+	for i := 0; i < 100; i++ {
+		hs.Put(common.KeyType(i), []byte("old"))
+	}
+	if err := hs.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if _, tr := hs.GetExplain(5); tr.Source != SourceLearnedIndex {
+		t.Fatalf("expected key 5 from the learned index, got %+v", tr)
+	}
+
+	// The update reaches an SSTable the index was not built from.
+	hs.Put(5, []byte("new"))
+	for i := 100; i < 199; i++ {
+		hs.Put(common.KeyType(i), []byte("filler"))
+	}
+	if n := hs.ShardStats()[0]["l0_sstable_count"]; n != 1 {
+		t.Fatalf("expected the update flushed to L0, got %v L0 tables", n)
+	}
+	val, tr := hs.GetExplain(5)
+	if string(val) != "new" || tr.Source != SourceSSTable {
+		t.Fatalf("expected the flushed update from its SSTable, got %q via %+v", val, tr)
+	}
+
+	hs.rebuildLearnedIndexFromSSTables(hs.shards[0])
+	if val, tr := hs.GetExplain(5); string(val) != "new" || tr.Source != SourceLearnedIndex {
+		t.Fatalf("expected the update from the rebuilt index, got %q via %+v", val, tr)
+	}
+}
+
+func TestOpenRefusesDataWithOtherShardCount(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 4
+	hs := NewHybridStore(cfg)
+	for i := 0; i < 1000; i++ {
+		hs.Put(common.KeyType(i), []byte("v"))
+	}
+	hs.Close()
+
+	other := *cfg
+	other.System.ShardCount = 2
+	if _, err := OpenHybridStore(&other); !errors.Is(err, ErrShardCount) {
+		t.Fatalf("expected ErrShardCount opening 4-shard data with 2 shards, got %v", err)
+	} else if !strings.Contains(err.Error(), "4 shards") || !strings.Contains(err.Error(), "reshard_on_open") {
+		t.Fatalf("error does not say what to do: %v", err)
+	}
+
+	// Refusing left the data routed as it was.
+	hs = NewHybridStore(cfg)
+	if got := hs.manifest.Sharding(); got != "splitmix64/4" {
+		t.Fatalf("routing changed by the refused open: %q", got)
+	}
+	if v, ok := hs.Get(999); !ok || string(v) != "v" {
+		t.Fatalf("key 999 lost after the refused open")
+	}
+	hs.Close()
+
+	other.System.ReshardOnOpen = true
+	hs, err := OpenHybridStore(&other)
+	if err != nil {
+		t.Fatalf("open with reshard_on_open: %v", err)
+	}
+	defer hs.Close()
+	for i := 0; i < 1000; i++ {
+		if v, ok := hs.Get(common.KeyType(i)); !ok || string(v) != "v" {
+			t.Fatalf("key %d not found after re-routing into 2 shards", i)
+		}
+	}
+}
+
+func TestReshardFourToEightShards(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 4
+	hs := NewHybridStore(cfg)
+	// Most keys are flushed to SSTables; the last few are only in the WAL.
+	for i := 0; i < 2050; i++ {
+		hs.Put(common.KeyType(i), []byte(fmt.Sprintf("v%d", i)))
+	}
+	hs.Delete(7)
+	hs.Close()
+
+	if err := Reshard(cfg, 8); err != nil {
+		t.Fatalf("Reshard: %v", err)
+	}
+
+	cfg.System.ShardCount = 8
+	hs, err := OpenHybridStore(cfg)
+	if err != nil {
+		t.Fatalf("open resharded store with 8 shards: %v", err)
+	}
+	defer hs.Close()
+	if got := hs.manifest.Sharding(); got != "splitmix64/8" {
+		t.Fatalf("expected routing splitmix64/8 recorded, got %q", got)
+	}
+	for i := 0; i < 2050; i++ {
+		v, ok := hs.Get(common.KeyType(i))
+		if i == 7 {
+			if ok {
+				t.Fatalf("deleted key 7 came back after resharding")
+			}
+			continue
+		}
+		if !ok || string(v) != fmt.Sprintf("v%d", i) {
+			t.Fatalf("Get(%d) = %q, %v after resharding", i, v, ok)
+		}
+	}
+	for _, shard := range hs.shards {
+		for _, sst := range shard.sstables {
+			for _, k := range appendTableKeys(nil, sst) {
+				if r := hs.route(k); r != shard.id {
+					t.Fatalf("key %d stored in shard %d, routes to %d", k, shard.id, r)
+				}
+			}
+		}
+		if len(shard.sstables) == 0 {
+			t.Fatalf("shard %d holds no tables", shard.id)
+		}
+	}
+}
+
+func TestStatsDoNotWaitForShardLocks(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 2
+	cfg.Storage.MemTableFlushThreshold = 200
+	cfg.Storage.CompactionThreshold = 2
+	hs := NewHybridStore(cfg)
+	defer hs.Close()
+
+	// A flush or compaction holding a shard's lock does not hold up Stats.
+	hs.shards[0].mutex.Lock()
+	done := make(chan struct{})
+	go func() {
+		hs.Stats()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		hs.shards[0].mutex.Unlock()
+		t.Fatal("Stats blocked on a locked shard")
+	}
+	hs.shards[0].mutex.Unlock()
+
+	// Under continuous flushes and compactions no Stats call takes long.
+	stop := make(chan struct{})
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			hs.Put(common.KeyType(i%5000), []byte("value"))
+		}
+	}()
+	var slowest time.Duration
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		start := time.Now()
+		hs.Stats()
+		if d := time.Since(start); d > slowest {
+			slowest = d
+		}
+	}
+	close(stop)
+	<-writerDone
+	if slowest > 500*time.Millisecond {
+		t.Fatalf("slowest Stats call took %v during compactions", slowest)
+	}
+	if st := hs.Stats(); st["learned_indexes_count"].(int) == 0 {
+		t.Fatalf("expected compactions to have built learned indexes, got %v", st)
+	}
+}
+
+func TestStartupStatsRecordRecovery(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	cfg.Storage.MemTableFlushThreshold = 100
+	hs := NewHybridStore(cfg)
+	// 100 records reach an SSTable; the last 50 are only in the WAL.
+	for i := 0; i < 150; i++ {
+		hs.Put(common.KeyType(i), []byte("v"))
+	}
+	hs.Close()
+
+	hs = NewHybridStore(cfg)
+	defer hs.Close()
+	st := hs.Startup()
+	if st.SSTablesRestored != 1 || st.IndexesLoaded+st.IndexesRebuilt != 1 {
+		t.Fatalf("expected 1 SSTable and its index restored, got %+v", st)
+	}
+	if st.WALRecords < 50 || st.WALBytes == 0 || st.Checkpoint == 0 {
+		t.Fatalf("expected the unflushed records replayed and checkpointed, got %+v", st)
+	}
+	if st.Total <= 0 || st.Total < st.SSTableRestore+st.IndexRestore+st.WALReplay+st.Checkpoint {
+		t.Fatalf("total %v does not cover the phases: %+v", st.Total, st)
+	}
+	fields, ok := hs.Stats()["startup"].(map[string]interface{})
+	if !ok || fields["wal_records_replayed"] != st.WALRecords || fields["total_ms"].(float64) <= 0 {
+		t.Fatalf("expected startup in stats, got %v", hs.Stats()["startup"])
+	}
+}
+
+func TestDisabledLearnedIndexRunsPlainLSM(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 2
+	cfg.Storage.MemTableFlushThreshold = 100
+	cfg.Storage.CompactionThreshold = 2
+	disabled := false
+	cfg.System.LearnedIndexEnabled = &disabled
+	hs := NewHybridStore(cfg)
+	for i := 0; i < 1000; i++ {
+		hs.Put(common.KeyType(i), []byte(fmt.Sprintf("v%d", i)))
+	}
+	for i := 0; i < 1000; i += 10 {
+		hs.Delete(common.KeyType(i))
+	}
+	if err := hs.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	// Left in the WAL for the next open to replay.
+	for i := 1000; i < 1200; i++ {
+		hs.Put(common.KeyType(i), []byte(fmt.Sprintf("v%d", i)))
+	}
+	hs.Close()
+
+	hs = NewHybridStore(cfg)
+	defer hs.Close()
+	check := func(when string) {
+		for i := 0; i < 1200; i++ {
+			val, ok := hs.Get(common.KeyType(i))
+			if want := i%10 != 0 || i >= 1000; ok != want || (ok && string(val) != fmt.Sprintf("v%d", i)) {
+				t.Fatalf("%s: Get(%d) = %q, %v", when, i, val, ok)
+			}
+		}
+		if n := len(hs.Scan(0, 1199)); n != 1100 {
+			t.Fatalf("%s: Scan returned %d records, want 1100", when, n)
+		}
+		if _, tr := hs.GetExplain(1); tr.Source != SourceSSTable {
+			t.Fatalf("%s: expected key 1 from an SSTable, got %+v", when, tr)
+		}
+		st := hs.Stats()
+		if st["learned_indexes_count"] != 0 || st["index_decision"] != "disabled" || st["index_deferrals"] != uint64(0) {
+			t.Fatalf("%s: expected no learned indexes, got %v", when, st)
+		}
+	}
+	check("after reopen")
+	if st := hs.Startup(); st.IndexesLoaded+st.IndexesRebuilt != 0 {
+		t.Fatalf("expected no indexes restored, got %+v", st)
+	}
+
+	for i := 1200; i < 1400; i++ {
+		hs.Put(common.KeyType(i), []byte(fmt.Sprintf("v%d", i)))
+	}
+	if err := hs.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	check("after compaction")
+	if files, _ := filepath.Glob(filepath.Join(cfg.Storage.Path, "*.li")); len(files) != 0 {
+		t.Fatalf("expected no learned index files, found %v", files)
+	}
+}
+
+func TestScanDoesNotHoldShardLockWhileReading(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	cfg.Storage.MemTableFlushThreshold = 100
+	cfg.Storage.CompactionThreshold = 2
+	hs := NewHybridStore(cfg)
+	defer hs.Close()
+	for i := 0; i < 550; i++ {
+		hs.Put(common.KeyType(i), []byte("old"))
+	}
+
+	// The scan stops at its first key until the writes below are done.
+	paused := make(chan struct{})
+	release := make(chan struct{})
+	scanned := make(chan map[common.KeyType]string, 1)
+	go func() {
+		got := make(map[common.KeyType]string)
+		hs.scanShards(context.Background(), 0, 549, 0, false, func(k common.KeyType, val common.ValueType, _ int) {
+			if len(got) == 0 {
+				close(paused)
+				<-release
+			}
+			got[k] = string(val)
+		})
+		scanned <- got
+	}()
+	<-paused
+
+	// Flushes and compactions replace every table the scan is reading.
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 550; i++ {
+			hs.Put(common.KeyType(i), []byte("new"))
+		}
+		done <- hs.Compact()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Compact: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("writes and compaction blocked behind a paused scan")
+	}
+	close(release)
+
+	got := <-scanned
+	if len(got) != 550 {
+		t.Fatalf("scan over compacted tables returned %d keys, want 550", len(got))
+	}
+	for k, v := range got {
+		if v != "old" {
+			t.Fatalf("scan saw %q for key %d written after it started", v, k)
+		}
+	}
+	if recs := hs.Scan(0, 549); len(recs) != 550 || string(recs[0].Value) != "new" {
+		t.Fatalf("expected the new values after the scan, got %d records", len(recs))
+	}
+}
+
+func TestReadsDuringCompactionsNeverSeeClosedTables(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 2
+	cfg.Storage.MemTableFlushThreshold = 100
+	cfg.Storage.CompactionThreshold = 2
+	hs := NewHybridStore(cfg)
+	defer hs.Close()
+	const keys = 1000
+	value := func(k int) []byte { return []byte(fmt.Sprintf("value-%d", k)) }
+	for i := 0; i < keys; i++ {
+		hs.Put(common.KeyType(i), value(i))
+	}
+
+	// Rewriting the same values keeps flushing and compacting the tables
+	// the readers are in, and full compactions replace all of them.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			hs.Put(common.KeyType(i%keys), value(i%keys))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := hs.Compact(); err != nil {
+				t.Errorf("Compact: %v", err)
+				return
+			}
+		}
+	}()
+
+	errs := make(chan error, 4)
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func(r int) {
+			defer readers.Done()
+			for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+				if r%2 == 0 {
+					recs := hs.Scan(0, keys-1)
+					if len(recs) != keys {
+						errs <- fmt.Errorf("scan returned %d of %d keys", len(recs), keys)
+						return
+					}
+					continue
+				}
+				for i := 0; i < keys; i += 7 {
+					if val, ok := hs.Get(common.KeyType(i)); !ok || !bytes.Equal(val, value(i)) {
+						errs <- fmt.Errorf("Get(%d) = %q, %v", i, val, ok)
+						return
+					}
+				}
+			}
+		}(r)
+	}
+	readers.Wait()
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestDeleteExistingReportsPresence(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	cfg.Storage.MemTableFlushThreshold = 100
+	hs := NewHybridStore(cfg)
+	defer hs.Close()
+	// Keys 0-99 are flushed to an SSTable; 100-109 stay in the memtable.
+	for i := 0; i < 110; i++ {
+		hs.Put(common.KeyType(i), []byte("v"))
+	}
+	hs.Delete(5)
+	if err := hs.DeleteRange(20, 30); err != nil {
+		t.Fatalf("delete range: %v", err)
+	}
+
+	for _, tc := range []struct {
+		key  common.KeyType
+		want bool
+	}{
+		{1, true},    // in an SSTable
+		{105, true},  // in the memtable
+		{5, false},   // deleted
+		{25, false},  // range-deleted
+		{500, false}, // never written
+		{1, false},   // deleted by the first call
+	} {
+		got, err := hs.DeleteExisting(tc.key)
+		if err != nil || got != tc.want {
+			t.Fatalf("DeleteExisting(%d) = %v, %v; want %v", tc.key, got, err, tc.want)
+		}
+		if _, ok := hs.Get(tc.key); ok {
+			t.Fatalf("key %d still readable after DeleteExisting", tc.key)
+		}
+	}
+
+	// Of concurrent deletes of one key, exactly one finds it.
+	hs.Put(7, []byte("v"))
+	var found atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := hs.DeleteExisting(7); ok {
+				found.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if found.Load() != 1 {
+		t.Fatalf("%d concurrent deletes reported the key existed, want 1", found.Load())
+	}
+}
+
+func TestGetWithStatusTellsDeletedFromAbsent(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	hs := NewHybridStore(cfg)
+	defer hs.Close()
+
+	// The 100th record flushes 1, 3's tombstone and 4-101 to an SSTable;
+	// 200 and the later deletes stay in the memtable.
+	hs.Put(1, []byte("v"))
+	hs.Put(3, []byte("v"))
+	hs.Delete(3)
+	for i := 4; i <= 101; i++ {
+		hs.Put(common.KeyType(i), []byte("v"))
+	}
+	hs.Put(200, []byte("v"))
+	hs.Delete(1)
+	hs.Delete(2)
+	if err := hs.DeleteRange(10, 20); err != nil {
+		t.Fatalf("delete range: %v", err)
+	}
+	if st := hs.ShardStats()[0]; st["l0_sstable_count"] != 1 || st["memtable_record_count"] != 3 {
+		t.Fatalf("expected one SSTable and 3 memtable records, got %v", st)
+	}
+
+	check := func(key common.KeyType, want common.KeyStatus) {
+		t.Helper()
+		val, st := hs.GetWithStatus(key)
+		if st != want || (st == common.KeyFound) != (val != nil) {
+			t.Fatalf("key %d: got %q, %v; want %v", key, val, st, want)
+		}
+		if _, ok := hs.Get(key); ok != (want == common.KeyFound) {
+			t.Fatalf("key %d: Get found = %v, want %v", key, ok, want == common.KeyFound)
+		}
+	}
+	check(4, common.KeyFound)    // in the SSTable
+	check(200, common.KeyFound)  // in the memtable
+	check(1, common.KeyDeleted)  // memtable tombstone over an SSTable value
+	check(2, common.KeyDeleted)  // tombstone for a key never written
+	check(3, common.KeyDeleted)  // tombstone in the SSTable
+	check(15, common.KeyDeleted) // range-deleted
+	check(500, common.KeyAbsent) // never written
+	check(-1, common.KeyAbsent)  // never written
+
+	// A full compaction drops the SSTable's tombstones, so key 3 is now
+	// absent; the memtable still says 1, 2 and 15 were deleted.
+	if err := hs.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	check(3, common.KeyAbsent)
+	check(1, common.KeyDeleted)
+	check(2, common.KeyDeleted)
+	check(15, common.KeyDeleted)
+	check(4, common.KeyFound)
+}
+
+func TestScanPageReportsTruncation(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Storage.MemTableFlushThreshold = 50
+	hs := NewHybridStore(cfg)
+	defer hs.Close()
+	// Keys 0, 2, ..., 198 over SSTables and memtables.
+	for i := 0; i < 100; i++ {
+		hs.Put(common.KeyType(i*2), []byte("v"))
+	}
+	hs.Delete(20)
+
+	for _, tc := range []struct {
+		name       string
+		start, end common.KeyType
+		limit      int
+		count      int
+		truncated  bool
+		next       common.KeyType
+	}{
+		{"under limit", 0, 9, 10, 5, false, 0},
+		{"exact limit", 0, 19, 10, 10, false, 0},
+		{"over limit", 0, 23, 10, 10, true, 22},
+		{"no limit", 0, 199, 0, 99, false, 0},
+	} {
+		res, err := hs.ScanPageContext(context.Background(), tc.start, tc.end, tc.limit)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if len(res.Records) != tc.count || res.Truncated != tc.truncated || res.NextKey != tc.next {
+			t.Fatalf("%s: %d records, truncated=%v next=%d; want %d, %v, %d",
+				tc.name, len(res.Records), res.Truncated, res.NextKey, tc.count, tc.truncated, tc.next)
+		}
+	}
+}
+
+func TestWALKeepsWriteOrderUnderBackpressure(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Storage.WalBufferSize = 1
+	cfg.Storage.WalBatchSize = 1
+	cfg.Storage.MemTableFlushThreshold = 1 << 20
+	hs := NewHybridStore(cfg)
+
+	// The queue holds one write and each is synced on its own, so nearly
+	// every Put finds it full.
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				hs.Put(7, []byte(fmt.Sprintf("g%d-%d", g, i)))
+			}
+		}()
+	}
+	wg.Wait()
+	last, ok := hs.Get(7)
+	if !ok {
+		t.Fatalf("key 7 missing after the writes")
+	}
+	for deadline := time.Now().Add(10 * time.Second); hs.pendingWrites() > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d writes still queued", hs.pendingWrites())
+		}
+	}
+	hs.Close()
+
+	// Nothing was flushed, so the value comes back from the WAL alone.
+	hs = NewHybridStore(cfg)
+	defer hs.Close()
+	if got, ok := hs.Get(7); !ok || string(got) != string(last) {
+		t.Fatalf("replayed value %q, want the last one written, %q", got, last)
+	}
+}
+
+func TestModelStatsReportCompactionTraining(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	hs := NewHybridStore(cfg)
+	defer hs.Close()
+	if ms := hs.ModelStats()[0]; ms != (ModelStats{}) {
+		t.Fatalf("expected no model before any build, got %+v", ms)
+	}
+
+	// Three flushed tables of 100 keys, compacted into one.
+	for i := 0; i < 300; i++ {
+		hs.Put(common.KeyType(i), []byte("v"))
+	}
+	if err := hs.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	ms := hs.ModelStats()[0]
+	want := model.NewRMIModel(1000).SizeInBytes()
+	if ms.RecordCount != 300 || ms.SizeBytes != want || ms.BuildMs <= 0 {
+		t.Fatalf("model stats = %+v, want 300 records in %d bytes and a build time", ms, want)
+	}
+	st := hs.ShardStats()[0]
+	if st["model_record_count"] != 300 || st["model_size_bytes"] != want || st["model_build_ms"] != ms.BuildMs {
+		t.Fatalf("shard stats = %v, want %+v", st, ms)
+	}
+	if got := hs.Stats()["learned_models"].([]ModelStats); len(got) != 1 || got[0] != ms {
+		t.Fatalf("stats learned_models = %+v, want [%+v]", got, ms)
+	}
+}
+
+func TestWritesRacingCloseAreLoggedOrRefused(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Storage.WalBufferSize = 1
+	hs := NewHybridStore(cfg)
+
+	const writers = 8
+	acked := make([][]common.KeyType, writers)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				key := common.KeyType(w*1_000_000 + i)
+				err := hs.Put(key, []byte("v"))
+				if errors.Is(err, ErrClosed) {
+					return
+				}
+				if err != nil {
+					t.Errorf("put %d: %v", key, err)
+					return
+				}
+				acked[w] = append(acked[w], key)
+			}
+		}(w)
+	}
+	time.Sleep(20 * time.Millisecond)
+	hs.Close()
+	wg.Wait()
+
+	if err := hs.Put(1, []byte("late")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("put after close: expected ErrClosed, got %v", err)
+	}
+	if err := hs.DeleteRange(0, 10); !errors.Is(err, ErrClosed) {
+		t.Fatalf("delete range after close: expected ErrClosed, got %v", err)
+	}
+
+	// Every acknowledged write reached the WAL before Close returned.
+	reopened := NewHybridStore(cfg)
+	defer reopened.Close()
+	total := 0
+	for _, keys := range acked {
+		total += len(keys)
+		for _, key := range keys {
+			if _, ok := reopened.Get(key); !ok {
+				t.Fatalf("acknowledged key %d lost across close", key)
+			}
+		}
+	}
+	if total == 0 {
+		t.Fatal("no write got in before close")
+	}
+}
+
+func TestResetIsAtomicUnderConcurrentReadsAndWrites(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Storage.WalBufferSize = 4
+	hs := NewHybridStore(cfg)
+
+	for k := common.KeyType(0); k < 500; k++ {
+		hs.Put(k, []byte("old"))
+	}
+
+	// Keys are split by when their Put ran: done before Reset started (must
+	// be gone) or started after it returned (must be kept).
+	var resetStarted, resetDone, stop atomic.Bool
+	const writers = 4
+	before := make([][]common.KeyType, writers)
+	after := make([][]common.KeyType, writers)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; !stop.Load(); i++ {
+				key := common.KeyType(1000 + w*1_000_000 + i)
+				startedAfter := resetDone.Load()
+				if err := hs.Put(key, []byte("v")); err != nil {
+					t.Errorf("put %d: %v", key, err)
+					return
+				}
+				switch {
+				case startedAfter:
+					after[w] = append(after[w], key)
+				case !resetStarted.Load():
+					before[w] = append(before[w], key)
+				}
+			}
+		}(w)
+	}
+	// Readers and Stats use the workload counters without the shard locks
+	// (run with -race).
+	for r := 0; r < 2; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; !stop.Load(); i++ {
+				hs.Get(common.KeyType(1000 + r*1_000_000 + i%1000))
+				if i%100 == 0 {
+					hs.Stats()
+				}
+			}
+		}(r)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	resetStarted.Store(true)
+	if err := hs.Reset(); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	resetDone.Store(true)
+	time.Sleep(20 * time.Millisecond)
+	stop.Store(true)
+	wg.Wait()
+
+	check := func(hs *HybridStore, when string) {
+		t.Helper()
+		for k := common.KeyType(0); k < 500; k++ {
+			if _, ok := hs.Get(k); ok {
+				t.Fatalf("%s: key %d written before the reset survived it", when, k)
+			}
+		}
+		for w := range before {
+			for _, key := range before[w] {
+				if _, ok := hs.Get(key); ok {
+					t.Fatalf("%s: key %d written before the reset survived it", when, key)
+				}
+			}
+			for _, key := range after[w] {
+				if _, ok := hs.Get(key); !ok {
+					t.Fatalf("%s: key %d written after the reset is missing", when, key)
+				}
+			}
+		}
+	}
+	check(hs, "after reset")
+	hs.Close()
+
+	// Nothing from before the reset is left in the WAL to replay.
+	reopened := NewHybridStore(cfg)
+	defer reopened.Close()
+	check(reopened, "after reopen")
+}
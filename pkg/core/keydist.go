@@ -0,0 +1,72 @@
+package core
+
+import (
+	"fmt"
+
+	"neurodb/pkg/common"
+)
+
+// KeyHistogram counts keys in Buckets equal-width buckets spanning
+// [Min, Max], the smallest and largest key counted. Bucket i holds the keys
+// from Min + i*BucketWidth up to the next bucket's start.
+type KeyHistogram struct {
+	Shard       int            `json:"shard"` // -1 for every shard
+	Min         common.KeyType `json:"min"`
+	Max         common.KeyType `json:"max"`
+	BucketWidth float64        `json:"bucket_width"`
+	Counts      []int          `json:"counts"`
+	Records     int            `json:"records"`
+}
+
+// KeyDistribution histograms the keys of the learned indexes of one shard,
+// or of every shard with shard -1, into buckets equal-width buckets. A flat
+// histogram suits the RMI's equal-width model buckets; dense spikes and
+// empty stretches show where they fit the keys poorly. Keys not yet indexed
+// (memtables, tables flushed since the last index) are not counted.
+func (hs *HybridStore) KeyDistribution(buckets, shard int) (KeyHistogram, error) {
+	if shard >= len(hs.shards) {
+		return KeyHistogram{}, fmt.Errorf("shard %d out of range (0-%d)", shard, len(hs.shards)-1)
+	}
+	if buckets <= 0 {
+		return KeyHistogram{}, fmt.Errorf("bucket count must be positive, got %d", buckets)
+	}
+
+	// Index key slices are never modified once built, so they are read
+	// without the shard locks.
+	var sets [][]common.KeyType
+	for i, s := range hs.shards {
+		if shard >= 0 && i != shard {
+			continue
+		}
+		s.mutex.RLock()
+		for _, li := range s.learnedIndexes {
+			if len(li.Keys) > 0 {
+				sets = append(sets, li.Keys)
+			}
+		}
+		s.mutex.RUnlock()
+	}
+
+	h := KeyHistogram{Shard: shard, Counts: make([]int, buckets)}
+	if len(sets) == 0 {
+		return h, nil
+	}
+	h.Min, h.Max = sets[0][0], sets[0][len(sets[0])-1]
+	for _, keys := range sets[1:] {
+		h.Min = min(h.Min, keys[0])
+		h.Max = max(h.Max, keys[len(keys)-1])
+	}
+
+	// The span can exceed int64, so offsets are taken as uint64.
+	span := float64(uint64(h.Max-h.Min)) + 1
+	h.BucketWidth = span / float64(buckets)
+	for _, keys := range sets {
+		for _, k := range keys {
+			b := int(float64(uint64(k-h.Min)) / h.BucketWidth)
+			h.Counts[min(b, buckets-1)]++
+		}
+		h.Records += len(keys)
+	}
+	h.Min, h.Max = hs.orderKey(h.Min), hs.orderKey(h.Max)
+	return h, nil
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+
+	"neurodb/pkg/common"
+	"neurodb/pkg/config"
+	"neurodb/pkg/storage"
+)
+
+// ErrKeyOrder is returned by OpenHybridStore for data written with another
+// system.key_order.
+var ErrKeyOrder = errors.New("core: data was written with another key_order")
+
+// orderKey maps a key between the caller's order and the one the store
+// sorts by. Every structure (memtables, SSTables, learned indexes, merges,
+// scan bounds) compares keys as signed integers; with unsigned key order the
+// sign bit is flipped on the way in, so their signed order is the caller's
+// unsigned order. It is its own inverse, so it also maps keys back out. The
+// WAL, and so the replication stream, carries keys as stored, i.e. flipped.
+func (hs *HybridStore) orderKey(k common.KeyType) common.KeyType {
+	return k ^ hs.keyFlip
+}
+
+// orderRecords maps the keys of records read from the store back to the
+// caller's order, in place.
+func (hs *HybridStore) orderRecords(records []common.Record) {
+	if hs.keyFlip == 0 {
+		return
+	}
+	for i := range records {
+		records[i].Key ^= hs.keyFlip
+	}
+}
+
+// FullRange returns the first and last key under the store's key order,
+// the bounds of a scan of every key: math.MinInt64 and math.MaxInt64, or 0
+// and -1 (the largest unsigned key) with unsigned order.
+func (hs *HybridStore) FullRange() (start, end common.KeyType) {
+	return hs.orderKey(math.MinInt64), hs.orderKey(math.MaxInt64)
+}
+
+// KeyOrder returns the store's key order, which keys built with the
+// common.KeyBuilder family must be built for to scan in field order.
+func (hs *HybridStore) KeyOrder() common.KeyOrder {
+	if hs.keyFlip != 0 {
+		return common.UnsignedOrder
+	}
+	return common.SignedOrder
+}
+
+// checkKeyOrder refuses data written with another key order, since its
+// keys would be read in the wrong places. A manifest with none recorded was
+// written with signed order. A store with no data yet takes the configured
+// order and records it.
+func (hs *HybridStore) checkKeyOrder() error {
+	want := config.KeyOrderSigned
+	if hs.conf.System.KeyOrder == config.KeyOrderUnsigned {
+		want = config.KeyOrderUnsigned
+		hs.keyFlip = math.MinInt64
+	}
+	recorded := hs.manifest.KeyOrder()
+	if recorded == "" {
+		recorded = config.KeyOrderSigned
+	}
+	if recorded == want {
+		return nil
+	}
+	if len(hs.manifest.Live()) == 0 && !hs.walHasEntries() {
+		return hs.manifest.Apply(storage.VersionEdit{KeyOrder: want})
+	}
+	return fmt.Errorf("%w: %s has %s key order, config has key_order %s; set key_order back to %s",
+		ErrKeyOrder, hs.conf.Storage.Path, recorded, want, recorded)
+}
+
+// walHasEntries reports whether the WAL holds anything to replay. It is
+// called before the backend is opened.
+func (hs *HybridStore) walHasEntries() bool {
+	info, err := os.Stat(storage.WALFile(filepath.Join(hs.layout.WAL, backendName)))
+	return err == nil && info.Size() > 0
+}
@@ -0,0 +1,153 @@
+package core
+
+import (
+	"errors"
+	"math"
+	"neurodb/pkg/common"
+	"neurodb/pkg/config"
+	"testing"
+)
+
+// ukey is the key holding u under unsigned order.
+func ukey(u uint64) common.KeyType {
+	return common.KeyType(u)
+}
+
+func TestUnsignedOrderScansAcrossSignBoundary(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.KeyOrder = config.KeyOrderUnsigned
+	hs := NewHybridStore(cfg)
+
+	// Enough keys on both sides of 1<<63 to flush and compact some of them;
+	// the rest stay in the memtables and the WAL.
+	const boundary = uint64(1) << 63
+	for u := boundary - 300; u < boundary+300; u++ {
+		hs.Put(ukey(u), []byte("v"))
+	}
+	hs.Put(ukey(1), []byte("low"))
+	hs.Put(ukey(math.MaxUint64), []byte("high"))
+
+	check := func(hs *HybridStore, when string) {
+		t.Helper()
+		recs := hs.Scan(ukey(boundary-5), ukey(boundary+4))
+		if len(recs) != 10 {
+			t.Fatalf("%s: expected 10 records across the boundary, got %d", when, len(recs))
+		}
+		for i, rec := range recs {
+			if want := ukey(boundary - 5 + uint64(i)); rec.Key != want {
+				t.Fatalf("%s: record %d has key %d, want %d", when, i, uint64(rec.Key), uint64(want))
+			}
+		}
+		first, last := hs.FullRange()
+		all := hs.Scan(first, last)
+		if len(all) != 602 || all[0].Key != ukey(1) || all[len(all)-1].Key != ukey(math.MaxUint64) {
+			t.Fatalf("%s: full scan returned %d records from %d to %d", when, len(all), uint64(all[0].Key), uint64(all[len(all)-1].Key))
+		}
+		if ks, err := hs.KeyspaceStats(); err != nil || ks.Min != ukey(1) || ks.Max != ukey(math.MaxUint64) {
+			t.Fatalf("%s: keyspace bounds %d..%d, %v", when, uint64(ks.Min), uint64(ks.Max), err)
+		}
+	}
+	check(hs, "before compaction")
+	if err := hs.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	check(hs, "after compaction")
+
+	// A range delete across the boundary removes exactly its keys.
+	if err := hs.DeleteRange(ukey(boundary-2), ukey(boundary+2)); err != nil {
+		t.Fatalf("delete range: %v", err)
+	}
+	recs := hs.Scan(ukey(boundary-3), ukey(boundary+2))
+	if len(recs) != 2 || recs[0].Key != ukey(boundary-3) || recs[1].Key != ukey(boundary+2) {
+		t.Fatalf("expected only the keys around the deleted range, got %v", recs)
+	}
+	hs.Put(ukey(boundary-1), []byte("v"))
+	hs.Put(ukey(boundary), []byte("v"))
+	hs.Put(ukey(boundary+1), []byte("v"))
+	hs.Delete(ukey(boundary - 2))
+	hs.Put(ukey(boundary-2), []byte("v"))
+	hs.Close()
+
+	// The WAL replays in the same order.
+	reopened := NewHybridStore(cfg)
+	check(reopened, "after reopen")
+	reopened.Close()
+
+	signed := *cfg
+	signed.System.KeyOrder = config.KeyOrderSigned
+	if _, err := OpenHybridStore(&signed); !errors.Is(err, ErrKeyOrder) {
+		t.Fatalf("opening unsigned data with signed order: expected ErrKeyOrder, got %v", err)
+	}
+}
+
+func TestKeyOrderCheckedWithOnlyWALData(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.KeyOrder = config.KeyOrderUnsigned
+	hs := NewHybridStore(cfg)
+	hs.Put(5, []byte("v"))
+	// Close leaves the write in the WAL only: nothing is flushed.
+	hs.Close()
+
+	signed := *cfg
+	signed.System.KeyOrder = config.KeyOrderSigned
+	if _, err := OpenHybridStore(&signed); !errors.Is(err, ErrKeyOrder) {
+		t.Fatalf("opening unsigned WAL data with signed order: expected ErrKeyOrder, got %v", err)
+	}
+
+	reopened := NewHybridStore(cfg)
+	defer reopened.Close()
+	if v, ok := reopened.Get(5); !ok || string(v) != "v" {
+		t.Fatalf("key 5 after reopening with its own order: got %q, %v", v, ok)
+	}
+}
+
+func TestBuiltKeysScanInFieldOrderUnderBothKeyOrders(t *testing.T) {
+	for _, order := range []string{config.KeyOrderSigned, config.KeyOrderUnsigned} {
+		t.Run(order, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.System.KeyOrder = order
+			hs := NewHybridStore(cfg)
+			defer hs.Close()
+
+			// The first field straddles the top bit of the packed value, and
+			// the second is signed.
+			type row struct {
+				hi  uint64
+				day int64
+			}
+			var rows []row
+			for _, hi := range []uint64{0, 1, 0x7f, 0x80, 0xff} {
+				for _, day := range []int64{-3, -1, 0, 2} {
+					rows = append(rows, row{hi, day})
+				}
+			}
+			ko := hs.KeyOrder()
+			for i := len(rows) - 1; i >= 0; i-- {
+				k, err := ko.Builder().Uint(rows[i].hi, 8).Int(rows[i].day, 8).Key()
+				if err != nil {
+					t.Fatalf("build %+v: %v", rows[i], err)
+				}
+				hs.Put(k, []byte("v"))
+			}
+
+			first, last := hs.FullRange()
+			recs := hs.Scan(first, last)
+			if len(recs) != len(rows) {
+				t.Fatalf("scan returned %d records, want %d", len(recs), len(rows))
+			}
+			for i, rec := range recs {
+				r := ko.Reader(rec.Key)
+				if got := (row{r.Uint(8), r.Int(8)}); got != rows[i] {
+					t.Fatalf("record %d is %+v, want %+v", i, got, rows[i])
+				}
+			}
+
+			// A prefix range holds exactly its rows.
+			k, _ := ko.Builder().Uint(0x80, 8).Key()
+			start, end := ko.PrefixRange(k, 8)
+			if recs := hs.Scan(start, end); len(recs) != 4 {
+				t.Fatalf("prefix scan returned %d records, want 4", len(recs))
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package core
+
+import (
+	"context"
+
+	"neurodb/pkg/common"
+)
+
+// KeyspaceStats describes the keys the store holds, over all shards and per
+// shard. Min and Max bound the stored keys: they come from the SSTables'
+// key ranges and the memtables' extremes, so a deleted key at either end
+// still counts until a compaction drops it. Keys counts live keys only.
+type KeyspaceStats struct {
+	ShardKeyspace
+	Shards []ShardKeyspace `json:"shards"`
+}
+
+// ShardKeyspace is one shard's part of KeyspaceStats, or the whole store's
+// with Shard -1. Empty is set when it stores no keys at all.
+type ShardKeyspace struct {
+	Shard int            `json:"shard"`
+	Min   common.KeyType `json:"min"`
+	Max   common.KeyType `json:"max"`
+	Empty bool           `json:"empty,omitempty"`
+	Keys  int            `json:"keys"`
+	// AvgGap is the mean distance between neighbouring keys, (Max-Min)/(Keys-1);
+	// Density is its inverse, keys per key of span. Both are 0 below 2 keys.
+	AvgGap  float64 `json:"avg_gap"`
+	Density float64 `json:"density"`
+}
+
+// KeyspaceStats reports the store's key bounds, live key count and density.
+func (hs *HybridStore) KeyspaceStats() (KeyspaceStats, error) {
+	return hs.KeyspaceStatsContext(context.Background())
+}
+
+// KeyspaceStatsContext is KeyspaceStats that gives up once ctx is done.
+// The bounds cost nothing to find; counting live keys reads every key.
+func (hs *HybridStore) KeyspaceStatsContext(ctx context.Context) (KeyspaceStats, error) {
+	ks := KeyspaceStats{
+		ShardKeyspace: ShardKeyspace{Shard: -1, Empty: true},
+		Shards:        make([]ShardKeyspace, len(hs.shards)),
+	}
+	for i, shard := range hs.shards {
+		sk := ShardKeyspace{Shard: shard.id, Empty: true}
+		v := shard.view.Load()
+		if lo, hi, ok := v.mem.Bounds(); ok {
+			sk.include(lo, hi)
+		}
+		for _, t := range v.tables {
+			if lo, hi, ok := t.KeyRange(); ok {
+				sk.include(lo, hi)
+			}
+		}
+		if !sk.Empty {
+			err := hs.scanShard(ctx, shard, sk.Min, sk.Max, 0, true, func(common.KeyType, common.ValueType, int) {
+				sk.Keys++
+			})
+			if err != nil {
+				return KeyspaceStats{}, err
+			}
+			sk.setDensity()
+			ks.include(sk.Min, sk.Max)
+			ks.Keys += sk.Keys
+			sk.Min, sk.Max = hs.orderKey(sk.Min), hs.orderKey(sk.Max)
+		}
+		ks.Shards[i] = sk
+	}
+	ks.setDensity()
+	if !ks.Empty {
+		ks.Min, ks.Max = hs.orderKey(ks.Min), hs.orderKey(ks.Max)
+	}
+	return ks, nil
+}
+
+func (sk *ShardKeyspace) include(lo, hi common.KeyType) {
+	if sk.Empty || lo < sk.Min {
+		sk.Min = lo
+	}
+	if sk.Empty || hi > sk.Max {
+		sk.Max = hi
+	}
+	sk.Empty = false
+}
+
+func (sk *ShardKeyspace) setDensity() {
+	if sk.Keys < 2 {
+		return
+	}
+	// The span can exceed int64, so it is taken as uint64.
+	sk.AvgGap = float64(uint64(sk.Max-sk.Min)) / float64(sk.Keys-1)
+	if sk.AvgGap > 0 {
+		sk.Density = 1 / sk.AvgGap
+	}
+}
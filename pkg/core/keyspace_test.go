@@ -0,0 +1,57 @@
+package core
+
+import (
+	"neurodb/pkg/common"
+	"testing"
+)
+
+func TestKeyspaceStatsSpanMemtableAndSSTables(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	hs := NewHybridStore(cfg)
+	defer hs.Close()
+
+	if ks, err := hs.KeyspaceStats(); err != nil || !ks.Empty || ks.Keys != 0 {
+		t.Fatalf("expected an empty keyspace, got %+v, %v", ks, err)
+	}
+
+	// The smallest key is flushed to an SSTable with the first 100 writes;
+	// the largest stays in the memtable.
+	hs.Put(-5000, []byte("low"))
+	for i := 0; i < 149; i++ {
+		hs.Put(common.KeyType(i*10), []byte("v"))
+	}
+	hs.Put(90000, []byte("high"))
+	hs.Delete(10)
+	st := hs.ShardStats()[0]
+	if st["l0_sstable_count"] != 1 || st["memtable_record_count"] == 0 {
+		t.Fatalf("expected data in both an SSTable and the memtable, got %v", st)
+	}
+
+	ks, err := hs.KeyspaceStats()
+	if err != nil {
+		t.Fatalf("KeyspaceStats: %v", err)
+	}
+	if ks.Empty || ks.Min != -5000 || ks.Max != 90000 {
+		t.Fatalf("expected keys in [-5000, 90000], got %+v", ks.ShardKeyspace)
+	}
+	if ks.Keys != 150 {
+		t.Fatalf("expected 150 live keys, got %d", ks.Keys)
+	}
+	if want := 95000.0 / 149; ks.AvgGap != want || ks.Density != 1/want {
+		t.Fatalf("expected avg gap %v, got %v (density %v)", want, ks.AvgGap, ks.Density)
+	}
+	if sh := ks.Shards[0]; sh.Shard != 0 || sh.Min != ks.Min || sh.Max != ks.Max || sh.Keys != ks.Keys {
+		t.Fatalf("expected shard 0 to match the store, got %+v", sh)
+	}
+
+	// After a compaction the bounds cover its table and newer writes.
+	if err := hs.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	hs.Put(-6000, []byte("lower"))
+	ks, err = hs.KeyspaceStats()
+	if err != nil || ks.Min != -6000 || ks.Max != 90000 || ks.Keys != 151 {
+		t.Fatalf("expected 151 keys in [-6000, 90000], got %+v, %v", ks.ShardKeyspace, err)
+	}
+}
@@ -0,0 +1,94 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+
+	"neurodb/pkg/config"
+	"neurodb/pkg/storage"
+)
+
+// Layout says which directory each kind of file goes in. The manifest and
+// learned-index models stay in Dir; the WAL and each level's SSTables can be
+// put on other volumes.
+type Layout struct {
+	Dir string
+	WAL string
+	L0  string
+	L1  string
+}
+
+// LayoutOf resolves the storage config's paths: wal_path and sstable_path
+// default to path, and l0_path to sstable_path.
+func LayoutOf(s config.StorageConfig) Layout {
+	l := Layout{Dir: s.Path, WAL: s.WALPath, L0: s.L0Path, L1: s.SSTablePath}
+	if l.WAL == "" {
+		l.WAL = l.Dir
+	}
+	if l.L1 == "" {
+		l.L1 = l.Dir
+	}
+	if l.L0 == "" {
+		l.L0 = l.L1
+	}
+	return l
+}
+
+// Dirs lists each distinct directory of the layout once.
+func (l Layout) Dirs() []string {
+	return distinct(l.Dir, l.WAL, l.L0, l.L1)
+}
+
+// TableDirs lists each distinct SSTable directory once.
+func (l Layout) TableDirs() []string {
+	return distinct(l.L0, l.L1)
+}
+
+// TableDir is where new tables of level are written.
+func (l Layout) TableDir(level int) string {
+	if level == 0 {
+		return l.L0
+	}
+	return l.L1
+}
+
+// TablePath finds the live table meta. It is looked for in its level's
+// directory first and then in the others, so tables written before the
+// layout changed are still found; a table found nowhere gets the path it
+// would have in its level's directory.
+func (l Layout) TablePath(meta storage.FileMeta) string {
+	want := filepath.Join(l.TableDir(meta.Level), meta.Name)
+	if _, err := os.Stat(want); err == nil {
+		return want
+	}
+	for _, dir := range distinct(l.L0, l.L1, l.Dir) {
+		path := filepath.Join(dir, meta.Name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return want
+}
+
+// globTables matches pattern in every SSTable directory, and in Dir for
+// tables written before the layout changed.
+func (l Layout) globTables(pattern string) []string {
+	var out []string
+	for _, dir := range distinct(l.L0, l.L1, l.Dir) {
+		files, _ := filepath.Glob(filepath.Join(dir, pattern))
+		out = append(out, files...)
+	}
+	return out
+}
+
+func distinct(dirs ...string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, d := range dirs {
+		if c := filepath.Clean(d); !seen[c] {
+			seen[c] = true
+			out = append(out, d)
+		}
+	}
+	return out
+}
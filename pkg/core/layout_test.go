@@ -0,0 +1,71 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+
+	"neurodb/pkg/common"
+	"neurodb/pkg/storage"
+)
+
+func TestLayoutPlacesFilesByKind(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	cfg.Storage.WALPath = t.TempDir()
+	cfg.Storage.SSTablePath = t.TempDir()
+	cfg.Storage.L0Path = t.TempDir()
+
+	glob := func(dir, pattern string) []string {
+		files, _ := filepath.Glob(filepath.Join(dir, pattern))
+		return files
+	}
+
+	hs := NewHybridStore(cfg)
+	for k := 0; k < 250; k++ {
+		hs.Put(common.KeyType(k), []byte("v"))
+	}
+	if n := len(glob(cfg.Storage.L0Path, "shard-0-l0-*.sst")); n != 2 {
+		t.Fatalf("expected 2 flushed tables in l0_path, found %d", n)
+	}
+	if err := hs.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	hs.Close()
+
+	if n := len(glob(cfg.Storage.SSTablePath, "shard-0-l1-*.sst")); n != 1 {
+		t.Fatalf("expected the compacted table in sstable_path, found %d", n)
+	}
+	if files := glob(cfg.Storage.L0Path, "*.sst"); len(files) != 0 {
+		t.Fatalf("compacted L0 tables left behind: %v", files)
+	}
+	if len(glob(cfg.Storage.WALPath, backendName+".wal")) != 1 {
+		t.Fatalf("WAL not in wal_path")
+	}
+	if len(glob(cfg.Storage.Path, storage.ManifestName)) != 1 {
+		t.Fatalf("manifest not in path")
+	}
+	if files := glob(cfg.Storage.Path, "*.sst"); len(files) != 0 {
+		t.Fatalf("tables written to path: %v", files)
+	}
+	report, err := VerifyLayout(LayoutOf(cfg.Storage), false)
+	if err != nil || !report.OK() {
+		t.Fatalf("VerifyLayout: %+v, %v", report, err)
+	}
+
+	// Dropping l0_path still finds every table, and new flushes go to
+	// sstable_path.
+	cfg.Storage.L0Path = ""
+	hs = NewHybridStore(cfg)
+	defer hs.Close()
+	for k := 0; k < 250; k++ {
+		if _, ok := hs.Get(common.KeyType(k)); !ok {
+			t.Fatalf("key %d lost after reopening", k)
+		}
+	}
+	for k := 1000; k < 1100; k++ {
+		hs.Put(common.KeyType(k), []byte("v"))
+	}
+	if n := len(glob(cfg.Storage.SSTablePath, "shard-0-l0-*.sst")); n != 1 {
+		t.Fatalf("expected a flushed table in sstable_path, found %d", n)
+	}
+}
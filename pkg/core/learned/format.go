@@ -0,0 +1,166 @@
+package learned
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"neurodb/pkg/common"
+	"neurodb/pkg/model"
+	"os"
+)
+
+// .li file layout (little endian):
+//
+//	[Magic "NLIX" 4B] [Version 2B]
+//	[Fanout 4B] [GlobalMin 8B] [GlobalMax 8B] [MinErr 8B] [MaxErr 8B] [Count 8B]
+//	Fanout x [Slope Intercept N MeanX MeanY Cxy Cxx (float64 each) Origin MinPos MaxPos (int64 each)]
+//
+// A Fanout of 0 is an index without a model (see Options.MinModelKeys).
+//
+// Only the model is stored; keys and value locations come from the SSTables
+// it was trained on and are attached after loading (see Attach).
+
+// FormatVersion history: 1 = initial; 2 = per-bucket position bounds;
+// 3 = centered (Welford) bucket regressions with a key origin.
+const FormatVersion uint16 = 3
+
+var formatMagic = [4]byte{'N', 'L', 'I', 'X'}
+
+// ErrFormatVersion is returned by Load for files written in another format version.
+var ErrFormatVersion = errors.New("learned: unsupported index format version")
+
+// maxFanout bounds the bucket count read from disk so a corrupt header cannot
+// trigger a huge allocation.
+const maxFanout = 1 << 20
+
+func (li *LearnedIndex) Save(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := li.encode(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (li *LearnedIndex) encode(w io.Writer) error {
+	m := li.Model
+	if m == nil {
+		m = &model.RMIModel{}
+	}
+	header := []interface{}{
+		formatMagic,
+		FormatVersion,
+		uint32(m.Fanout),
+		int64(m.GlobalMin),
+		int64(m.GlobalMax),
+		int64(li.MinErr),
+		int64(li.MaxErr),
+		uint64(li.Size()),
+	}
+	for _, v := range header {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	for i, b := range m.Buckets {
+		params := [7]float64{b.Slope, b.Intercept, b.N, b.MeanX, b.MeanY, b.Cxy, b.Cxx}
+		if err := binary.Write(w, binary.LittleEndian, params); err != nil {
+			return err
+		}
+		bounds := [3]int64{int64(b.Origin), int64(m.MinPos[i]), int64(m.MaxPos[i])}
+		if err := binary.Write(w, binary.LittleEndian, bounds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load reads a model written by Save. The returned index has no keys until
+// Attach is called with the data it was trained on.
+func Load(filename string) (*LearnedIndex, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decode(bufio.NewReader(f))
+}
+
+func decode(r io.Reader) (*LearnedIndex, error) {
+	var magic [4]byte
+	if err := binary.Read(r, binary.LittleEndian, &magic); err != nil {
+		return nil, err
+	}
+	if magic != formatMagic {
+		return nil, errors.New("learned: not a learned index file")
+	}
+	var version uint16
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return nil, err
+	}
+	if version != FormatVersion {
+		return nil, fmt.Errorf("%w %d (want %d)", ErrFormatVersion, version, FormatVersion)
+	}
+
+	var hdr struct {
+		Fanout    uint32
+		GlobalMin int64
+		GlobalMax int64
+		MinErr    int64
+		MaxErr    int64
+		Count     uint64
+	}
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if hdr.Fanout > maxFanout {
+		return nil, fmt.Errorf("learned: invalid fanout %d", hdr.Fanout)
+	}
+	if hdr.Fanout == 0 {
+		return &LearnedIndex{MinErr: int(hdr.MinErr), MaxErr: int(hdr.MaxErr), expected: int(hdr.Count)}, nil
+	}
+
+	m := model.NewRMIModel(int(hdr.Fanout))
+	m.GlobalMin = common.KeyType(hdr.GlobalMin)
+	m.GlobalMax = common.KeyType(hdr.GlobalMax)
+	for i := range m.Buckets {
+		var p [7]float64
+		if err := binary.Read(r, binary.LittleEndian, &p); err != nil {
+			return nil, err
+		}
+		var bounds [3]int64
+		if err := binary.Read(r, binary.LittleEndian, &bounds); err != nil {
+			return nil, err
+		}
+		m.Buckets[i] = model.LinearModel{Slope: p[0], Intercept: p[1], N: p[2], MeanX: p[3], MeanY: p[4], Cxy: p[5], Cxx: p[6], Origin: common.KeyType(bounds[0])}
+		m.MinPos[i], m.MaxPos[i] = int(bounds[1]), int(bounds[2])
+	}
+	return &LearnedIndex{
+		Model:    m,
+		MinErr:   int(hdr.MinErr),
+		MaxErr:   int(hdr.MaxErr),
+		expected: int(hdr.Count),
+	}, nil
+}
+
+// Attach supplies the sorted keys (and where their values live) that a
+// loaded model was trained on.
+func (li *LearnedIndex) Attach(keys []common.KeyType, locs []Location, sources []ValueReader) error {
+	if len(keys) != li.expected || len(locs) != len(keys) {
+		return fmt.Errorf("learned: model trained on %d keys, got %d", li.expected, len(keys))
+	}
+	li.Keys = keys
+	li.locs = locs
+	li.sources = sources
+	return nil
+}
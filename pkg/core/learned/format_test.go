@@ -0,0 +1,81 @@
+package learned
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"neurodb/pkg/common"
+)
+
+func sampleRecords(n int) []common.Record {
+	recs := make([]common.Record, n)
+	for i := range recs {
+		recs[i] = common.Record{Key: common.KeyType(i * 7), Value: []byte(fmt.Sprintf("v%d", i))}
+	}
+	return recs
+}
+
+func TestSaveLoadRoundTrip(t *testing.T) {
+	recs := sampleRecords(5000)
+	li := Build(recs, Options{})
+	path := filepath.Join(t.TempDir(), "shard-0-x.li")
+	if err := li.Save(path); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if st.Size() > int64(li.Model.Fanout*10*8+64) {
+		t.Fatalf("expected model-only file, got %d bytes", st.Size())
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if loaded.MinErr != li.MinErr || loaded.MaxErr != li.MaxErr || loaded.Model.GlobalMax != li.Model.GlobalMax {
+		t.Fatalf("model header mismatch: got %+v want %+v", loaded, li)
+	}
+	if err := loaded.Attach(li.Keys[:10], li.locs[:10], li.sources); err == nil {
+		t.Fatalf("expected attach to reject a key set of the wrong size")
+	}
+	if err := loaded.Attach(li.Keys, li.locs, li.sources); err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	for _, i := range []int{0, 1, 2500, 4999} {
+		if v, ok := loaded.Get(recs[i].Key); !ok || string(v) != string(recs[i].Value) {
+			t.Fatalf("get key=%d after load: ok=%v val=%q", recs[i].Key, ok, v)
+		}
+	}
+}
+
+func TestLoadRejectsOtherVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shard-0-x.li")
+	if err := Build(sampleRecords(100), Options{}).Save(path); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	binary.LittleEndian.PutUint16(data[4:6], FormatVersion+1)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := Load(path); !errors.Is(err, ErrFormatVersion) {
+		t.Fatalf("expected ErrFormatVersion, got %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("gob-encoded legacy data"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Fatalf("expected legacy file to be rejected")
+	}
+}
@@ -1,11 +1,10 @@
 package learned
 
 import (
-	"encoding/gob"
+	"fmt"
 	"math/rand"
 	"neurodb/pkg/common"
 	"neurodb/pkg/model"
-	"os"
 	"sort"
 	"time"
 )
@@ -17,85 +16,277 @@ type DiagnosticPoint struct {
 	Error        int
 }
 
+// ValueReader resolves a value stored at an offset, e.g. a record in an SSTable.
+type ValueReader interface {
+	ValueAt(offset int64) (common.ValueType, error)
+}
+
+// Location says where the value for Keys[i] lives: Sources[Source] at Offset.
+type Location struct {
+	Source int32
+	Offset int64
+}
+
+// LearnedIndex is a model over sorted keys. It keeps only the keys and the
+// location of each value; values are read from the underlying sources.
 type LearnedIndex struct {
-	Records []common.Record // 原始数据
+	Keys    []common.KeyType
 	Model   *model.RMIModel
 	MinErr  int
 	MaxErr  int
+	locs    []Location
+	sources []ValueReader
+
+	// Tombstones are range deletes older than every key in the index, e.g.
+	// replayed from the WAL with its records. They are not persisted.
+	Tombstones []common.RangeTombstone
+
+	// RetrainWindow is the Window above which Append retrains the model
+	// rather than keep widening its bounds; 0 means DefaultRetrainWindow and
+	// a negative value never retrains. It is not persisted.
+	RetrainWindow int
+
+	// MinModelKeys is the fewest keys Retrain fits a model to; 0 means
+	// DefaultMinModelKeys. Build sets it from its Options. It is not
+	// persisted.
+	MinModelKeys int
+
+	expected      int // key count a loaded model was trained on
+	trainedWindow int // Window right after the last Retrain
+}
+
+// memValues serves values kept in memory (e.g. records replayed from the WAL
+// that are not in any SSTable yet). The offset is the value's index.
+type memValues []common.ValueType
+
+func (m memValues) ValueAt(offset int64) (common.ValueType, error) {
+	if offset < 0 || offset >= int64(len(m)) {
+		return nil, fmt.Errorf("learned: value offset %d out of range", offset)
+	}
+	return m[offset], nil
+}
+
+// Options tune how Build and BuildFromSources train an index.
+type Options struct {
+	// MinModelKeys is the fewest keys a model is fit to; 0 means
+	// DefaultMinModelKeys. Below it the index has no Model and lookups
+	// binary-search the sorted keys: a 1000-bucket model over a handful of
+	// keys is mostly empty buckets and predicts no better than the search.
+	MinModelKeys int
+}
+
+// DefaultMinModelKeys is the MinModelKeys of an index built with zero Options.
+const DefaultMinModelKeys = 64
+
+// Build indexes records held in memory.
+func Build(data []common.Record, opts Options) *LearnedIndex {
+	li := BuildUntrained(data)
+	li.MinModelKeys = opts.MinModelKeys
+	li.Retrain()
+	return li
 }
 
-func Build(data []common.Record) *LearnedIndex {
+// BuildUntrained is Build without a model: lookups binary-search the keys,
+// as in an index under its MinModelKeys.
+func BuildUntrained(data []common.Record) *LearnedIndex {
 	sort.Slice(data, func(i, j int) bool {
 		return data[i].Key < data[j].Key
 	})
 
 	keys := make([]common.KeyType, len(data))
+	locs := make([]Location, len(data))
+	values := make(memValues, len(data))
 	for i, r := range data {
 		keys[i] = r.Key
+		locs[i] = Location{Offset: int64(i)}
+		values[i] = r.Value
+	}
+	li := &LearnedIndex{
+		Keys:    keys,
+		locs:    locs,
+		sources: []ValueReader{values},
+	}
+	li.trainedWindow = li.Window()
+	return li
+}
+
+// BuildFromSources indexes sorted keys whose values live in sources.
+func BuildFromSources(keys []common.KeyType, locs []Location, sources []ValueReader, opts Options) *LearnedIndex {
+	li := &LearnedIndex{
+		Keys:         keys,
+		locs:         locs,
+		sources:      sources,
+		MinModelKeys: opts.MinModelKeys,
+	}
+	li.Retrain()
+	return li
+}
+
+// minModelKeys is MinModelKeys with its default applied.
+func (li *LearnedIndex) minModelKeys() int {
+	if li.MinModelKeys <= 0 {
+		return DefaultMinModelKeys
+	}
+	return li.MinModelKeys
+}
+
+// Retrain fits a new model to all keys and recomputes the error bounds from
+// scratch, undoing any widening by Append.
+func (li *LearnedIndex) Retrain() {
+	if len(li.Keys) < li.minModelKeys() {
+		li.Model = nil
+		li.MinErr, li.MaxErr = 0, 0
+		li.trainedWindow = li.Window()
+		return
+	}
+	li.Model = model.NewRMIModel(1000)
+	li.Model.Train(li.Keys)
+	li.MinErr, li.MaxErr = 0, 0
+	li.widenBounds(0)
+	li.trainedWindow = li.Window()
+}
+
+// ModelSize is the size of the index's model in bytes, 0 without one.
+func (li *LearnedIndex) ModelSize() int {
+	if li.Model == nil {
+		return 0
 	}
+	return li.Model.SizeInBytes()
+}
 
-	rmi := model.NewRMIModel(1000)
-	rmi.Train(keys)
+// HasModel reports whether the index has a model, or searches its keys.
+func (li *LearnedIndex) HasModel() bool {
+	return li.Model != nil
+}
 
-	minErr, maxErr := 0, 0
-	for i, key := range keys {
-		predictedPos := rmi.Predict(key)
-		actualPos := i
-		err := actualPos - predictedPos
+// predict is the model's position for key or, without a model, the exact
+// position of the first key >= key.
+func (li *LearnedIndex) predict(key common.KeyType) int {
+	if li.Model == nil {
+		return sort.Search(len(li.Keys), func(i int) bool { return li.Keys[i] >= key })
+	}
+	return li.Model.Predict(key)
+}
 
-		if err < minErr {
-			minErr = err
+// widenBounds widens MinErr/MaxErr to cover the keys from position from on.
+func (li *LearnedIndex) widenBounds(from int) {
+	for i := from; i < len(li.Keys); i++ {
+		err := i - li.predict(li.Keys[i])
+		if err < li.MinErr {
+			li.MinErr = err
 		}
-		if err > maxErr {
-			maxErr = err
+		if err > li.MaxErr {
+			li.MaxErr = err
 		}
 	}
+}
 
-	return &LearnedIndex{
-		Records: data,
-		Model:   rmi,
-		MinErr:  minErr,
-		MaxErr:  maxErr,
-	}
+// Window is how many keys a lookup may have to search around the model's
+// prediction: the width of the error bounds.
+func (li *LearnedIndex) Window() int {
+	return li.MaxErr - li.MinErr + 1
 }
 
+// DefaultRetrainWindow is the error window width above which Append retrains
+// an index whose RetrainWindow is 0.
+const DefaultRetrainWindow = 64
+
+// Append adds records with keys above the current maximum. Their values are
+// kept in memory since they are not in any backing source yet.
 func (li *LearnedIndex) Append(newData []common.Record) {
 	if len(newData) == 0 {
 		return
 	}
 
-	startPos := len(li.Records)
-	li.Records = append(li.Records, newData...)
+	startPos := len(li.Keys)
+	src := int32(len(li.sources))
+	values := make(memValues, len(newData))
+	for i, rec := range newData {
+		li.Keys = append(li.Keys, rec.Key)
+		li.locs = append(li.locs, Location{Source: src, Offset: int64(i)})
+		values[i] = rec.Value
+	}
+	li.sources = append(li.sources, values)
+
+	if li.Model == nil {
+		// Still searched directly until there are keys enough for a model.
+		if len(li.Keys) >= li.minModelKeys() {
+			li.Retrain()
+		}
+		return
+	}
 
+	// Updating a bucket's model moves its predictions for the keys already
+	// in it too, so the bounds are rechecked from the first bucket touched.
+	from := startPos
+	if b := li.Model.Bucket(newData[0].Key); li.Model.Buckets[b].N > 0 {
+		from = li.Model.MinPos[b]
+	}
 	for i, rec := range newData {
 		globalPos := startPos + i
 		li.Model.Update(rec.Key, globalPos)
 	}
+	li.widenBounds(from)
 
-	for i, rec := range newData {
-		globalPos := startPos + i
-		predPos := li.Model.Predict(rec.Key)
-		err := globalPos - predPos
+	// Bounds only widen here. Past the limit, a fresh model over all the
+	// keys is cheaper than the scans the wide window would cost.
+	limit := li.RetrainWindow
+	if limit == 0 {
+		limit = DefaultRetrainWindow
+	}
+	// If retraining could not get under the limit either, wait for the window
+	// to double before trying again.
+	if limit > 0 && li.Window() > max(limit, 2*li.trainedWindow) {
+		li.Retrain()
+	}
+}
 
-		if err < li.MinErr {
-			li.MinErr = err
-		}
-		if err > li.MaxErr {
-			li.MaxErr = err
+func (li *LearnedIndex) valueAt(i int) (common.ValueType, error) {
+	loc := li.locs[i]
+	return li.sources[loc.Source].ValueAt(loc.Offset)
+}
+
+// GetAllRecords reads every indexed record back from its source.
+func (li *LearnedIndex) GetAllRecords() []common.Record {
+	out := make([]common.Record, 0, len(li.Keys))
+	for i, k := range li.Keys {
+		if v, err := li.valueAt(i); err == nil {
+			out = append(out, common.Record{Key: k, Value: v})
 		}
 	}
+	return out
 }
 
-func (li *LearnedIndex) GetAllRecords() []common.Record {
-	return li.Records
+// Probe describes one lookup: the position the model predicted, the window
+// [Low, High] of Keys searched around it after clamping the error bounds, and
+// where the key was found (-1 if it was not).
+type Probe struct {
+	Predicted int
+	Low       int
+	High      int
+	Found     int
 }
 
-func (li *LearnedIndex) Get(key common.KeyType) (common.ValueType, bool) {
-	if len(li.Records) == 0 {
-		return nil, false
+// Window is the number of keys the lookup had to search.
+func (p Probe) Window() int {
+	if p.High < p.Low {
+		return 0
 	}
+	return p.High - p.Low + 1
+}
 
-	predictedPos := li.Model.Predict(key)
+// position returns the index of key in Keys, or -1.
+func (li *LearnedIndex) position(key common.KeyType) int {
+	return li.Probe(key).Found
+}
+
+// Probe looks key up the way Get does and reports how the model did.
+func (li *LearnedIndex) Probe(key common.KeyType) Probe {
+	if len(li.Keys) == 0 {
+		return Probe{Low: 0, High: -1, Found: -1}
+	}
+
+	predictedPos := li.predict(key)
 
 	low := predictedPos + li.MinErr
 	high := predictedPos + li.MaxErr
@@ -103,56 +294,83 @@ func (li *LearnedIndex) Get(key common.KeyType) (common.ValueType, bool) {
 	if low < 0 {
 		low = 0
 	}
-	if high >= len(li.Records) {
-		high = len(li.Records) - 1
+	if high >= len(li.Keys) {
+		high = len(li.Keys) - 1
 	}
+	p := Probe{Predicted: predictedPos, Low: low, High: high, Found: -1}
 	if low > high {
-		return nil, false
+		return p
 	}
 
 	if high-low < 16 {
 		for i := low; i <= high; i++ {
-			if li.Records[i].Key == key {
-				return li.Records[i].Value, true
+			if li.Keys[i] == key {
+				p.Found = i
+				return p
 			}
-			if li.Records[i].Key > key {
-				return nil, false
+			if li.Keys[i] > key {
+				return p
 			}
 		}
-		return nil, false
+		return p
 	}
 
-	slice := li.Records[low : high+1]
+	slice := li.Keys[low : high+1]
 	idx := sort.Search(len(slice), func(i int) bool {
-		return slice[i].Key >= key
+		return slice[i] >= key
 	})
 
-	if idx < len(slice) && slice[idx].Key == key {
-		return slice[idx].Value, true
+	if idx < len(slice) && slice[idx] == key {
+		p.Found = low + idx
+	}
+	return p
+}
+
+// GetProbe is Get that also returns the lookup's Probe.
+func (li *LearnedIndex) GetProbe(key common.KeyType) (common.ValueType, bool, Probe) {
+	p := li.Probe(key)
+	if p.Found < 0 {
+		return nil, false, p
 	}
-	return nil, false
+	val, err := li.valueAt(p.Found)
+	if err != nil {
+		return nil, false, p
+	}
+	return val, true, p
+}
+
+func (li *LearnedIndex) Get(key common.KeyType) (common.ValueType, bool) {
+	pos := li.position(key)
+	if pos < 0 {
+		return nil, false
+	}
+	val, err := li.valueAt(pos)
+	if err != nil {
+		return nil, false
+	}
+	return val, true
 }
 
 func (li *LearnedIndex) Size() int {
-	return len(li.Records)
+	return len(li.Keys)
 }
 
 func (li *LearnedIndex) ExportDiagnostics() []DiagnosticPoint {
 	// 采样导出，避免数据量过大
 	step := 1
-	if len(li.Records) > 5000 {
-		step = len(li.Records) / 5000
+	if len(li.Keys) > 5000 {
+		step = len(li.Keys) / 5000
 	}
 
-	results := make([]DiagnosticPoint, 0, len(li.Records)/step)
+	results := make([]DiagnosticPoint, 0, len(li.Keys)/step)
 
-	for i := 0; i < len(li.Records); i += step {
-		record := li.Records[i]
-		pred := li.Model.Predict(record.Key)
+	for i := 0; i < len(li.Keys); i += step {
+		key := li.Keys[i]
+		pred := li.predict(key)
 		err := i - pred
 
 		results = append(results, DiagnosticPoint{
-			Key:          int64(record.Key),
+			Key:          int64(key),
 			RealPos:      i,
 			PredictedPos: pred,
 			Error:        err,
@@ -162,21 +380,21 @@ func (li *LearnedIndex) ExportDiagnostics() []DiagnosticPoint {
 }
 
 func (li *LearnedIndex) BenchmarkInternal(iterations int) (float64, float64, error) {
-	if len(li.Records) == 0 {
+	if len(li.Keys) == 0 {
 		return 0, 0, nil
 	}
 
 	keys := make([]common.KeyType, iterations)
 	for i := 0; i < iterations; i++ {
-		idx := rand.Intn(len(li.Records))
-		keys[i] = li.Records[idx].Key
+		idx := rand.Intn(len(li.Keys))
+		keys[i] = li.Keys[idx]
 	}
 
 	// B-Tree (Binary Search) Benchmark
 	startBin := time.Now()
 	for _, key := range keys {
-		sort.Search(len(li.Records), func(i int) bool {
-			return li.Records[i].Key >= key
+		sort.Search(len(li.Keys), func(i int) bool {
+			return li.Keys[i] >= key
 		})
 	}
 	avgBin := float64(time.Since(startBin).Nanoseconds()) / float64(iterations)
@@ -184,25 +402,25 @@ func (li *LearnedIndex) BenchmarkInternal(iterations int) (float64, float64, err
 	// Learned Index Benchmark
 	startRMI := time.Now()
 	for _, key := range keys {
-		pred := li.Model.Predict(key)
+		pred := li.predict(key)
 		l, h := pred+li.MinErr, pred+li.MaxErr
 		if l < 0 {
 			l = 0
 		}
-		if h >= len(li.Records) {
-			h = len(li.Records) - 1
+		if h >= len(li.Keys) {
+			h = len(li.Keys) - 1
 		}
 
 		if h-l < 16 {
 			for i := l; i <= h; i++ {
-				if li.Records[i].Key == key {
+				if li.Keys[i] == key {
 					break
 				}
 			}
 		} else {
-			slice := li.Records[l : h+1]
+			slice := li.Keys[l : h+1]
 			sort.Search(len(slice), func(i int) bool {
-				return slice[i].Key >= key
+				return slice[i] >= key
 			})
 		}
 	}
@@ -213,63 +431,89 @@ func (li *LearnedIndex) BenchmarkInternal(iterations int) (float64, float64, err
 
 func (li *LearnedIndex) Scan(lowKey, highKey common.KeyType) []common.Record {
 	var res []common.Record
-	if len(li.Records) == 0 {
-		return res
-	}
-
-	pos := li.Model.Predict(lowKey)
-	startIdx := pos + li.MinErr
-
-	// Boundary checks
-	if startIdx < 0 {
-		startIdx = 0
-	}
-	if startIdx >= len(li.Records) {
-		startIdx = len(li.Records) - 1
-	}
-
-	// Correction scan
-	for startIdx > 0 && li.Records[startIdx].Key >= lowKey {
-		startIdx--
-	}
-	for startIdx < len(li.Records) && li.Records[startIdx].Key < lowKey {
-		startIdx++
+	for i := li.scanStart(lowKey); i < len(li.Keys); i++ {
+		k := li.Keys[i]
+		if k > highKey {
+			break
+		}
+		val, err := li.valueAt(i)
+		if err != nil {
+			continue
+		}
+		res = append(res, common.Record{Key: k, Value: val})
 	}
+	return res
+}
 
-	for i := startIdx; i < len(li.Records); i++ {
-		rec := li.Records[i]
-		if rec.Key > highKey {
+// ScanSizes is Scan without the values: each key comes with the length of
+// its value, read from the source's record header where the source allows
+// it.
+func (li *LearnedIndex) ScanSizes(lowKey, highKey common.KeyType) []common.KeySize {
+	var res []common.KeySize
+	for i := li.scanStart(lowKey); i < len(li.Keys); i++ {
+		k := li.Keys[i]
+		if k > highKey {
 			break
 		}
-		if rec.Key >= lowKey {
-			res = append(res, rec)
+		size, err := li.valueLenAt(i)
+		if err != nil {
+			continue
 		}
+		res = append(res, common.KeySize{Key: k, Size: size})
 	}
 	return res
 }
 
-func (li *LearnedIndex) Save(filename string) error {
-	f, err := os.Create(filename)
-	if err != nil {
-		return err
+func (li *LearnedIndex) valueLenAt(i int) (int, error) {
+	loc := li.locs[i]
+	src := li.sources[loc.Source]
+	if l, ok := src.(interface {
+		ValueLenAt(offset int64) (int, error)
+	}); ok {
+		return l.ValueLenAt(loc.Offset)
 	}
-	defer f.Close()
+	val, err := src.ValueAt(loc.Offset)
+	return len(val), err
+}
 
-	enc := gob.NewEncoder(f)
-	return enc.Encode(li)
+// EstimateCount approximates how many keys lie in [start, end] from the
+// model's predictions alone, without searching Keys. The estimate is within
+// the returned bound of the true count: each prediction is off by the error
+// bounds at most, plus one for a key that is not in the index.
+func (li *LearnedIndex) EstimateCount(start, end common.KeyType) (count, bound int) {
+	if len(li.Keys) == 0 || end < start || end < li.Keys[0] || start > li.Keys[len(li.Keys)-1] {
+		return 0, 0
+	}
+	start = max(start, li.Keys[0])
+	end = min(end, li.Keys[len(li.Keys)-1])
+	count = li.predict(end) - li.predict(start) + 1
+	return min(max(count, 0), len(li.Keys)), li.Window() + 1
 }
 
-func Load(filename string) (*LearnedIndex, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return nil, err
+// scanStart is the index of the first key >= lowKey, found from the model's
+// prediction.
+func (li *LearnedIndex) scanStart(lowKey common.KeyType) int {
+	if len(li.Keys) == 0 {
+		return 0
 	}
-	defer f.Close()
 
-	var li LearnedIndex
-	dec := gob.NewDecoder(f)
-	if err := dec.Decode(&li); err != nil {
-		return nil, err
+	pos := li.predict(lowKey)
+	startIdx := pos + li.MinErr
+
+	// Boundary checks
+	if startIdx < 0 {
+		startIdx = 0
+	}
+	if startIdx >= len(li.Keys) {
+		startIdx = len(li.Keys) - 1
+	}
+
+	// Correction scan
+	for startIdx > 0 && li.Keys[startIdx] >= lowKey {
+		startIdx--
+	}
+	for startIdx < len(li.Keys) && li.Keys[startIdx] < lowKey {
+		startIdx++
 	}
-	return &li, nil
+	return startIdx
 }
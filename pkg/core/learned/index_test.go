@@ -0,0 +1,272 @@
+package learned
+
+import (
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+
+	"neurodb/pkg/common"
+)
+
+// offsetValues stands in for an SSTable: values are materialized on read.
+type offsetValues struct{ size int }
+
+func (o offsetValues) ValueAt(offset int64) (common.ValueType, error) {
+	return make([]byte, o.size), nil
+}
+
+func heapInUse() uint64 {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// BenchmarkLearnedIndexMemory compares the resident size of a million-key
+// shard's index when values are held in memory (the old layout) against one
+// that only keeps keys and value locations.
+func BenchmarkLearnedIndexMemory(b *testing.B) {
+	const n = 1000000
+	const valueSize = 64
+
+	b.Run("in_memory_records", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			before := heapInUse()
+			recs := make([]common.Record, n)
+			for j := range recs {
+				recs[j] = common.Record{Key: common.KeyType(j * 3), Value: make([]byte, valueSize)}
+			}
+			// Build keeps the values alive through its in-memory source.
+			li := Build(recs, Options{})
+			recs = nil
+			after := heapInUse()
+			b.ReportMetric(float64(after-before)/n, "heap_B/key")
+			runtime.KeepAlive(li)
+		}
+	})
+
+	b.Run("keys_and_locations", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			before := heapInUse()
+			keys := make([]common.KeyType, n)
+			locs := make([]Location, n)
+			for j := range keys {
+				keys[j] = common.KeyType(j * 3)
+				locs[j] = Location{Offset: int64(j) * (12 + valueSize)}
+			}
+			li := BuildFromSources(keys, locs, []ValueReader{offsetValues{size: valueSize}}, Options{})
+			after := heapInUse()
+			b.ReportMetric(float64(after-before)/n, "heap_B/key")
+			runtime.KeepAlive(li)
+		}
+	})
+}
+
+func TestGetResolvesValuesFromSource(t *testing.T) {
+	keys := []common.KeyType{10, 20, 30}
+	locs := []Location{{Source: 0, Offset: 2}, {Source: 1, Offset: 0}, {Source: 0, Offset: 0}}
+	sources := []ValueReader{
+		memValues{[]byte("thirty"), nil, []byte("ten")},
+		memValues{[]byte("twenty")},
+	}
+	li := BuildFromSources(keys, locs, sources, Options{})
+	for k, want := range map[common.KeyType]string{10: "ten", 20: "twenty", 30: "thirty"} {
+		if v, ok := li.Get(k); !ok || string(v) != want {
+			t.Fatalf("get %d: ok=%v val=%q want %q", k, ok, v, want)
+		}
+	}
+	if _, ok := li.Get(25); ok {
+		t.Fatalf("expected key 25 missing")
+	}
+	if got := li.Scan(15, 30); len(got) != 2 || string(got[0].Value) != "twenty" || string(got[1].Value) != "thirty" {
+		t.Fatalf("unexpected scan result %+v", got)
+	}
+}
+
+func TestAppendLargeKeysKeepsErrorBounded(t *testing.T) {
+	const base = int64(4_000_000_000_000_000_000)
+	record := func(i int) common.Record {
+		return common.Record{Key: common.KeyType(base + int64(i)*3), Value: []byte{byte(i)}}
+	}
+	initial := make([]common.Record, 1000)
+	for i := range initial {
+		initial[i] = record(i)
+	}
+	li := Build(initial, Options{})
+
+	next := len(initial)
+	for batch := 0; batch < 200; batch++ {
+		recs := make([]common.Record, 500)
+		for i := range recs {
+			recs[i] = record(next)
+			next++
+		}
+		li.Append(recs)
+	}
+
+	if window := li.MaxErr - li.MinErr; window > 8 {
+		t.Fatalf("error window grew to %d (MinErr=%d MaxErr=%d) after %d appended keys", window, li.MinErr, li.MaxErr, next-len(initial))
+	}
+	for _, i := range []int{0, 999, 1000, 50_000, next - 1} {
+		if v, ok := li.Get(record(i).Key); !ok || v[0] != byte(i) {
+			t.Fatalf("get position %d: ok=%v", i, ok)
+		}
+	}
+}
+
+func TestAppendRetrainsWhenWindowGrows(t *testing.T) {
+	// Appended keys land in the last bucket, whose one incrementally updated
+	// line fits batches alternating between dense and sparse keys worse and
+	// worse. A model retrained over the whole range fits each stretch.
+	build := func(retrainWindow int) (*LearnedIndex, []common.KeyType) {
+		initial := make([]common.Record, 1000)
+		for i := range initial {
+			initial[i] = common.Record{Key: common.KeyType(i), Value: []byte{1}}
+		}
+		li := Build(initial, Options{})
+		li.RetrainWindow = retrainWindow
+		key := common.KeyType(1000)
+		for batch := 1; batch <= 50; batch++ {
+			recs := make([]common.Record, 200)
+			for i := range recs {
+				key += common.KeyType(1 + 6*(batch%2))
+				recs[i] = common.Record{Key: key, Value: []byte{1}}
+			}
+			li.Append(recs)
+		}
+		return li, li.Keys
+	}
+
+	unbounded, _ := build(-1)
+	if unbounded.Window() <= DefaultRetrainWindow {
+		t.Fatalf("test data too easy: window without retraining is only %d", unbounded.Window())
+	}
+
+	li, keys := build(0)
+	if w := li.Window(); w > DefaultRetrainWindow {
+		t.Fatalf("window grew to %d (MinErr=%d MaxErr=%d), limit %d", w, li.MinErr, li.MaxErr, DefaultRetrainWindow)
+	}
+	for i, k := range keys {
+		if li.Probe(k).Found != i {
+			t.Fatalf("key %d at position %d not found within the bounds", k, i)
+		}
+		if unbounded.Probe(k).Found != i {
+			t.Fatalf("without retraining, key %d at position %d fell outside the bounds", k, i)
+		}
+	}
+}
+
+func TestEstimateCountWithinErrorBound(t *testing.T) {
+	// Quadratically spaced keys, so the buckets' lines have different slopes.
+	recs := make([]common.Record, 20000)
+	for i := range recs {
+		recs[i] = common.Record{Key: common.KeyType(i * i / 7), Value: []byte{1}}
+	}
+	li := Build(recs, Options{})
+	keys := li.Keys
+
+	trueCount := func(start, end common.KeyType) int {
+		lo := sort.Search(len(keys), func(i int) bool { return keys[i] >= start })
+		hi := sort.Search(len(keys), func(i int) bool { return keys[i] > end })
+		return hi - lo
+	}
+	rng := rand.New(rand.NewSource(1))
+	maxKey := int64(keys[len(keys)-1])
+	for i := 0; i < 2000; i++ {
+		// Half the ranges start and end on indexed keys, half anywhere,
+		// including past either end.
+		var start, end common.KeyType
+		if i%2 == 0 {
+			start, end = keys[rng.Intn(len(keys))], keys[rng.Intn(len(keys))]
+		} else {
+			start = common.KeyType(rng.Int63n(maxKey+200) - 100)
+			end = common.KeyType(rng.Int63n(maxKey+200) - 100)
+		}
+		if end < start {
+			start, end = end, start
+		}
+		got, bound := li.EstimateCount(start, end)
+		want := trueCount(start, end)
+		if diff := got - want; diff > bound || -diff > bound {
+			t.Fatalf("[%d, %d]: estimate %d, true count %d, bound %d", start, end, got, want, bound)
+		}
+	}
+	if n, _ := li.EstimateCount(common.KeyType(maxKey+1), common.KeyType(maxKey+100)); n != 0 {
+		t.Fatalf("range past the last key: estimate %d", n)
+	}
+}
+
+func TestSmallIndexSearchesKeysWithoutModel(t *testing.T) {
+	recs := sampleRecords(50)
+	li := Build(recs, Options{})
+	if li.HasModel() || li.Model != nil {
+		t.Fatalf("expected no model for %d keys (MinModelKeys %d)", len(recs), DefaultMinModelKeys)
+	}
+	if w := li.Window(); w != 1 {
+		t.Fatalf("expected a window of 1 key, got %d", w)
+	}
+	for _, r := range recs {
+		if v, ok := li.Get(r.Key); !ok || string(v) != string(r.Value) {
+			t.Fatalf("get key=%d: ok=%v val=%q", r.Key, ok, v)
+		}
+		if _, ok := li.Get(r.Key + 1); ok {
+			t.Fatalf("found missing key %d", r.Key+1)
+		}
+	}
+	// Keys are multiples of 7: 70..140 holds 70, 77, ..., 140.
+	if got := li.Scan(65, 140); len(got) != 11 || got[0].Key != 70 || got[10].Key != 140 {
+		t.Fatalf("unexpected scan of [65, 140]: %+v", got)
+	}
+	if n, bound := li.EstimateCount(65, 140); n < 11-bound || n > 11+bound {
+		t.Fatalf("estimate %d±%d, want 11", n, bound)
+	}
+	if _, _, err := li.BenchmarkInternal(100); err != nil {
+		t.Fatalf("benchmark: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "small.li")
+	if err := li.Save(path); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if err := loaded.Attach(li.Keys, li.locs, li.sources); err != nil || loaded.HasModel() {
+		t.Fatalf("attach: %v, model %v", err, loaded.HasModel())
+	}
+	if v, ok := loaded.Get(recs[20].Key); !ok || string(v) != string(recs[20].Value) {
+		t.Fatalf("get key=%d after load: ok=%v val=%q", recs[20].Key, ok, v)
+	}
+
+	// Appending past MinModelKeys trains one.
+	more := make([]common.Record, DefaultMinModelKeys)
+	for i := range more {
+		more[i] = common.Record{Key: common.KeyType(1000 + i), Value: []byte{byte(i)}}
+	}
+	li.Append(more)
+	if !li.HasModel() {
+		t.Fatalf("expected a model after growing to %d keys", len(li.Keys))
+	}
+	for i, k := range li.Keys {
+		if li.Probe(k).Found != i {
+			t.Fatalf("key %d at position %d not found after training", k, i)
+		}
+	}
+}
+
+func TestMinModelKeysOption(t *testing.T) {
+	recs := sampleRecords(50)
+	if li := Build(recs, Options{MinModelKeys: 10}); !li.HasModel() {
+		t.Fatalf("expected a model for %d keys with MinModelKeys 10", len(recs))
+	}
+	li := Build(sampleRecords(100), Options{MinModelKeys: 200})
+	if li.HasModel() {
+		t.Fatalf("expected no model for 100 keys with MinModelKeys 200")
+	}
+	li.Retrain()
+	if li.HasModel() {
+		t.Fatalf("Retrain ignored MinModelKeys 200")
+	}
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"neurodb/pkg/common"
+	"neurodb/pkg/logger"
+	"neurodb/pkg/storage/sstable"
+)
+
+type logEntry struct {
+	level logger.Level
+	msg   string
+}
+
+// captureLogger records every message regardless of level.
+type captureLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (c *captureLogger) log(level logger.Level, format string, args ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = append(c.entries, logEntry{level, fmt.Sprintf(format, args...)})
+}
+
+func (c *captureLogger) Debug(format string, args ...interface{}) {
+	c.log(logger.LevelDebug, format, args...)
+}
+func (c *captureLogger) Info(format string, args ...interface{}) {
+	c.log(logger.LevelInfo, format, args...)
+}
+func (c *captureLogger) Warn(format string, args ...interface{}) {
+	c.log(logger.LevelWarn, format, args...)
+}
+func (c *captureLogger) Error(format string, args ...interface{}) {
+	c.log(logger.LevelError, format, args...)
+}
+
+// levelsOf returns the levels of the messages containing substr.
+func (c *captureLogger) levelsOf(substr string) []logger.Level {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []logger.Level
+	for _, e := range c.entries {
+		if strings.Contains(e.msg, substr) {
+			out = append(out, e.level)
+		}
+	}
+	return out
+}
+
+func TestStoreLogsRoutineWorkAtDebug(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	cfg.Storage.CompactionThreshold = 2
+	capture := &captureLogger{}
+
+	hs := NewHybridStore(cfg, WithLogger(capture))
+	var tables []*sstable.SSTable
+	for i := 1; i <= 2; i++ {
+		path := filepath.Join(cfg.Storage.Path, fmt.Sprintf("shard-0-%d.sst", i))
+		writeTestSST(t, path, []common.Record{{Key: common.KeyType(i), Value: []byte("v")}})
+		sst, err := sstable.Open(path)
+		if err != nil {
+			t.Fatalf("open sstable: %v", err)
+		}
+		tables = append(tables, sst)
+	}
+	shard := hs.shards[0]
+	shard.mutex.Lock()
+	shard.l0SSTables = tables
+	shard.rebuildSSTableViewLocked()
+	shard.mutex.Unlock()
+
+	hs.compactShard(shard)
+	hs.Close()
+
+	merged := capture.levelsOf("[Compaction] Shard 0: Merged")
+	if len(merged) != 1 || merged[0] != logger.LevelDebug {
+		t.Fatalf("expected one compaction logged at debug, got %v", merged)
+	}
+
+	capture = &captureLogger{}
+	reopened := NewHybridStore(cfg, WithLogger(capture))
+	defer reopened.Close()
+	restored := capture.levelsOf("SSTables from disk")
+	if len(restored) != 1 || restored[0] != logger.LevelInfo {
+		t.Fatalf("expected one restore summary at info, got %v", restored)
+	}
+}
+
+func TestRestoreLogsTableWithIncompleteFooter(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	hs := NewHybridStore(cfg, WithLogger(&captureLogger{}))
+	for _, rec := range sortedRecords(150) {
+		hs.Put(rec.Key, rec.Value)
+	}
+	hs.Close()
+
+	tables, _ := filepath.Glob(filepath.Join(cfg.Storage.Path, "shard-0-l0-*.sst"))
+	if len(tables) != 1 {
+		t.Fatalf("expected one flushed table, got %v", tables)
+	}
+	if err := os.Truncate(tables[0], fileSize(t, tables[0])-4); err != nil {
+		t.Fatalf("truncate table: %v", err)
+	}
+
+	capture := &captureLogger{}
+	reopened := NewHybridStore(cfg, WithLogger(capture))
+	defer reopened.Close()
+	skipped := capture.levelsOf("Skipping live SSTable " + filepath.Base(tables[0]) + ", its write looks incomplete")
+	if len(skipped) != 1 || skipped[0] != logger.LevelError {
+		t.Fatalf("expected the truncated table to be logged once as an error, got %v", skipped)
+	}
+}
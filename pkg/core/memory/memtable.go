@@ -7,9 +7,14 @@ import (
 	"github.com/google/btree"
 )
 
+// Item is a key's latest write. Operands are merge operands written after
+// Val, oldest first; with Partial set there is no Val in the memtable and
+// they apply to whatever older data holds for the key.
 type Item struct {
-	Key common.KeyType
-	Val common.ValueType
+	Key      common.KeyType
+	Val      common.ValueType
+	Operands [][]byte
+	Partial  bool
 }
 
 func (i Item) Less(than btree.Item) bool {
@@ -20,6 +25,7 @@ type shard struct {
 	tree *btree.BTree
 	lock sync.RWMutex
 	size int
+	ops  int // merge operands held
 }
 
 func newShard(degree int) *shard {
@@ -29,6 +35,11 @@ func newShard(degree int) *shard {
 type MemTable struct {
 	shards []*shard
 	mask   int64
+
+	// tombstones are range deletes applied to this memtable. Points still in
+	// the memtable were written after every tombstone covering them.
+	tombMu     sync.RWMutex
+	tombstones []common.RangeTombstone
 }
 
 const ShardCount = 16
@@ -55,10 +66,33 @@ func (smt *MemTable) Put(key common.KeyType, val common.ValueType) {
 	defer s.lock.Unlock()
 
 	item := Item{Key: key, Val: val}
-	s.tree.ReplaceOrInsert(item)
+	if old := s.tree.ReplaceOrInsert(item); old != nil {
+		s.ops -= len(old.(Item).Operands)
+	}
 	s.size += 8 + len(val)
 }
 
+// Merge adds a merge operand to key's latest write.
+func (smt *MemTable) Merge(key common.KeyType, operand []byte) {
+	// A key a range delete in the memtable covers is empty, not partial.
+	covered := smt.Covers(key)
+	s := smt.getShard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	item := Item{Key: key, Partial: !covered}
+	if old := s.tree.Get(item); old != nil {
+		item = old.(Item)
+	} else {
+		s.size += 8
+	}
+	item.Operands = append(item.Operands, operand)
+	s.tree.ReplaceOrInsert(item)
+	s.size += len(operand)
+	s.ops++
+}
+
+// Get returns the value put for key. It ignores merge operands; see GetItem.
 func (smt *MemTable) Get(key common.KeyType) (common.ValueType, bool) {
 	s := smt.getShard(key)
 	s.lock.RLock()
@@ -72,6 +106,48 @@ func (smt *MemTable) Get(key common.KeyType) (common.ValueType, bool) {
 	return res.(Item).Val, true
 }
 
+// GetItem returns key's latest write, merge operands included.
+func (smt *MemTable) GetItem(key common.KeyType) (Item, bool) {
+	s := smt.getShard(key)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	res := s.tree.Get(Item{Key: key})
+	if res == nil {
+		return Item{}, false
+	}
+	return res.(Item), true
+}
+
+// Merges returns the items that hold merge operands.
+func (smt *MemTable) Merges() []Item {
+	var res []Item
+	for _, s := range smt.shards {
+		s.lock.RLock()
+		if s.ops > 0 {
+			s.tree.Ascend(func(i btree.Item) bool {
+				if item := i.(Item); len(item.Operands) > 0 {
+					res = append(res, item)
+				}
+				return true
+			})
+		}
+		s.lock.RUnlock()
+	}
+	return res
+}
+
+// Operands is the number of merge operands in the memtable.
+func (smt *MemTable) Operands() int {
+	total := 0
+	for _, s := range smt.shards {
+		s.lock.RLock()
+		total += s.ops
+		s.lock.RUnlock()
+	}
+	return total
+}
+
 func (smt *MemTable) Size() int {
 	total := 0
 	for _, s := range smt.shards {
@@ -92,6 +168,26 @@ func (smt *MemTable) Count() int {
 	return total
 }
 
+// Bounds returns the smallest and largest key in the memtable, deletes
+// included; ok is false when it holds none.
+func (smt *MemTable) Bounds() (lo, hi common.KeyType, ok bool) {
+	for _, s := range smt.shards {
+		s.lock.RLock()
+		if s.tree.Len() > 0 {
+			min, max := s.tree.Min().(Item).Key, s.tree.Max().(Item).Key
+			if !ok || min < lo {
+				lo = min
+			}
+			if !ok || max > hi {
+				hi = max
+			}
+			ok = true
+		}
+		s.lock.RUnlock()
+	}
+	return lo, hi, ok
+}
+
 func (smt *MemTable) Iterator(fn func(key common.KeyType, val common.ValueType) bool) {
 	for _, s := range smt.shards {
 		s.lock.RLock()
@@ -122,3 +218,44 @@ func (smt *MemTable) Scan(low, high common.KeyType) []Item {
 	}
 	return res
 }
+
+// DeleteRange drops the points in [start, end) and records the range
+// tombstone, which hides older data below the memtable.
+func (smt *MemTable) DeleteRange(start, end common.KeyType) {
+	smt.tombMu.Lock()
+	smt.tombstones = append(smt.tombstones, common.RangeTombstone{Start: start, End: end})
+	smt.tombMu.Unlock()
+
+	for _, s := range smt.shards {
+		s.lock.Lock()
+		var doomed []btree.Item
+		s.tree.AscendRange(Item{Key: start}, Item{Key: end}, func(i btree.Item) bool {
+			doomed = append(doomed, i)
+			return true
+		})
+		for _, i := range doomed {
+			s.tree.Delete(i)
+			item := i.(Item)
+			s.size -= 8 + len(item.Val)
+			s.ops -= len(item.Operands)
+			for _, op := range item.Operands {
+				s.size -= len(op)
+			}
+		}
+		s.lock.Unlock()
+	}
+}
+
+// RangeTombstones returns the range deletes applied to the memtable.
+func (smt *MemTable) RangeTombstones() []common.RangeTombstone {
+	smt.tombMu.RLock()
+	defer smt.tombMu.RUnlock()
+	return append([]common.RangeTombstone(nil), smt.tombstones...)
+}
+
+// Covers reports whether a range delete in the memtable covers key.
+func (smt *MemTable) Covers(key common.KeyType) bool {
+	smt.tombMu.RLock()
+	defer smt.tombMu.RUnlock()
+	return common.Covered(smt.tombstones, key)
+}
@@ -0,0 +1,199 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"neurodb/pkg/common"
+	"neurodb/pkg/core/memory"
+	"neurodb/pkg/storage"
+)
+
+// MergeFunc folds operand into the current value of key, which is nil when
+// the key is absent or deleted. The result becomes the new value; an empty
+// result deletes the key.
+type MergeFunc func(key common.KeyType, existing common.ValueType, operand []byte) (common.ValueType, error)
+
+// ErrNoMergeOperator is returned by Merge on a store opened without
+// WithMergeOperator, and by OpenHybridStore for a WAL with merges to replay.
+var ErrNoMergeOperator = errors.New("core: no merge operator registered")
+
+// WithMergeOperator sets the function merge operands are folded with.
+func WithMergeOperator(f MergeFunc) Option {
+	return func(hs *HybridStore) { hs.merge = f }
+}
+
+// Int64Add treats values and operands as base-10 integers and adds them; an
+// absent key counts as 0.
+func Int64Add(key common.KeyType, existing common.ValueType, operand []byte) (common.ValueType, error) {
+	var sum int64
+	if len(existing) > 0 {
+		n, err := strconv.ParseInt(string(existing), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: existing value %q is not an integer", key, existing)
+		}
+		sum = n
+	}
+	delta, err := strconv.ParseInt(string(operand), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("key %d: operand %q is not an integer", key, operand)
+	}
+	return strconv.AppendInt(nil, sum+delta, 10), nil
+}
+
+// ListAppend appends operand to the value as a new comma-separated element.
+func ListAppend(_ common.KeyType, existing common.ValueType, operand []byte) (common.ValueType, error) {
+	if len(existing) == 0 {
+		return append(common.ValueType(nil), operand...), nil
+	}
+	out := make(common.ValueType, 0, len(existing)+1+len(operand))
+	out = append(out, existing...)
+	out = append(out, ',')
+	return append(out, operand...), nil
+}
+
+// Merge records operand as an update of key, to be folded into its value
+// with the store's merge operator. Nothing is read: like a Put, the operand
+// is logged and kept in the memtable. Reads fold the pending operands over
+// the value below them, and the flush that writes the memtable out collapses
+// them into that value, so SSTables only ever hold values. Each Merge is a
+// single write, so concurrent Merges of a key never lose an update and no
+// client round trip is needed. An operand the operator rejects, or whose
+// result is over the size limit, is skipped: reads fold the others and the
+// flush logs and drops it.
+func (hs *HybridStore) Merge(key common.KeyType, operand []byte) error {
+	if hs.merge == nil {
+		return ErrNoMergeOperator
+	}
+	if err := hs.checkValueSize(key, operand); err != nil {
+		return err
+	}
+	return hs.mergeRaw(hs.orderKey(key), operand)
+}
+
+// mergeRaw is Merge for a key in the store's order.
+func (hs *HybridStore) mergeRaw(key common.KeyType, operand []byte) error {
+	shard := hs.getShard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	return hs.writeLocked(shard, walEntry{rec: common.Record{Key: key, Value: operand}, merge: true})
+}
+
+// fold applies operands, oldest first, to base, the stored value of key (nil
+// or empty when it has none), and returns the stored result. Each operand
+// rejected is skipped and passed to rejected when that is not nil.
+func (hs *HybridStore) fold(key common.KeyType, base common.ValueType, operands [][]byte, rejected func(error)) common.ValueType {
+	if rejected == nil {
+		rejected = func(error) {}
+	}
+	// The merge operator gets key as the caller gave it.
+	userKey := hs.orderKey(key)
+	if hs.merge == nil {
+		rejected(ErrNoMergeOperator)
+		return base
+	}
+	existing, err := hs.decode(base)
+	if err != nil {
+		rejected(fmt.Errorf("key %d: %w", userKey, err))
+		return base
+	}
+	stored := base
+	for _, op := range operands {
+		merged, err := hs.merge(userKey, existing, op)
+		if err == nil {
+			var enc common.ValueType
+			if enc, err = hs.encode(merged); err == nil {
+				if err = hs.checkValueSize(userKey, enc); err == nil {
+					existing, stored = merged, enc
+					continue
+				}
+			}
+		}
+		rejected(err)
+	}
+	return stored
+}
+
+// memValueLocked is the stored value of a memtable item with its merge
+// operands folded in. The caller holds shard.mutex.
+func (hs *HybridStore) memValueLocked(shard *Shard, item memory.Item, rejected func(error)) common.ValueType {
+	if len(item.Operands) == 0 {
+		return item.Val
+	}
+	base := item.Val
+	if item.Partial {
+		base, _ = hs.lookupTablesLocked(shard, item.Key, nil)
+	}
+	return hs.fold(item.Key, base, item.Operands, rejected)
+}
+
+// collapseMergesLocked replaces the merge operands in the shard's memtable
+// with the values they fold to. The values are logged first, after the
+// operands, so a WAL replay starts from them rather than folding the
+// operands again into the tables the memtable is flushed to. The caller
+// holds shard.mutex for writing.
+func (hs *HybridStore) collapseMergesLocked(shard *Shard) error {
+	items := shard.mutableMem.Merges()
+	if len(items) == 0 {
+		return nil
+	}
+	records := make([]common.Record, len(items))
+	for i, item := range items {
+		records[i] = common.Record{Key: item.Key, Value: hs.memValueLocked(shard, item, func(err error) {
+			hs.log.Error("[Merge] Dropping an operand of key %d: %v", hs.orderKey(item.Key), err)
+		})}
+	}
+	if err := hs.logDurably(records); err != nil {
+		return err
+	}
+	for _, r := range records {
+		shard.mutableMem.Put(r.Key, r.Value)
+	}
+	return nil
+}
+
+// logDurably logs records after every write queued before them and returns
+// once they are synced.
+func (hs *HybridStore) logDurably(records []common.Record) error {
+	done := make(chan error, 1)
+	err := hs.queueWrite(walEntry{batch: records, done: done})
+	if errors.Is(err, ErrClosed) && hs.persistStopped.Load() {
+		// Shutdown's flushes: everything queued is already logged.
+		return hs.backend.BatchWrite(records)
+	}
+	if err != nil {
+		return err
+	}
+	return <-done
+}
+
+// foldReplayedMerges folds the merge chains of a WAL replay into values,
+// over the restored tables for chains without a base in the log, and logs
+// the values after the chains so the next replay does not fold them again.
+func (hs *HybridStore) foldReplayedMerges(merges []storage.MergeChain) ([]common.Record, error) {
+	if len(merges) == 0 {
+		return nil, nil
+	}
+	if hs.merge == nil {
+		return nil, fmt.Errorf("%w: the WAL holds merges for %d keys", ErrNoMergeOperator, len(merges))
+	}
+	records := make([]common.Record, 0, len(merges))
+	for _, c := range merges {
+		base := c.Value
+		if !c.HasBase {
+			shard := hs.shards[hs.route(c.Key)]
+			shard.mutex.RLock()
+			base, _ = hs.lookupLocked(shard, c.Key, nil)
+			shard.mutex.RUnlock()
+		}
+		val := hs.fold(c.Key, base, c.Operands, func(err error) {
+			hs.log.Error("[Merge] Dropping an operand of key %d: %v", hs.orderKey(c.Key), err)
+		})
+		records = append(records, common.Record{Key: c.Key, Value: val})
+	}
+	if err := hs.backend.BatchWrite(records); err != nil {
+		return nil, fmt.Errorf("log replayed merges: %w", err)
+	}
+	return records, nil
+}
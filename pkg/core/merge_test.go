@@ -0,0 +1,232 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"neurodb/pkg/common"
+	"neurodb/pkg/config"
+	"neurodb/pkg/logger"
+	"neurodb/pkg/storage"
+)
+
+func TestInt64AddMergeAcrossFlushes(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	hs := NewHybridStore(cfg, WithMergeOperator(Int64Add))
+	defer hs.Close()
+
+	// 250 merges of the counter among other writes: its value moves from
+	// the memtable into L0 tables and, with Compact, into L1.
+	for i := 1; i <= 250; i++ {
+		if err := hs.Merge(7, []byte("2")); err != nil {
+			t.Fatalf("Merge %d: %v", i, err)
+		}
+		hs.Put(common.KeyType(1000+i), []byte("x"))
+		if i == 120 {
+			if err := hs.Compact(); err != nil {
+				t.Fatalf("Compact: %v", err)
+			}
+		}
+	}
+	if val, ok := hs.Get(7); !ok || string(val) != "500" {
+		t.Fatalf("counter = %q, %v; want 500", val, ok)
+	}
+
+	// A deleted counter starts again from 0, also once the delete is on disk.
+	hs.Delete(7)
+	for i := 0; i < 150; i++ {
+		hs.Put(common.KeyType(2000+i), []byte("x"))
+	}
+	if err := hs.Merge(7, []byte("-3")); err != nil {
+		t.Fatalf("Merge after delete: %v", err)
+	}
+	if val, _ := hs.Get(7); string(val) != "-3" {
+		t.Fatalf("counter after delete = %q, want -3", val)
+	}
+
+	// An operand the operator rejects is skipped, in the memtable and once
+	// the flush has collapsed it.
+	hs.Put(8, []byte("not a number"))
+	if err := hs.Merge(8, []byte("1")); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	for i := 0; ; i++ {
+		if val, _ := hs.Get(8); string(val) != "not a number" {
+			t.Fatalf("value after a rejected operand = %q", val)
+		}
+		if i == 1 {
+			break
+		}
+		for j := 0; j < 100; j++ {
+			hs.Put(common.KeyType(3000+j), []byte("x"))
+		}
+	}
+}
+
+func TestConcurrentMergesLoseNoUpdates(t *testing.T) {
+	hs := NewHybridStore(testConfig(t), WithMergeOperator(Int64Add))
+	defer hs.Close()
+
+	const workers, rounds = 8, 200
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				hs.Merge(1, []byte("1"))
+				hs.Put(common.KeyType(10+w*1000+i), []byte("x"))
+			}
+		}(w)
+	}
+	wg.Wait()
+	if val, _ := hs.Get(1); string(val) != fmt.Sprint(workers*rounds) {
+		t.Fatalf("counter = %q, want %d", val, workers*rounds)
+	}
+}
+
+func TestMergeWithoutOperator(t *testing.T) {
+	hs := NewHybridStore(testConfig(t))
+	defer hs.Close()
+	if err := hs.Merge(1, []byte("1")); !errors.Is(err, ErrNoMergeOperator) {
+		t.Fatalf("Merge without operator: %v", err)
+	}
+}
+
+func TestMergeReadsFoldOperands(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	hs := NewHybridStore(cfg, WithMergeOperator(ListAppend))
+	defer hs.Close()
+
+	// Key 3's base is in an L0 table, key 4 has none and key 5 is deleted
+	// by a range delete still in the memtable.
+	hs.Put(3, []byte("a"))
+	hs.Put(5, []byte("z"))
+	for i := 0; i < 100; i++ {
+		hs.Put(common.KeyType(100+i), []byte("x"))
+	}
+	hs.DeleteRange(5, 6)
+	for _, m := range []struct {
+		key     common.KeyType
+		operand string
+	}{{3, "b"}, {4, "c"}, {3, "d"}, {5, "e"}} {
+		if err := hs.Merge(m.key, []byte(m.operand)); err != nil {
+			t.Fatalf("Merge(%d): %v", m.key, err)
+		}
+	}
+	want := map[common.KeyType]string{3: "a,b,d", 4: "c", 5: "e"}
+	for k, v := range want {
+		if val, ok := hs.Get(k); !ok || string(val) != v {
+			t.Fatalf("Get(%d) = %q, %v; want %q", k, val, ok, v)
+		}
+	}
+	got := make(map[common.KeyType]string)
+	for _, r := range hs.Scan(0, 10) {
+		got[r.Key] = string(r.Value)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Scan = %v, want %v", got, want)
+	}
+}
+
+// walOps counts the ops in the WAL of a closed store.
+func walOps(t *testing.T, cfg *config.Config) map[storage.WALOp]int {
+	t.Helper()
+	w, err := storage.OpenWAL(storage.WALFile(filepath.Join(LayoutOf(cfg.Storage).WAL, backendName)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	it, err := w.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	ops := make(map[storage.WALOp]int)
+	for {
+		e, err := it.Next()
+		if err == io.EOF {
+			return ops
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops[e.Op]++
+	}
+}
+
+func TestMergeOperandsReplayOnce(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	open := func(opts ...Option) (*HybridStore, error) {
+		opts = append(opts, WithLogger(logger.New(io.Discard, logger.LevelError)))
+		return OpenHybridStore(cfg, opts...)
+	}
+	check := func(hs *HybridStore, want map[common.KeyType]string) {
+		t.Helper()
+		for k, v := range want {
+			if val, _ := hs.Get(k); string(val) != v {
+				t.Fatalf("Get(%d) = %q, want %q", k, val, v)
+			}
+		}
+	}
+
+	hs, err := open(WithMergeOperator(Int64Add))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.Put(1, []byte("10"))
+	for i := 0; i < 100; i++ {
+		hs.Put(common.KeyType(100+i), []byte("x"))
+	}
+	hs.Merge(1, []byte("5"))
+	hs.Merge(2, []byte("7"))
+	hs.Close()
+
+	// The operands are logged, not the values they fold to.
+	if n := walOps(t, cfg)[storage.WALMerge]; n != 2 {
+		t.Fatalf("WAL holds %d merges, want 2", n)
+	}
+	if _, err := open(); !errors.Is(err, ErrNoMergeOperator) {
+		t.Fatalf("open without a merge operator: %v", err)
+	}
+
+	hs, err = open(WithMergeOperator(Int64Add))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(hs, map[common.KeyType]string{1: "15", 2: "7"})
+
+	// A flush writes the folded values to a table while the operands stay
+	// in the WAL; replaying it must not fold them in a second time.
+	hs.Merge(1, []byte("1"))
+	hs.Merge(2, []byte("1"))
+	for i := 0; i < 100; i++ {
+		hs.Put(common.KeyType(200+i), []byte("x"))
+	}
+	hs.Merge(1, []byte("1"))
+	hs.Close()
+
+	hs, err = open(WithMergeOperator(Int64Add))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(hs, map[common.KeyType]string{1: "17", 2: "8"})
+	hs.Merge(2, []byte("2"))
+	if err := hs.Shutdown(); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	hs, err = open(WithMergeOperator(Int64Add))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hs.Close()
+	check(hs, map[common.KeyType]string{1: "17", 2: "10"})
+}
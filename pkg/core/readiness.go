@@ -0,0 +1,62 @@
+package core
+
+import "fmt"
+
+const (
+	// writeQueueReadyLimit is the fill ratio of the WAL write queue above
+	// which the store stops reporting ready.
+	writeQueueReadyLimit = 0.9
+	// compactionStallFactor times compaction_threshold L0 tables in one shard
+	// means compaction has fallen behind (or stopped) for that shard.
+	compactionStallFactor = 4
+)
+
+// Readiness reports whether the store should be sent traffic and, when it
+// should not, why.
+type Readiness struct {
+	Ready         bool     `json:"ready"`
+	Problems      []string `json:"problems,omitempty"`
+	PendingWrites int      `json:"pending_writes"`
+	WriteQueueCap int      `json:"write_queue_capacity"`
+	MaxL0Tables   int      `json:"max_l0_sstables"`
+}
+
+// Readiness checks that the store is open and writable, that its WAL write
+// queue is not nearly full, that no shard's flushes are failing and that
+// compaction is keeping up with L0.
+func (hs *HybridStore) Readiness() Readiness {
+	r := Readiness{
+		PendingWrites: hs.pendingWrites(),
+		WriteQueueCap: cap(hs.writeCh),
+	}
+	select {
+	case <-hs.closeCh:
+		r.Problems = append(r.Problems, "store is closed")
+	default:
+	}
+	if err := hs.ReadOnly(); err != nil {
+		r.Problems = append(r.Problems, fmt.Sprintf("store is read-only: %v", err))
+	}
+	if r.WriteQueueCap > 0 && float64(r.PendingWrites) >= writeQueueReadyLimit*float64(r.WriteQueueCap) {
+		r.Problems = append(r.Problems, fmt.Sprintf("WAL write queue is %d/%d full", r.PendingWrites, r.WriteQueueCap))
+	}
+	stall := compactionStallFactor * hs.conf.Storage.CompactionThreshold
+	for _, shard := range hs.shards {
+		shard.mutex.RLock()
+		flushErr := shard.flushErr
+		l0 := len(shard.l0SSTables)
+		shard.mutex.RUnlock()
+
+		if flushErr != nil {
+			r.Problems = append(r.Problems, fmt.Sprintf("shard %d: flush failing: %v", shard.id, flushErr))
+		}
+		if l0 > r.MaxL0Tables {
+			r.MaxL0Tables = l0
+		}
+		if stall > 0 && l0 >= stall {
+			r.Problems = append(r.Problems, fmt.Sprintf("shard %d: %d L0 tables waiting for compaction", shard.id, l0))
+		}
+	}
+	r.Ready = len(r.Problems) == 0
+	return r
+}
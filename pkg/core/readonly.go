@@ -0,0 +1,115 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"neurodb/pkg/storage/sstable"
+)
+
+// ErrReadOnly is returned by writes while the store is read-only because the
+// disk refused to persist data (see ReadOnly).
+var ErrReadOnly = errors.New("core: store is read-only")
+
+// readOnlyRetryInterval is how often a rejected write checks whether the
+// disk takes writes again.
+var readOnlyRetryInterval = 5 * time.Second
+
+// newTableBuilder starts every SSTable the store writes; tests replace it to
+// simulate a failing disk.
+var newTableBuilder = sstable.NewBuilder
+
+// readOnlyState is why and since when the store has been read-only.
+type readOnlyState struct {
+	mu        sync.Mutex
+	cause     error // nil while writable
+	since     time.Time
+	lastProbe time.Time
+}
+
+// isDiskError reports whether err means the disk will not take writes: it is
+// full, over quota, mounted read-only or not writable by this process.
+func isDiskError(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) ||
+		errors.Is(err, syscall.EROFS) || errors.Is(err, fs.ErrPermission)
+}
+
+// noteWriteError makes the store read-only if err, from op, is a disk error.
+// Other errors are left to the caller.
+func (hs *HybridStore) noteWriteError(op string, err error) {
+	if err == nil || !isDiskError(err) {
+		return
+	}
+	hs.ro.mu.Lock()
+	defer hs.ro.mu.Unlock()
+	if hs.ro.cause != nil {
+		return
+	}
+	hs.ro.cause = fmt.Errorf("%s: %w", op, err)
+	hs.ro.since = time.Now()
+	hs.ro.lastProbe = hs.ro.since
+	hs.readOnly.Store(true)
+	hs.log.Error("[NeuroDB] %v; rejecting writes until the disk accepts them again", hs.ro.cause)
+}
+
+// ReadOnly is why the store rejects writes, or nil if it takes them. Reads
+// keep working while it is read-only; the data written before stays in the
+// memtables and reaches disk with their next flush.
+func (hs *HybridStore) ReadOnly() error {
+	if !hs.readOnly.Load() {
+		return nil
+	}
+	hs.ro.mu.Lock()
+	defer hs.ro.mu.Unlock()
+	return hs.ro.cause
+}
+
+// checkWritable returns ErrReadOnly while the store is read-only. Every
+// readOnlyRetryInterval it tries the disk first and leaves read-only mode if
+// every data directory takes a write again.
+func (hs *HybridStore) checkWritable() error {
+	if !hs.readOnly.Load() {
+		return nil
+	}
+	hs.ro.mu.Lock()
+	defer hs.ro.mu.Unlock()
+	if hs.ro.cause == nil {
+		return nil
+	}
+	if time.Since(hs.ro.lastProbe) >= readOnlyRetryInterval {
+		hs.ro.lastProbe = time.Now()
+		if err := hs.probeDisk(); err == nil {
+			hs.log.Info("[NeuroDB] Disk accepts writes again after %v; leaving read-only mode", time.Since(hs.ro.since).Round(time.Second))
+			hs.ro.cause = nil
+			hs.readOnly.Store(false)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %v", ErrReadOnly, hs.ro.cause)
+}
+
+// probeDisk writes, syncs and removes a small file in every data directory.
+func (hs *HybridStore) probeDisk() error {
+	block := make([]byte, 4096)
+	for _, dir := range hs.layout.Dirs() {
+		f, err := os.CreateTemp(dir, ".probe-*")
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(block)
+		if err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+		os.Remove(f.Name())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"neurodb/pkg/common"
+	"neurodb/pkg/logger"
+	"neurodb/pkg/storage/sstable"
+)
+
+func TestFullDiskRejectsWritesInsteadOfLosingThem(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.System.ShardCount = 1
+	hs := NewHybridStore(cfg, WithLogger(logger.New(io.Discard, logger.LevelError)))
+	defer hs.Close()
+
+	origInterval := readOnlyRetryInterval
+	defer func() {
+		newTableBuilder = sstable.NewBuilder
+		readOnlyRetryInterval = origInterval
+	}()
+	newTableBuilder = func(path string) (*sstable.Builder, error) {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: syscall.ENOSPC}
+	}
+	readOnlyRetryInterval = time.Hour
+
+	// The 100th write fills the memtable and its flush hits the full disk.
+	for i := 0; i < 100; i++ {
+		if err := hs.Put(common.KeyType(i), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatalf("Put(%d) before the disk filled: %v", i, err)
+		}
+	}
+	if err := hs.ReadOnly(); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected the store to be read-only on ENOSPC, got %v", err)
+	}
+	err := hs.Put(100, []byte("v100"))
+	if !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if err := hs.DeleteRange(0, 10); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected DeleteRange to be rejected, got %v", err)
+	}
+	if _, ok := hs.Get(100); ok {
+		t.Fatalf("a rejected write is readable")
+	}
+	for i := 0; i < 100; i++ {
+		if v, ok := hs.Get(common.KeyType(i)); !ok || string(v) != fmt.Sprintf("v%d", i) {
+			t.Fatalf("key %d accepted before the disk filled: got %q, %v", i, v, ok)
+		}
+	}
+	if stats := hs.Stats(); stats["read_only"] != true {
+		t.Fatalf("expected read_only in stats, got %v", stats["read_only"])
+	}
+	if hs.Readiness().Ready {
+		t.Fatalf("expected a read-only store not to be ready")
+	}
+
+	// Once the disk has room the next write finds out and goes through, and
+	// the pending flush with it.
+	newTableBuilder = sstable.NewBuilder
+	readOnlyRetryInterval = 0
+	if err := hs.Put(100, []byte("v100")); err != nil {
+		t.Fatalf("Put after the disk freed up: %v", err)
+	}
+	if err := hs.ReadOnly(); err != nil {
+		t.Fatalf("expected the store to be writable again, got %v", err)
+	}
+	if v, ok := hs.Get(100); !ok || string(v) != "v100" {
+		t.Fatalf("Get(100) = %q, %v", v, ok)
+	}
+	if n := hs.Stats()["l0_sstable_count"]; n != 1 {
+		t.Fatalf("expected the retried flush to write 1 L0 table, got %v", n)
+	}
+}
+
+func TestOpenReturnsErrorForUnwritableWAL(t *testing.T) {
+	t.Run("read-only directory", func(t *testing.T) {
+		cfg := testConfig(t)
+		cfg.Storage.WALPath = t.TempDir()
+		if err := os.Chmod(cfg.Storage.WALPath, 0555); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chmod(cfg.Storage.WALPath, 0755)
+		if f, err := os.Create(filepath.Join(cfg.Storage.WALPath, "probe")); err == nil {
+			f.Close()
+			t.Skip("permissions are not enforced for this user")
+		}
+		hs, err := OpenHybridStore(cfg, WithLogger(logger.New(io.Discard, logger.LevelError)))
+		if err == nil {
+			hs.Close()
+			t.Fatal("expected an error opening a store whose WAL directory is read-only")
+		}
+	})
+
+	// Unlike permissions, this fails for root too.
+	t.Run("directory in the way", func(t *testing.T) {
+		cfg := testConfig(t)
+		if err := os.Mkdir(filepath.Join(cfg.Storage.Path, backendName+".wal"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		hs, err := OpenHybridStore(cfg, WithLogger(logger.New(io.Discard, logger.LevelError)))
+		if err == nil {
+			hs.Close()
+			t.Fatal("expected an error opening a store whose WAL cannot be created")
+		}
+	})
+}
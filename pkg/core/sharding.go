@@ -0,0 +1,206 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"neurodb/pkg/common"
+	"neurodb/pkg/config"
+	"neurodb/pkg/storage/sstable"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// shardIndex routes key to one of n shards. The key is mixed (splitmix64
+// finalizer) before the modulo so structured keys, such as multiples of the
+// shard count or SQL table bases, still spread across shards.
+func shardIndex(key common.KeyType, n int) int {
+	z := uint64(key)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return int(z % uint64(n))
+}
+
+// route returns the shard owning key under the configured strategy.
+func (hs *HybridStore) route(key common.KeyType) int {
+	if hs.splits != nil {
+		return sort.Search(len(hs.splits), func(i int) bool { return hs.splits[i] > key })
+	}
+	return shardIndex(key, len(hs.shards))
+}
+
+// shardBounds returns the key range [lo, hi] shard i owns under range
+// sharding; ok is false for hash sharding, where every shard spans all keys.
+func (hs *HybridStore) shardBounds(i int) (lo, hi common.KeyType, ok bool) {
+	if hs.splits == nil {
+		return 0, 0, false
+	}
+	lo, hi = math.MinInt64, math.MaxInt64
+	if i > 0 {
+		lo = hs.splits[i-1]
+	}
+	if i < len(hs.splits) {
+		hi = hs.splits[i] - 1
+	}
+	return lo, hi, true
+}
+
+// ErrShardCount is returned by OpenHybridStore for data written with another
+// shard_count, unless system.reshard_on_open is set.
+var ErrShardCount = errors.New("core: data was written with another shard_count")
+
+// checkShardCount refuses data whose recorded routing used another shard
+// count. Stores from before the routing was recorded carry none and are
+// re-routed as before.
+func (hs *HybridStore) checkShardCount() error {
+	recorded, ok := schemeShardCount(hs.manifest.Sharding())
+	if !ok || recorded == len(hs.shards) {
+		return nil
+	}
+	if hs.conf.System.ReshardOnOpen {
+		hs.log.Warn("[NeuroDB] Data in %s has %d shards, config %d; re-routing (reshard_on_open)", hs.conf.Storage.Path, recorded, len(hs.shards))
+		return nil
+	}
+	return fmt.Errorf("%w: %s has %d shards, config has shard_count %d; set shard_count back to %d, or set system.reshard_on_open to re-route the data into %d shards",
+		ErrShardCount, hs.conf.Storage.Path, recorded, len(hs.shards), recorded, len(hs.shards))
+}
+
+// Reshard rewrites the store in cfg's data directory into shards shards and
+// records the new routing, so it can be opened with shard_count set to
+// shards from then on. Every SSTable is merged and rewritten under the new
+// routing in one manifest edit, and the WAL is replayed into the new shards
+// and checkpointed. The store must not be open elsewhere while it runs.
+func Reshard(cfg *config.Config, shards int, opts ...Option) error {
+	if shards <= 0 {
+		return fmt.Errorf("core: invalid shard count %d", shards)
+	}
+	c := *cfg
+	c.System.ShardCount = shards
+	c.System.ReshardOnOpen = true
+	hs, err := OpenHybridStore(&c, opts...)
+	if err != nil {
+		return err
+	}
+	hs.Close()
+	return nil
+}
+
+// schemeShardCount is the shard count of a routing named by shardingScheme.
+func schemeShardCount(scheme string) (int, bool) {
+	_, rest, ok := strings.Cut(scheme, "/")
+	if !ok {
+		return 0, false
+	}
+	rest, _, _ = strings.Cut(rest, ":")
+	n, err := strconv.Atoi(rest)
+	return n, err == nil && n > 0
+}
+
+// shardingScheme names the routing for this store's shard count (and split
+// points). It is recorded in the manifest so a store written with other
+// routing (key%n before hashing, another shard count or other splits) is
+// detected and re-routed on open.
+func (hs *HybridStore) shardingScheme() string {
+	if hs.splits == nil {
+		return fmt.Sprintf("splitmix64/%d", len(hs.shards))
+	}
+	parts := make([]string, len(hs.splits))
+	for i, k := range hs.splits {
+		parts[i] = strconv.FormatInt(int64(k), 10)
+	}
+	return fmt.Sprintf("range/%d:%s", len(hs.shards), strings.Join(parts, ","))
+}
+
+// parseRangeScheme extracts the split points from a range scheme for n shards.
+func parseRangeScheme(scheme string, n int) ([]common.KeyType, bool) {
+	prefix := fmt.Sprintf("range/%d:", n)
+	if !strings.HasPrefix(scheme, prefix) {
+		return nil, false
+	}
+	rest := strings.TrimPrefix(scheme, prefix)
+	splits := make([]common.KeyType, 0, n-1)
+	if rest != "" {
+		for _, p := range strings.Split(rest, ",") {
+			k, err := strconv.ParseInt(p, 10, 64)
+			if err != nil {
+				return nil, false
+			}
+			splits = append(splits, common.KeyType(k))
+		}
+	}
+	if len(splits) != n-1 {
+		return nil, false
+	}
+	return splits, true
+}
+
+// chooseRangeSplits sets hs.splits for range sharding. Splits recorded in the
+// manifest are kept unless the data on disk has drifted so far from them that
+// the shards are imbalanced; otherwise they are chosen as quantiles of the
+// SSTables' sampled keys (evenly over the non-negative keys for an empty store).
+func (hs *HybridStore) chooseRangeSplits() {
+	n := len(hs.shards)
+	samples := hs.sampleLiveKeys()
+	if recorded, ok := parseRangeScheme(hs.manifest.Sharding(), n); ok {
+		if !splitsSkewed(recorded, samples) {
+			hs.splits = recorded
+			return
+		}
+		hs.log.Info("[Shard] Range splits imbalanced for current data; choosing new splits")
+	}
+
+	splits := make([]common.KeyType, 0, n-1)
+	if len(samples) < n {
+		step := math.MaxInt64 / int64(n)
+		for i := 1; i < n; i++ {
+			splits = append(splits, common.KeyType(step*int64(i)))
+		}
+	} else {
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+		for i := 1; i < n; i++ {
+			k := samples[i*len(samples)/n]
+			if len(splits) > 0 && k <= splits[len(splits)-1] {
+				k = splits[len(splits)-1] + 1
+			}
+			splits = append(splits, k)
+		}
+	}
+	hs.splits = splits
+}
+
+// sampleLiveKeys collects the sparse-index keys of every live SSTable.
+func (hs *HybridStore) sampleLiveKeys() []common.KeyType {
+	var samples []common.KeyType
+	for _, meta := range hs.manifest.Live() {
+		sst, err := sstable.Open(hs.layout.TablePath(meta))
+		if err != nil {
+			continue
+		}
+		samples = append(samples, sst.SampleKeys()...)
+		sst.Close()
+	}
+	return samples
+}
+
+// splitsSkewed reports whether samples would be spread over the shards
+// defined by splits with a max/mean ratio above shardImbalanceWarn. Too few
+// samples never count as skewed.
+func splitsSkewed(splits, samples []common.KeyType) bool {
+	n := len(splits) + 1
+	if len(samples)*sstable.IndexRate < minImbalanceRecords {
+		return false
+	}
+	counts := make([]int, n)
+	for _, k := range samples {
+		counts[sort.Search(len(splits), func(i int) bool { return splits[i] > k })]++
+	}
+	maxCount := 0
+	for _, c := range counts {
+		if c > maxCount {
+			maxCount = c
+		}
+	}
+	return float64(maxCount)/(float64(len(samples))/float64(n)) > shardImbalanceWarn
+}
@@ -0,0 +1,54 @@
+package core
+
+import (
+	"neurodb/pkg/core/memory"
+	"neurodb/pkg/core/structure"
+	"neurodb/pkg/storage/sstable"
+)
+
+// shardView is what Stats reports about a shard, published whenever the
+// shard's tables, indexes, memtable or bloom filter change so that Stats
+// reads it without the shard lock: a flush or compaction holding the lock
+// never stalls observability. It is never modified once published.
+type shardView struct {
+	mem     *memory.MemTable
+	bloom   *structure.BloomFilter
+	tables  []*sstable.SSTable // shard.sstables, replaced rather than modified
+	indexes int
+	indexed int // keys in the newest learned index
+	// Size of the learned indexes' models and the keys they were fit to.
+	modelBytes   int
+	modelRecords int
+	l0           int
+	l0Bytes      int64
+	l1           int
+}
+
+// publishLocked publishes the shard's current view. The caller holds
+// shard.mutex for writing and has finished changing the shard.
+func (shard *Shard) publishLocked() {
+	v := &shardView{
+		mem:     shard.mutableMem,
+		bloom:   shard.bloom,
+		tables:  shard.sstables,
+		indexes: len(shard.learnedIndexes),
+		indexed: shard.indexedCountLocked(),
+		l0:      len(shard.l0SSTables),
+		l1:      len(shard.l1SSTables),
+	}
+	for _, sst := range shard.l0SSTables {
+		v.l0Bytes += sst.Size()
+	}
+	for _, li := range shard.learnedIndexes {
+		if li.HasModel() {
+			v.modelBytes += li.ModelSize()
+			v.modelRecords += li.Size()
+		}
+	}
+	shard.view.Store(v)
+}
+
+// records approximates the records in the shard like recordCountLocked.
+func (v *shardView) records() int {
+	return v.mem.Count() + v.indexed
+}
@@ -0,0 +1,72 @@
+package core
+
+import (
+	"neurodb/pkg/common"
+	"neurodb/pkg/storage/sstable"
+)
+
+// spaceUsage is the SSTable footprint of one set of a shard's tables.
+type spaceUsage struct {
+	sig   string
+	total int64 // bytes of the table files
+	data  int64 // bytes of their records
+	live  int64 // bytes of the records Compact would keep
+}
+
+// shardSpace reports the shard's SSTable bytes and how many bytes of records
+// they hold in all and live; the difference is shadowed versions, deleted
+// keys and tombstones that a full compaction reclaims. Finding the live bytes
+// reads every table, so the result is kept until the shard's tables change.
+func (hs *HybridStore) shardSpace(shard *Shard) spaceUsage {
+	tables := shard.view.Load().tables
+
+	sig := tableSetSignature(tables)
+	if u := shard.space.Load(); u != nil && u.sig == sig {
+		return *u
+	}
+
+	u := &spaceUsage{sig: sig}
+	for i, t := range tables {
+		// A table compacted away since the view was published: report the
+		// last result and measure the new tables next time.
+		if !t.Ref() {
+			for _, held := range tables[:i] {
+				held.Close()
+			}
+			if last := shard.space.Load(); last != nil {
+				return *last
+			}
+			return *u
+		}
+	}
+	defer func() {
+		for _, t := range tables {
+			t.Close()
+		}
+	}()
+	iters := make([]*sstable.Iterator, len(tables))
+	inputs := make([]sstable.KVIterator, len(tables))
+	var tombstones [][]common.RangeTombstone
+	for i, t := range tables {
+		u.total += t.Size()
+		u.data += t.DataSize()
+		iters[i] = t.NewIterator()
+		inputs[i] = iters[i]
+		tombstones = append(tombstones, t.RangeTombstones())
+	}
+	merged := sstable.NewMergingIterator(inputs, sstable.NewerFirst)
+	for merged.Next() {
+		if len(merged.Value()) > 0 && !deletedByNewer(tombstones, merged.Source(), merged.Key()) {
+			u.live += 12 + int64(len(merged.Value()))
+		}
+	}
+	merged.Close()
+	for _, it := range iters {
+		// A failed read; try again next time.
+		if it.Err() != nil {
+			return *u
+		}
+	}
+	shard.space.Store(u)
+	return *u
+}
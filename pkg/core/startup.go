@@ -0,0 +1,41 @@
+package core
+
+import "time"
+
+// StartupStats is what opening the store recovered and how long each phase
+// of the recovery took. It does not change after the store is open.
+type StartupStats struct {
+	SSTablesRestored int
+	IndexesLoaded    int // learned indexes read from their persisted files
+	IndexesRebuilt   int // learned indexes trained again from the SSTables
+	WALBytes         int64
+	WALRecords       int // records and range deletes replayed from the WAL
+
+	SSTableRestore time.Duration
+	IndexRestore   time.Duration
+	WALReplay      time.Duration
+	Checkpoint     time.Duration // writing the replayed records to SSTables
+	Total          time.Duration // all of opening, from the manifest on
+}
+
+// Startup reports how the store's open went.
+func (hs *HybridStore) Startup() StartupStats {
+	return hs.startup
+}
+
+// fields is the stats form of s, with durations in milliseconds.
+func (s StartupStats) fields() map[string]interface{} {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return map[string]interface{}{
+		"sstables_restored":    s.SSTablesRestored,
+		"indexes_loaded":       s.IndexesLoaded,
+		"indexes_rebuilt":      s.IndexesRebuilt,
+		"wal_bytes":            s.WALBytes,
+		"wal_records_replayed": s.WALRecords,
+		"sstable_restore_ms":   ms(s.SSTableRestore),
+		"index_restore_ms":     ms(s.IndexRestore),
+		"wal_replay_ms":        ms(s.WALReplay),
+		"checkpoint_ms":        ms(s.Checkpoint),
+		"total_ms":             ms(s.Total),
+	}
+}
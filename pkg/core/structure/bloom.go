@@ -11,7 +11,9 @@ type BloomFilter struct {
 	bitset []bool
 	k      uint
 	m      uint
+	n      uint // elements the filter is designed for
 	count  uint
+	set    uint // bits currently true
 	lock   sync.RWMutex
 }
 
@@ -27,6 +29,7 @@ func NewBloomFilter(n uint, p float64) *BloomFilter {
 		bitset: make([]bool, m),
 		k:      k,
 		m:      m,
+		n:      n,
 		count:  0,
 	}
 }
@@ -41,7 +44,10 @@ func (bf *BloomFilter) Add(key common.KeyType) {
 
 	for i := uint(0); i < bf.k; i++ {
 		pos := (h1 + uint32(i)*h2) % uint32(bf.m)
-		bf.bitset[pos] = true
+		if !bf.bitset[pos] {
+			bf.bitset[pos] = true
+			bf.set++
+		}
 	}
 	bf.count++
 }
@@ -76,12 +82,38 @@ func hash2(n int64) uint32 {
 	return uint32(n ^ (n >> 32))
 }
 
-func (bf *BloomFilter) Stats() map[string]interface{} {
+// BloomStats describes how saturated a filter is. EstimatedFP is the chance
+// that a key never added passes Contains at the current fill: FillRatio^k.
+// Past Capacity elements it exceeds the p the filter was sized for.
+type BloomStats struct {
+	Bits        uint
+	SetBits     uint
+	Hashes      uint
+	Elements    uint
+	Capacity    uint
+	FillRatio   float64
+	EstimatedFP float64
+}
+
+func (bf *BloomFilter) Snapshot() BloomStats {
 	bf.lock.RLock()
 	defer bf.lock.RUnlock()
+	st := BloomStats{Bits: bf.m, SetBits: bf.set, Hashes: bf.k, Elements: bf.count, Capacity: bf.n}
+	if bf.m > 0 {
+		st.FillRatio = float64(bf.set) / float64(bf.m)
+		st.EstimatedFP = math.Pow(st.FillRatio, float64(bf.k))
+	}
+	return st
+}
+
+func (bf *BloomFilter) Stats() map[string]interface{} {
+	st := bf.Snapshot()
 	return map[string]interface{}{
-		"bloom_bits_size": bf.m,
-		"bloom_hashes":    bf.k,
-		"bloom_count":     bf.count,
+		"bloom_bits_size":    st.Bits,
+		"bloom_hashes":       st.Hashes,
+		"bloom_count":        st.Elements,
+		"bloom_capacity":     st.Capacity,
+		"bloom_fill_ratio":   st.FillRatio,
+		"bloom_estimated_fp": st.EstimatedFP,
 	}
 }
@@ -0,0 +1,190 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"neurodb/pkg/storage"
+	"neurodb/pkg/storage/sstable"
+	"os"
+	"path/filepath"
+)
+
+// QuarantineDir is the subdirectory of the data directory that Verify moves
+// corrupt files into when repairing.
+const QuarantineDir = "quarantine"
+
+// VerifyProblem is one file Verify found damaged. Repaired is set once
+// Verify has quarantined or rewritten it.
+type VerifyProblem struct {
+	File     string `json:"file"`
+	Problem  string `json:"problem"`
+	Repaired bool   `json:"repaired,omitempty"`
+}
+
+// VerifyReport lists the files Verify checked and what was wrong with them.
+type VerifyReport struct {
+	Scanned  []string        `json:"scanned"`
+	Problems []VerifyProblem `json:"problems"`
+}
+
+// OK reports whether no problems were found.
+func (r *VerifyReport) OK() bool { return len(r.Problems) == 0 }
+
+func (r *VerifyReport) add(file, format string, args ...interface{}) *VerifyProblem {
+	r.Problems = append(r.Problems, VerifyProblem{File: file, Problem: fmt.Sprintf(format, args...)})
+	return &r.Problems[len(r.Problems)-1]
+}
+
+// Verify checks the data directory dir without opening a store: that the
+// manifest reads cleanly, every live SSTable it lists exists and is well
+// formed, and every WAL entry passes its CRC.
+//
+// With repair set, damaged SSTables are moved to QuarantineDir and dropped
+// from the manifest (their records are lost), and a WAL is cut back to its
+// last good entry after copying it to QuarantineDir. The store must not be
+// running while Verify repairs.
+func Verify(dir string, repair bool) (*VerifyReport, error) {
+	return VerifyLayout(Layout{Dir: dir, WAL: dir, L0: dir, L1: dir}, repair)
+}
+
+// VerifyLayout is Verify for a store whose WAL or SSTables live outside its
+// data directory. Damaged files are quarantined next to where they were found.
+func VerifyLayout(layout Layout, repair bool) (*VerifyReport, error) {
+	dir := layout.Dir
+	report := &VerifyReport{Problems: []VerifyProblem{}}
+
+	// No manifest is a store that never flushed or predates the manifest.
+	var live []storage.FileMeta
+	manifestPath := filepath.Join(dir, storage.ManifestName)
+	if _, err := os.Stat(manifestPath); err == nil {
+		report.Scanned = append(report.Scanned, storage.ManifestName)
+		if live, err = storage.ReadManifest(manifestPath); err != nil {
+			p := report.add(storage.ManifestName, "%v", err)
+			if repair {
+				// A copy is kept, since the rewrite drops the damaged record
+				// and every edit after it.
+				if err := quarantine(dir, storage.ManifestName, false); err != nil {
+					return report, err
+				}
+				if err := storage.RepairManifest(manifestPath); err != nil {
+					return report, err
+				}
+				p.Repaired = true
+				// Tables only the dropped edits listed would otherwise be
+				// deleted as garbage on the next open.
+				if err := quarantineUnlisted(layout, live, report); err != nil {
+					return report, err
+				}
+			}
+		}
+	}
+
+	var bad []string
+	for _, meta := range live {
+		report.Scanned = append(report.Scanned, meta.Name)
+		path := layout.TablePath(meta)
+		if _, err := os.Stat(path); err != nil {
+			report.add(meta.Name, "listed in the manifest but missing: %v", err)
+			bad = append(bad, meta.Name)
+			continue
+		}
+		sst, err := sstable.Open(path)
+		if err == nil {
+			err = sst.Verify()
+			sst.Close()
+		}
+		if err != nil {
+			p := report.add(meta.Name, "%v", err)
+			bad = append(bad, meta.Name)
+			if repair {
+				if err := quarantine(filepath.Dir(path), meta.Name, true); err != nil {
+					return report, err
+				}
+				p.Repaired = true
+			}
+		}
+	}
+	if repair && len(bad) > 0 {
+		m, _, err := storage.OpenManifest(manifestPath)
+		if err != nil {
+			return report, err
+		}
+		err = m.Apply(storage.VersionEdit{Remove: bad})
+		m.Close()
+		if err != nil {
+			return report, err
+		}
+	}
+
+	walName := backendName + ".wal"
+	walPath := filepath.Join(layout.WAL, walName)
+	if _, err := os.Stat(walPath); err == nil {
+		report.Scanned = append(report.Scanned, walName)
+		entries, valid, err := storage.CheckWAL(walPath)
+		if err != nil {
+			p := report.add(walName, "entry %d at byte %d: %v", entries, valid, err)
+			if repair {
+				if err := quarantine(layout.WAL, walName, false); err != nil {
+					return report, err
+				}
+				if err := os.Truncate(walPath, valid); err != nil {
+					return report, err
+				}
+				p.Repaired = true
+			}
+		}
+	}
+	return report, nil
+}
+
+// Verify checks the store's files on disk; see the package-level Verify.
+// Files being written while it runs may be reported as torn.
+func (hs *HybridStore) Verify() (*VerifyReport, error) {
+	return VerifyLayout(hs.layout, false)
+}
+
+// quarantineUnlisted moves the SSTables in layout that live does not list
+// into QuarantineDir, reporting each as repaired.
+func quarantineUnlisted(layout Layout, live []storage.FileMeta, report *VerifyReport) error {
+	listed := make(map[string]bool, len(live))
+	for _, meta := range live {
+		listed[meta.Name] = true
+	}
+	for _, f := range layout.globTables("shard-*.sst") {
+		name := filepath.Base(f)
+		if listed[name] {
+			continue
+		}
+		if err := quarantine(filepath.Dir(f), name, true); err != nil {
+			return err
+		}
+		report.add(name, "not listed in the repaired manifest").Repaired = true
+	}
+	return nil
+}
+
+// quarantine moves (or, with move unset, copies) dir/name into QuarantineDir.
+func quarantine(dir, name string, move bool) error {
+	qdir := filepath.Join(dir, QuarantineDir)
+	if err := os.MkdirAll(qdir, 0755); err != nil {
+		return err
+	}
+	src, dst := filepath.Join(dir, name), filepath.Join(qdir, name)
+	if move {
+		return os.Rename(src, dst)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
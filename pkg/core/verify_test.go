@@ -0,0 +1,96 @@
+package core
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"neurodb/pkg/storage"
+)
+
+func TestVerifyFlagsAndQuarantinesCorruptFiles(t *testing.T) {
+	dir := t.TempDir()
+	good, bad := "shard-0-l1-1.sst", "shard-0-l1-2.sst"
+	writeTestSST(t, filepath.Join(dir, good), sortedRecords(300))
+	writeTestSST(t, filepath.Join(dir, bad), sortedRecords(300))
+	m, _, err := storage.OpenManifest(filepath.Join(dir, storage.ManifestName))
+	if err != nil {
+		t.Fatalf("open manifest: %v", err)
+	}
+	if err := m.Apply(storage.VersionEdit{Add: []storage.FileMeta{{Name: good, Level: 1}, {Name: bad, Level: 1}}}); err != nil {
+		t.Fatalf("apply edit: %v", err)
+	}
+	m.Close()
+	walPath := filepath.Join(dir, backendName+".wal")
+	wal, err := storage.OpenWAL(walPath)
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	wal.Append(1, []byte("one"))
+	wal.Append(2, []byte("two"))
+	wal.Close()
+	walSize := fileSize(t, walPath)
+
+	report, err := Verify(dir, false)
+	if err != nil || !report.OK() || len(report.Scanned) != 4 {
+		t.Fatalf("clean directory: err=%v report=%+v", err, report)
+	}
+
+	// A huge value length in the table's first record, and a torn WAL tail.
+	f, err := os.OpenFile(filepath.Join(dir, bad), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open sstable: %v", err)
+	}
+	lenField := make([]byte, 4)
+	binary.LittleEndian.PutUint32(lenField, 1<<30)
+	f.WriteAt(lenField, 8)
+	f.Close()
+	wf, _ := os.OpenFile(walPath, os.O_WRONLY|os.O_APPEND, 0)
+	wf.Write([]byte("torn"))
+	wf.Close()
+
+	report, err = Verify(dir, false)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	flagged := map[string]bool{}
+	for _, p := range report.Problems {
+		flagged[p.File] = true
+	}
+	if len(report.Problems) != 2 || !flagged[bad] || !flagged[backendName+".wal"] {
+		t.Fatalf("expected the corrupt table and the WAL flagged, got %+v", report.Problems)
+	}
+
+	report, err = Verify(dir, true)
+	if err != nil {
+		t.Fatalf("repair: %v", err)
+	}
+	for _, p := range report.Problems {
+		if !p.Repaired {
+			t.Fatalf("problem not repaired: %+v", p)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, QuarantineDir, bad)); err != nil {
+		t.Fatalf("corrupt table not quarantined: %v", err)
+	}
+	if got := fileSize(t, walPath); got != walSize {
+		t.Fatalf("repaired WAL is %d bytes, want %d", got, walSize)
+	}
+	live, err := storage.ReadManifest(filepath.Join(dir, storage.ManifestName))
+	if err != nil || len(live) != 1 || live[0].Name != good {
+		t.Fatalf("manifest after repair: %v %+v", err, live)
+	}
+	if report, _ = Verify(dir, false); !report.OK() {
+		t.Fatalf("problems remain after repair: %+v", report.Problems)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat %s: %v", path, err)
+	}
+	return st.Size()
+}
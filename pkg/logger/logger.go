@@ -0,0 +1,82 @@
+// Package logger is the leveled logging interface used across NeuroDB, so
+// operators can set verbosity or route logs into their own pipeline.
+package logger
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Logger takes Printf-style messages at four levels. Debug is for
+// per-operation and per-flush detail that is off by default.
+type Logger interface {
+	Debug(format string, args ...interface{})
+	Info(format string, args ...interface{})
+	Warn(format string, args ...interface{})
+	Error(format string, args ...interface{})
+}
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel accepts debug, info, warn (or warning) and error in any case.
+// An empty string is info.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("logger: unknown level %q", s)
+}
+
+type stdLogger struct {
+	out *log.Logger
+	min Level
+}
+
+// New returns a Logger writing messages at min or above to w through the
+// standard log package, prefixed with the level.
+func New(w io.Writer, min Level) Logger {
+	return &stdLogger{out: log.New(w, "", log.LstdFlags), min: min}
+}
+
+// Default logs Info and above to stderr.
+func Default() Logger {
+	return New(os.Stderr, LevelInfo)
+}
+
+func (l *stdLogger) logf(level Level, format string, args ...interface{}) {
+	if level < l.min {
+		return
+	}
+	l.out.Printf("%-5s %s", level, fmt.Sprintf(format, args...))
+}
+
+func (l *stdLogger) Debug(format string, args ...interface{}) { l.logf(LevelDebug, format, args...) }
+func (l *stdLogger) Info(format string, args ...interface{})  { l.logf(LevelInfo, format, args...) }
+func (l *stdLogger) Warn(format string, args ...interface{})  { l.logf(LevelWarn, format, args...) }
+func (l *stdLogger) Error(format string, args ...interface{}) { l.logf(LevelError, format, args...) }
@@ -0,0 +1,35 @@
+package logger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNewFiltersBelowMinLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, LevelWarn)
+	l.Debug("flush %d", 1)
+	l.Info("restored %d tables", 2)
+	l.Warn("imbalance %.1f", 2.5)
+	l.Error("write failed: %v", "disk full")
+
+	out := buf.String()
+	if strings.Contains(out, "flush") || strings.Contains(out, "restored") {
+		t.Fatalf("messages below warn were logged:\n%s", out)
+	}
+	if !strings.Contains(out, "WARN  imbalance 2.5") || !strings.Contains(out, "ERROR write failed: disk full") {
+		t.Fatalf("expected warn and error lines with their level, got:\n%s", out)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for in, want := range map[string]Level{"": LevelInfo, "DEBUG": LevelDebug, "warning": LevelWarn, " error ": LevelError} {
+		if got, err := ParseLevel(in); err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+}
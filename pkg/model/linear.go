@@ -2,14 +2,19 @@ package model
 
 import "neurodb/pkg/common"
 
+// LinearModel fits pos = Slope*(key-Origin) + Intercept. Keys are shifted to
+// the first trained key and the fit is kept as running means and co-moments
+// (Welford), so large int64 keys and long runs of incremental updates do not
+// lose precision the way raw sums of x*x do.
 type LinearModel struct {
 	Slope     float64
 	Intercept float64
 	N         float64
-	SumX      float64
-	SumY      float64
-	SumXY     float64
-	SumXX     float64
+	MeanX     float64
+	MeanY     float64
+	Cxy       float64
+	Cxx       float64
+	Origin    common.KeyType
 }
 
 func NewLinearModel() *LinearModel {
@@ -17,58 +22,68 @@ func NewLinearModel() *LinearModel {
 }
 
 func (lm *LinearModel) Train(keys []common.KeyType) {
-	lm.N = float64(len(keys))
-	lm.SumX, lm.SumY, lm.SumXY, lm.SumXX = 0, 0, 0, 0
-
+	lm.reset(keys)
 	for i, key := range keys {
-		x := float64(key)
-		y := float64(i)
-		lm.SumX += x
-		lm.SumY += y
-		lm.SumXY += x * y
-		lm.SumXX += x * x
+		lm.add(key, float64(i))
 	}
 	lm.solve()
 }
 
 func (lm *LinearModel) TrainWithPos(keys []common.KeyType, positions []int) {
-	lm.N = float64(len(keys))
-	lm.SumX, lm.SumY, lm.SumXY, lm.SumXX = 0, 0, 0, 0
-
+	lm.reset(keys)
 	for i, key := range keys {
-		x := float64(key)
-		y := float64(positions[i])
-		lm.SumX += x
-		lm.SumY += y
-		lm.SumXY += x * y
-		lm.SumXX += x * x
+		lm.add(key, float64(positions[i]))
 	}
 	lm.solve()
 }
 
 func (lm *LinearModel) Update(key common.KeyType, pos int) {
-	x := float64(key)
-	y := float64(pos)
-
-	lm.N += 1
-	lm.SumX += x
-	lm.SumY += y
-	lm.SumXY += x * y
-	lm.SumXX += x * x
+	if lm.N == 0 {
+		lm.Origin = key
+	}
+	lm.add(key, float64(pos))
 	lm.solve()
 }
 
+func (lm *LinearModel) reset(keys []common.KeyType) {
+	*lm = LinearModel{}
+	if len(keys) > 0 {
+		lm.Origin = keys[0]
+	}
+}
+
+// offset returns key-Origin, exact whenever the difference fits in an int64.
+func (lm *LinearModel) offset(key common.KeyType) float64 {
+	d := key - lm.Origin
+	if (d < 0) != (key < lm.Origin) {
+		return float64(key) - float64(lm.Origin)
+	}
+	return float64(d)
+}
+
+func (lm *LinearModel) add(key common.KeyType, y float64) {
+	x := lm.offset(key)
+	lm.N++
+	dx := x - lm.MeanX
+	lm.MeanX += dx / lm.N
+	lm.MeanY += (y - lm.MeanY) / lm.N
+	lm.Cxx += dx * (x - lm.MeanX)
+	lm.Cxy += dx * (y - lm.MeanY)
+}
+
 func (lm *LinearModel) solve() {
-	denominator := lm.N*lm.SumXX - lm.SumX*lm.SumX
-	if denominator == 0 {
+	if lm.N == 0 {
+		lm.Slope, lm.Intercept = 0, 0
+		return
+	}
+	if lm.Cxx == 0 {
 		lm.Slope = 0
-		lm.Intercept = 0
 	} else {
-		lm.Slope = (lm.N*lm.SumXY - lm.SumX*lm.SumY) / denominator
-		lm.Intercept = (lm.SumY - lm.Slope*lm.SumX) / lm.N
+		lm.Slope = lm.Cxy / lm.Cxx
 	}
+	lm.Intercept = lm.MeanY - lm.Slope*lm.MeanX
 }
 
 func (lm *LinearModel) Predict(key common.KeyType) int {
-	return int(lm.Slope*float64(key) + lm.Intercept)
+	return int(lm.Slope*lm.offset(key) + lm.Intercept)
 }
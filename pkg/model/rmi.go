@@ -2,6 +2,7 @@ package model
 
 import (
 	"neurodb/pkg/common"
+	"unsafe"
 )
 
 type RMIModel struct {
@@ -9,15 +10,30 @@ type RMIModel struct {
 	GlobalMax common.KeyType
 	Fanout    int
 	Buckets   []LinearModel
+	// MinPos/MaxPos bound each bucket's predictions to the positions its
+	// training keys occupied. An empty bucket holds the insertion point.
+	MinPos []int
+	MaxPos []int
 }
 
 func NewRMIModel(fanout int) *RMIModel {
 	return &RMIModel{
 		Fanout:  fanout,
 		Buckets: make([]LinearModel, fanout),
+		MinPos:  make([]int, fanout),
+		MaxPos:  make([]int, fanout),
 	}
 }
 
+// SizeInBytes is the memory the model takes: its header plus, per bucket, a
+// linear model and the bucket's position bounds. It grows with Fanout, not
+// with the number of keys trained on.
+func (rmi *RMIModel) SizeInBytes() int {
+	return int(unsafe.Sizeof(*rmi)) +
+		len(rmi.Buckets)*int(unsafe.Sizeof(LinearModel{})) +
+		(len(rmi.MinPos)+len(rmi.MaxPos))*int(unsafe.Sizeof(int(0)))
+}
+
 func (rmi *RMIModel) Train(keys []common.KeyType) {
 	if len(keys) == 0 {
 		return
@@ -47,15 +63,22 @@ func (rmi *RMIModel) Train(keys []common.KeyType) {
 		bucketPoss[bucketIdx] = append(bucketPoss[bucketIdx], i)
 	}
 
+	next := 0
 	for i := 0; i < rmi.Fanout; i++ {
 		(&rmi.Buckets[i]).TrainWithPos(bucketKeys[i], bucketPoss[i])
+		if n := len(bucketPoss[i]); n > 0 {
+			rmi.MinPos[i], rmi.MaxPos[i] = bucketPoss[i][0], bucketPoss[i][n-1]
+			next = bucketPoss[i][n-1] + 1
+		} else {
+			rmi.MinPos[i], rmi.MaxPos[i] = next, next
+		}
 	}
 }
 
-func (rmi *RMIModel) Predict(key common.KeyType) int {
+func (rmi *RMIModel) bucket(key common.KeyType) int {
 	keyRange := float64(rmi.GlobalMax - rmi.GlobalMin)
 	if keyRange == 0 {
-		return 0
+		keyRange = 1
 	}
 
 	bucketIdx := int(float64(key-rmi.GlobalMin) / keyRange * float64(rmi.Fanout))
@@ -65,23 +88,42 @@ func (rmi *RMIModel) Predict(key common.KeyType) int {
 	if bucketIdx < 0 {
 		bucketIdx = 0
 	}
+	return bucketIdx
+}
 
-	return rmi.Buckets[bucketIdx].Predict(key)
+// Bucket is the index of the bucket model that predicts key.
+func (rmi *RMIModel) Bucket(key common.KeyType) int {
+	return rmi.bucket(key)
 }
 
-func (rmi *RMIModel) Update(key common.KeyType, pos int) {
-	keyRange := float64(rmi.GlobalMax - rmi.GlobalMin)
-	if keyRange == 0 {
-		keyRange = 1
+// Predict returns the bucket model's estimate clamped to the positions the
+// bucket covers, so extrapolation near bucket edges cannot widen the error
+// bounds.
+func (rmi *RMIModel) Predict(key common.KeyType) int {
+	if rmi.GlobalMax == rmi.GlobalMin {
+		return 0
 	}
 
-	bucketIdx := int(float64(key-rmi.GlobalMin) / keyRange * float64(rmi.Fanout))
-	if bucketIdx >= rmi.Fanout {
-		bucketIdx = rmi.Fanout - 1
+	b := rmi.bucket(key)
+	pos := rmi.Buckets[b].Predict(key)
+	if pos < rmi.MinPos[b] {
+		return rmi.MinPos[b]
 	}
-	if bucketIdx < 0 {
-		bucketIdx = 0
+	if pos > rmi.MaxPos[b] {
+		return rmi.MaxPos[b]
+	}
+	return pos
+}
+
+func (rmi *RMIModel) Update(key common.KeyType, pos int) {
+	b := rmi.bucket(key)
+	if rmi.Buckets[b].N == 0 {
+		rmi.MinPos[b], rmi.MaxPos[b] = pos, pos
+	} else if pos < rmi.MinPos[b] {
+		rmi.MinPos[b] = pos
+	} else if pos > rmi.MaxPos[b] {
+		rmi.MaxPos[b] = pos
 	}
 
-	(&rmi.Buckets[bucketIdx]).Update(key, pos)
+	(&rmi.Buckets[b]).Update(key, pos)
 }
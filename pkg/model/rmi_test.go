@@ -0,0 +1,83 @@
+package model
+
+import (
+	"sort"
+	"testing"
+	"unsafe"
+
+	"neurodb/pkg/common"
+)
+
+// maxMiss returns the largest distance between a prediction and the true
+// insertion point of each query, i.e. how far a lookup must search.
+func maxMiss(keys, queries []common.KeyType, predict func(common.KeyType) int) int {
+	worst := 0
+	for _, q := range queries {
+		ip := sort.Search(len(keys), func(i int) bool { return keys[i] >= q })
+		d := predict(q) - ip
+		if d < 0 {
+			d = -d
+		}
+		if d > worst {
+			worst = d
+		}
+	}
+	return worst
+}
+
+func TestRMIPredictClampsToBucketPositions(t *testing.T) {
+	// Dense runs separated by wide gaps. Keys just past a run extrapolate
+	// its steep line far beyond the bucket, and buckets that fall entirely in
+	// a gap have no model at all.
+	var keys, edges []common.KeyType
+	for run := int64(0); run < 20; run++ {
+		base := run * 1000000
+		for i := int64(0); i < 500; i++ {
+			keys = append(keys, common.KeyType(base+i))
+		}
+		edges = append(edges, common.KeyType(base+500), common.KeyType(base+5000), common.KeyType(base+400000))
+	}
+	rmi := NewRMIModel(30)
+	rmi.Train(keys)
+
+	before := maxMiss(keys, edges, func(k common.KeyType) int {
+		return rmi.Buckets[rmi.bucket(k)].Predict(k)
+	})
+	after := maxMiss(keys, edges, rmi.Predict)
+	t.Logf("edge-key search distance: unclamped=%d clamped=%d", before, after)
+	if after >= before || after > 500 {
+		t.Fatalf("expected clamping to bound the search distance, unclamped=%d clamped=%d", before, after)
+	}
+
+	for i, k := range keys {
+		b := rmi.bucket(k)
+		if p := rmi.Predict(k); p < rmi.MinPos[b] || p > rmi.MaxPos[b] {
+			t.Fatalf("key %d (pos %d): prediction %d outside bucket range [%d, %d]", k, i, p, rmi.MinPos[b], rmi.MaxPos[b])
+		}
+	}
+}
+
+func TestRMISizeGrowsWithFanoutNotKeys(t *testing.T) {
+	perBucket := int(unsafe.Sizeof(LinearModel{})) + 2*int(unsafe.Sizeof(int(0)))
+	small, large := NewRMIModel(100), NewRMIModel(1000)
+	if d := large.SizeInBytes() - small.SizeInBytes(); d != 900*perBucket {
+		t.Fatalf("900 more buckets add %d bytes, want %d", d, 900*perBucket)
+	}
+
+	keys := make([]common.KeyType, 100000)
+	for i := range keys {
+		keys[i] = common.KeyType(i * 3)
+	}
+	before := small.SizeInBytes()
+	small.Train(keys[:100])
+	if small.SizeInBytes() != before {
+		t.Fatalf("training on 100 keys changed the size from %d to %d", before, small.SizeInBytes())
+	}
+	small.Train(keys)
+	if small.SizeInBytes() != before {
+		t.Fatalf("training on %d keys changed the size from %d to %d", len(keys), before, small.SizeInBytes())
+	}
+	if before < 100*perBucket {
+		t.Fatalf("size %d is under the %d bytes of its buckets", before, 100*perBucket)
+	}
+}
@@ -46,3 +46,10 @@ func (ws *WorkloadStats) Snapshot() (reads, writes, hits uint64) {
 	hits = atomic.LoadUint64(&ws.HitCount)
 	return
 }
+
+// Reset zeroes the counters in place, so callers holding ws keep using it.
+func (ws *WorkloadStats) Reset() {
+	atomic.StoreUint64(&ws.ReadCount, 0)
+	atomic.StoreUint64(&ws.WriteCount, 0)
+	atomic.StoreUint64(&ws.HitCount, 0)
+}
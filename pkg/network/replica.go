@@ -0,0 +1,177 @@
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"neurodb/pkg/client"
+	"neurodb/pkg/core"
+	"neurodb/pkg/logger"
+	"neurodb/pkg/storage"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// replicaRetryInterval is how long a replica waits before reconnecting to
+// its primary.
+const replicaRetryInterval = time.Second
+
+// replicaSaveInterval is how often a following replica saves its offset.
+const replicaSaveInterval = time.Second
+
+// ReplicaOffsetName is the file in the replica store's data directory that
+// holds the primary's WAL offset the store has durably applied.
+const ReplicaOffsetName = "REPLICA_OFFSET"
+
+// ErrResyncRequired is returned by Replica.Run when the primary can no longer
+// stream from the replica's offset: the entries it needs were truncated, or
+// the offset is past the end of the primary's log. The replica's store has to
+// be rebuilt from a copy of the primary's data.
+var ErrResyncRequired = errors.New("replication: resync required")
+
+// Replica keeps a local store up to date with a primary by applying its WAL
+// stream. The store keeps serving reads meanwhile; writes sent to it directly
+// are not forwarded to the primary.
+type Replica struct {
+	store     *core.HybridStore
+	primary   string
+	tlsConfig *tls.Config
+	log       logger.Logger
+	offset    atomic.Int64
+	saved     int64 // offset in the offset file
+	path      string
+}
+
+// NewReplica replicates the primary at addr into store, resuming from the
+// offset saved in the store's data directory. A nil conf dials plaintext TCP.
+func NewReplica(store *core.HybridStore, addr string, conf *tls.Config) (*Replica, error) {
+	r := &Replica{
+		store:     store,
+		primary:   addr,
+		tlsConfig: conf,
+		log:       store.Logger(),
+		path:      filepath.Join(store.Layout().Dir, ReplicaOffsetName),
+	}
+	data, err := os.ReadFile(r.path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	case len(data) != 8:
+		return nil, fmt.Errorf("replication: corrupted offset file %s", r.path)
+	default:
+		r.saved = int64(binary.LittleEndian.Uint64(data))
+		r.offset.Store(r.saved)
+	}
+	return r, nil
+}
+
+// Offset is the primary's WAL position up to which entries have been applied.
+func (r *Replica) Offset() int64 {
+	return r.offset.Load()
+}
+
+// Run follows the primary until ctx is done, reconnecting after errors and
+// resuming from the last applied offset. It returns ErrResyncRequired,
+// without retrying, once the primary cannot stream from that offset.
+//
+// The offset is saved once the store has logged what came before it, so
+// after a crash the replica resumes at or before the last entry it applied:
+// entries can be applied twice, which is harmless for puts and deletes but
+// repeats a merge.
+func (r *Replica) Run(ctx context.Context) error {
+	for {
+		err := r.follow(ctx)
+		if serr := r.save(); serr != nil {
+			r.log.Warn("[Replication] Cannot save offset %d: %v", r.Offset(), serr)
+		}
+		if errors.Is(err, storage.ErrOffsetTruncated) || errors.Is(err, storage.ErrOffsetOutOfRange) {
+			return fmt.Errorf("%w: primary %s at offset %d: %v", ErrResyncRequired, r.primary, r.Offset(), err)
+		}
+		if err != nil && ctx.Err() == nil {
+			r.log.Warn("[Replication] Lost primary %s at offset %d: %v", r.primary, r.Offset(), err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(replicaRetryInterval):
+		}
+	}
+}
+
+// follow applies one connection's worth of the stream.
+func (r *Replica) follow(ctx context.Context) error {
+	c, err := client.DialTLS(r.primary, r.tlsConfig)
+	if err != nil {
+		return err
+	}
+	stream, err := c.StreamWAL(r.Offset())
+	if err != nil {
+		c.Close()
+		return err
+	}
+	defer stream.Close()
+	// Unblocks Next when ctx ends.
+	stop := context.AfterFunc(ctx, func() { stream.Close() })
+	defer stop()
+
+	r.log.Info("[Replication] Following %s from offset %d", r.primary, r.Offset())
+	lastSave := time.Now()
+	for {
+		entry, err := stream.Next()
+		if err != nil {
+			return err
+		}
+		// Already in the primary's key order and encoding. On failure the
+		// entry is fetched again after reconnecting.
+		if err := r.store.ApplyWAL(entry); err != nil {
+			return err
+		}
+		r.offset.Store(stream.Offset())
+		if time.Since(lastSave) >= replicaSaveInterval {
+			if err := r.save(); err != nil {
+				r.log.Warn("[Replication] Cannot save offset %d: %v", r.Offset(), err)
+			}
+			lastSave = time.Now()
+		}
+	}
+}
+
+// save durably records the applied offset once the store has logged the
+// entries before it.
+func (r *Replica) save() error {
+	offset := r.Offset()
+	if offset == r.saved {
+		return nil
+	}
+	if err := r.store.SyncWAL(); err != nil {
+		return err
+	}
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(offset))
+	tmp := r.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return err
+	}
+	r.saved = offset
+	return nil
+}
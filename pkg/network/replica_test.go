@@ -0,0 +1,205 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"neurodb/pkg/common"
+	"neurodb/pkg/config"
+	"neurodb/pkg/core"
+)
+
+func newReplicationStore(t *testing.T) *core.HybridStore {
+	t.Helper()
+	store := openReplicationStore(t.TempDir())
+	t.Cleanup(store.Close)
+	return store
+}
+
+func openReplicationStore(dir string) *core.HybridStore {
+	return core.NewHybridStore(&config.Config{
+		Storage: config.StorageConfig{
+			Path:                   dir,
+			WalBufferSize:          8192,
+			MemTableFlushThreshold: 1000,
+			CompactionThreshold:    4,
+			WalBatchSize:           8,
+		},
+		System: config.SystemConfig{
+			ShardCount:     2,
+			BloomSize:      4096,
+			BloomFalseProb: 0.01,
+		},
+	})
+}
+
+// servePrimary serves store's replication stream and returns its address.
+func servePrimary(t *testing.T, store *core.HybridStore) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go NewTCPServer(store, 0).serve(ln)
+	return ln.Addr().String()
+}
+
+// runReplica runs replica in the background until the returned stop is
+// called.
+func runReplica(replica *Replica) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		replica.Run(ctx)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// waitFor polls cond for up to five seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplicaCatchesUpAfterDisconnect(t *testing.T) {
+	primary := newReplicationStore(t)
+	addr := servePrimary(t, primary)
+
+	replicaStore := newReplicationStore(t)
+	replica, err := NewReplica(replicaStore, addr, nil)
+	if err != nil {
+		t.Fatalf("new replica: %v", err)
+	}
+	run := func() (stop func()) { return runReplica(replica) }
+
+	for i := 0; i < 100; i++ {
+		primary.Put(common.KeyType(i), []byte(fmt.Sprintf("v%d", i)))
+	}
+	if err := primary.DeleteRange(10, 20); err != nil {
+		t.Fatalf("delete range: %v", err)
+	}
+	stop := run()
+	waitFor(t, "initial catch-up", func() bool { return replica.Offset() > 0 && replica.Offset() == primary.WALOffset() })
+	stop()
+	caughtUp := replica.Offset()
+
+	// Written while the replica is disconnected.
+	for i := 100; i < 200; i++ {
+		primary.Put(common.KeyType(i), []byte(fmt.Sprintf("v%d", i)))
+	}
+	primary.Delete(5)
+	waitFor(t, "primary WAL to grow", func() bool { return primary.WALOffset() > caughtUp })
+
+	stop = run()
+	defer stop()
+	// The primary logs writes in the background, so the replica only has
+	// all of them once the last batch is flushed.
+	waitFor(t, "catch-up after reconnect", func() bool {
+		return sameRecords(replicaStore.Scan(0, 1000), primary.Scan(0, 1000))
+	})
+	if n := len(replicaStore.Scan(0, 1000)); n != 189 {
+		t.Fatalf("replica has %d records, want 189", n)
+	}
+	if replica.Offset() <= caughtUp || replica.Offset() != primary.WALOffset() {
+		t.Fatalf("replica offset %d, want primary WAL offset %d (> %d)", replica.Offset(), primary.WALOffset(), caughtUp)
+	}
+}
+
+func TestReplicaResumesFromSavedOffset(t *testing.T) {
+	primary := newReplicationStore(t)
+	addr := servePrimary(t, primary)
+	for i := 0; i < 100; i++ {
+		primary.Put(common.KeyType(i), []byte(fmt.Sprintf("v%d", i)))
+	}
+
+	dir := t.TempDir()
+	replicaStore := openReplicationStore(dir)
+	replica, err := NewReplica(replicaStore, addr, nil)
+	if err != nil {
+		t.Fatalf("new replica: %v", err)
+	}
+	stop := runReplica(replica)
+	waitFor(t, "initial catch-up", func() bool { return replica.Offset() > 0 && replica.Offset() == primary.WALOffset() })
+	stop()
+	caughtUp := replica.Offset()
+	if err := replicaStore.Shutdown(); err != nil {
+		t.Fatalf("shutdown replica store: %v", err)
+	}
+
+	// Restarted replicas pick up where they stopped instead of at 0.
+	for i := 100; i < 150; i++ {
+		primary.Put(common.KeyType(i), []byte(fmt.Sprintf("v%d", i)))
+	}
+	replicaStore = openReplicationStore(dir)
+	t.Cleanup(replicaStore.Close)
+	replica, err = NewReplica(replicaStore, addr, nil)
+	if err != nil {
+		t.Fatalf("reopen replica: %v", err)
+	}
+	if replica.Offset() != caughtUp {
+		t.Fatalf("reopened replica at offset %d, want %d", replica.Offset(), caughtUp)
+	}
+	stop = runReplica(replica)
+	defer stop()
+	waitFor(t, "catch-up after restart", func() bool {
+		return sameRecords(replicaStore.Scan(0, 1000), primary.Scan(0, 1000))
+	})
+	if n := len(replicaStore.Scan(0, 1000)); n != 150 {
+		t.Fatalf("replica has %d records, want 150", n)
+	}
+}
+
+func TestReplicaRequiresResyncAfterTruncation(t *testing.T) {
+	primary := newReplicationStore(t)
+	addr := servePrimary(t, primary)
+	for i := 0; i < 10; i++ {
+		primary.Put(common.KeyType(i), []byte("v"))
+	}
+	waitFor(t, "primary WAL to grow", func() bool { return primary.WALOffset() > 0 })
+	// Drops the log the replica would start from.
+	if err := primary.Reset(); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+
+	replica, err := NewReplica(newReplicationStore(t), addr, nil)
+	if err != nil {
+		t.Fatalf("new replica: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- replica.Run(context.Background()) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrResyncRequired) {
+			t.Fatalf("Run returned %v, want ErrResyncRequired", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run kept retrying a truncated offset")
+	}
+}
+
+func sameRecords(a, b []common.Record) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || string(a[i].Value) != string(b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
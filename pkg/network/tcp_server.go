@@ -2,48 +2,210 @@ package network
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"io"
-	"log"
 	"net"
 	"neurodb/pkg/common"
 	"neurodb/pkg/core"
+	"neurodb/pkg/logger"
 	"neurodb/pkg/protocol"
+	"os"
+	"sync"
+	"time"
 )
 
 type TCPServer struct {
-	store *core.HybridStore
+	store        *core.HybridStore
+	maxValueSize uint32
+	tlsConfig    *tls.Config
+	log          logger.Logger
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closing  bool
+	handlers sync.WaitGroup
+}
+
+// ErrServerClosed is returned by Start after Shutdown.
+var ErrServerClosed = errors.New("network: server closed")
+
+// NewTCPServer serves store. Frames whose value exceeds maxValueSize bytes
+// are rejected and the connection closed; 0 selects the protocol default.
+func NewTCPServer(store *core.HybridStore, maxValueSize int) *TCPServer {
+	if maxValueSize <= 0 {
+		maxValueSize = protocol.DefaultMaxValueSize
+	}
+	return &TCPServer{store: store, maxValueSize: uint32(maxValueSize), log: store.Logger()}
 }
 
-func NewTCPServer(store *core.HybridStore) *TCPServer {
-	return &TCPServer{store: store}
+// UseLogger replaces the store's logger for this server.
+func (s *TCPServer) UseLogger(l logger.Logger) {
+	s.log = l
 }
 
+// UseTLS makes Start accept only TLS connections; see ServerTLSConfig.
+func (s *TCPServer) UseTLS(conf *tls.Config) {
+	s.tlsConfig = conf
+}
+
+// Start listens on addr, a TCP host:port or a unix:///path socket, and
+// serves until Shutdown.
 func (s *TCPServer) Start(addr string) error {
-	listener, err := net.Listen("tcp", addr)
+	network, address := protocol.SplitAddr(addr)
+	if network == "unix" {
+		removeStaleSocket(address)
+	}
+	var listener net.Listener
+	var err error
+	if s.tlsConfig != nil {
+		listener, err = tls.Listen(network, address, s.tlsConfig)
+	} else {
+		listener, err = net.Listen(network, address)
+	}
 	if err != nil {
 		return err
 	}
-	log.Printf("[TCP] Listening on %s (Binary Protocol)", addr)
+	if s.tlsConfig != nil {
+		s.log.Info("[TCP] Listening on %s (Binary Protocol, TLS)", addr)
+	} else {
+		s.log.Info("[TCP] Listening on %s (Binary Protocol)", addr)
+	}
+	return s.serve(listener)
+}
+
+// removeStaleSocket removes the socket a server that did not shut down
+// cleanly left at path, which would otherwise fail the listen. Anything other
+// than a socket is left alone.
+func removeStaleSocket(path string) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+}
+
+func (s *TCPServer) serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("[TCP] Accept error: %v", err)
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			s.log.Error("[TCP] Accept error: %v", err)
 			continue
 		}
-		go s.handleConn(conn)
+		if !s.track(conn) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer s.handlers.Done()
+			defer s.untrack(conn)
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func (s *TCPServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	s.handlers.Add(1)
+	return true
+}
+
+func (s *TCPServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
+
+func (s *TCPServer) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// Shutdown stops accepting connections and lets each open one finish the
+// request it is serving, then closes it. Replication streams end. If ctx is
+// done first the remaining connections are closed outright and ctx's error
+// is returned.
+func (s *TCPServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	// An expired read deadline fails the read a handler is waiting in (or
+	// its next one), so it returns between requests.
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
 	}
 }
 
 func (s *TCPServer) handleConn(conn net.Conn) {
 	defer conn.Close()
+	// Requests on the connection share its lifetime.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Handshake up front so a failed one is not reported as a bad frame.
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			s.log.Warn("[TCP] TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
 
 	for {
-		req, err := protocol.Decode(conn)
+		req, err := protocol.DecodeLimit(conn, s.maxValueSize)
+		if err == nil {
+			err = req.Validate()
+		}
 		if err != nil {
-			if err != io.EOF {
-				log.Printf("[TCP] Decode error: %v", err)
+			// Once one frame is bad the stream position can't be trusted, so
+			// report the error and drop the connection rather than guess.
+			if err != io.EOF && !s.shuttingDown() {
+				s.log.Warn("[TCP] Malformed frame from %s: %v", conn.RemoteAddr(), err)
+				protocol.Encode(conn, protocol.RespErr, nil, []byte(err.Error()))
 			}
 			return
 		}
@@ -51,35 +213,121 @@ func (s *TCPServer) handleConn(conn net.Conn) {
 		switch req.Op {
 		case protocol.OpPut:
 			k := bytesToInt64(req.Key)
-			s.store.Put(common.KeyType(k), req.Value)
+			if err := s.store.PutContext(ctx, common.KeyType(k), req.Value); err != nil {
+				protocol.Encode(conn, errorResponse(err), nil, []byte(err.Error()))
+				continue
+			}
 			protocol.Encode(conn, protocol.RespOK, nil, nil)
 
 		case protocol.OpGet:
 			k := bytesToInt64(req.Key)
-			val, found := s.store.Get(common.KeyType(k))
-			if found {
+			val, st, err := s.store.GetWithStatusContext(ctx, common.KeyType(k))
+			if err != nil {
+				protocol.Encode(conn, protocol.RespErr, nil, []byte(err.Error()))
+			} else if st == common.KeyFound {
 				protocol.Encode(conn, protocol.RespVal, nil, val)
 			} else {
-				protocol.Encode(conn, protocol.RespErr, nil, []byte("Not Found"))
+				protocol.Encode(conn, protocol.RespErr, nil, []byte(st.String()))
 			}
 
 		case protocol.OpDel:
 			k := bytesToInt64(req.Key)
-			s.store.Delete(common.KeyType(k))
+			if err := s.store.DeleteContext(ctx, common.KeyType(k)); err != nil {
+				protocol.Encode(conn, errorResponse(err), nil, []byte(err.Error()))
+				continue
+			}
 			protocol.Encode(conn, protocol.RespOK, nil, nil)
 
-		case protocol.OpScan:
-			// Key=StartKey, Value=EndKey
-			start := bytesToInt64(req.Key)
-			end := bytesToInt64(req.Value)
+		case protocol.OpDelExisting:
+			k := bytesToInt64(req.Key)
+			existed, err := s.store.DeleteExistingContext(ctx, common.KeyType(k))
+			if err != nil {
+				protocol.Encode(conn, errorResponse(err), nil, []byte(err.Error()))
+				continue
+			}
+			flag := []byte{0}
+			if existed {
+				flag[0] = 1
+			}
+			protocol.Encode(conn, protocol.RespVal, nil, flag)
 
-			records := s.store.Scan(common.KeyType(start), common.KeyType(end))
+		case protocol.OpScan:
+			scan := protocol.DecodeScanRequest(req)
+			page, err := s.store.ScanPageContext(ctx, common.KeyType(scan.Start), common.KeyType(scan.End), scan.Limit)
+			if err != nil {
+				protocol.Encode(conn, protocol.RespErr, nil, []byte(err.Error()))
+				continue
+			}
 
+			var next []byte
+			if page.Truncated {
+				next = binary.BigEndian.AppendUint64(nil, uint64(page.NextKey))
+			}
 			// [Count 4B] + ( [Key 8B] + [ValLen 4B] + [Val Bytes] ) * Count
-			encodedData := encodeRecords(records)
-			protocol.Encode(conn, protocol.RespVal, nil, encodedData)
+			encodedData := encodeRecords(page.Records)
+			protocol.Encode(conn, protocol.RespVal, next, encodedData)
+
+		case protocol.OpReplicate:
+			s.replicate(ctx, conn, bytesToInt64(req.Key))
+			return
+		}
+	}
+}
+
+// replicatePollInterval is how often a replication stream that has caught
+// up checks the WAL for new entries.
+const replicatePollInterval = 50 * time.Millisecond
+
+// replicate streams the WAL from offset to conn until the replica hangs up.
+// Only the end of the stream is ever a partly written entry, so a read error
+// means "nothing more yet" and the entry is retried from the same offset.
+func (s *TCPServer) replicate(ctx context.Context, conn net.Conn, offset int64) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// The replica sends nothing more; a read returning means it is gone.
+	go func() {
+		io.Copy(io.Discard, conn)
+		cancel()
+	}()
+
+	s.log.Info("[Replication] Streaming WAL to %s from offset %d", conn.RemoteAddr(), offset)
+	for {
+		it, err := s.store.WALFrom(offset)
+		if err != nil {
+			s.log.Warn("[Replication] Cannot stream to %s from offset %d: %v", conn.RemoteAddr(), offset, err)
+			protocol.Encode(conn, protocol.RespErr, nil, []byte(err.Error()))
+			return
 		}
+		for {
+			raw, err := it.NextRaw()
+			if err != nil {
+				break
+			}
+			next := make([]byte, 8)
+			binary.BigEndian.PutUint64(next, uint64(it.Offset()))
+			if err := protocol.Encode(conn, protocol.RespVal, next, raw); err != nil {
+				it.Close()
+				return
+			}
+			offset = it.Offset()
+		}
+		it.Close()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(replicatePollInterval):
+		}
+	}
+}
+
+// errorResponse is the response op for a failed write: RespBusy when the
+// store may accept it again later, RespErr otherwise.
+func errorResponse(err error) byte {
+	if errors.Is(err, core.ErrFlushFailed) || errors.Is(err, core.ErrReadOnly) {
+		return protocol.RespBusy
 	}
+	return protocol.RespErr
 }
 
 func bytesToInt64(b []byte) int64 {
@@ -0,0 +1,321 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"neurodb/pkg/client"
+	"neurodb/pkg/common"
+	"neurodb/pkg/config"
+	"neurodb/pkg/core"
+	"neurodb/pkg/logger"
+	"neurodb/pkg/protocol"
+)
+
+func frame(t *testing.T, op byte, key int64, value []byte) []byte {
+	t.Helper()
+	keyBuf := make([]byte, 8)
+	binary.BigEndian.PutUint64(keyBuf, uint64(key))
+	buf := new(bytes.Buffer)
+	if err := protocol.Encode(buf, op, keyBuf, value); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestMalformedFrameClosesConnection(t *testing.T) {
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			Path:                   t.TempDir(),
+			WalBufferSize:          8,
+			MemTableFlushThreshold: 1000,
+			CompactionThreshold:    4,
+			WalBatchSize:           4,
+		},
+		System: config.SystemConfig{
+			ShardCount:     1,
+			BloomSize:      512,
+			BloomFalseProb: 0.01,
+		},
+	}
+	store := core.NewHybridStore(cfg)
+	defer store.Close()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go NewTCPServer(store, 0).handleConn(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go client.Write(frame(t, protocol.OpPut, 1, []byte("one")))
+	if resp, err := protocol.Decode(client); err != nil || resp.Op != protocol.RespOK {
+		t.Fatalf("put: resp=%+v err=%v", resp, err)
+	}
+
+	// A GET whose value length is overstated by one whole frame: the
+	// following GET is swallowed as its value, so the stream is desynced.
+	get := frame(t, protocol.OpGet, 1, nil)
+	bad := frame(t, protocol.OpGet, 1, nil)
+	binary.BigEndian.PutUint32(bad[4:8], uint32(len(get)))
+	stream := append(append(append(bad, get...), get...), get...)
+	go client.Write(stream)
+
+	resp, err := protocol.Decode(client)
+	if err != nil || resp.Op != protocol.RespErr {
+		t.Fatalf("expected an error response for the malformed frame, got resp=%+v err=%v", resp, err)
+	}
+	if resp, err := protocol.Decode(client); err != io.EOF {
+		t.Fatalf("expected connection closed after malformed frame, got resp=%+v err=%v", resp, err)
+	}
+}
+
+func TestWriteErrorsReachClient(t *testing.T) {
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			Path:                   t.TempDir(),
+			WalBufferSize:          8192,
+			MemTableFlushThreshold: 100,
+			CompactionThreshold:    4,
+			WalBatchSize:           8,
+		},
+		System: config.SystemConfig{
+			ShardCount:     1,
+			BloomSize:      512,
+			BloomFalseProb: 0.01,
+		},
+	}
+	store := core.NewHybridStore(cfg, core.WithLogger(logger.New(io.Discard, logger.LevelError)))
+	defer store.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go NewTCPServer(store, 0).serve(ln)
+
+	cli, err := client.Dial(ln.Addr().String(), client.WithBackoff(time.Millisecond, 4*time.Millisecond))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer cli.Close()
+
+	// Make every flush fail: the 100th write triggers one, the next is refused.
+	os.RemoveAll(cfg.Storage.Path)
+	os.WriteFile(cfg.Storage.Path, nil, 0644)
+	for i := 0; i < 100; i++ {
+		if err := cli.Put(int64(i), []byte("v")); err != nil {
+			t.Fatalf("Put(%d): %v", i, err)
+		}
+	}
+	err = cli.Put(100, []byte("v"))
+	var serverErr *client.ServerError
+	if !errors.As(err, &serverErr) || !strings.Contains(serverErr.Message, "flush failed") {
+		t.Fatalf("expected the flush failure from the server, got %v", err)
+	}
+	// A failing flush may clear up, so the server reports it as busy.
+	if !errors.Is(err, client.ErrUnavailable) {
+		t.Fatalf("expected the server to answer busy, got %v", err)
+	}
+	if err := cli.Delete(1); !errors.Is(err, client.ErrUnavailable) {
+		t.Fatalf("expected Delete to fail too, got %v", err)
+	}
+}
+
+func TestShutdownDrainsConnections(t *testing.T) {
+	store := newReplicationStore(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := NewTCPServer(store, 0)
+	served := make(chan error, 1)
+	go func() { served <- srv.serve(ln) }()
+
+	cli, err := client.Dial(ln.Addr().String(), client.WithMaxRetries(0))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer cli.Close()
+	if err := cli.Put(1, []byte("v")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// The idle connection must not hold up shutdown.
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("serve returned %v, want ErrServerClosed", err)
+	}
+	if err := cli.Put(2, []byte("v")); err == nil {
+		t.Fatalf("Put succeeded after shutdown")
+	}
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Fatalf("server still accepting after shutdown")
+	}
+}
+
+func TestRoundTripOverUnixSocket(t *testing.T) {
+	store := newReplicationStore(t)
+	addr := protocol.UnixScheme + filepath.Join(t.TempDir(), "neuro.sock")
+	srv := NewTCPServer(store, 0)
+	served := make(chan error, 1)
+	go func() { served <- srv.Start(addr) }()
+
+	var cli *client.Client
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if cli, err = client.Dial(addr, client.WithMaxRetries(0)); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("dial %s: %v", addr, err)
+	}
+	defer cli.Close()
+
+	if err := cli.Put(42, []byte("over the socket")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if val, err := cli.Get(42); err != nil || string(val) != "over the socket" {
+		t.Fatalf("Get: %q, %v", val, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Start returned %v, want ErrServerClosed", err)
+	}
+}
+
+func TestScanPagesOverTCP(t *testing.T) {
+	store := newReplicationStore(t)
+	for i := 0; i < 250; i++ {
+		store.Put(common.KeyType(i*2), []byte(fmt.Sprintf("v%d", i)))
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go NewTCPServer(store, 0).serve(ln)
+
+	cli, err := client.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer cli.Close()
+
+	// Pages of 100 over [10, 409] hold keys 10..408 in steps of 2: 200 keys.
+	var keys []common.KeyType
+	pages := 0
+	for start, more := int64(10), true; more; pages++ {
+		var records []common.Record
+		records, start, more, err = cli.ScanPage(start, 409, 100)
+		if err != nil {
+			t.Fatalf("ScanPage: %v", err)
+		}
+		if len(records) > 100 {
+			t.Fatalf("page of %d records exceeds the limit", len(records))
+		}
+		for _, r := range records {
+			keys = append(keys, r.Key)
+		}
+	}
+	if len(keys) != 200 || keys[0] != 10 || keys[199] != 408 {
+		t.Fatalf("paged scan returned %d keys from %v to %v", len(keys), keys[0], keys[len(keys)-1])
+	}
+	for i := 1; i < len(keys); i++ {
+		if keys[i] != keys[i-1]+2 {
+			t.Fatalf("page boundary skipped or repeated keys: %v then %v", keys[i-1], keys[i])
+		}
+	}
+	// 200 keys fill exactly two pages, and the second says it ends the range.
+	if pages != 2 {
+		t.Fatalf("expected 2 pages, got %d", pages)
+	}
+
+	all, err := cli.Scan(10, 409)
+	if err != nil || len(all) != 200 {
+		t.Fatalf("unlimited Scan: %d records, %v", len(all), err)
+	}
+}
+
+func TestDeleteExistingOverTCP(t *testing.T) {
+	store := newReplicationStore(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go NewTCPServer(store, 0).serve(ln)
+
+	cli, err := client.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer cli.Close()
+	if err := cli.Put(1, []byte("v")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if existed, err := cli.DeleteExisting(1); err != nil || !existed {
+		t.Fatalf("deleting a present key: %v, %v", existed, err)
+	}
+	if existed, err := cli.DeleteExisting(1); err != nil || existed {
+		t.Fatalf("deleting an absent key: %v, %v", existed, err)
+	}
+	if _, err := cli.Get(1); err == nil {
+		t.Fatalf("key still readable after DeleteExisting")
+	}
+}
+
+func TestGetStatusOverTCP(t *testing.T) {
+	store := newReplicationStore(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go NewTCPServer(store, 0).serve(ln)
+
+	cli, err := client.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer cli.Close()
+	store.Put(1, []byte("v"))
+	store.Put(2, []byte("v"))
+	store.Delete(2)
+
+	for _, tc := range []struct {
+		key  int64
+		want common.KeyStatus
+	}{
+		{1, common.KeyFound},
+		{2, common.KeyDeleted},
+		{3, common.KeyAbsent},
+	} {
+		val, st, err := cli.GetWithStatus(tc.key)
+		if err != nil || st != tc.want || (st == common.KeyFound) != (val != nil) {
+			t.Fatalf("GetWithStatus(%d) = %q, %v, %v; want %v", tc.key, val, st, err, tc.want)
+		}
+		if _, err := cli.Get(tc.key); (err == nil) != (tc.want == common.KeyFound) ||
+			(err != nil && !errors.Is(err, client.ErrNotFound)) {
+			t.Fatalf("Get(%d): %v", tc.key, err)
+		}
+	}
+}
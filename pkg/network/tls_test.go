@@ -0,0 +1,209 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"neurodb/pkg/client"
+	"neurodb/pkg/config"
+	"neurodb/pkg/core"
+)
+
+// selfSignedCert writes a self-signed certificate for 127.0.0.1, usable for
+// both server and client auth, and returns the cert and key file paths.
+func selfSignedCert(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "neurodb-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+// startTLSServer serves a fresh store over TLS on a loopback port.
+func startTLSServer(t *testing.T, conf *tls.Config) string {
+	t.Helper()
+	store := core.NewHybridStore(&config.Config{
+		Storage: config.StorageConfig{
+			Path:                   t.TempDir(),
+			WalBufferSize:          64,
+			MemTableFlushThreshold: 1000,
+			CompactionThreshold:    4,
+			WalBatchSize:           8,
+		},
+		System: config.SystemConfig{
+			ShardCount:     1,
+			BloomSize:      512,
+			BloomFalseProb: 0.01,
+		},
+	})
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := NewTCPServer(store, 0)
+	srv.UseTLS(conf)
+	go srv.serve(ln)
+	t.Cleanup(func() {
+		ln.Close()
+		store.Close()
+	})
+	return ln.Addr().String()
+}
+
+func TestTLSRoundTrip(t *testing.T) {
+	certFile, keyFile := selfSignedCert(t)
+	conf, err := ServerTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("server tls config: %v", err)
+	}
+	addr := startTLSServer(t, conf)
+
+	pemBytes, _ := os.ReadFile(certFile)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pemBytes)
+
+	cli, err := client.DialTLS(addr, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatalf("dial tls: %v", err)
+	}
+	defer cli.Close()
+	if err := cli.Put(7, []byte("secret")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if val, err := cli.Get(7); err != nil || string(val) != "secret" {
+		t.Fatalf("get = %q, %v", val, err)
+	}
+	recs, err := cli.Scan(0, 10)
+	if err != nil || len(recs) != 1 || string(recs[0].Value) != "secret" {
+		t.Fatalf("scan = %v, %v", recs, err)
+	}
+
+	// A plaintext client cannot talk to the TLS listener.
+	plain, err := client.Dial(addr)
+	if err != nil {
+		t.Fatalf("dial plaintext: %v", err)
+	}
+	defer plain.Close()
+	if err := plain.Put(8, []byte("leak")); err == nil {
+		t.Fatal("expected a plaintext request to fail against a TLS server")
+	}
+}
+
+func TestMutualTLSRequiresClientCert(t *testing.T) {
+	certFile, keyFile := selfSignedCert(t)
+	conf, err := ServerTLSConfig(certFile, keyFile, certFile)
+	if err != nil {
+		t.Fatalf("server tls config: %v", err)
+	}
+	addr := startTLSServer(t, conf)
+
+	pemBytes, _ := os.ReadFile(certFile)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pemBytes)
+
+	anon, err := client.DialTLS(addr, &tls.Config{RootCAs: roots})
+	if err == nil {
+		defer anon.Close()
+		if err := anon.Put(1, []byte("x")); err == nil {
+			t.Fatal("expected a client without a certificate to be rejected")
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("load client cert: %v", err)
+	}
+	cli, err := client.DialTLS(addr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("dial with client cert: %v", err)
+	}
+	defer cli.Close()
+	if err := cli.Put(1, []byte("x")); err != nil {
+		t.Fatalf("put with client cert: %v", err)
+	}
+}
+
+func TestReplicaFollowsMutualTLSPrimary(t *testing.T) {
+	certFile, keyFile := selfSignedCert(t)
+	serverConf, err := ServerTLSConfig(certFile, keyFile, certFile)
+	if err != nil {
+		t.Fatalf("server tls config: %v", err)
+	}
+	addr := startTLSServer(t, serverConf)
+	conf, err := ClientTLSConfig(certFile, keyFile, certFile)
+	if err != nil {
+		t.Fatalf("client tls config: %v", err)
+	}
+	cli, err := client.DialTLS(addr, conf)
+	if err != nil {
+		t.Fatalf("dial tls: %v", err)
+	}
+	defer cli.Close()
+	for i := 0; i < 10; i++ {
+		if err := cli.Put(int64(i), []byte("v")); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+
+	replicaStore := newReplicationStore(t)
+	replica, err := NewReplica(replicaStore, addr, conf)
+	if err != nil {
+		t.Fatalf("new replica: %v", err)
+	}
+	stop := runReplica(replica)
+	defer stop()
+	waitFor(t, "replica to catch up over TLS", func() bool { return len(replicaStore.Scan(0, 100)) == 10 })
+}
+
+func TestClientTLSConfigNeedsCertAndKey(t *testing.T) {
+	certFile, _ := selfSignedCert(t)
+	if _, err := ClientTLSConfig(certFile, "", ""); err == nil {
+		t.Fatal("expected a certificate without a key to be rejected")
+	}
+	conf, err := ClientTLSConfig("", "", certFile)
+	if err != nil {
+		t.Fatalf("CA only: %v", err)
+	}
+	if conf.RootCAs == nil || len(conf.Certificates) != 0 {
+		t.Fatalf("CA only: RootCAs %v, %d certificates", conf.RootCAs, len(conf.Certificates))
+	}
+}
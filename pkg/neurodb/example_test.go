@@ -0,0 +1,68 @@
+package neurodb_test
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"testing"
+
+	"neurodb/pkg/neurodb"
+)
+
+func Example() {
+	db, err := neurodb.Open(neurodb.WithInMemory(), neurodb.WithShards(4))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	for k := neurodb.Key(1); k <= 5; k++ {
+		db.Put(k, []byte(fmt.Sprintf("value-%d", k)))
+	}
+	db.Delete(3)
+
+	val, _ := db.Get(2)
+	fmt.Println(string(val))
+	if _, err := db.Get(3); errors.Is(err, neurodb.ErrNotFound) {
+		fmt.Println("3 is gone")
+	}
+	records, _ := db.Scan(1, 5)
+	for _, r := range records {
+		fmt.Println(r.Key, string(r.Value))
+	}
+	// Output:
+	// value-2
+	// 3 is gone
+	// 1 value-1
+	// 2 value-2
+	// 4 value-4
+	// 5 value-5
+}
+
+func TestReopenKeepsData(t *testing.T) {
+	dir := t.TempDir()
+	db, err := neurodb.Open(neurodb.WithPath(dir), neurodb.WithShards(2))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for k := neurodb.Key(0); k < 100; k++ {
+		if err := db.Put(k, []byte("v")); err != nil {
+			t.Fatalf("put %d: %v", k, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	db, err = neurodb.Open(neurodb.WithPath(dir), neurodb.WithShards(2))
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	if records, err := db.Scan(0, 99); err != nil || len(records) != 100 {
+		t.Fatalf("scan after reopen: %d records, %v", len(records), err)
+	}
+	if _, err := neurodb.Open(neurodb.WithPath(dir), neurodb.WithShards(0)); err == nil {
+		t.Fatalf("expected an error for 0 shards")
+	}
+}
@@ -0,0 +1,155 @@
+// Package neurodb embeds a NeuroDB store in a Go program, without the HTTP
+// and TCP servers or a config file:
+//
+//	db, err := neurodb.Open(neurodb.WithPath("data"))
+//	...
+//	defer db.Close()
+//	db.Put(1, []byte("hello"))
+//
+// Anything it does not cover is on the core.HybridStore that DB.Store
+// returns.
+package neurodb
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"neurodb/pkg/common"
+	"neurodb/pkg/config"
+	"neurodb/pkg/core"
+)
+
+type (
+	Key    = common.KeyType
+	Record = common.Record
+)
+
+// ErrNotFound is returned by Get for a key with no value.
+var ErrNotFound = errors.New("neurodb: key not found")
+
+// DefaultPath is where Open keeps its files without WithPath.
+const DefaultPath = "neuro_data"
+
+// Option customizes Open.
+type Option func(*options)
+
+type options struct {
+	cfg      *config.Config
+	inMemory bool
+}
+
+// WithPath keeps the store's files in dir, which is created if missing.
+func WithPath(dir string) Option {
+	return func(o *options) { o.cfg.Storage.Path = dir }
+}
+
+// WithShards splits the store into n shards (16 by default). A store must
+// be reopened with the shard count it was created with.
+func WithShards(n int) Option {
+	return func(o *options) { o.cfg.System.ShardCount = n }
+}
+
+// WithInMemory keeps nothing after Close: the store works in a temporary
+// directory that Close removes. WithPath is ignored.
+func WithInMemory() Option {
+	return func(o *options) { o.inMemory = true }
+}
+
+// WithUnsignedKeys sorts keys as unsigned integers, for Z-order codes or
+// unsigned IDs with the high bit set, instead of as int64. A store keeps the
+// order it was created with.
+func WithUnsignedKeys() Option {
+	return func(o *options) { o.cfg.System.KeyOrder = config.KeyOrderUnsigned }
+}
+
+// WithLogLevel sets what the store logs to stderr: debug, info, warn (the
+// default) or error.
+func WithLogLevel(level string) Option {
+	return func(o *options) { o.cfg.System.LogLevel = level }
+}
+
+// DB is an open store. Its methods are safe for concurrent use.
+type DB struct {
+	store   *core.HybridStore
+	tempDir string // removed by Close; set by WithInMemory
+}
+
+// Open opens the store, creating it if needed. Without options it lives in
+// DefaultPath with the server's default settings.
+func Open(opts ...Option) (*DB, error) {
+	o := &options{cfg: config.Default()}
+	o.cfg.System.LogLevel = "warn"
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.cfg.System.ShardCount <= 0 {
+		return nil, errors.New("neurodb: shard count must be positive")
+	}
+	if o.cfg.Storage.Path == "" {
+		o.cfg.Storage.Path = DefaultPath
+	}
+
+	db := &DB{}
+	if o.inMemory {
+		dir, err := os.MkdirTemp("", "neurodb-")
+		if err != nil {
+			return nil, err
+		}
+		o.cfg.Storage.Path = dir
+		db.tempDir = dir
+	}
+	store, err := core.OpenHybridStore(o.cfg)
+	if err != nil {
+		if db.tempDir != "" {
+			os.RemoveAll(db.tempDir)
+		}
+		return nil, err
+	}
+	db.store = store
+	return db, nil
+}
+
+// Get returns key's value, or ErrNotFound.
+func (db *DB) Get(key Key) ([]byte, error) {
+	val, ok, err := db.store.GetContext(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return val, nil
+}
+
+// Put writes key. It is visible to Get at once and logged to the WAL
+// shortly after. An empty value deletes key.
+func (db *DB) Put(key Key, value []byte) error {
+	return db.store.Put(key, value)
+}
+
+// Delete deletes key; deleting an absent key is not an error.
+func (db *DB) Delete(key Key) error {
+	return db.store.Delete(key)
+}
+
+// Scan returns the records in [start, end] in key order (see
+// WithUnsignedKeys).
+func (db *DB) Scan(start, end Key) ([]Record, error) {
+	return db.store.ScanContext(context.Background(), start, end)
+}
+
+// Store is the underlying store, for what DB does not wrap.
+func (db *DB) Store() *core.HybridStore {
+	return db.store
+}
+
+// Close flushes the memtables and closes the store, so the next Open has no
+// WAL to replay. An in-memory store is discarded instead.
+func (db *DB) Close() error {
+	if db.tempDir != "" {
+		db.store.Close()
+		return os.RemoveAll(db.tempDir)
+	}
+	return db.store.Shutdown()
+}
@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"testing"
 )
@@ -81,3 +82,60 @@ func TestDecodeIncompleteHeader(t *testing.T) {
 		t.Errorf("expected EOF or error for incomplete header, got %v", err)
 	}
 }
+
+func TestDecodeRejectsOversizedLengths(t *testing.T) {
+	// Headers only: a decoder that trusted the lengths would try to allocate
+	// ~4GB (or 64KB for the key) before failing on the short read.
+	cases := map[string][]byte{
+		"value": {MagicNumber, OpPut, 0, 8, 0xFF, 0xFF, 0xFF, 0xFF},
+		"key":   {MagicNumber, OpPut, 0xFF, 0xFF, 0, 0, 0, 0},
+	}
+	for name, header := range cases {
+		_, err := Decode(bytes.NewReader(header))
+		if !errors.Is(err, ErrFrameTooLarge) {
+			t.Errorf("%s: expected ErrFrameTooLarge, got %v", name, err)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := Encode(buf, OpPut, []byte("k"), make([]byte, 100)); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if _, err := DecodeLimit(bytes.NewReader(buf.Bytes()), 99); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("expected custom limit to reject 100-byte value, got %v", err)
+	}
+	if _, err := DecodeLimit(bytes.NewReader(buf.Bytes()), 100); err != nil {
+		t.Errorf("value at the limit should decode, got %v", err)
+	}
+}
+
+func TestScanRequestEncodeDecode(t *testing.T) {
+	for _, want := range []ScanRequest{
+		{Start: -5, End: 1 << 40},
+		{Start: 100, End: 200, Limit: 25},
+	} {
+		key, val := want.Encode()
+		buf := new(bytes.Buffer)
+		if err := Encode(buf, OpScan, key, val); err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		pkg, err := Decode(buf)
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		if err := pkg.Validate(); err != nil {
+			t.Fatalf("Validate %+v: %v", want, err)
+		}
+		if got := DecodeScanRequest(pkg); got != want {
+			t.Fatalf("decoded %+v, want %+v", got, want)
+		}
+	}
+	// An unlimited scan keeps the original 8-byte end key.
+	if _, val := (ScanRequest{End: 1}).Encode(); len(val) != 8 {
+		t.Fatalf("unlimited scan value is %d bytes, want 8", len(val))
+	}
+	bad := &Packet{Op: OpScan, Key: make([]byte, 8), Value: make([]byte, 10)}
+	if err := bad.Validate(); err == nil {
+		t.Fatalf("expected a 10-byte scan value to be rejected")
+	}
+}
@@ -0,0 +1,442 @@
+package sql
+
+import (
+	"fmt"
+	"neurodb/pkg/common"
+	"strings"
+	"sync"
+)
+
+// catalogTable names the reserved table range whose first key holds the catalog.
+const catalogTable = "__neurodb_catalog"
+
+// Store is the subset of the storage engine the executor needs.
+type Store interface {
+	Get(key common.KeyType) (common.ValueType, bool)
+	Put(key common.KeyType, val common.ValueType) error
+	Delete(key common.KeyType) error
+	Scan(start, end common.KeyType) []common.Record
+}
+
+// Result is the outcome of executing a statement.
+type Result struct {
+	Table   string                   `json:"table"`
+	Columns []string                 `json:"columns,omitempty"`
+	Count   int                      `json:"count"`
+	Rows    []map[string]interface{} `json:"rows"`
+	Plan    *Plan                    `json:"plan,omitempty"`
+}
+
+// Executor runs statements against a Store. The catalog lives in the store
+// itself so it survives restarts and is included in backups.
+type Executor struct {
+	store Store
+	mu    sync.Mutex
+}
+
+func NewExecutor(store Store) *Executor {
+	return &Executor{store: store}
+}
+
+func catalogKey() common.KeyType {
+	start, _ := TableKeyRange(catalogTable)
+	return common.KeyType(start)
+}
+
+// Catalog loads the current schema registry from the store.
+func (e *Executor) Catalog() (*Catalog, error) {
+	raw, ok := e.store.Get(catalogKey())
+	if !ok {
+		return NewCatalog(), nil
+	}
+	return DecodeCatalog(raw)
+}
+
+func (e *Executor) Execute(query string) (*Result, error) {
+	stmt, err := ParseStatement(query)
+	if err != nil {
+		return nil, err
+	}
+	switch s := stmt.(type) {
+	case *CreateTableStmt:
+		return e.createTable(s)
+	case *CreateIndexStmt:
+		return e.createIndex(s)
+	case *InsertStmt:
+		return e.insert(s)
+	case *DeleteStmt:
+		return e.deleteRow(s)
+	case *SelectStmt:
+		return e.selectRows(s)
+	case *ExplainStmt:
+		return e.explain(s.Select)
+	default:
+		return nil, fmt.Errorf("unsupported statement %T", stmt)
+	}
+}
+
+func (e *Executor) createTable(s *CreateTableStmt) (*Result, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	cat, err := e.Catalog()
+	if err != nil {
+		return nil, err
+	}
+	if cat.Lookup(s.Table) != nil {
+		return nil, fmt.Errorf("table %s already exists", s.Table)
+	}
+	if _, err := cat.Reserve(s.Table); err != nil {
+		return nil, err
+	}
+	schema := &TableSchema{Name: s.Table, Columns: s.Columns}
+	cat.Tables[strings.ToLower(s.Table)] = schema
+	if err := e.saveCatalog(cat); err != nil {
+		return nil, err
+	}
+	return &Result{Table: s.Table, Columns: schema.ColumnNames(), Rows: []map[string]interface{}{}}, nil
+}
+
+func (e *Executor) saveCatalog(cat *Catalog) error {
+	data, err := cat.Encode()
+	if err != nil {
+		return err
+	}
+	return e.store.Put(catalogKey(), data)
+}
+
+// createIndex registers a secondary index and backfills it from existing rows.
+func (e *Executor) createIndex(s *CreateIndexStmt) (*Result, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	cat, err := e.Catalog()
+	if err != nil {
+		return nil, err
+	}
+	schema := cat.Lookup(s.Table)
+	if schema == nil {
+		return nil, fmt.Errorf("table %s does not exist (CREATE TABLE first)", s.Table)
+	}
+	if schema.Column(s.Column) == nil {
+		return nil, fmt.Errorf("unknown column %s in table %s", s.Column, s.Table)
+	}
+	if s.Column == schema.Columns[0].Name {
+		return nil, fmt.Errorf("column %s is the primary key and needs no index", s.Column)
+	}
+	if schema.HasIndex(s.Column) {
+		return nil, fmt.Errorf("index on %s(%s) already exists", s.Table, s.Column)
+	}
+
+	start, end, err := cat.KeyRange(s.Table)
+	if err != nil {
+		return nil, err
+	}
+	base, err := cat.Reserve(indexTableName(s.Table, s.Column))
+	if err != nil {
+		return nil, err
+	}
+	records := e.store.Scan(common.KeyType(start), common.KeyType(end))
+	for _, rec := range records {
+		if rec.Key == catalogKey() {
+			continue
+		}
+		id := int64(rec.Key) - start
+		row, err := schema.DecodeRow(id, rec.Value)
+		if err != nil {
+			return nil, err
+		}
+		if err := e.indexAdd(base, row[s.Column], id); err != nil {
+			return nil, err
+		}
+	}
+
+	schema.Indexes = append(schema.Indexes, s.Column)
+	if err := e.saveCatalog(cat); err != nil {
+		return nil, err
+	}
+	return &Result{Table: s.Table, Columns: schema.ColumnNames(), Count: len(records), Rows: []map[string]interface{}{}}, nil
+}
+
+// currentRow returns the decoded row stored at id in the table range starting at start, or nil.
+func (e *Executor) currentRow(schema *TableSchema, start, id int64) (map[string]interface{}, error) {
+	raw, ok := e.store.Get(common.KeyType(start + id))
+	if !ok {
+		return nil, nil
+	}
+	return schema.DecodeRow(id, raw)
+}
+
+func (e *Executor) insert(s *InsertStmt) (*Result, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	cat, err := e.Catalog()
+	if err != nil {
+		return nil, err
+	}
+	schema := cat.Lookup(s.Table)
+	if schema == nil {
+		return nil, fmt.Errorf("table %s does not exist (CREATE TABLE first)", s.Table)
+	}
+	id, val, err := schema.EncodeRow(s.Values)
+	if err != nil {
+		return nil, err
+	}
+	start, _, err := cat.KeyRange(s.Table)
+	if err != nil {
+		return nil, err
+	}
+	var old map[string]interface{}
+	if len(schema.Indexes) > 0 {
+		if old, err = e.currentRow(schema, start, id); err != nil {
+			return nil, err
+		}
+	}
+	// The row goes first, so a value the store rejects leaves the indexes alone.
+	if err := e.store.Put(common.KeyType(start+id), val); err != nil {
+		return nil, err
+	}
+	if len(schema.Indexes) > 0 {
+		row, err := schema.DecodeRow(id, val)
+		if err != nil {
+			return nil, err
+		}
+		for _, col := range schema.Indexes {
+			base, _, err := cat.KeyRange(indexTableName(s.Table, col))
+			if err != nil {
+				return nil, err
+			}
+			if old != nil {
+				if err := e.indexRemove(base, old[col], id); err != nil {
+					return nil, err
+				}
+			}
+			if err := e.indexAdd(base, row[col], id); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &Result{Table: s.Table, Columns: schema.ColumnNames(), Count: 1, Rows: []map[string]interface{}{}}, nil
+}
+
+func (e *Executor) deleteRow(s *DeleteStmt) (*Result, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	cat, err := e.Catalog()
+	if err != nil {
+		return nil, err
+	}
+	schema := cat.Lookup(s.Table)
+	if schema == nil {
+		return nil, fmt.Errorf("table %s does not exist (CREATE TABLE first)", s.Table)
+	}
+	start, _, err := cat.KeyRange(s.Table)
+	if err != nil {
+		return nil, err
+	}
+	old, err := e.currentRow(schema, start, s.ID)
+	if err != nil {
+		return nil, err
+	}
+	if old == nil {
+		return &Result{Table: s.Table, Columns: schema.ColumnNames(), Rows: []map[string]interface{}{}}, nil
+	}
+	// As in insert, the row goes first so a failed write leaves the indexes alone.
+	if err := e.store.Delete(common.KeyType(start + s.ID)); err != nil {
+		return nil, err
+	}
+	for _, col := range schema.Indexes {
+		base, _, err := cat.KeyRange(indexTableName(s.Table, col))
+		if err != nil {
+			return nil, err
+		}
+		if err := e.indexRemove(base, old[col], s.ID); err != nil {
+			return nil, err
+		}
+	}
+	return &Result{Table: s.Table, Columns: schema.ColumnNames(), Count: 1, Rows: []map[string]interface{}{}}, nil
+}
+
+// selectRows answers a SELECT by scanning the table's key range. A WHERE on a
+// value column (anything but the primary key) is evaluated against each
+// decoded row, so it is a full scan of the table unless the predicate is an
+// equality on an indexed column; LIMIT still stops early.
+func (e *Executor) selectRows(s *SelectStmt) (*Result, error) {
+	cat, err := e.Catalog()
+	if err != nil {
+		return nil, err
+	}
+	schema := cat.Lookup(s.Table)
+	if err := validateWhere(s, schema); err != nil {
+		return nil, err
+	}
+	start, end, err := cat.KeyRange(s.Table)
+	if err != nil {
+		return nil, err
+	}
+	plan := e.planSelect(s, schema, start, end)
+	switch plan.Access {
+	case AccessSecondaryIndex:
+		base, _, err := cat.KeyRange(indexTableName(s.Table, plan.SecondaryIndex))
+		if err != nil {
+			return nil, err
+		}
+		return e.selectByIndex(s, schema, plan.SecondaryIndex, start, base)
+	case AccessEmpty:
+		res := &Result{Table: s.Table, Rows: []map[string]interface{}{}}
+		if schema != nil {
+			res.Columns = schema.ColumnNames()
+		}
+		return res, nil
+	}
+	records := e.store.Scan(common.KeyType(plan.StartKey), common.KeyType(plan.EndKey))
+
+	res := &Result{Table: s.Table, Rows: make([]map[string]interface{}, 0, len(records))}
+	if schema != nil {
+		res.Columns = schema.ColumnNames()
+	}
+	for _, rec := range records {
+		if rec.Key == catalogKey() {
+			continue
+		}
+		if schema == nil {
+			if !s.MatchID(int64(rec.Key)) {
+				continue
+			}
+			res.Rows = append(res.Rows, map[string]interface{}{
+				"id":   rec.Key,
+				"data": string(rec.Value),
+			})
+		} else {
+			id := int64(rec.Key) - start
+			row, err := schema.DecodeRow(id, rec.Value)
+			if err != nil {
+				return nil, err
+			}
+			if s.Where != nil && !s.Where.MatchValue(row[whereColumn(s, schema)]) {
+				continue
+			}
+			res.Rows = append(res.Rows, row)
+		}
+		if s.Limit >= 0 && len(res.Rows) >= s.Limit {
+			break
+		}
+	}
+	res.Count = len(res.Rows)
+	if _, ok := cat.Ranges[strings.ToLower(s.Table)]; !ok && res.Count > 0 {
+		if err := e.claim(s.Table); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// claim registers a schemaless table found to hold rows (see Catalog.Claim),
+// so a name whose home range overlaps it is rejected rather than shown its
+// rows. Reads keep working on a store that refuses the catalog write, e.g. a
+// read-only one; a later SELECT claims the name instead.
+func (e *Executor) claim(table string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	cat, err := e.Catalog()
+	if err != nil {
+		return err
+	}
+	changed, err := cat.Claim(table)
+	if err != nil || !changed {
+		return err
+	}
+	_ = e.saveCatalog(cat) // best effort, see above
+	return nil
+}
+
+// explain validates s and returns its plan without executing it.
+func (e *Executor) explain(s *SelectStmt) (*Result, error) {
+	cat, err := e.Catalog()
+	if err != nil {
+		return nil, err
+	}
+	schema := cat.Lookup(s.Table)
+	if err := validateWhere(s, schema); err != nil {
+		return nil, err
+	}
+	start, end, err := cat.KeyRange(s.Table)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{Table: s.Table, Rows: []map[string]interface{}{}, Plan: e.planSelect(s, schema, start, end)}
+	if schema != nil {
+		res.Columns = schema.ColumnNames()
+	}
+	return res, nil
+}
+
+// indexedWhereColumn returns the column whose secondary index can answer the
+// WHERE clause, or "" when a scan is required.
+func indexedWhereColumn(s *SelectStmt, schema *TableSchema) string {
+	if schema == nil || s.Where == nil || s.Where.Op != "=" {
+		return ""
+	}
+	col := whereColumn(s, schema)
+	if !schema.HasIndex(col) {
+		return ""
+	}
+	return col
+}
+
+func (e *Executor) selectByIndex(s *SelectStmt, schema *TableSchema, col string, start, base int64) (*Result, error) {
+	var operand interface{} = s.Where.Value
+	if s.Where.IsText {
+		operand = s.Where.Text
+	}
+	ids, err := e.indexLookup(base, operand)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{Table: s.Table, Columns: schema.ColumnNames(), Rows: make([]map[string]interface{}, 0, len(ids))}
+	for _, id := range ids {
+		row, err := e.currentRow(schema, start, id)
+		if err != nil {
+			return nil, err
+		}
+		// Re-check against the row: the index is advisory, the row is authoritative.
+		if row == nil || !s.Where.MatchValue(row[col]) {
+			continue
+		}
+		res.Rows = append(res.Rows, row)
+		if s.Limit >= 0 && len(res.Rows) >= s.Limit {
+			break
+		}
+	}
+	res.Count = len(res.Rows)
+	return res, nil
+}
+
+// whereColumn maps the WHERE field to a schema column; "id" always means the primary key.
+func whereColumn(s *SelectStmt, schema *TableSchema) string {
+	if s.Where.Field == "id" {
+		return schema.Columns[0].Name
+	}
+	return s.Where.Field
+}
+
+func validateWhere(s *SelectStmt, schema *TableSchema) error {
+	if s.Where == nil {
+		return nil
+	}
+	if schema == nil {
+		if s.Where.Field != "id" {
+			return fmt.Errorf("WHERE %s requires a typed table (CREATE TABLE %s first)", s.Where.Field, s.Table)
+		}
+		if s.Where.IsText {
+			return fmt.Errorf("WHERE id expects an integer")
+		}
+		return nil
+	}
+	col := schema.Column(whereColumn(s, schema))
+	if col == nil {
+		return fmt.Errorf("unknown column %s in table %s", s.Where.Field, s.Table)
+	}
+	if (col.Type == TypeText) != s.Where.IsText {
+		return fmt.Errorf("column %s is %s; WHERE operand has the wrong type", col.Name, col.Type)
+	}
+	return nil
+}
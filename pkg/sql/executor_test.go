@@ -0,0 +1,444 @@
+package sql
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"neurodb/pkg/common"
+)
+
+type memStore struct {
+	m map[common.KeyType]common.ValueType
+}
+
+func newMemStore() *memStore {
+	return &memStore{m: make(map[common.KeyType]common.ValueType)}
+}
+
+func (s *memStore) Get(k common.KeyType) (common.ValueType, bool) {
+	v, ok := s.m[k]
+	if !ok || len(v) == 0 {
+		return nil, false
+	}
+	return v, true
+}
+
+func (s *memStore) Put(k common.KeyType, v common.ValueType) error {
+	s.m[k] = append([]byte(nil), v...)
+	return nil
+}
+
+func (s *memStore) Delete(k common.KeyType) error {
+	s.m[k] = []byte{}
+	return nil
+}
+
+func (s *memStore) Scan(start, end common.KeyType) []common.Record {
+	var out []common.Record
+	for k, v := range s.m {
+		if k >= start && k <= end && len(v) > 0 {
+			out = append(out, common.Record{Key: k, Value: v})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+func TestExecutorTypedTable(t *testing.T) {
+	store := newMemStore()
+	ex := NewExecutor(store)
+
+	if _, err := ex.Execute("CREATE TABLE users (id INT, name TEXT, age INT)"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := ex.Execute("CREATE TABLE users (id INT)"); err == nil {
+		t.Fatalf("expected duplicate table error")
+	}
+	for _, q := range []string{
+		"INSERT INTO users VALUES (1, 'alice', 31)",
+		"INSERT INTO users VALUES (2, 'bob', 25)",
+		"INSERT INTO users VALUES (3, 'carol', 40)",
+	} {
+		if _, err := ex.Execute(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	if _, err := ex.Execute("INSERT INTO users VALUES (4, 5, 'x')"); err == nil {
+		t.Fatalf("expected type mismatch error")
+	}
+
+	res, err := ex.Execute("SELECT * FROM users WHERE id >= 2")
+	if err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if res.Count != 2 || len(res.Columns) != 3 {
+		t.Fatalf("expected 2 rows with 3 columns, got count=%d columns=%v", res.Count, res.Columns)
+	}
+	row := res.Rows[0]
+	if row["id"] != int64(2) || row["name"] != "bob" || row["age"] != int64(25) {
+		t.Fatalf("unexpected typed row: %#v", row)
+	}
+
+	// Schemaless tables keep the raw {id, data} representation.
+	start, _ := TableKeyRange("logs")
+	store.Put(common.KeyType(start+1), []byte("raw"))
+	res, err = ex.Execute("SELECT * FROM logs")
+	if err != nil {
+		t.Fatalf("select schemaless: %v", err)
+	}
+	if res.Count != 1 || res.Rows[0]["data"] != "raw" || res.Columns != nil {
+		t.Fatalf("unexpected schemaless result: %+v", res)
+	}
+}
+
+func TestExecutorWhereOnValueColumn(t *testing.T) {
+	ex := NewExecutor(newMemStore())
+	mustExec := func(q string) *Result {
+		t.Helper()
+		res, err := ex.Execute(q)
+		if err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		return res
+	}
+
+	mustExec("CREATE TABLE users (id INT, name TEXT, age INT)")
+	mustExec("INSERT INTO users VALUES (1, 'alice', 31)")
+	mustExec("INSERT INTO users VALUES (2, 'bob', 25)")
+	mustExec("INSERT INTO users VALUES (3, 'bob', 40)")
+	mustExec("INSERT INTO users VALUES (4, 'carol', 22)")
+
+	res := mustExec("SELECT * FROM users WHERE name = 'bob'")
+	if res.Count != 2 || res.Rows[0]["id"] != int64(2) || res.Rows[1]["id"] != int64(3) {
+		t.Fatalf("name = 'bob': unexpected rows %#v", res.Rows)
+	}
+
+	res = mustExec("SELECT * FROM users WHERE name != 'bob'")
+	if res.Count != 2 || res.Rows[0]["name"] != "alice" || res.Rows[1]["name"] != "carol" {
+		t.Fatalf("name != 'bob': unexpected rows %#v", res.Rows)
+	}
+
+	res = mustExec("SELECT * FROM users WHERE name != 'bob' LIMIT 1")
+	if res.Count != 1 || res.Rows[0]["name"] != "alice" {
+		t.Fatalf("LIMIT on value-column WHERE: unexpected rows %#v", res.Rows)
+	}
+
+	res = mustExec("SELECT * FROM users WHERE age > 30")
+	if res.Count != 2 {
+		t.Fatalf("age > 30: expected 2 rows, got %d", res.Count)
+	}
+
+	for _, q := range []string{
+		"SELECT * FROM users WHERE nickname = 'x'",
+		"SELECT * FROM users WHERE age = 'old'",
+		"SELECT * FROM users WHERE name = 3",
+		"SELECT * FROM logs WHERE name = 'bob'",
+	} {
+		if _, err := ex.Execute(q); err == nil {
+			t.Fatalf("%s: expected error", q)
+		}
+	}
+}
+
+func TestExecutorSecondaryIndex(t *testing.T) {
+	store := newMemStore()
+	ex := NewExecutor(store)
+	mustExec := func(q string) *Result {
+		t.Helper()
+		res, err := ex.Execute(q)
+		if err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		return res
+	}
+	ids := func(res *Result) []int64 {
+		out := make([]int64, 0, len(res.Rows))
+		for _, r := range res.Rows {
+			out = append(out, r["id"].(int64))
+		}
+		return out
+	}
+
+	mustExec("CREATE TABLE users (id INT, name TEXT, age INT)")
+	mustExec("INSERT INTO users VALUES (1, 'alice', 31)")
+	mustExec("INSERT INTO users VALUES (2, 'bob', 25)")
+	mustExec("CREATE INDEX ON users(name)")
+	mustExec("INSERT INTO users VALUES (3, 'bob', 40)")
+
+	if _, err := ex.Execute("CREATE INDEX ON users(name)"); err == nil {
+		t.Fatalf("expected duplicate index error")
+	}
+
+	// A row written behind the executor's back has no index entry; an index
+	// lookup must not see it, while a scan-based predicate does.
+	start, _ := TableKeyRange("users")
+	store.Put(common.KeyType(start+9), []byte(`{"name":"bob","age":1}`))
+	if got := ids(mustExec("SELECT * FROM users WHERE age = 1")); len(got) != 1 || got[0] != 9 {
+		t.Fatalf("scan for age=1: got %v", got)
+	}
+	if got := ids(mustExec("SELECT * FROM users WHERE name = 'bob'")); len(got) != 2 || got[0] != 2 || got[1] != 3 {
+		t.Fatalf("index lookup for bob: got %v", got)
+	}
+	store.Delete(common.KeyType(start + 9))
+
+	// Update moves id=2 from bob to dave.
+	mustExec("INSERT INTO users VALUES (2, 'dave', 26)")
+	if got := ids(mustExec("SELECT * FROM users WHERE name = 'bob'")); len(got) != 1 || got[0] != 3 {
+		t.Fatalf("after update, bob: got %v", got)
+	}
+	if got := ids(mustExec("SELECT * FROM users WHERE name = 'dave'")); len(got) != 1 || got[0] != 2 {
+		t.Fatalf("after update, dave: got %v", got)
+	}
+
+	// Delete removes the posting.
+	mustExec("DELETE FROM users WHERE id = 3")
+	if got := ids(mustExec("SELECT * FROM users WHERE name = 'bob'")); len(got) != 0 {
+		t.Fatalf("after delete, bob: got %v", got)
+	}
+	cat, err := ex.Catalog()
+	if err != nil {
+		t.Fatalf("catalog: %v", err)
+	}
+	base, _, err := cat.KeyRange(indexTableName("users", "name"))
+	if err != nil {
+		t.Fatalf("index range: %v", err)
+	}
+	entries, err := ex.loadPostings(indexSlot(base, indexValueKey("bob")))
+	if err != nil {
+		t.Fatalf("load postings: %v", err)
+	}
+	for _, e := range entries {
+		if e.Value == indexValueKey("bob") {
+			t.Fatalf("expected bob posting removed, got %+v", e)
+		}
+	}
+	if got := ids(mustExec("SELECT * FROM users WHERE name = 'alice'")); len(got) != 1 || got[0] != 1 {
+		t.Fatalf("backfilled alice: got %v", got)
+	}
+}
+
+func TestExecutorExplain(t *testing.T) {
+	store := newMemStore()
+	ex := NewExecutor(store)
+	if _, err := ex.Execute("CREATE TABLE users (id INT, name TEXT)"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	for _, q := range []string{
+		"INSERT INTO users VALUES (1, 'alice')",
+		"INSERT INTO users VALUES (2, 'bob')",
+		"INSERT INTO users VALUES (3, 'carol')",
+	} {
+		if _, err := ex.Execute(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	start, end := TableKeyRange("users")
+
+	res, err := ex.Execute("EXPLAIN SELECT * FROM users WHERE id >= 2")
+	if err != nil {
+		t.Fatalf("explain: %v", err)
+	}
+	p := res.Plan
+	if p == nil || p.Access != AccessRangeScan || p.FullScan || p.StartKey != start+2 || p.EndKey != end {
+		t.Fatalf("unexpected ranged plan: %+v", p)
+	}
+	if p.KeyLookup != "unknown" || p.EstimatedRows != -1 || len(res.Rows) != 0 {
+		t.Fatalf("explain should not execute or estimate without a planner: %+v", res)
+	}
+
+	res, err = ex.Execute("EXPLAIN SELECT * FROM users WHERE name = 'bob'")
+	if err != nil {
+		t.Fatalf("explain: %v", err)
+	}
+	if !res.Plan.FullScan || res.Plan.StartKey != start || res.Plan.Filter != "name = 'bob'" {
+		t.Fatalf("value-column predicate should be a full scan: %+v", res.Plan)
+	}
+
+	res, err = ex.Execute("EXPLAIN SELECT * FROM users WHERE id < 0")
+	if err != nil || res.Plan.Access != AccessEmpty {
+		t.Fatalf("expected empty plan, got %+v (%v)", res, err)
+	}
+
+	res, err = ex.Execute("SELECT * FROM users WHERE id > 1")
+	if err != nil || res.Count != 2 {
+		t.Fatalf("ranged select: %+v (%v)", res, err)
+	}
+	if _, err := ex.Execute("EXPLAIN SELECT * FROM users WHERE nope = 1"); err == nil {
+		t.Fatalf("expected unknown column error")
+	}
+}
+
+func TestCatalogResolvesTableRangeCollisions(t *testing.T) {
+	// Two names whose home ranges overlap without starting at the same key,
+	// as the hashed ranges can: "other" is registered halfway into a's.
+	const a, b = "alpha", "beta"
+	homeA, _ := TableKeyRange(a)
+	store := newMemStore()
+	ex := NewExecutor(store)
+	seed := NewCatalog()
+	seed.Ranges["other"] = homeA + TableSpan/2
+	if err := ex.saveCatalog(seed); err != nil {
+		t.Fatalf("save catalog: %v", err)
+	}
+	store.Put(common.KeyType(homeA+TableSpan/2+1), []byte(`{"v":"from-other"}`))
+
+	// A schemaless table whose home range is taken is rejected, not merged.
+	if _, err := ex.Execute("SELECT * FROM " + a); err == nil {
+		t.Fatalf("expected collision error for %s", a)
+	}
+
+	// A typed table moves to a free range instead.
+	for _, q := range []string{
+		"CREATE TABLE " + a + " (id INT, v TEXT)",
+		"CREATE TABLE " + b + " (id INT, v TEXT)",
+		"INSERT INTO " + a + " VALUES (1, 'from-a')",
+		"INSERT INTO " + b + " VALUES (1, 'from-b')",
+	} {
+		if _, err := ex.Execute(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	cat, err := ex.Catalog()
+	if err != nil {
+		t.Fatalf("catalog: %v", err)
+	}
+	for _, pair := range [][2]string{{a, b}, {a, "other"}, {b, "other"}} {
+		if rangesOverlap(cat.Ranges[pair[0]], cat.Ranges[pair[1]]) {
+			t.Fatalf("%s at %d overlaps %s at %d", pair[0], cat.Ranges[pair[0]], pair[1], cat.Ranges[pair[1]])
+		}
+	}
+	if home, _ := TableKeyRange(b); cat.Ranges[b] != home {
+		t.Fatalf("%s left its free home range %d for %d", b, home, cat.Ranges[b])
+	}
+	for table, want := range map[string]string{a: "from-a", b: "from-b"} {
+		res, err := ex.Execute("SELECT * FROM " + table)
+		if err != nil {
+			t.Fatalf("select %s: %v", table, err)
+		}
+		if res.Count != 1 || res.Rows[0]["v"] != want {
+			t.Fatalf("%s leaked rows: %+v", table, res.Rows)
+		}
+	}
+}
+
+func TestCatalogMovesHashCollidingTable(t *testing.T) {
+	// Real pairs of names whose hashed home ranges collide: the first at the
+	// same start, the second 758080 keys apart.
+	for _, pair := range [][2]string{{"nixmrgco", "iqsaoemn"}, {"tjuxqeey", "rhiupbnt"}} {
+		first, second := pair[0], pair[1]
+		homeFirst, _ := TableKeyRange(first)
+		homeSecond, _ := TableKeyRange(second)
+		if !rangesOverlap(homeFirst, homeSecond) {
+			t.Fatalf("%s at %d and %s at %d do not collide", first, homeFirst, second, homeSecond)
+		}
+
+		ex := NewExecutor(newMemStore())
+		for _, q := range []string{
+			"CREATE TABLE " + first + " (id INT, v TEXT)",
+			"CREATE TABLE " + second + " (id INT, v TEXT)",
+			"INSERT INTO " + first + " VALUES (1, 'from-first')",
+			"INSERT INTO " + second + " VALUES (1, 'from-second')",
+		} {
+			if _, err := ex.Execute(q); err != nil {
+				t.Fatalf("%s: %v", q, err)
+			}
+		}
+		cat, err := ex.Catalog()
+		if err != nil {
+			t.Fatalf("catalog: %v", err)
+		}
+		if cat.Ranges[first] != homeFirst {
+			t.Fatalf("%s at %d, want its home range %d", first, cat.Ranges[first], homeFirst)
+		}
+		// The first aligned range probed from second's slot is free.
+		if want := int64(tableSlot(second, tableSlots)) * TableSpan; cat.Ranges[second] != want {
+			t.Fatalf("%s at %d, want the next free range %d", second, cat.Ranges[second], want)
+		}
+		for table, want := range map[string]string{first: "from-first", second: "from-second"} {
+			res, err := ex.Execute("SELECT * FROM " + table)
+			if err != nil {
+				t.Fatalf("select %s: %v", table, err)
+			}
+			if res.Count != 1 || res.Rows[0]["v"] != want {
+				t.Fatalf("%s leaked rows: %+v", table, res.Rows)
+			}
+		}
+	}
+}
+
+func TestCatalogReserveProbesAndFills(t *testing.T) {
+	// Each name's home range is taken, so it probes a space of 8 slots.
+	const slots = 8
+	c := NewCatalog()
+	reserve := func(name string) (int64, error) {
+		home, _ := TableKeyRange(name)
+		c.Ranges["home-of-"+name] = home
+		return c.reserve(name, slots)
+	}
+	seen := make(map[int64]string)
+	for i := 0; i < slots-1; i++ {
+		name := fmt.Sprintf("t%d", i)
+		start, err := reserve(name)
+		if err != nil {
+			t.Fatalf("reserve %s: %v", name, err)
+		}
+		if start < TableSpan || start%TableSpan != 0 || start >= slots*TableSpan {
+			t.Fatalf("%s: start %d is not a probed slot", name, start)
+		}
+		if prev, ok := seen[start]; ok {
+			t.Fatalf("%s and %s share the range at %d", prev, name, start)
+		}
+		seen[start] = name
+	}
+	if _, err := reserve("full"); err == nil {
+		t.Fatalf("expected an error once every slot is taken")
+	}
+	if start, err := c.reserve("t3", slots); err != nil || seen[start] != "t3" {
+		t.Fatalf("reserving t3 again: %d, %v", start, err)
+	}
+}
+
+func TestCatalogKeepsRangesOfOlderTables(t *testing.T) {
+	store := newMemStore()
+	ex := NewExecutor(store)
+	// A catalog and rows written before ranges were recorded.
+	old := `{"tables":{"users":{"name":"users","columns":[{"name":"id","type":"INT"},{"name":"name","type":"TEXT"}],"indexes":["name"]}}}`
+	store.Put(catalogKey(), []byte(old))
+	usersStart, _ := TableKeyRange("users")
+	indexStart, _ := TableKeyRange(indexTableName("users", "name"))
+	store.Put(common.KeyType(usersStart+1), []byte(`{"name":"bob"}`))
+	if err := ex.indexAdd(indexStart, "bob", 1); err != nil {
+		t.Fatalf("index add: %v", err)
+	}
+	logsStart, _ := TableKeyRange("logs")
+	store.Put(common.KeyType(logsStart+1), []byte("raw"))
+
+	for _, q := range []string{"SELECT * FROM users", "SELECT * FROM users WHERE name = 'bob'"} {
+		res, err := ex.Execute(q)
+		if err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		if res.Count != 1 || res.Rows[0]["name"] != "bob" {
+			t.Fatalf("%s: %+v", q, res.Rows)
+		}
+	}
+	if res, err := ex.Execute("SELECT * FROM logs"); err != nil || res.Count != 1 {
+		t.Fatalf("select logs: %+v, %v", res, err)
+	}
+
+	// The schemaless table is registered once a SELECT finds rows in it.
+	cat, err := ex.Catalog()
+	if err != nil {
+		t.Fatalf("catalog: %v", err)
+	}
+	if cat.Ranges["logs"] != logsStart || cat.Ranges["users"] != usersStart {
+		t.Fatalf("ranges: %v", cat.Ranges)
+	}
+	if res, err := ex.Execute("SELECT * FROM empty"); err != nil || res.Count != 0 {
+		t.Fatalf("select empty: %+v, %v", res, err)
+	}
+	if cat, _ := ex.Catalog(); len(cat.Ranges) != 3 {
+		t.Fatalf("an empty table was registered: %v", cat.Ranges)
+	}
+}
@@ -0,0 +1,133 @@
+package sql
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"neurodb/pkg/common"
+	"sort"
+	"strings"
+)
+
+// Secondary indexes reuse the table-range trick: each (table, column) index
+// owns a key range reserved in the catalog, and a column value hashes to one
+// slot in it. A slot holds a posting list so hash collisions and duplicate
+// values coexist.
+
+type postingEntry struct {
+	Value string  `json:"v"`
+	IDs   []int64 `json:"ids"`
+}
+
+func indexTableName(table, column string) string {
+	return "__idx_" + strings.ToLower(table) + "_" + column
+}
+
+// indexValueKey renders a column value in a type-tagged canonical form.
+func indexValueKey(v interface{}) string {
+	switch x := v.(type) {
+	case int64:
+		return fmt.Sprintf("i:%d", x)
+	case string:
+		return "s:" + x
+	default:
+		return ""
+	}
+}
+
+// indexSlot maps a value to its slot in the index range starting at base.
+func indexSlot(base int64, valueKey string) common.KeyType {
+	h := fnv.New64a()
+	h.Write([]byte(valueKey))
+	return common.KeyType(base + int64(h.Sum64()%TableSpan))
+}
+
+func (e *Executor) loadPostings(slot common.KeyType) ([]postingEntry, error) {
+	raw, ok := e.store.Get(slot)
+	if !ok {
+		return nil, nil
+	}
+	var entries []postingEntry
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil, fmt.Errorf("corrupt index slot %d: %w", slot, err)
+	}
+	return entries, nil
+}
+
+func (e *Executor) storePostings(slot common.KeyType, entries []postingEntry) error {
+	if len(entries) == 0 {
+		return e.store.Delete(slot)
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return e.store.Put(slot, data)
+}
+
+// indexAdd records id under v in the index range starting at base.
+func (e *Executor) indexAdd(base int64, v interface{}, id int64) error {
+	vk := indexValueKey(v)
+	slot := indexSlot(base, vk)
+	entries, err := e.loadPostings(slot)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		if entries[i].Value != vk {
+			continue
+		}
+		for _, existing := range entries[i].IDs {
+			if existing == id {
+				return nil
+			}
+		}
+		entries[i].IDs = append(entries[i].IDs, id)
+		sort.Slice(entries[i].IDs, func(a, b int) bool { return entries[i].IDs[a] < entries[i].IDs[b] })
+		return e.storePostings(slot, entries)
+	}
+	entries = append(entries, postingEntry{Value: vk, IDs: []int64{id}})
+	return e.storePostings(slot, entries)
+}
+
+// indexRemove drops id from v in the index range starting at base.
+func (e *Executor) indexRemove(base int64, v interface{}, id int64) error {
+	vk := indexValueKey(v)
+	slot := indexSlot(base, vk)
+	entries, err := e.loadPostings(slot)
+	if err != nil {
+		return err
+	}
+	kept := entries[:0]
+	for _, entry := range entries {
+		if entry.Value == vk {
+			ids := entry.IDs[:0]
+			for _, existing := range entry.IDs {
+				if existing != id {
+					ids = append(ids, existing)
+				}
+			}
+			entry.IDs = ids
+			if len(entry.IDs) == 0 {
+				continue
+			}
+		}
+		kept = append(kept, entry)
+	}
+	return e.storePostings(slot, kept)
+}
+
+// indexLookup returns the primary keys stored under v in the index range starting at base.
+func (e *Executor) indexLookup(base int64, v interface{}) ([]int64, error) {
+	vk := indexValueKey(v)
+	entries, err := e.loadPostings(indexSlot(base, vk))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Value == vk {
+			return entry.IDs, nil
+		}
+	}
+	return nil, nil
+}
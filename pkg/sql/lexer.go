@@ -0,0 +1,121 @@
+package sql
+
+import (
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokSymbol
+)
+
+// token is a lexeme with its byte offset in the query. For tokString, Text
+// holds the unescaped contents without the surrounding quotes.
+type token struct {
+	Kind tokenKind
+	Text string
+	Pos  int
+}
+
+func (t token) String() string {
+	switch t.Kind {
+	case tokEOF:
+		return "end of input"
+	case tokString:
+		return "'" + strings.ReplaceAll(t.Text, "'", "''") + "'"
+	default:
+		return t.Text
+	}
+}
+
+// isKeyword reports whether t is the identifier kw (case-insensitive).
+func (t token) isKeyword(kw string) bool {
+	return t.Kind == tokIdent && strings.EqualFold(t.Text, kw)
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// tokenize splits a query into identifiers, integer literals, single-quoted
+// string literals and operator/punctuation symbols. In a string literal a
+// doubled single quote escapes a quote:
+//
+//	'it''s'
+func tokenize(s string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isIdentStart(c):
+			start := i
+			for i < len(s) && (isIdentStart(s[i]) || isDigit(s[i])) {
+				i++
+			}
+			toks = append(toks, token{Kind: tokIdent, Text: s[start:i], Pos: start})
+		case isDigit(c) || (c == '-' && i+1 < len(s) && isDigit(s[i+1])):
+			start := i
+			i++
+			for i < len(s) && isDigit(s[i]) {
+				i++
+			}
+			toks = append(toks, token{Kind: tokNumber, Text: s[start:i], Pos: start})
+		case c == '\'':
+			start := i
+			var sb strings.Builder
+			i++
+			closed := false
+			for i < len(s) {
+				if s[i] == '\'' {
+					if i+1 < len(s) && s[i+1] == '\'' {
+						sb.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					closed = true
+					break
+				}
+				sb.WriteByte(s[i])
+				i++
+			}
+			if !closed {
+				return nil, &ParseError{Msg: "syntax: unterminated string literal", Token: s[start:], Pos: start}
+			}
+			toks = append(toks, token{Kind: tokString, Text: sb.String(), Pos: start})
+		case c == '!' || c == '<' || c == '>':
+			start := i
+			i++
+			if i < len(s) && (s[i] == '=' || (c == '<' && s[i] == '>')) {
+				i++
+			}
+			op := s[start:i]
+			if op == "!" {
+				return nil, &ParseError{Msg: "syntax: unexpected '!'", Token: op, Pos: start}
+			}
+			if op == "<>" {
+				op = "!="
+			}
+			toks = append(toks, token{Kind: tokSymbol, Text: op, Pos: start})
+		case strings.IndexByte("=*(),;", c) >= 0:
+			toks = append(toks, token{Kind: tokSymbol, Text: string(c), Pos: i})
+			i++
+		default:
+			return nil, &ParseError{Msg: "syntax: unexpected character " + string(c), Token: string(c), Pos: i}
+		}
+	}
+	toks = append(toks, token{Kind: tokEOF, Pos: len(s)})
+	return toks, nil
+}
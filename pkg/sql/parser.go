@@ -1,12 +1,18 @@
 package sql
 
 import (
-	"errors"
+	"fmt"
 	"hash/fnv"
-	"regexp"
+	"math"
+	"strconv"
 	"strings"
 )
 
+// Statement is any parsed SQL statement.
+type Statement interface {
+	statement()
+}
+
 // SelectStmt represents a parsed SELECT * FROM table statement.
 type SelectStmt struct {
 	Table string
@@ -14,72 +20,414 @@ type SelectStmt struct {
 	Limit int
 }
 
+// WhereClause is a single comparison. Value holds integer operands; string
+// literal operands are stored in Text with IsText set.
 type WhereClause struct {
-	Field string
-	Op    string
-	Value int64
+	Field  string
+	Op     string
+	Value  int64
+	Text   string
+	IsText bool
+}
+
+// CreateTableStmt represents CREATE TABLE t (id INT, name TEXT, ...).
+// The first column is the primary key and must be INT.
+type CreateTableStmt struct {
+	Table   string
+	Columns []Column
+}
+
+// InsertStmt represents INSERT INTO t VALUES (...). Values are int64 or string.
+type InsertStmt struct {
+	Table  string
+	Values []interface{}
+}
+
+// CreateIndexStmt represents CREATE INDEX ON t (column).
+type CreateIndexStmt struct {
+	Table  string
+	Column string
+}
+
+// DeleteStmt represents DELETE FROM t WHERE id = N.
+type DeleteStmt struct {
+	Table string
+	ID    int64
 }
 
+// ExplainStmt wraps a SELECT whose plan should be returned instead of rows.
+type ExplainStmt struct {
+	Select *SelectStmt
+}
+
+func (*SelectStmt) statement()      {}
+func (*ExplainStmt) statement()     {}
+func (*CreateTableStmt) statement() {}
+func (*InsertStmt) statement()      {}
+func (*CreateIndexStmt) statement() {}
+func (*DeleteStmt) statement()      {}
+
 // Parse parses simple SQL:
 // "SELECT * FROM table"
 // "SELECT * FROM table WHERE id >= 100"
 // "SELECT * FROM table LIMIT 10"
 // "SELECT * FROM table WHERE id >= 100 LIMIT 10"
+// "SELECT * FROM table WHERE name = 'bob'"
 // Table name must be a valid identifier (letters, digits, underscore).
 func Parse(s string) (*SelectStmt, error) {
-	orig := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), ";"))
-	if orig == "" {
-		return nil, errors.New("empty query")
+	stmt, err := ParseStatement(s)
+	if err != nil {
+		return nil, err
 	}
+	sel, ok := stmt.(*SelectStmt)
+	if !ok {
+		return nil, &ParseError{Msg: "syntax: expected SELECT statement", Pos: 0}
+	}
+	return sel, nil
+}
 
-	re := regexp.MustCompile(`(?i)^SELECT\s+\*\s+FROM\s+([a-zA-Z_][a-zA-Z0-9_]*)(?:\s+WHERE\s+([a-zA-Z_][a-zA-Z0-9_]*)\s*(=|!=|>=|<=|>|<)\s*(-?\d+))?(?:\s+LIMIT\s+(\d+))?\s*;?\s*$`)
-	matches := re.FindStringSubmatch(orig)
-	if matches == nil {
-		return nil, errors.New("syntax: expected SELECT * FROM <table> [WHERE id <op> <int>] [LIMIT <n>]")
+// ParseStatement parses any supported statement: [EXPLAIN] SELECT, CREATE
+// TABLE, CREATE INDEX, INSERT or DELETE.
+func ParseStatement(s string) (Statement, error) {
+	toks, err := tokenize(s)
+	if err != nil {
+		return nil, err
 	}
-	table := strings.TrimSpace(matches[1])
-	if table == "" {
-		return nil, errors.New("missing table name")
+	p := &parser{toks: toks}
+	if p.peek().Kind == tokEOF {
+		return nil, errAt(p.peek(), "empty query")
 	}
 
-	stmt := &SelectStmt{
-		Table: table,
-		Limit: -1,
+	var stmt Statement
+	first := p.peek()
+	switch {
+	case first.isKeyword("SELECT"):
+		stmt, err = p.parseSelect()
+	case first.isKeyword("EXPLAIN"):
+		p.next()
+		if tok := p.peek(); !tok.isKeyword("SELECT") {
+			return nil, errAt(tok, "syntax: EXPLAIN supports SELECT only, got %s", tok)
+		}
+		var sel *SelectStmt
+		sel, err = p.parseSelect()
+		stmt = &ExplainStmt{Select: sel}
+	case first.isKeyword("CREATE"):
+		if p.toks[p.pos+1].isKeyword("INDEX") {
+			stmt, err = p.parseCreateIndex()
+		} else {
+			stmt, err = p.parseCreateTable()
+		}
+	case first.isKeyword("INSERT"):
+		stmt, err = p.parseInsert()
+	case first.isKeyword("DELETE"):
+		stmt, err = p.parseDelete()
+	default:
+		return nil, errAt(first, "syntax: expected SELECT, EXPLAIN, CREATE, INSERT or DELETE, got %s", first)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().isSymbol(";") {
+		p.next()
 	}
+	if tok := p.peek(); tok.Kind != tokEOF {
+		return nil, errAt(tok, "syntax: unexpected %s after end of statement", tok)
+	}
+	return stmt, nil
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
 
-	if matches[2] != "" {
-		field := strings.ToLower(strings.TrimSpace(matches[2]))
-		if field != "id" {
-			return nil, errors.New("only WHERE id is supported")
+// ParseError is a syntax error with the offending token and its byte offset
+// in the query.
+type ParseError struct {
+	Msg   string
+	Token string
+	Pos   int
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s (at position %d)", e.Msg, e.Pos)
+}
+
+func errAt(tok token, format string, args ...interface{}) *ParseError {
+	return &ParseError{Msg: fmt.Sprintf(format, args...), Token: tok.String(), Pos: tok.Pos}
+}
+
+func (t token) isSymbol(sym string) bool {
+	return t.Kind == tokSymbol && t.Text == sym
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.toks[p.pos]
+	if tok.Kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) expectKeyword(kw string) error {
+	if tok := p.next(); !tok.isKeyword(kw) {
+		return errAt(tok, "syntax: expected %s, got %s", kw, tok)
+	}
+	return nil
+}
+
+func (p *parser) expectSymbol(sym string) error {
+	if tok := p.next(); !tok.isSymbol(sym) {
+		return errAt(tok, "syntax: expected '%s', got %s", sym, tok)
+	}
+	return nil
+}
+
+func (p *parser) expectIdent(what string) (string, error) {
+	tok := p.next()
+	if tok.Kind != tokIdent {
+		return "", errAt(tok, "syntax: expected %s, got %s", what, tok)
+	}
+	return tok.Text, nil
+}
+
+func (p *parser) expectInt(what string) (int64, error) {
+	tok := p.next()
+	if tok.Kind != tokNumber {
+		return 0, errAt(tok, "syntax: expected %s, got %s", what, tok)
+	}
+	n, err := strconv.ParseInt(tok.Text, 10, 64)
+	if err != nil {
+		return 0, errAt(tok, "invalid %s %s", what, tok.Text)
+	}
+	return n, nil
+}
+
+// parseLiteral returns an int64 or string literal.
+func (p *parser) parseLiteral() (interface{}, error) {
+	tok := p.peek()
+	switch tok.Kind {
+	case tokString:
+		p.next()
+		return tok.Text, nil
+	case tokNumber:
+		return p.expectInt("value")
+	default:
+		p.next()
+		return nil, errAt(tok, "syntax: expected integer or 'string' literal, got %s", tok)
+	}
+}
+
+func (p *parser) parseSelect() (*SelectStmt, error) {
+	p.next() // SELECT
+	if err := p.expectSymbol("*"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	table, err := p.expectIdent("table name")
+	if err != nil {
+		return nil, err
+	}
+	stmt := &SelectStmt{Table: table, Limit: -1}
+
+	if p.peek().isKeyword("WHERE") {
+		p.next()
+		field, err := p.expectIdent("column name")
+		if err != nil {
+			return nil, err
 		}
-		whereVal, err := parseInt64(matches[4])
+		op := p.next()
+		if op.Kind != tokSymbol || !isComparison(op.Text) {
+			return nil, errAt(op, "syntax: expected comparison operator, got %s", op)
+		}
+		lit, err := p.parseLiteral()
 		if err != nil {
-			return nil, errors.New("invalid WHERE value")
+			return nil, err
 		}
-		stmt.Where = &WhereClause{
-			Field: field,
-			Op:    matches[3],
-			Value: whereVal,
+		where := &WhereClause{Field: strings.ToLower(field), Op: op.Text}
+		switch v := lit.(type) {
+		case string:
+			where.Text = v
+			where.IsText = true
+		case int64:
+			where.Value = v
 		}
+		stmt.Where = where
 	}
 
-	if matches[5] != "" {
-		limitVal, err := parseInt64(matches[5])
-		if err != nil || limitVal < 0 {
-			return nil, errors.New("invalid LIMIT value")
+	if p.peek().isKeyword("LIMIT") {
+		p.next()
+		limitTok := p.peek()
+		limit, err := p.expectInt("LIMIT value")
+		if err != nil {
+			return nil, err
 		}
-		stmt.Limit = int(limitVal)
+		if limit < 0 {
+			return nil, errAt(limitTok, "invalid LIMIT value")
+		}
+		stmt.Limit = int(limit)
 	}
+	return stmt, nil
+}
 
+func isComparison(op string) bool {
+	switch op {
+	case "=", "!=", ">", "<", ">=", "<=":
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseCreateTable() (*CreateTableStmt, error) {
+	p.next() // CREATE
+	if err := p.expectKeyword("TABLE"); err != nil {
+		return nil, err
+	}
+	table, err := p.expectIdent("table name")
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	stmt := &CreateTableStmt{Table: table}
+	firstCol := p.peek()
+	seen := make(map[string]bool)
+	for {
+		nameTok := p.peek()
+		name, err := p.expectIdent("column name")
+		if err != nil {
+			return nil, err
+		}
+		name = strings.ToLower(name)
+		if seen[name] {
+			return nil, errAt(nameTok, "duplicate column %s", name)
+		}
+		seen[name] = true
+		typTok := p.peek()
+		typName, err := p.expectIdent("column type")
+		if err != nil {
+			return nil, err
+		}
+		typ, err := parseColumnType(typName)
+		if err != nil {
+			return nil, errAt(typTok, "%v", err)
+		}
+		stmt.Columns = append(stmt.Columns, Column{Name: name, Type: typ})
+		if p.peek().isSymbol(",") {
+			p.next()
+			continue
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		break
+	}
+	if stmt.Columns[0].Type != TypeInt {
+		return nil, errAt(firstCol, "first column is the primary key and must be INT")
+	}
 	return stmt, nil
 }
 
+func (p *parser) parseCreateIndex() (*CreateIndexStmt, error) {
+	p.next() // CREATE
+	p.next() // INDEX
+	if err := p.expectKeyword("ON"); err != nil {
+		return nil, err
+	}
+	table, err := p.expectIdent("table name")
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	column, err := p.expectIdent("column name")
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	return &CreateIndexStmt{Table: table, Column: strings.ToLower(column)}, nil
+}
+
+func (p *parser) parseInsert() (*InsertStmt, error) {
+	p.next() // INSERT
+	if err := p.expectKeyword("INTO"); err != nil {
+		return nil, err
+	}
+	table, err := p.expectIdent("table name")
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("VALUES"); err != nil {
+		return nil, err
+	}
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	stmt := &InsertStmt{Table: table}
+	for {
+		v, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Values = append(stmt.Values, v)
+		if p.peek().isSymbol(",") {
+			p.next()
+			continue
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return stmt, nil
+	}
+}
+
+func (p *parser) parseDelete() (*DeleteStmt, error) {
+	p.next() // DELETE
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	table, err := p.expectIdent("table name")
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("WHERE"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("id"); err != nil {
+		return nil, err
+	}
+	if err := p.expectSymbol("="); err != nil {
+		return nil, err
+	}
+	id, err := p.expectInt("id")
+	if err != nil {
+		return nil, err
+	}
+	return &DeleteStmt{Table: table, ID: id}, nil
+}
+
 // TableKeyRange returns (startKey, endKey) for the given table name.
-// Uses FNV hash to map table name to a deterministic int64 range.
-// Each table gets a 1M key range for scanning.
 func (stmt *SelectStmt) TableKeyRange() (start, end int64) {
+	return TableKeyRange(stmt.Table)
+}
+
+// TableKeyRange returns the home (startKey, endKey) of a table name, derived
+// from its FNV hash. It is where tables the catalog has no range for are
+// read, so it must not change: schemaless data already lives there. Two names
+// can overlap; the Catalog rejects a name overlapping a registered range.
+func TableKeyRange(table string) (start, end int64) {
 	h := fnv.New64a()
-	h.Write([]byte(strings.ToLower(stmt.Table)))
+	h.Write([]byte(strings.ToLower(table)))
 	hash := h.Sum64()
 	base := int64((hash >> 16) & 0x7FFFFFFFFFFF)
 	start = base * 1000000
@@ -90,44 +438,74 @@ func (stmt *SelectStmt) TableKeyRange() (start, end int64) {
 	return start, end
 }
 
+// tableSlots is the number of TableSpan-sized ranges in the non-negative key
+// space. Slot 0 ([0, TableSpan)) is never hashed to, leaving small keys to
+// raw key-value traffic.
+const tableSlots = math.MaxInt64 / TableSpan
+
+// tableSlot hashes a table name to a slot in [1, slots), where the Catalog
+// starts probing for a free aligned range.
+func tableSlot(table string, slots uint64) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToLower(table)))
+	return 1 + h.Sum64()%(slots-1)
+}
+
 func (stmt *SelectStmt) MatchID(id int64) bool {
 	if stmt.Where == nil {
 		return true
 	}
-	v := stmt.Where.Value
-	switch stmt.Where.Op {
+	if stmt.Where.IsText {
+		return false
+	}
+	return compareOp(stmt.Where.Op, cmpInt64(id, stmt.Where.Value))
+}
+
+// MatchValue evaluates the WHERE clause against a decoded column value
+// (int64 or string). Mismatched operand types never match.
+func (w *WhereClause) MatchValue(v interface{}) bool {
+	switch x := v.(type) {
+	case int64:
+		if w.IsText {
+			return false
+		}
+		return compareOp(w.Op, cmpInt64(x, w.Value))
+	case string:
+		if !w.IsText {
+			return false
+		}
+		return compareOp(w.Op, strings.Compare(x, w.Text))
+	default:
+		return false
+	}
+}
+
+func cmpInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareOp(op string, c int) bool {
+	switch op {
 	case "=":
-		return id == v
+		return c == 0
 	case "!=":
-		return id != v
+		return c != 0
 	case ">":
-		return id > v
+		return c > 0
 	case "<":
-		return id < v
+		return c < 0
 	case ">=":
-		return id >= v
+		return c >= 0
 	case "<=":
-		return id <= v
+		return c <= 0
 	default:
 		return false
 	}
 }
-
-func parseInt64(s string) (int64, error) {
-	var sign int64 = 1
-	if strings.HasPrefix(s, "-") {
-		sign = -1
-		s = s[1:]
-	}
-	if s == "" {
-		return 0, errors.New("empty int")
-	}
-	var n int64
-	for _, ch := range s {
-		if ch < '0' || ch > '9' {
-			return 0, errors.New("invalid int")
-		}
-		n = n*10 + int64(ch-'0')
-	}
-	return sign * n, nil
-}
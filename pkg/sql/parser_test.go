@@ -1,6 +1,7 @@
 package sql
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -20,7 +21,11 @@ func TestParseSelect(t *testing.T) {
 		{"SELECT * FROM users LIMIT 10", "users", 10, false, false},
 		{"SELECT * FROM users WHERE id >= 100", "users", -1, true, false},
 		{"SELECT * FROM users WHERE id >= 100 LIMIT 5", "users", 5, true, false},
-		{"SELECT * FROM users WHERE name = 1", "", 0, false, true},
+		{"SELECT * FROM users WHERE name = 'bob'", "users", -1, true, false},
+		{"SELECT * FROM users WHERE name = 'it''s'", "users", -1, true, false},
+		{"SELECT * FROM users WHERE name = 'open", "", 0, false, true},
+		{"SELECT * FROM users LIMIT 5 extra", "", 0, false, true},
+		{"SELECT * FROM users WHERE name = bob", "", 0, false, true},
 		{"SELECT * FROM ", "", 0, false, true},
 		{"SELECT a FROM users", "", 0, false, true},
 		{"INSERT INTO users", "", 0, false, true},
@@ -62,6 +67,13 @@ func TestTableKeyRange(t *testing.T) {
 	if s2 != start || e2 != end {
 		t.Errorf("inconsistent range: (%d,%d) vs (%d,%d)", start, end, s2, e2)
 	}
+	// Probed slots are aligned, non-negative and never wrap past MaxInt64.
+	for i := 0; i < 10000; i++ {
+		s := int64(tableSlot(fmt.Sprintf("t%d", i), tableSlots)) * TableSpan
+		if s < TableSpan || s%TableSpan != 0 || s+TableSpan-1 < s {
+			t.Fatalf("table t%d: bad slot at %d", i, s)
+		}
+	}
 }
 
 func TestMatchID(t *testing.T) {
@@ -77,3 +89,107 @@ func TestMatchID(t *testing.T) {
 		t.Fatalf("expected query without WHERE to match any id")
 	}
 }
+
+func TestParseCreateTableAndInsert(t *testing.T) {
+	stmt, err := ParseStatement("CREATE TABLE users (id INT, name TEXT, age INT)")
+	if err != nil {
+		t.Fatalf("parse create: %v", err)
+	}
+	ct, ok := stmt.(*CreateTableStmt)
+	if !ok {
+		t.Fatalf("expected *CreateTableStmt, got %T", stmt)
+	}
+	if ct.Table != "users" || len(ct.Columns) != 3 || ct.Columns[1].Type != TypeText {
+		t.Fatalf("unexpected create stmt: %+v", ct)
+	}
+
+	if _, err := ParseStatement("CREATE TABLE users (name TEXT, id INT)"); err == nil {
+		t.Fatalf("expected error for non-INT primary key")
+	}
+	if _, err := ParseStatement("CREATE TABLE users (id INT, id TEXT)"); err == nil {
+		t.Fatalf("expected error for duplicate column")
+	}
+
+	stmt, err = ParseStatement("INSERT INTO users VALUES (7, 'bob smith', 30)")
+	if err != nil {
+		t.Fatalf("parse insert: %v", err)
+	}
+	ins := stmt.(*InsertStmt)
+	if len(ins.Values) != 3 || ins.Values[0] != int64(7) || ins.Values[1] != "bob smith" || ins.Values[2] != int64(30) {
+		t.Fatalf("unexpected insert values: %#v", ins.Values)
+	}
+	if _, err := ParseStatement("INSERT INTO users VALUES (7, 'bob)"); err == nil {
+		t.Fatalf("expected error for unterminated string")
+	}
+}
+
+func TestParseStringLiterals(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		{"SELECT * FROM users WHERE name = 'bob smith'", "bob smith"},
+		{"SELECT * FROM users WHERE name = 'it''s'", "it's"},
+		{"SELECT * FROM users WHERE name = ''''", "'"},
+		{"SELECT * FROM users WHERE name = 'agent 007'", "agent 007"},
+		{"SELECT * FROM users WHERE name = 'a; DROP TABLE users; --'", "a; DROP TABLE users; --"},
+		{"SELECT * FROM users WHERE name = ''", ""},
+	}
+	for _, tt := range tests {
+		stmt, err := Parse(tt.sql)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.sql, err)
+			continue
+		}
+		if !stmt.Where.IsText || stmt.Where.Text != tt.want {
+			t.Errorf("Parse(%q): literal=%q isText=%v, want %q", tt.sql, stmt.Where.Text, stmt.Where.IsText, tt.want)
+		}
+	}
+
+	stmt, err := ParseStatement("INSERT INTO users VALUES (42, 'O''Brien, Pat', -7)")
+	if err != nil {
+		t.Fatalf("parse insert: %v", err)
+	}
+	ins := stmt.(*InsertStmt)
+	if len(ins.Values) != 3 || ins.Values[0] != int64(42) || ins.Values[1] != "O'Brien, Pat" || ins.Values[2] != int64(-7) {
+		t.Fatalf("unexpected insert values: %#v", ins.Values)
+	}
+
+	// A digit-only string stays a string; a bare number stays an integer.
+	stmt, _ = ParseStatement("SELECT * FROM users WHERE name = '123'")
+	if w := stmt.(*SelectStmt).Where; !w.IsText || w.Text != "123" {
+		t.Fatalf("expected text literal '123', got %+v", w)
+	}
+	stmt, _ = ParseStatement("SELECT * FROM users WHERE id = 123")
+	if w := stmt.(*SelectStmt).Where; w.IsText || w.Value != 123 {
+		t.Fatalf("expected integer literal 123, got %+v", w)
+	}
+}
+
+func TestParseErrorPosition(t *testing.T) {
+	tests := []struct {
+		sql   string
+		pos   int
+		token string
+	}{
+		{"SELECT a FROM users", 7, "a"},
+		{"SELECT * FORM users", 9, "FORM"},
+		{"SELECT * FROM users WHERE id >> 5", 30, ">"},
+		{"SELECT * FROM users WHERE name = 'bob", 33, "'bob"},
+		{"SELECT * FROM users LIMIT x", 26, "x"},
+		{"SELECT * FROM users LIMIT 5 extra", 28, "extra"},
+		{"INSERT INTO users VALUES (1, 'a'", 32, "end of input"},
+		{"CREATE TABLE t (id INT, name BLOB)", 29, "BLOB"},
+	}
+	for _, tt := range tests {
+		_, err := ParseStatement(tt.sql)
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("ParseStatement(%q): expected *ParseError, got %T (%v)", tt.sql, err, err)
+			continue
+		}
+		if perr.Pos != tt.pos || perr.Token != tt.token {
+			t.Errorf("ParseStatement(%q): pos=%d token=%q, want pos=%d token=%q", tt.sql, perr.Pos, perr.Token, tt.pos, tt.token)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package sql
+
+import (
+	"math"
+	"neurodb/pkg/common"
+	"strconv"
+)
+
+// Access paths chosen by the planner.
+const (
+	AccessRangeScan      = "range_scan"
+	AccessSecondaryIndex = "secondary_index"
+	AccessEmpty          = "empty"
+)
+
+// RangePlanner is implemented by stores that can describe how a key range
+// would be served: the lookup method ("learned_index" or "binary_search") and
+// an estimate of the number of live keys in [start, end].
+type RangePlanner interface {
+	PlanRange(start, end common.KeyType) (method string, estimatedRows int)
+}
+
+// Plan describes how a SELECT will be executed.
+type Plan struct {
+	Table          string `json:"table"`
+	Typed          bool   `json:"typed"`
+	Access         string `json:"access"`
+	StartKey       int64  `json:"start_key"`
+	EndKey         int64  `json:"end_key"`
+	FullScan       bool   `json:"full_scan"`
+	SecondaryIndex string `json:"secondary_index,omitempty"`
+	KeyLookup      string `json:"key_lookup"`
+	EstimatedRows  int    `json:"estimated_rows"`
+	Filter         string `json:"filter,omitempty"`
+	Limit          int    `json:"limit"`
+}
+
+// planSelect picks the access path for s over the table range [start, end].
+// A WHERE on the primary key narrows the scanned key range; an equality on an
+// indexed column uses the index; anything else scans the whole table range
+// and filters rows.
+func (e *Executor) planSelect(s *SelectStmt, schema *TableSchema, start, end int64) *Plan {
+	plan := &Plan{
+		Table:     s.Table,
+		Typed:     schema != nil,
+		Access:    AccessRangeScan,
+		StartKey:  start,
+		EndKey:    end,
+		FullScan:  true,
+		KeyLookup: "unknown",
+		Limit:     s.Limit,
+	}
+	if s.Where != nil {
+		plan.Filter = s.Where.Field + " " + s.Where.Op + " " + whereOperand(s.Where)
+	}
+
+	if col := indexedWhereColumn(s, schema); col != "" {
+		plan.Access = AccessSecondaryIndex
+		plan.SecondaryIndex = col
+		plan.FullScan = false
+		plan.EstimatedRows = -1
+		return plan
+	}
+
+	if s.Where != nil && isPrimaryKeyField(s, schema) {
+		offset := int64(0)
+		if schema != nil {
+			offset = start
+		}
+		lo, hi := idBounds(s.Where)
+		if lo != math.MinInt64 {
+			lo += offset
+		}
+		if hi != math.MaxInt64 {
+			hi += offset
+		}
+		if lo > plan.StartKey {
+			plan.StartKey = lo
+		}
+		if hi < plan.EndKey {
+			plan.EndKey = hi
+		}
+		plan.FullScan = plan.StartKey == start && plan.EndKey == end
+	}
+
+	if plan.StartKey > plan.EndKey {
+		plan.Access = AccessEmpty
+		plan.FullScan = false
+		plan.KeyLookup = "none"
+		return plan
+	}
+
+	plan.EstimatedRows = -1
+	if rp, ok := e.store.(RangePlanner); ok {
+		plan.KeyLookup, plan.EstimatedRows = rp.PlanRange(common.KeyType(plan.StartKey), common.KeyType(plan.EndKey))
+	}
+	return plan
+}
+
+func isPrimaryKeyField(s *SelectStmt, schema *TableSchema) bool {
+	if s.Where.Field == "id" {
+		return true
+	}
+	return schema != nil && s.Where.Field == schema.Columns[0].Name
+}
+
+// idBounds converts a primary-key predicate into an inclusive id interval.
+func idBounds(w *WhereClause) (lo, hi int64) {
+	lo, hi = math.MinInt64, math.MaxInt64
+	if w.IsText {
+		return lo, hi
+	}
+	v := w.Value
+	switch w.Op {
+	case "=":
+		return v, v
+	case ">=":
+		return v, hi
+	case ">":
+		if v == math.MaxInt64 {
+			return 1, 0
+		}
+		return v + 1, hi
+	case "<=":
+		return lo, v
+	case "<":
+		if v == math.MinInt64 {
+			return 1, 0
+		}
+		return lo, v - 1
+	}
+	return lo, hi
+}
+
+func whereOperand(w *WhereClause) string {
+	if w.IsText {
+		return "'" + w.Text + "'"
+	}
+	return strconv.FormatInt(w.Value, 10)
+}
@@ -0,0 +1,282 @@
+package sql
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type ColumnType string
+
+const (
+	TypeInt  ColumnType = "INT"
+	TypeText ColumnType = "TEXT"
+)
+
+// TableSpan is the number of keys reserved for each table.
+const TableSpan = 1000000
+
+type Column struct {
+	Name string     `json:"name"`
+	Type ColumnType `json:"type"`
+}
+
+// TableSchema describes a typed table. Columns[0] is the primary key; the
+// remaining columns are stored as a JSON object under key = tableStart + id.
+type TableSchema struct {
+	Name    string   `json:"name"`
+	Columns []Column `json:"columns"`
+	Indexes []string `json:"indexes,omitempty"`
+}
+
+func parseColumnType(s string) (ColumnType, error) {
+	switch strings.ToUpper(s) {
+	case "INT", "INTEGER", "BIGINT":
+		return TypeInt, nil
+	case "TEXT", "VARCHAR", "STRING":
+		return TypeText, nil
+	default:
+		return "", fmt.Errorf("unsupported column type %s", s)
+	}
+}
+
+func (ts *TableSchema) ColumnNames() []string {
+	names := make([]string, len(ts.Columns))
+	for i, c := range ts.Columns {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// Column returns the column with the given name, or nil.
+func (ts *TableSchema) Column(name string) *Column {
+	name = strings.ToLower(name)
+	for i := range ts.Columns {
+		if ts.Columns[i].Name == name {
+			return &ts.Columns[i]
+		}
+	}
+	return nil
+}
+
+// HasIndex reports whether a secondary index exists on the column.
+func (ts *TableSchema) HasIndex(column string) bool {
+	for _, c := range ts.Indexes {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+// EncodeRow validates values against the schema and returns the row id and encoded value.
+func (ts *TableSchema) EncodeRow(values []interface{}) (int64, []byte, error) {
+	if len(values) != len(ts.Columns) {
+		return 0, nil, fmt.Errorf("table %s expects %d values, got %d", ts.Name, len(ts.Columns), len(values))
+	}
+	id, ok := values[0].(int64)
+	if !ok {
+		return 0, nil, fmt.Errorf("primary key %s must be INT", ts.Columns[0].Name)
+	}
+	if id < 0 || id >= TableSpan {
+		return 0, nil, fmt.Errorf("primary key %s out of range [0, %d)", ts.Columns[0].Name, TableSpan)
+	}
+	row := make(map[string]interface{}, len(values)-1)
+	for i, col := range ts.Columns[1:] {
+		v := values[i+1]
+		switch col.Type {
+		case TypeInt:
+			if _, ok := v.(int64); !ok {
+				return 0, nil, fmt.Errorf("column %s expects INT", col.Name)
+			}
+		case TypeText:
+			if _, ok := v.(string); !ok {
+				return 0, nil, fmt.Errorf("column %s expects TEXT", col.Name)
+			}
+		}
+		row[col.Name] = v
+	}
+	data, err := json.Marshal(row)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, data, nil
+}
+
+// DecodeRow decodes a stored value into a typed row including the primary key.
+func (ts *TableSchema) DecodeRow(id int64, raw []byte) (map[string]interface{}, error) {
+	var stored map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&stored); err != nil {
+		return nil, fmt.Errorf("decode row %d: %w", id, err)
+	}
+	row := make(map[string]interface{}, len(ts.Columns))
+	row[ts.Columns[0].Name] = id
+	for _, col := range ts.Columns[1:] {
+		v, ok := stored[col.Name]
+		if !ok {
+			row[col.Name] = nil
+			continue
+		}
+		switch col.Type {
+		case TypeInt:
+			n, ok := v.(json.Number)
+			if !ok {
+				return nil, fmt.Errorf("decode row %d: column %s is not INT", id, col.Name)
+			}
+			i, err := n.Int64()
+			if err != nil {
+				return nil, fmt.Errorf("decode row %d: %w", id, err)
+			}
+			row[col.Name] = i
+		case TypeText:
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("decode row %d: column %s is not TEXT", id, col.Name)
+			}
+			row[col.Name] = s
+		}
+	}
+	return row, nil
+}
+
+// Catalog is the schema registry. Tables without an entry use the schemaless
+// {id, data} representation.
+//
+// Ranges records the key range start of every registered table and
+// secondary index, and of every schemaless table a SELECT has found rows in.
+// Registered ranges never overlap: a new table takes its TableKeyRange when
+// that is free and otherwise the first free aligned range from its hashed
+// slot. Tables and indexes created before ranges were recorded keep their
+// TableKeyRange, where their rows already are.
+type Catalog struct {
+	Tables map[string]*TableSchema `json:"tables"`
+	Ranges map[string]int64        `json:"ranges,omitempty"`
+}
+
+func NewCatalog() *Catalog {
+	return &Catalog{Tables: make(map[string]*TableSchema), Ranges: make(map[string]int64)}
+}
+
+// rangesOverlap reports whether the TableSpan-sized ranges starting at a and
+// b share a key. Distances wrap, as a range near MaxInt64 does.
+func rangesOverlap(a, b int64) bool {
+	d := uint64(a - b)
+	return d < TableSpan || -d < TableSpan
+}
+
+// owner returns the registered name whose range overlaps the one starting at
+// start, or "".
+func (c *Catalog) owner(start int64) string {
+	if home, _ := TableKeyRange(catalogTable); rangesOverlap(start, home) {
+		return catalogTable
+	}
+	for name, s := range c.Ranges {
+		if rangesOverlap(start, s) {
+			return name
+		}
+	}
+	return ""
+}
+
+// Reserve assigns a key range to name if it has none and returns its start.
+// It fails once every aligned range is taken.
+func (c *Catalog) Reserve(name string) (int64, error) {
+	return c.reserve(name, tableSlots)
+}
+
+// reserve is Reserve probing the first slots aligned ranges.
+func (c *Catalog) reserve(name string, slots uint64) (int64, error) {
+	name = strings.ToLower(name)
+	if start, ok := c.Ranges[name]; ok {
+		return start, nil
+	}
+	if home, _ := TableKeyRange(name); c.owner(home) == "" {
+		c.Ranges[name] = home
+		return home, nil
+	}
+	slot := tableSlot(name, slots)
+	for i := uint64(0); i < slots-1; i++ {
+		if start := int64(slot) * TableSpan; c.owner(start) == "" {
+			c.Ranges[name] = start
+			return start, nil
+		}
+		slot++
+		if slot >= slots {
+			slot = 1
+		}
+	}
+	return 0, fmt.Errorf("no free key range left for %s", name)
+}
+
+// Claim registers a schemaless table at its TableKeyRange, so that a name
+// overlapping it is rejected from then on. It reports whether the catalog
+// changed.
+func (c *Catalog) Claim(name string) (bool, error) {
+	name = strings.ToLower(name)
+	if _, ok := c.Ranges[name]; ok {
+		return false, nil
+	}
+	start, _, err := c.KeyRange(name)
+	if err != nil {
+		return false, err
+	}
+	c.Ranges[name] = start
+	return true, nil
+}
+
+// KeyRange returns the key range for name. Registered names use their
+// assigned range; others use TableKeyRange, which is rejected when it
+// overlaps the range of a registered name.
+func (c *Catalog) KeyRange(name string) (start, end int64, err error) {
+	name = strings.ToLower(name)
+	if s, ok := c.Ranges[name]; ok {
+		return s, s + TableSpan - 1, nil
+	}
+	start, end = TableKeyRange(name)
+	if owner := c.owner(start); owner != "" && owner != name {
+		return 0, 0, fmt.Errorf("table %s collides with %s in key range [%d, %d]", name, owner, start, end)
+	}
+	return start, end, nil
+}
+
+func (c *Catalog) Lookup(table string) *TableSchema {
+	return c.Tables[strings.ToLower(table)]
+}
+
+func (c *Catalog) Encode() ([]byte, error) {
+	return json.Marshal(c)
+}
+
+func DecodeCatalog(data []byte) (*Catalog, error) {
+	if len(data) == 0 {
+		return NewCatalog(), nil
+	}
+	c := NewCatalog()
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, errors.New("corrupt catalog: " + err.Error())
+	}
+	if c.Tables == nil {
+		c.Tables = make(map[string]*TableSchema)
+	}
+	if c.Ranges == nil {
+		c.Ranges = make(map[string]int64)
+	}
+	// A catalog written before ranges were recorded: its tables and indexes
+	// stay where their rows were written.
+	for name, ts := range c.Tables {
+		names := []string{name}
+		for _, col := range ts.Indexes {
+			names = append(names, indexTableName(name, col))
+		}
+		for _, n := range names {
+			if _, ok := c.Ranges[n]; !ok {
+				c.Ranges[n], _ = TableKeyRange(n)
+			}
+		}
+	}
+	return c, nil
+}
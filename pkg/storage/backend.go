@@ -2,42 +2,87 @@ package storage
 
 import (
 	"io"
-	"log"
 	"neurodb/pkg/common"
+	"neurodb/pkg/logger"
 )
 
 type Backend interface {
 	Write(key common.KeyType, val common.ValueType) error
 	BatchWrite(records []common.Record) error
+	// BatchWriteEntries is BatchWrite for entries that carry their own op,
+	// such as merges.
+	BatchWriteEntries(entries []WALEntry) error
+	DeleteRange(start, end common.KeyType) error
 	Read(key common.KeyType) (common.ValueType, bool)
-	LoadAll() ([]common.Record, error)
+	// LoadAll replays the log: the latest value of each key, the range
+	// deletes, and the merge operands logged for a key since its latest
+	// value. A key is in records or in merges, not both. Every returned
+	// record and chain was written after the range deletes covering it.
+	LoadAll() ([]common.Record, []common.RangeTombstone, []MergeChain, error)
 	Close()
 	Truncate() error
 	Size() (int64, error)
+	// CurrentOffset is the log offset the next write will get; offsets keep
+	// growing across Truncate.
+	CurrentOffset() int64
+	// IterateFrom reads the log from an offset, for replication.
+	IterateFrom(offset int64) (*WALIterator, error)
+}
+
+// MergeChain is the merge operands logged for a key since its latest value,
+// oldest first. With HasBase set the log holds that value (Value, empty for
+// a delete); otherwise the operands apply to whatever older data holds.
+type MergeChain struct {
+	Key      common.KeyType
+	Value    common.ValueType
+	HasBase  bool
+	Operands [][]byte
 }
 
 type DiskBackend struct {
 	wal *WAL
+	log logger.Logger
 }
 
-func NewDiskBackend(path string) *DiskBackend {
-	walPath := path + ".wal"
-	wal, err := OpenWAL(walPath)
+// WALFile is the file the DiskBackend for path keeps its log in.
+func WALFile(path string) string {
+	return path + ".wal"
+}
+
+// NewDiskBackend opens the WAL at WALFile(path). A nil l logs to the default logger.
+func NewDiskBackend(path string, l logger.Logger) (*DiskBackend, error) {
+	wal, err := OpenWAL(WALFile(path))
 	if err != nil {
-		log.Fatalf("Failed to open WAL: %v", err)
+		return nil, err
+	}
+	if l == nil {
+		l = logger.Default()
 	}
-	return &DiskBackend{wal: wal}
+	return &DiskBackend{wal: wal, log: l}, nil
 }
 
 func (d *DiskBackend) Write(key common.KeyType, val common.ValueType) error {
-	return d.wal.Append(key, val)
+	_, err := d.wal.Append(key, val)
+	return err
 }
 
 func (d *DiskBackend) BatchWrite(records []common.Record) error {
-	for _, r := range records {
-		if err := d.wal.Append(r.Key, r.Value); err != nil {
-			return err
-		}
+	if _, err := d.wal.AppendBatch(records); err != nil {
+		return err
+	}
+	return d.wal.Sync()
+}
+
+func (d *DiskBackend) BatchWriteEntries(entries []WALEntry) error {
+	if _, err := d.wal.AppendEntries(entries); err != nil {
+		return err
+	}
+	return d.wal.Sync()
+}
+
+func (d *DiskBackend) DeleteRange(start, end common.KeyType) error {
+	if _, err := d.wal.AppendRangeDelete(start, end); err != nil {
+		return err
 	}
 	return d.wal.Sync()
 }
@@ -46,14 +91,16 @@ func (d *DiskBackend) Read(key common.KeyType) (common.ValueType, bool) {
 	return nil, false
 }
 
-func (d *DiskBackend) LoadAll() ([]common.Record, error) {
+func (d *DiskBackend) LoadAll() ([]common.Record, []common.RangeTombstone, []MergeChain, error) {
 	it, err := d.wal.NewIterator()
 	if err != nil {
-		return []common.Record{}, nil
+		return []common.Record{}, nil, nil, nil
 	}
 	defer it.Close()
 
 	tempMap := make(map[common.KeyType]common.ValueType)
+	chains := make(map[common.KeyType]*MergeChain)
+	var tombstones []common.RangeTombstone
 	count := 0
 
 	for {
@@ -62,20 +109,55 @@ func (d *DiskBackend) LoadAll() ([]common.Record, error) {
 			break
 		}
 		if err != nil {
-			log.Printf("[WAL] Warning: Log corruption detected (truncating rest): %v", err)
+			d.log.Warn("[WAL] Log corruption detected (truncating rest): %v", err)
 			break
 		}
-		tempMap[rec.Key] = rec.Value
 		count++
+		switch rec.Op {
+		case WALRangeDelete:
+			t := common.RangeTombstone{Start: rec.Key, End: rec.End}
+			for k := range tempMap {
+				if t.Covers(k) {
+					delete(tempMap, k)
+				}
+			}
+			for k := range chains {
+				if t.Covers(k) {
+					delete(chains, k)
+				}
+			}
+			tombstones = append(tombstones, t)
+		case WALMerge:
+			c, ok := chains[rec.Key]
+			if !ok {
+				c = &MergeChain{Key: rec.Key}
+				if v, ok := tempMap[rec.Key]; ok {
+					c.Value, c.HasBase = v, true
+					delete(tempMap, rec.Key)
+				} else if common.Covered(tombstones, rec.Key) {
+					// A logged range delete left the key empty.
+					c.HasBase = true
+				}
+				chains[rec.Key] = c
+			}
+			c.Operands = append(c.Operands, rec.Value)
+		default:
+			delete(chains, rec.Key)
+			tempMap[rec.Key] = rec.Value
+		}
 	}
 
 	records := make([]common.Record, 0, len(tempMap))
 	for k, v := range tempMap {
 		records = append(records, common.Record{Key: k, Value: v})
 	}
+	merges := make([]MergeChain, 0, len(chains))
+	for _, c := range chains {
+		merges = append(merges, *c)
+	}
 
-	log.Printf("[WAL] Replay complete. Processed %d entries, Recovered %d unique records.", count, len(records))
-	return records, nil
+	d.log.Info("[WAL] Replay complete. Processed %d entries, Recovered %d unique records, %d merged keys and %d range deletes.", count, len(records), len(merges), len(tombstones))
+	return records, tombstones, merges, nil
 }
 
 func (d *DiskBackend) Close() {
@@ -89,3 +171,11 @@ func (d *DiskBackend) Truncate() error {
 func (d *DiskBackend) Size() (int64, error) {
 	return d.wal.Size()
 }
+
+func (d *DiskBackend) IterateFrom(offset int64) (*WALIterator, error) {
+	return d.wal.NewIteratorAt(offset)
+}
+
+func (d *DiskBackend) CurrentOffset() int64 {
+	return d.wal.CurrentOffset()
+}
@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// [CRC32 4B] [Len 4B] [VersionEdit JSON]
+
+const ManifestName = "MANIFEST"
+
+// DataFormat is the version of the on-disk layout (manifest, SSTables and
+// WAL) this build reads and writes. It is recorded in the manifest; bump it
+// when a change would make older builds misread the data. Format 2 added
+// merge entries to the WAL.
+const DataFormat = 2
+
+// ErrDataFormat is returned by OpenManifest for data written in a newer
+// format than DataFormat.
+var ErrDataFormat = errors.New("manifest: data written in a newer format")
+
+// ErrManifestCorrupt is returned by OpenManifest for a manifest with a
+// damaged record other than a torn last one; RepairManifest drops it.
+var ErrManifestCorrupt = errors.New("manifest: corrupt record")
+
+// errTorn marks a record cut short by the end of the file: an append the
+// process did not finish.
+var errTorn = errors.New("manifest: torn record")
+
+// FileMeta identifies a live SSTable by its base name in the data directory.
+type FileMeta struct {
+	Name  string `json:"name"`
+	Shard int    `json:"shard"`
+	Level int    `json:"level"`
+}
+
+// VersionEdit is one atomic change to the set of live SSTables. Sharding,
+// when set, records the key-to-shard routing the live files were written with;
+// Format, the DataFormat they were written in; KeyOrder, the order their
+// keys sort in.
+type VersionEdit struct {
+	Add      []FileMeta `json:"add,omitempty"`
+	Remove   []string   `json:"remove,omitempty"`
+	Sharding string     `json:"sharding,omitempty"`
+	Format   int        `json:"format,omitempty"`
+	KeyOrder string     `json:"key_order,omitempty"`
+}
+
+// Manifest is an append-only log of VersionEdits and the source of truth for
+// which SSTables are live. A torn trailing record (crash mid-append) fails its
+// checksum and is dropped on open.
+type Manifest struct {
+	path     string
+	file     *os.File
+	mu       sync.Mutex
+	live     []FileMeta
+	sharding string
+	format   int
+	keyOrder string
+	torn     bool // replay dropped a torn last record
+}
+
+// OpenManifest replays the manifest at path, rewrites it as a single snapshot
+// edit and opens it for appending. existed reports whether a manifest was found.
+// A torn last record is dropped (see Clean). A manifest with any other damaged
+// record is left untouched and fails with ErrManifestCorrupt, as does one of a
+// newer DataFormat with ErrDataFormat; older ones are recorded as DataFormat
+// from then on.
+func OpenManifest(path string) (m *Manifest, existed bool, err error) {
+	m = &Manifest{path: path}
+	f, err := os.Open(path)
+	switch {
+	case err == nil:
+		existed = true
+		err = m.replay(f)
+		f.Close()
+		if errors.Is(err, errTorn) {
+			m.torn = true
+		} else if err != nil {
+			return nil, existed, fmt.Errorf("%w: %s: %v", ErrManifestCorrupt, path, err)
+		}
+	case !os.IsNotExist(err):
+		return nil, false, err
+	}
+	if m.format > DataFormat {
+		return nil, existed, fmt.Errorf("%w: %s has format %d, this build reads up to %d", ErrDataFormat, path, m.format, DataFormat)
+	}
+	m.format = DataFormat
+	if err := m.rewrite(); err != nil {
+		return nil, false, err
+	}
+	return m, existed, nil
+}
+
+// RepairManifest rewrites the manifest at path with the edits before its
+// first damaged record, dropping that record and everything after it. The
+// tables only those edits listed are no longer live.
+func RepairManifest(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	m := &Manifest{path: path}
+	m.replay(f)
+	f.Close()
+	if m.format > DataFormat {
+		return fmt.Errorf("%w: %s has format %d, this build reads up to %d", ErrDataFormat, path, m.format, DataFormat)
+	}
+	m.format = DataFormat
+	if err := m.rewrite(); err != nil {
+		return err
+	}
+	m.Close()
+	return nil
+}
+
+// ReadManifest returns the live files recorded in the manifest at path
+// without changing it. A non-nil error describes the record replay stopped
+// at; the files are those of the edits before it.
+func ReadManifest(path string) ([]FileMeta, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := &Manifest{path: path}
+	err = m.replay(f)
+	return m.live, err
+}
+
+// replay applies every intact edit in r. It returns nil if r ends cleanly
+// after the last one.
+func (m *Manifest) replay(r io.Reader) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, 8)
+	for n := 0; ; n++ {
+		// Only appended edits can be torn: the snapshot record is written to
+		// a temporary file and synced before it replaces the manifest.
+		short := func(what string) error {
+			if n == 0 {
+				return fmt.Errorf("manifest: %s 0 is cut short", what)
+			}
+			return fmt.Errorf("%w: %s %d", errTorn, what, n)
+		}
+		if _, err := io.ReadFull(br, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return short("header of record")
+		}
+		size := binary.LittleEndian.Uint32(header[4:8])
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return short("record")
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[0:4]) {
+			return fmt.Errorf("manifest: checksum mismatch in record %d", n)
+		}
+		var edit VersionEdit
+		if err := json.Unmarshal(payload, &edit); err != nil {
+			return fmt.Errorf("manifest: bad record %d: %w", n, err)
+		}
+		m.applyLocked(edit)
+	}
+}
+
+func (m *Manifest) applyLocked(edit VersionEdit) {
+	if edit.Sharding != "" {
+		m.sharding = edit.Sharding
+	}
+	if edit.Format != 0 {
+		m.format = edit.Format
+	}
+	if edit.KeyOrder != "" {
+		m.keyOrder = edit.KeyOrder
+	}
+	if len(edit.Remove) > 0 {
+		removed := make(map[string]bool, len(edit.Remove))
+		for _, name := range edit.Remove {
+			removed[name] = true
+		}
+		kept := m.live[:0]
+		for _, f := range m.live {
+			if !removed[f.Name] {
+				kept = append(kept, f)
+			}
+		}
+		m.live = kept
+	}
+	m.live = append(m.live, edit.Add...)
+}
+
+func encodeEdit(edit VersionEdit) ([]byte, error) {
+	payload, err := json.Marshal(edit)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 8+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(payload)))
+	copy(buf[8:], payload)
+	return buf, nil
+}
+
+// rewrite replaces the manifest with one edit adding the current live set.
+func (m *Manifest) rewrite() error {
+	rec, err := encodeEdit(VersionEdit{Add: m.live, Sharding: m.sharding, Format: m.format, KeyOrder: m.keyOrder})
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	tf, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := tf.Write(rec); err != nil {
+		tf.Close()
+		return err
+	}
+	if err := tf.Sync(); err != nil {
+		tf.Close()
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	if m.file != nil {
+		m.file.Close()
+		m.file = nil
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(m.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	m.file = f
+	return nil
+}
+
+// Apply durably appends edit and updates the live set.
+func (m *Manifest) Apply(edit VersionEdit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, err := encodeEdit(edit)
+	if err != nil {
+		return err
+	}
+	if _, err := m.file.Write(rec); err != nil {
+		return err
+	}
+	if err := m.file.Sync(); err != nil {
+		return err
+	}
+	m.applyLocked(edit)
+	return nil
+}
+
+// Clean reports whether the manifest was opened without dropping a torn
+// record. When one was dropped, an edit was being appended when the process
+// stopped, and files it named may be on disk without being listed.
+func (m *Manifest) Clean() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return !m.torn
+}
+
+// Live returns the live files in the order they were added.
+func (m *Manifest) Live() []FileMeta {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]FileMeta, len(m.live))
+	copy(out, m.live)
+	return out
+}
+
+// Sharding returns the routing recorded by the latest edit that set one, or
+// "" if none did (stores from before it was recorded).
+func (m *Manifest) Sharding() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sharding
+}
+
+// KeyOrder returns the key order recorded by the latest edit that set one,
+// or "" if none did.
+func (m *Manifest) KeyOrder() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.keyOrder
+}
+
+// Reset empties the live set.
+func (m *Manifest) Reset() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.live = nil
+	return m.rewrite()
+}
+
+func (m *Manifest) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.file != nil {
+		m.file.Close()
+		m.file = nil
+	}
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifestReplayAndTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ManifestName)
+	m, existed, err := OpenManifest(path)
+	if err != nil {
+		t.Fatalf("open manifest: %v", err)
+	}
+	if existed {
+		t.Fatalf("expected fresh manifest")
+	}
+	edits := []VersionEdit{
+		{Add: []FileMeta{{Name: "a.sst", Level: 0}, {Name: "b.sst", Level: 0}}},
+		{Add: []FileMeta{{Name: "c.sst", Level: 1}}, Remove: []string{"a.sst", "b.sst"}},
+		{Add: []FileMeta{{Name: "d.sst", Level: 0}}},
+	}
+	for _, e := range edits {
+		if err := m.Apply(e); err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+	}
+	m.Close()
+
+	// Simulate a crash mid-append: a partial record after the last good one.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("open for torn write: %v", err)
+	}
+	f.Write([]byte{0xde, 0xad, 0xbe, 0xef, 0x40, 0, 0, 0, '{'})
+	f.Close()
+
+	m2, existed, err := OpenManifest(path)
+	if err != nil {
+		t.Fatalf("reopen manifest: %v", err)
+	}
+	defer m2.Close()
+	if !existed {
+		t.Fatalf("expected existing manifest")
+	}
+	live := m2.Live()
+	if len(live) != 2 || live[0].Name != "c.sst" || live[0].Level != 1 || live[1].Name != "d.sst" {
+		t.Fatalf("unexpected live set after replay: %+v", live)
+	}
+	if m2.Clean() {
+		t.Fatalf("expected the dropped torn record to be reported")
+	}
+	// The torn tail is dropped, so later appends are readable again.
+	if err := m2.Apply(VersionEdit{Remove: []string{"d.sst"}}); err != nil {
+		t.Fatalf("apply after reopen: %v", err)
+	}
+	m2.Close()
+	m3, _, err := OpenManifest(path)
+	if err != nil {
+		t.Fatalf("reopen manifest: %v", err)
+	}
+	defer m3.Close()
+	if live := m3.Live(); len(live) != 1 || live[0].Name != "c.sst" {
+		t.Fatalf("unexpected live set: %+v", live)
+	}
+}
+
+func TestManifestRejectsNewerFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ManifestName)
+	m, _, err := OpenManifest(path)
+	if err != nil {
+		t.Fatalf("open manifest: %v", err)
+	}
+	if err := m.Apply(VersionEdit{Add: []FileMeta{{Name: "a.sst"}}, Format: DataFormat + 1}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	m.Close()
+	before, _ := os.ReadFile(path)
+
+	if _, _, err := OpenManifest(path); !errors.Is(err, ErrDataFormat) {
+		t.Fatalf("expected ErrDataFormat, got %v", err)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Fatalf("refused manifest was rewritten")
+	}
+}
+
+func TestManifestCorruptRecordFailsOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ManifestName)
+	m, _, err := OpenManifest(path)
+	if err != nil {
+		t.Fatalf("open manifest: %v", err)
+	}
+	if err := m.Apply(VersionEdit{Add: []FileMeta{{Name: "a.sst"}}}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	m.Close()
+	// Reopening makes the live set the snapshot record, then damage it.
+	m, _, err = OpenManifest(path)
+	if err != nil {
+		t.Fatalf("reopen manifest: %v", err)
+	}
+	if err := m.Apply(VersionEdit{Add: []FileMeta{{Name: "b.sst"}}}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	m.Close()
+	data, _ := os.ReadFile(path)
+	data[10] ^= 0xff
+	os.WriteFile(path, data, 0644)
+
+	if _, _, err := OpenManifest(path); !errors.Is(err, ErrManifestCorrupt) {
+		t.Fatalf("expected ErrManifestCorrupt, got %v", err)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(data, after) {
+		t.Fatalf("corrupt manifest was rewritten")
+	}
+	if _, err := ReadManifest(path); err == nil {
+		t.Fatalf("ReadManifest reported no error")
+	}
+
+	// A snapshot record cut short is damage too, not a torn append.
+	short := filepath.Join(t.TempDir(), ManifestName)
+	os.WriteFile(short, data[:12], 0644)
+	if _, _, err := OpenManifest(short); !errors.Is(err, ErrManifestCorrupt) {
+		t.Fatalf("expected ErrManifestCorrupt for a short snapshot, got %v", err)
+	}
+
+	if err := RepairManifest(path); err != nil {
+		t.Fatalf("repair: %v", err)
+	}
+	m, _, err = OpenManifest(path)
+	if err != nil {
+		t.Fatalf("open repaired manifest: %v", err)
+	}
+	defer m.Close()
+	if live := m.Live(); len(live) != 0 || !m.Clean() {
+		t.Fatalf("repaired manifest: live %+v, clean %v", live, m.Clean())
+	}
+}
@@ -3,30 +3,46 @@ package sstable
 import (
 	"bufio"
 	"encoding/binary"
+	"fmt"
 	"neurodb/pkg/common"
 	"os"
 )
 
 const (
 	MagicNumber = 0x4E4555524F444201
-	IndexRate   = 100
+	// MagicNumberV2 marks a table with a range tombstone block. Its footer is
+	// [indexStart][tombstoneStart][magic]; tables without range tombstones
+	// keep the original [indexStart][magic] footer.
+	MagicNumberV2 = 0x4E4555524F444202
+	IndexRate     = 100
+	// TempSuffix marks a table still being built. Such files are never
+	// opened on recovery; they only become visible through the rename in Close.
+	TempSuffix = ".tmp"
+	// MaxValueSize is the longest value a record may hold. Readers take a
+	// longer length field for corruption.
+	MaxValueSize = 64 << 20
 )
 
 type Builder struct {
+	path         string
 	file         *os.File
 	writer       *bufio.Writer
 	offset       int64
 	count        int
 	indexKeys    []common.KeyType
 	indexOffsets []int64
+	tombstones   []common.RangeTombstone
 }
 
+// NewBuilder starts a table that will be published at filename. Records are
+// written to filename+TempSuffix until Close succeeds.
 func NewBuilder(filename string) (*Builder, error) {
-	f, err := os.Create(filename)
+	f, err := os.Create(filename + TempSuffix)
 	if err != nil {
 		return nil, err
 	}
 	return &Builder{
+		path:   filename,
 		file:   f,
 		writer: bufio.NewWriter(f),
 		offset: 0,
@@ -34,6 +50,9 @@ func NewBuilder(filename string) (*Builder, error) {
 }
 
 func (b *Builder) Add(key common.KeyType, val common.ValueType) error {
+	if len(val) > MaxValueSize {
+		return fmt.Errorf("sstable: value of key %d is %d bytes, over the %d byte limit", key, len(val), MaxValueSize)
+	}
 	if b.count%IndexRate == 0 {
 		b.indexKeys = append(b.indexKeys, key)
 		b.indexOffsets = append(b.indexOffsets, b.offset)
@@ -55,7 +74,27 @@ func (b *Builder) Add(key common.KeyType, val common.ValueType) error {
 	return nil
 }
 
+// AddRangeTombstone records that [start, end) is deleted in every older
+// table. Points added to the same table are newer than its tombstones.
+func (b *Builder) AddRangeTombstone(start, end common.KeyType) {
+	b.tombstones = append(b.tombstones, common.RangeTombstone{Start: start, End: end})
+}
+
+// Close writes the index and footer, syncs the file and atomically renames it
+// into place. On failure the temporary file is removed.
 func (b *Builder) Close() error {
+	if err := b.finish(); err != nil {
+		b.Abort()
+		return err
+	}
+	if err := b.file.Close(); err != nil {
+		os.Remove(b.path + TempSuffix)
+		return err
+	}
+	return os.Rename(b.path+TempSuffix, b.path)
+}
+
+func (b *Builder) finish() error {
 	indexStart := b.offset
 
 	idxCount := int32(len(b.indexKeys))
@@ -72,16 +111,40 @@ func (b *Builder) Close() error {
 		}
 	}
 
-	if err := binary.Write(b.writer, binary.LittleEndian, indexStart); err != nil {
-		return err
+	footer := []int64{indexStart, MagicNumber}
+	if len(b.tombstones) > 0 {
+		tombStart := indexStart + 4 + int64(len(b.indexKeys))*16
+		if err := b.writeTombstones(); err != nil {
+			return err
+		}
+		footer = []int64{indexStart, tombStart, MagicNumberV2}
 	}
-	magic := int64(MagicNumber)
-	if err := binary.Write(b.writer, binary.LittleEndian, magic); err != nil {
+	if err := binary.Write(b.writer, binary.LittleEndian, footer); err != nil {
 		return err
 	}
 
 	if err := b.writer.Flush(); err != nil {
 		return err
 	}
-	return b.file.Close()
+	return b.file.Sync()
+}
+
+// writeTombstones appends the tombstone block: a count, then a start and end
+// per tombstone.
+func (b *Builder) writeTombstones() error {
+	if err := binary.Write(b.writer, binary.LittleEndian, int32(len(b.tombstones))); err != nil {
+		return err
+	}
+	for _, t := range b.tombstones {
+		if err := binary.Write(b.writer, binary.LittleEndian, [2]int64{int64(t.Start), int64(t.End)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Abort discards a table that will not be published.
+func (b *Builder) Abort() {
+	b.file.Close()
+	os.Remove(b.path + TempSuffix)
 }
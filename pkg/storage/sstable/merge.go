@@ -0,0 +1,167 @@
+package sstable
+
+import (
+	"container/heap"
+	"neurodb/pkg/common"
+)
+
+// KVIterator is a key-ordered record stream. Next advances and reports whether
+// a record is available through Key and Value.
+type KVIterator interface {
+	Next() bool
+	Key() common.KeyType
+	Value() common.ValueType
+	Close()
+}
+
+// SliceIterator adapts sorted in-memory records (memtable, learned index) to KVIterator.
+type SliceIterator struct {
+	records []common.Record
+	pos     int
+}
+
+func NewSliceIterator(records []common.Record) *SliceIterator {
+	return &SliceIterator{records: records, pos: -1}
+}
+
+func (it *SliceIterator) Next() bool {
+	if it.pos < len(it.records) {
+		it.pos++
+	}
+	return it.pos < len(it.records)
+}
+
+func (it *SliceIterator) Key() common.KeyType     { return it.records[it.pos].Key }
+func (it *SliceIterator) Value() common.ValueType { return it.records[it.pos].Value }
+func (it *SliceIterator) Close()                  {}
+
+// KeySizeIterator adapts sorted keys with value lengths to KVIterator for
+// key-only merges. Value is always nil; ValueLen is the length.
+type KeySizeIterator struct {
+	keys []common.KeySize
+	pos  int
+}
+
+func NewKeySizeIterator(keys []common.KeySize) *KeySizeIterator {
+	return &KeySizeIterator{keys: keys, pos: -1}
+}
+
+func (it *KeySizeIterator) Next() bool {
+	if it.pos < len(it.keys) {
+		it.pos++
+	}
+	return it.pos < len(it.keys)
+}
+
+func (it *KeySizeIterator) Key() common.KeyType     { return it.keys[it.pos].Key }
+func (it *KeySizeIterator) Value() common.ValueType { return nil }
+func (it *KeySizeIterator) ValueLen() int           { return it.keys[it.pos].Size }
+func (it *KeySizeIterator) Close()                  {}
+
+// valueLen is the current value's length, which key-only iterators report
+// without a value.
+func valueLen(it KVIterator) int {
+	if l, ok := it.(interface{ ValueLen() int }); ok {
+		return l.ValueLen()
+	}
+	return len(it.Value())
+}
+
+// NewerFirst is the usual recency rule: inputs later in the slice are newer.
+func NewerFirst(a, b int) bool { return a > b }
+
+type mergeItem struct {
+	it  KVIterator
+	src int
+}
+
+type mergeHeap struct {
+	items []*mergeItem
+	newer func(a, b int) bool
+}
+
+func (h *mergeHeap) Len() int { return len(h.items) }
+func (h *mergeHeap) Less(i, j int) bool {
+	ki, kj := h.items[i].it.Key(), h.items[j].it.Key()
+	if ki != kj {
+		return ki < kj
+	}
+	return h.newer(h.items[i].src, h.items[j].src)
+}
+func (h *mergeHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *mergeHeap) Push(x interface{}) { h.items = append(h.items, x.(*mergeItem)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := h.items
+	n := len(old)
+	item := old[n-1]
+	h.items = old[:n-1]
+	return item
+}
+
+// MergingIterator merges sorted inputs into one sorted stream with each key
+// yielded once. When several inputs hold the same key, the value comes from
+// the input that newer ranks most recent; the others are skipped. Tombstones
+// (empty values) are passed through for the caller to interpret.
+type MergingIterator struct {
+	inputs  []KVIterator
+	h       *mergeHeap
+	started bool
+	key     common.KeyType
+	val     common.ValueType
+	valLen  int
+	src     int
+}
+
+// NewMergingIterator merges inputs. newer(a, b) reports whether inputs[a] is
+// more recent than inputs[b]. Inputs are advanced lazily on the first Next, so
+// callers may Seek them beforehand.
+func NewMergingIterator(inputs []KVIterator, newer func(a, b int) bool) *MergingIterator {
+	return &MergingIterator{
+		inputs: inputs,
+		h:      &mergeHeap{newer: newer},
+	}
+}
+
+func (m *MergingIterator) Next() bool {
+	if !m.started {
+		m.started = true
+		for i, it := range m.inputs {
+			if it.Next() {
+				m.h.items = append(m.h.items, &mergeItem{it: it, src: i})
+			}
+		}
+		heap.Init(m.h)
+	}
+	if m.h.Len() == 0 {
+		return false
+	}
+	top := m.h.items[0]
+	m.key, m.val, m.src = top.it.Key(), top.it.Value(), top.src
+	m.valLen = valueLen(top.it)
+	for m.h.Len() > 0 && m.h.items[0].it.Key() == m.key {
+		item := m.h.items[0]
+		if item.it.Next() {
+			heap.Fix(m.h, 0)
+		} else {
+			heap.Pop(m.h)
+		}
+	}
+	return true
+}
+
+func (m *MergingIterator) Key() common.KeyType     { return m.key }
+func (m *MergingIterator) Value() common.ValueType { return m.val }
+
+// ValueLen is the current value's length, also for key-only inputs; 0 is a
+// tombstone.
+func (m *MergingIterator) ValueLen() int { return m.valLen }
+
+// Source is the index of the input the current record was taken from, so
+// callers can tell whether a range tombstone in another input is newer.
+func (m *MergingIterator) Source() int { return m.src }
+
+func (m *MergingIterator) Close() {
+	for _, it := range m.inputs {
+		it.Close()
+	}
+}
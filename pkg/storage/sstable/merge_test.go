@@ -0,0 +1,148 @@
+package sstable
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"neurodb/pkg/common"
+)
+
+func buildTable(t *testing.T, name string, keys []int64, tag string) *SSTable {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	b, err := NewBuilder(path)
+	if err != nil {
+		t.Fatalf("new builder: %v", err)
+	}
+	for _, k := range keys {
+		if err := b.Add(common.KeyType(k), []byte(fmt.Sprintf("%s-%d", tag, k))); err != nil {
+			t.Fatalf("add %d: %v", k, err)
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("close builder: %v", err)
+	}
+	sst, err := Open(path)
+	if err != nil {
+		t.Fatalf("open %s: %v", name, err)
+	}
+	t.Cleanup(sst.Close)
+	return sst
+}
+
+func drain(it KVIterator) []common.Record {
+	var out []common.Record
+	for it.Next() {
+		out = append(out, common.Record{Key: it.Key(), Value: it.Value()})
+	}
+	it.Close()
+	return out
+}
+
+func TestIteratorStopsAtIndexAndSeeks(t *testing.T) {
+	keys := make([]int64, 0, 250)
+	for i := int64(0); i < 250; i++ {
+		keys = append(keys, i*2)
+	}
+	sst := buildTable(t, "a.sst", keys, "v")
+
+	if got := drain(sst.NewIterator()); len(got) != len(keys) {
+		t.Fatalf("expected %d records, got %d (index read as data?)", len(keys), len(got))
+	}
+
+	it := sst.NewIterator()
+	defer it.Close()
+	// 301 is odd and falls in the middle of the fourth index block.
+	if !it.Seek(301) || !it.Next() || it.Key() != 302 {
+		t.Fatalf("seek(301): expected 302, got %d", it.Key())
+	}
+	if !it.Next() || it.Key() != 304 {
+		t.Fatalf("after seek: expected 304, got %d", it.Key())
+	}
+	if !it.Seek(-5) || !it.Next() || it.Key() != 0 {
+		t.Fatalf("seek before first key: got %d", it.Key())
+	}
+	if it.Seek(10000) || it.Next() {
+		t.Fatalf("seek past last key should be exhausted")
+	}
+}
+
+func TestIteratorsShareTheTableFile(t *testing.T) {
+	keys := make([]int64, 0, 500)
+	for i := int64(0); i < 500; i++ {
+		keys = append(keys, i)
+	}
+	sst := buildTable(t, "a.sst", keys, "v")
+
+	// Interleaved iterators and point reads on one table must not disturb
+	// each other's position.
+	a, b := sst.NewIterator(), sst.NewKeyIterator()
+	b.Seek(250)
+	for i := int64(0); i < 250; i++ {
+		if !a.Next() || a.Key() != common.KeyType(i) || string(a.Value()) != fmt.Sprintf("v-%d", i) {
+			t.Fatalf("iterator a at %d: got %d=%q", i, a.Key(), a.Value())
+		}
+		if !b.Next() || b.Key() != common.KeyType(250+i) || b.Value() != nil || b.ValueLen() != len(fmt.Sprintf("v-%d", 250+i)) {
+			t.Fatalf("key iterator b at %d: got %d, %d bytes", 250+i, b.Key(), b.ValueLen())
+		}
+		if v, ok := sst.Get(common.KeyType(499 - i)); !ok || string(v) != fmt.Sprintf("v-%d", 499-i) {
+			t.Fatalf("Get(%d) = %q, %v", 499-i, v, ok)
+		}
+	}
+	a.Close()
+	b.Close()
+	if a.Next() || a.Seek(0) {
+		t.Fatalf("closed iterator still yields records")
+	}
+}
+
+func TestMergingIteratorNewestWins(t *testing.T) {
+	old := buildTable(t, "old.sst", []int64{1, 2, 3, 5}, "old")
+	mid := buildTable(t, "mid.sst", []int64{2, 4}, "mid")
+	mem := NewSliceIterator([]common.Record{
+		{Key: 3, Value: []byte{}}, // tombstone
+		{Key: 4, Value: []byte("mem-4")},
+		{Key: 6, Value: []byte("mem-6")},
+	})
+
+	got := drain(NewMergingIterator([]KVIterator{old.NewIterator(), mid.NewIterator(), mem}, NewerFirst))
+	want := []struct {
+		key int64
+		val string
+	}{
+		{1, "old-1"}, {2, "mid-2"}, {3, ""}, {4, "mem-4"}, {5, "old-5"}, {6, "mem-6"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d merged records, got %+v", len(want), got)
+	}
+	for i, w := range want {
+		if int64(got[i].Key) != w.key || string(got[i].Value) != w.val {
+			t.Fatalf("record %d: expected %d=%q, got %d=%q", i, w.key, w.val, got[i].Key, got[i].Value)
+		}
+	}
+
+	// The recency rule is the caller's: oldest-first flips every tie.
+	oldest := func(a, b int) bool { return a < b }
+	got = drain(NewMergingIterator([]KVIterator{old.NewIterator(), mid.NewIterator()}, oldest))
+	if len(got) != 5 || string(got[1].Value) != "old-2" {
+		t.Fatalf("expected old-2 with oldest-first rule, got %+v", got)
+	}
+}
+
+func TestMergingIteratorSeekedInputs(t *testing.T) {
+	a := buildTable(t, "a.sst", []int64{10, 20, 30, 40}, "a")
+	b := buildTable(t, "b.sst", []int64{15, 25, 35}, "b")
+
+	ia, ib := a.NewIterator(), b.NewIterator()
+	ia.Seek(22)
+	ib.Seek(22)
+	got := drain(NewMergingIterator([]KVIterator{ia, ib}, NewerFirst))
+	keys := make([]common.KeyType, len(got))
+	for i, r := range got {
+		keys[i] = r.Key
+	}
+	if fmt.Sprint(keys) != "[25 30 35 40]" {
+		t.Fatalf("expected [25 30 35 40], got %v", keys)
+	}
+}
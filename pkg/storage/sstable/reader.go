@@ -1,47 +1,92 @@
 package sstable
 
 import (
+	"bufio"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"neurodb/pkg/common"
 	"os"
 	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 type SSTable struct {
 	file         *os.File
 	fileSize     int64
+	dataEnd      int64
 	indexKeys    []common.KeyType
 	indexOffsets []int64
+	maxKey       common.KeyType
+	tombstones   []common.RangeTombstone
 	Filename     string
+	refs         atomic.Int32 // Open's reference plus one per Ref; the file closes at 0
+	remove       atomic.Bool  // delete the file with the last reference (see Remove)
 }
 
-func Open(filename string) (*SSTable, error) {
+var (
+	// ErrFileTooSmall is returned by Open for a file shorter than the
+	// smallest footer.
+	ErrFileTooSmall = errors.New("sstable: file too small")
+	// ErrBadFooter is returned by Open when the file does not end in a
+	// footer it can use: the magic number is missing or the footer's
+	// offsets point outside the file. A table whose write stopped partway
+	// looks like this.
+	ErrBadFooter = errors.New("sstable: footer incomplete or invalid")
+)
+
+func Open(filename string) (t *SSTable, err error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
 
-	stat, _ := f.Stat()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
 	size := stat.Size()
 
 	if size < 16 {
-		return nil, errors.New("sstable: file too small")
+		return nil, fmt.Errorf("%w: %d bytes", ErrFileTooSmall, size)
 	}
 
-	footer := make([]byte, 16)
-	if _, err := f.ReadAt(footer, size-16); err != nil {
+	footer := make([]byte, 24)
+	if size < int64(len(footer)) {
+		footer = footer[8:]
+	}
+	if _, err := f.ReadAt(footer, size-int64(len(footer))); err != nil {
 		return nil, err
 	}
 
-	indexOffset := int64(binary.LittleEndian.Uint64(footer[0:8]))
-	magic := int64(binary.LittleEndian.Uint64(footer[8:16]))
-
-	if magic != MagicNumber {
-		return nil, errors.New("sstable: invalid magic number")
+	n := len(footer)
+	magic := int64(binary.LittleEndian.Uint64(footer[n-8:]))
+	indexOffset := int64(binary.LittleEndian.Uint64(footer[n-16 : n-8]))
+	var tombstones []common.RangeTombstone
+	switch {
+	case magic == MagicNumberV2 && n == 24:
+		tombOffset := indexOffset
+		indexOffset = int64(binary.LittleEndian.Uint64(footer[0:8]))
+		if tombOffset < 0 || tombOffset > size-24 {
+			return nil, fmt.Errorf("%w: tombstone offset %d in a %d-byte file", ErrBadFooter, tombOffset, size)
+		}
+		if tombstones, err = readTombstones(f, tombOffset, size-24); err != nil {
+			return nil, err
+		}
+	case magic != MagicNumber:
+		return nil, fmt.Errorf("%w: no magic number", ErrBadFooter)
 	}
 
+	if indexOffset < 0 || indexOffset > size {
+		return nil, fmt.Errorf("%w: index offset %d in a %d-byte file", ErrBadFooter, indexOffset, size)
+	}
 	if _, err := f.Seek(indexOffset, 0); err != nil {
 		return nil, err
 	}
@@ -50,6 +95,10 @@ func Open(filename string) (*SSTable, error) {
 	if err := binary.Read(f, binary.LittleEndian, &count); err != nil {
 		return nil, err
 	}
+	// Bound the allocation below by what the file can hold.
+	if count < 0 || indexOffset+4+int64(count)*16 > size {
+		return nil, errors.New("sstable: corrupt index block")
+	}
 
 	keys := make([]common.KeyType, count)
 	offsets := make([]int64, count)
@@ -67,13 +116,68 @@ func Open(filename string) (*SSTable, error) {
 		offsets[i] = off
 	}
 
-	return &SSTable{
+	t = &SSTable{
 		file:         f,
 		fileSize:     size,
+		dataEnd:      indexOffset,
 		indexKeys:    keys,
 		indexOffsets: offsets,
+		tombstones:   tombstones,
 		Filename:     filename,
-	}, nil
+	}
+	t.refs.Store(1)
+	if count > 0 {
+		if t.maxKey, err = t.lastKey(); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// readTombstones reads the tombstone block occupying [offset, end).
+func readTombstones(f *os.File, offset, end int64) ([]common.RangeTombstone, error) {
+	if offset < 0 || offset > end {
+		return nil, errors.New("sstable: corrupt tombstone offset")
+	}
+	r := io.NewSectionReader(f, offset, end-offset)
+	var count int32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	if count < 0 || 4+int64(count)*16 != end-offset {
+		return nil, errors.New("sstable: corrupt tombstone block")
+	}
+	raw := make([]int64, 2*int(count))
+	if err := binary.Read(r, binary.LittleEndian, raw); err != nil {
+		return nil, err
+	}
+	out := make([]common.RangeTombstone, count)
+	for i := range out {
+		out[i] = common.RangeTombstone{Start: common.KeyType(raw[2*i]), End: common.KeyType(raw[2*i+1])}
+	}
+	return out, nil
+}
+
+// lastKey walks the final index block (at most IndexRate records) to find
+// the largest key; the sparse index only records each block's first key.
+func (t *SSTable) lastKey() (common.KeyType, error) {
+	off := t.indexOffsets[len(t.indexOffsets)-1]
+	r := io.NewSectionReader(t.file, off, t.dataEnd-off)
+	var hdr [12]byte
+	var last common.KeyType
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return last, nil
+			}
+			return 0, err
+		}
+		last = common.KeyType(binary.LittleEndian.Uint64(hdr[0:8]))
+		valLen := int64(binary.LittleEndian.Uint32(hdr[8:12]))
+		if _, err := r.Seek(valLen, io.SeekCurrent); err != nil {
+			return 0, err
+		}
+	}
 }
 
 func (t *SSTable) Get(key common.KeyType) (common.ValueType, bool) {
@@ -86,25 +190,28 @@ func (t *SSTable) Get(key common.KeyType) (common.ValueType, bool) {
 		startIdx = 0
 	}
 
+	// Reads go through ReadAt: concurrent Gets share t.file, so seeking it
+	// would let one Get read from where another left the offset.
 	offset := t.indexOffsets[startIdx]
-	if _, err := t.file.Seek(offset, 0); err != nil {
-		return nil, false
-	}
+	r := io.NewSectionReader(t.file, offset, t.dataEnd-offset)
 
 	for {
 
 		var k int64
-		if err := binary.Read(t.file, binary.LittleEndian, &k); err != nil {
+		if err := binary.Read(r, binary.LittleEndian, &k); err != nil {
 			break
 		}
 
 		var valLen int32
-		if err := binary.Read(t.file, binary.LittleEndian, &valLen); err != nil {
+		if err := binary.Read(r, binary.LittleEndian, &valLen); err != nil {
+			break
+		}
+		if valLen < 0 || valLen > MaxValueSize {
 			break
 		}
 
 		val := make([]byte, valLen)
-		if _, err := io.ReadFull(t.file, val); err != nil {
+		if _, err := io.ReadFull(r, val); err != nil {
 			break
 		}
 
@@ -119,74 +226,312 @@ func (t *SSTable) Get(key common.KeyType) (common.ValueType, bool) {
 	return nil, false
 }
 
+// ValueAt reads the value of the record starting at offset. It uses ReadAt,
+// so it is safe for concurrent use.
+func (t *SSTable) ValueAt(offset int64) (common.ValueType, error) {
+	if offset < 0 || offset+12 > t.dataEnd {
+		return nil, errors.New("sstable: record offset out of range")
+	}
+	var header [12]byte
+	if _, err := t.file.ReadAt(header[:], offset); err != nil {
+		return nil, err
+	}
+	valLen := int64(int32(binary.LittleEndian.Uint32(header[8:12])))
+	if valLen < 0 || offset+12+valLen > t.dataEnd {
+		return nil, errors.New("sstable: corrupt record length")
+	}
+	val := make([]byte, valLen)
+	if _, err := t.file.ReadAt(val, offset+12); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// ValueLenAt is the length of the value of the record starting at offset,
+// read from the record header alone.
+func (t *SSTable) ValueLenAt(offset int64) (int, error) {
+	if offset < 0 || offset+12 > t.dataEnd {
+		return 0, errors.New("sstable: record offset out of range")
+	}
+	var lenBuf [4]byte
+	if _, err := t.file.ReadAt(lenBuf[:], offset+8); err != nil {
+		return 0, err
+	}
+	valLen := int64(int32(binary.LittleEndian.Uint32(lenBuf[:])))
+	if valLen < 0 || offset+12+valLen > t.dataEnd {
+		return 0, errors.New("sstable: corrupt record length")
+	}
+	return int(valLen), nil
+}
+
+// Verify reads the whole data section and checks that its records are well
+// formed and in strictly ascending key order, fill it exactly, and that every
+// sparse index entry points at a record with the indexed key.
+func (t *SSTable) Verify() error {
+	r := bufio.NewReader(io.NewSectionReader(t.file, 0, t.dataEnd))
+	var hdr [12]byte
+	var off int64
+	var prev common.KeyType
+	next := 0 // next sparse index entry to match
+	for n := 0; off < t.dataEnd; n++ {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return fmt.Errorf("sstable: truncated record at offset %d", off)
+		}
+		key := common.KeyType(binary.LittleEndian.Uint64(hdr[0:8]))
+		valLen := int64(int32(binary.LittleEndian.Uint32(hdr[8:12])))
+		if valLen < 0 || off+12+valLen > t.dataEnd {
+			return fmt.Errorf("sstable: corrupt value length %d at offset %d", valLen, off)
+		}
+		if n > 0 && key <= prev {
+			return fmt.Errorf("sstable: key %d after %d at offset %d", key, prev, off)
+		}
+		if next < len(t.indexOffsets) && t.indexOffsets[next] == off {
+			if t.indexKeys[next] != key {
+				return fmt.Errorf("sstable: index entry %d has key %d, record has %d", next, t.indexKeys[next], key)
+			}
+			next++
+		}
+		if _, err := r.Discard(int(valLen)); err != nil {
+			return fmt.Errorf("sstable: truncated value at offset %d", off)
+		}
+		prev = key
+		off += 12 + valLen
+	}
+	if next != len(t.indexOffsets) {
+		return fmt.Errorf("sstable: index entry %d (offset %d) is not at a record boundary", next, t.indexOffsets[next])
+	}
+	return nil
+}
+
+// Size is the file size captured at Open.
+func (t *SSTable) Size() int64 { return t.fileSize }
+
+// DataSize is the size of the data section: the records, without the index,
+// tombstone block and footer.
+func (t *SSTable) DataSize() int64 { return t.dataEnd }
+
+// IndexEntries is the number of sparse index entries (one per IndexRate records).
+func (t *SSTable) IndexEntries() int { return len(t.indexKeys) }
+
+// SampleKeys returns the first key of every index block: one key per
+// IndexRate records, spread evenly over the table.
+func (t *SSTable) SampleKeys() []common.KeyType {
+	return append([]common.KeyType(nil), t.indexKeys...)
+}
+
+// Overlaps reports whether the table's key span intersects [start, end].
+// An empty table overlaps nothing.
+func (t *SSTable) Overlaps(start, end common.KeyType) bool {
+	if len(t.indexKeys) == 0 {
+		return false
+	}
+	return start <= t.maxKey && end >= t.indexKeys[0]
+}
+
+// KeyRange returns the table's smallest and largest key, both known since
+// Open, so no records are read; ok is false for an empty table.
+func (t *SSTable) KeyRange() (lo, hi common.KeyType, ok bool) {
+	if len(t.indexKeys) == 0 {
+		return 0, 0, false
+	}
+	return t.indexKeys[0], t.maxKey, true
+}
+
+// RangeTombstones returns the range deletes stored in the table. They hide
+// keys in older tables only; the slice must not be modified.
+func (t *SSTable) RangeTombstones() []common.RangeTombstone { return t.tombstones }
+
+// EstimateRange returns an upper-bound estimate of the records in [start, end]
+// using only the sparse index: each overlapping index block counts as IndexRate.
+func (t *SSTable) EstimateRange(start, end common.KeyType) int {
+	if end < start || !t.Overlaps(start, end) {
+		return 0
+	}
+	lo := sort.Search(len(t.indexKeys), func(i int) bool {
+		return t.indexKeys[i] > start
+	}) - 1
+	if lo < 0 {
+		lo = 0
+	}
+	hi := sort.Search(len(t.indexKeys), func(i int) bool {
+		return t.indexKeys[i] > end
+	})
+	if hi <= lo {
+		return 0
+	}
+	return (hi - lo) * IndexRate
+}
+
+// Ref takes a reference that keeps the file open until a matching Close, so
+// a reader can go on using the table after a compaction drops it. It fails
+// once the last reference is gone.
+func (t *SSTable) Ref() bool {
+	for {
+		n := t.refs.Load()
+		if n <= 0 {
+			return false
+		}
+		if t.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// Close releases a reference, Open's or one taken by Ref. The file is
+// closed with the last one.
 func (t *SSTable) Close() {
-	t.file.Close()
+	if t.refs.Add(-1) == 0 {
+		t.file.Close()
+		if t.remove.Load() {
+			os.Remove(t.Filename)
+		}
+	}
+}
+
+// Remove is Close for a table that is no longer needed: the file is deleted
+// too, once readers holding a reference are done with it.
+func (t *SSTable) Remove() {
+	t.remove.Store(true)
+	t.Close()
+}
+
+// Iterators read through the table's shared file with ReadAt, so creating
+// one costs no open/close syscalls; their read buffers are pooled.
+const iterBufSize = 4096
+
+var iterBufPool = sync.Pool{
+	New: func() interface{} { return bufio.NewReaderSize(nil, iterBufSize) },
 }
 
 type Iterator struct {
-	file     *os.File
-	fileSize int64
+	table *SSTable
+	r     *bufio.Reader // reads the data section from pos; nil once closed
+	pos   int64
 
 	currentKey common.KeyType
 	currentVal common.ValueType
+	currentLen int
+	currentOff int64
 	err        error
 	valid      bool
+	pending    bool
+	keysOnly   bool // skip values: Value is nil, ValueLen still set
+}
+
+// NewKeyIterator is NewIterator for callers that only need keys and value
+// lengths. It skips over each value instead of copying it out.
+func (t *SSTable) NewKeyIterator() *Iterator {
+	it := t.NewIterator()
+	it.keysOnly = true
+	return it
 }
 
 func (t *SSTable) NewIterator() *Iterator {
-	f, err := os.Open(t.Filename)
-	if err != nil {
-		return &Iterator{file: nil, fileSize: t.fileSize, err: err, valid: false}
+	it := &Iterator{table: t, r: iterBufPool.Get().(*bufio.Reader), valid: true}
+	it.readFrom(0)
+	return it
+}
+
+// readFrom points the iterator's reader at offset in the data section.
+func (it *Iterator) readFrom(offset int64) {
+	it.r.Reset(io.NewSectionReader(it.table.file, offset, it.table.dataEnd-offset))
+	it.pos = offset
+}
+
+// Seek positions the iterator so that the next call to Next yields the first
+// record with a key >= key. It uses the sparse index to jump to the right
+// block and scans linearly from there; it reports whether such a record exists.
+func (it *Iterator) Seek(key common.KeyType) bool {
+	if it.r == nil {
+		return false
+	}
+	it.pending = false
+	idx := sort.Search(len(it.table.indexKeys), func(i int) bool {
+		return it.table.indexKeys[i] > key
+	}) - 1
+	if idx < 0 {
+		idx = 0
 	}
-	return &Iterator{
-		file:     f,
-		fileSize: t.fileSize,
-		valid:    true,
+	var offset int64
+	if idx < len(it.table.indexOffsets) {
+		offset = it.table.indexOffsets[idx]
 	}
+	it.readFrom(offset)
+	it.valid = true
+	for it.Next() {
+		if it.currentKey >= key {
+			it.pending = true
+			return true
+		}
+	}
+	return false
 }
 
 func (it *Iterator) Next() bool {
+	if it.pending {
+		it.pending = false
+		return true
+	}
 	if !it.valid {
 		return false
 	}
-
-	var k int64
-	if err := binary.Read(it.file, binary.LittleEndian, &k); err != nil {
+	// The data section ends where the sparse index begins.
+	if it.pos >= it.table.dataEnd {
 		it.valid = false
-		if err != io.EOF {
-			it.err = err
-		}
 		return false
 	}
 
-	var valLen int32
-	if err := binary.Read(it.file, binary.LittleEndian, &valLen); err != nil {
+	var header [12]byte
+	if _, err := io.ReadFull(it.r, header[:]); err != nil {
 		it.valid = false
+		if err != io.EOF {
+			it.err = err
+		}
 		return false
 	}
-
-	if valLen < 0 || valLen > 1024*1024*10 {
+	k := int64(binary.LittleEndian.Uint64(header[0:8]))
+	valLen := int32(binary.LittleEndian.Uint32(header[8:12]))
+	if valLen < 0 || valLen > MaxValueSize {
 		it.valid = false
 		return false
 	}
 
-	val := make([]byte, valLen)
-	if _, err := io.ReadFull(it.file, val); err != nil {
-		it.valid = false
-		return false
+	var val []byte
+	if it.keysOnly {
+		if _, err := it.r.Discard(int(valLen)); err != nil {
+			it.valid = false
+			return false
+		}
+	} else {
+		val = make([]byte, valLen)
+		if _, err := io.ReadFull(it.r, val); err != nil {
+			it.valid = false
+			return false
+		}
 	}
 
+	it.currentOff = it.pos
+	it.pos += 8 + 4 + int64(valLen)
 	it.currentKey = common.KeyType(k)
 	it.currentVal = val
+	it.currentLen = int(valLen)
 	return true
 }
 
 func (it *Iterator) Key() common.KeyType     { return it.currentKey }
 func (it *Iterator) Value() common.ValueType { return it.currentVal }
+func (it *Iterator) ValueLen() int           { return it.currentLen }
 func (it *Iterator) Valid() bool             { return it.valid }
+func (it *Iterator) Err() error              { return it.err }
+
+// Offset is the file offset of the current record, usable with SSTable.ValueAt.
+func (it *Iterator) Offset() int64 { return it.currentOff }
 func (it *Iterator) Close() {
-	if it.file != nil {
-		it.file.Close()
-		it.file = nil
+	if it.r != nil {
+		it.r.Reset(nil)
+		iterBufPool.Put(it.r)
+		it.r = nil
 	}
+	it.valid = false
+	it.pending = false
 }
@@ -0,0 +1,147 @@
+package sstable
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"neurodb/pkg/common"
+)
+
+func TestOverlapsUsesFullKeySpan(t *testing.T) {
+	// 250 keys span three index blocks; the max key is inside the last block,
+	// past the last indexed key (200).
+	keys := make([]int64, 0, 250)
+	for i := int64(0); i < 250; i++ {
+		keys = append(keys, 1000+i)
+	}
+	sst := buildTable(t, "a.sst", keys, "v")
+
+	cases := []struct {
+		start, end int64
+		want       bool
+	}{
+		{0, 999, false},
+		{0, 1000, true},
+		{1240, 1300, true},
+		{1249, 1249, true},
+		{1250, 2000, false},
+	}
+	for _, c := range cases {
+		if got := sst.Overlaps(common.KeyType(c.start), common.KeyType(c.end)); got != c.want {
+			t.Errorf("Overlaps(%d, %d) = %v, want %v", c.start, c.end, got, c.want)
+		}
+	}
+	if n := sst.EstimateRange(2000, 3000); n != 0 {
+		t.Errorf("expected no estimate past the last key, got %d", n)
+	}
+}
+
+func TestRangeTombstonesRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.sst")
+	b, err := NewBuilder(path)
+	if err != nil {
+		t.Fatalf("new builder: %v", err)
+	}
+	b.AddRangeTombstone(10, 20)
+	b.AddRangeTombstone(-5, 0)
+	for k := int64(0); k < 250; k++ {
+		if err := b.Add(common.KeyType(k), []byte("v")); err != nil {
+			t.Fatalf("add %d: %v", k, err)
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("close builder: %v", err)
+	}
+	sst, err := Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer sst.Close()
+
+	want := []common.RangeTombstone{{Start: 10, End: 20}, {Start: -5, End: 0}}
+	if got := sst.RangeTombstones(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("tombstones = %v, want %v", got, want)
+	}
+	// The records and sparse index are unaffected by the extra block.
+	if val, ok := sst.Get(249); !ok || string(val) != "v" {
+		t.Fatalf("get 249 = %q/%v", val, ok)
+	}
+	if !sst.Overlaps(249, 300) || sst.Overlaps(250, 300) {
+		t.Fatal("key span changed by the tombstone block")
+	}
+
+	// A table without range tombstones keeps the original footer.
+	plain := buildTable(t, "plain.sst", []int64{1, 2, 3}, "v")
+	if len(plain.RangeTombstones()) != 0 {
+		t.Fatalf("unexpected tombstones in plain table: %v", plain.RangeTombstones())
+	}
+}
+
+func TestOpenReportsIncompleteFooter(t *testing.T) {
+	keys := make([]int64, 300)
+	for i := range keys {
+		keys[i] = int64(i)
+	}
+	sst := buildTable(t, "a.sst", keys, "v")
+	data, err := os.ReadFile(sst.Filename)
+	if err != nil {
+		t.Fatalf("read table: %v", err)
+	}
+
+	dir := t.TempDir()
+	cases := []struct {
+		name string
+		size int
+		want error
+	}{
+		{"footer cut short", len(data) - 5, ErrBadFooter},
+		{"footer missing", len(data) - 16, ErrBadFooter},
+		{"only a few bytes", 10, ErrFileTooSmall},
+	}
+	for _, c := range cases {
+		path := filepath.Join(dir, c.name+".sst")
+		if err := os.WriteFile(path, data[:c.size], 0644); err != nil {
+			t.Fatalf("write %s: %v", c.name, err)
+		}
+		if _, err := Open(path); !errors.Is(err, c.want) {
+			t.Errorf("%s: Open returned %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+func TestRefKeepsTableOpenUntilLastClose(t *testing.T) {
+	sst := buildTable(t, "ref.sst", []int64{1, 2, 3}, "v")
+	if !sst.Ref() {
+		t.Fatalf("Ref failed on an open table")
+	}
+	sst.Close() // Open's reference
+	if val, ok := sst.Get(2); !ok || string(val) != "v-2" {
+		t.Fatalf("Get with a reference held: %q, %v", val, ok)
+	}
+	sst.Close()
+	if _, ok := sst.Get(2); ok {
+		t.Fatalf("Get succeeded after the last reference was released")
+	}
+	if sst.Ref() {
+		t.Fatalf("Ref succeeded on a closed table")
+	}
+}
+
+func TestRemoveWaitsForLastReference(t *testing.T) {
+	sst := buildTable(t, "rm.sst", []int64{1, 2, 3}, "v")
+	sst.Ref()
+	sst.Remove()
+	if _, err := os.Stat(sst.Filename); err != nil {
+		t.Fatalf("file removed while a reference is held: %v", err)
+	}
+	if val, ok := sst.Get(3); !ok || string(val) != "v-3" {
+		t.Fatalf("Get after Remove with a reference held: %q, %v", val, ok)
+	}
+	sst.Close()
+	if _, err := os.Stat(sst.Filename); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the file removed with the last reference, got %v", err)
+	}
+}
@@ -2,51 +2,261 @@ package storage
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/crc32"
 	"io"
 	"neurodb/pkg/common"
+	"neurodb/pkg/storage/sstable"
 	"os"
 	"sync"
 	"time"
 )
 
-// [CRC32 4B] [Timestamp 8B] [Key 8B] [ValSize 4B] [Value NB]
+// [CRC32 4B] [Timestamp 8B] [Key 8B] [ValSize 4B] [Op 1B] [Value NB]
+//
+// The CRC covers everything from Key on. ValSize has opFlag set to mark the
+// op byte. A range delete's Key is the start and its 8-byte value is the
+// (exclusive) end. A merge's value is its operand.
+//
+// Logs written before the op byte have 24-byte headers without opFlag: a
+// range delete set rangeDeleteFlag instead and a delete was an empty value.
+// They are still read, so an old log replays after an upgrade.
 
 const (
-	HeaderSize = 4 + 8 + 8 + 4 // 24 Bytes
+	HeaderSize = 4 + 8 + 8 + 4 + 1 // 25 Bytes
+
+	legacyHeaderSize = 24
+	rangeDeleteFlag  = 1 << 31
+	opFlag           = 1 << 30
+	valSizeMask      = opFlag - 1
+
+	// maxValueSize caps a logged value at what a table can hold. Replay
+	// takes a longer size field for corruption rather than allocating it.
+	maxValueSize = sstable.MaxValueSize
+)
+
+// WALOp is the operation an entry logs.
+type WALOp uint8
+
+const (
+	WALPut WALOp = iota + 1
+	WALDelete
+	WALRangeDelete
+	WALMerge
+)
+
+func (op WALOp) String() string {
+	switch op {
+	case WALPut:
+		return "put"
+	case WALDelete:
+		return "delete"
+	case WALRangeDelete:
+		return "range_delete"
+	case WALMerge:
+		return "merge"
+	}
+	return fmt.Sprintf("op(%d)", uint8(op))
+}
+
+// WALEntry is one logged write. A WALDelete entry has no value; a
+// WALRangeDelete entry deletes [Key, End) and has no value; a WALMerge
+// entry's value is a merge operand for Key.
+type WALEntry struct {
+	common.Record
+	Op  WALOp
+	End common.KeyType
+}
+
+var (
+	// ErrOffsetOutOfRange is returned for an offset past the end of the log.
+	ErrOffsetOutOfRange = errors.New("wal: offset past end of log")
+	// ErrOffsetTruncated is returned for an offset whose entry was dropped
+	// when the log was truncated.
+	ErrOffsetTruncated = errors.New("wal: offset before start of log (truncated)")
 )
 
+// An offset is an entry's position in the log counted from the very first
+// entry ever written, so it keeps growing across truncations: the file holds
+// the entries from base onwards, and base is kept in the file named by
+// offsetMetaPath.
 type WAL struct {
 	file *os.File
 	mu   sync.Mutex
 	buf  *bufio.Writer
+	base int64 // offset of the first byte in file
+	size int64 // bytes in file
 }
 
 func OpenWAL(path string) (*WAL, error) {
+	base, err := readBaseOffset(offsetMetaPath(path))
+	if err != nil {
+		return nil, err
+	}
 	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, err
 	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 
 	return &WAL{
 		file: f,
 		buf:  bufio.NewWriter(f),
+		base: base,
+		size: st.Size(),
 	}, nil
 }
 
-func (w *WAL) Append(key common.KeyType, value common.ValueType) error {
+func offsetMetaPath(walPath string) string {
+	return walPath + ".offset"
+}
+
+func readBaseOffset(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 8 {
+		return 0, errors.New("wal: corrupted offset file")
+	}
+	return int64(binary.LittleEndian.Uint64(data)), nil
+}
+
+// writeBaseOffset durably replaces the offset file.
+func writeBaseOffset(path string, base int64) error {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(base))
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Append logs a write and returns its offset.
+func (w *WAL) Append(key common.KeyType, value common.ValueType) (int64, error) {
+	return w.appendEntry(WALPut, key, value)
+}
+
+// AppendDelete logs the deletion of key and returns its offset.
+func (w *WAL) AppendDelete(key common.KeyType) (int64, error) {
+	return w.appendEntry(WALDelete, key, nil)
+}
+
+// AppendMerge logs a merge operand for key and returns its offset.
+func (w *WAL) AppendMerge(key common.KeyType, operand []byte) (int64, error) {
+	return w.appendEntry(WALMerge, key, operand)
+}
+
+// AppendBatch logs records in order and returns the offset of the first.
+// The entries are written under one lock and flushed to the file once, so a
+// batch costs one write call rather than one per record; Sync afterwards
+// makes the whole batch durable with a single fsync. If the write fails,
+// none of the batch stays in the log. A record with an empty value is
+// logged as a delete, as the store writes one.
+func (w *WAL) AppendBatch(records []common.Record) (int64, error) {
+	entries := make([]WALEntry, len(records))
+	for i, r := range records {
+		entries[i] = WALEntry{Record: r, Op: WALPut}
+		if len(r.Value) == 0 {
+			entries[i].Op = WALDelete
+		}
+	}
+	return w.AppendEntries(entries)
+}
+
+// AppendEntries is AppendBatch for entries that carry their own op.
+func (w *WAL) AppendEntries(entries []WALEntry) (int64, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	offset := w.base + w.size
+	var n int64
+	for _, e := range entries {
+		value := e.Value
+		if e.Op == WALRangeDelete {
+			value = make([]byte, 8)
+			binary.LittleEndian.PutUint64(value, uint64(e.End))
+		}
+		written, err := w.writeEntryLocked(e.Op, e.Key, value)
+		if err != nil {
+			return 0, w.discardPartial(err)
+		}
+		n += written
+	}
+	if err := w.buf.Flush(); err != nil {
+		return 0, w.discardPartial(err)
+	}
+	w.size += n
+	return offset, nil
+}
+
+// AppendRangeDelete logs the deletion of [start, end) and returns its offset.
+func (w *WAL) AppendRangeDelete(start, end common.KeyType) (int64, error) {
+	value := make([]byte, 8)
+	binary.LittleEndian.PutUint64(value, uint64(end))
+	return w.appendEntry(WALRangeDelete, start, value)
+}
+
+// CurrentOffset is the offset the next entry will be logged at.
+func (w *WAL) CurrentOffset() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.base + w.size
+}
+
+func (w *WAL) appendEntry(op WALOp, key common.KeyType, value []byte) (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n, err := w.writeEntryLocked(op, key, value)
+	if err != nil {
+		return 0, w.discardPartial(err)
+	}
+	if err := w.buf.Flush(); err != nil {
+		return 0, w.discardPartial(err)
+	}
+
+	offset := w.base + w.size
+	w.size += n
+	return offset, nil
+}
+
+// writeEntryLocked buffers one entry without flushing it and returns its
+// size. The caller holds w.mu.
+func (w *WAL) writeEntryLocked(op WALOp, key common.KeyType, value []byte) (int64, error) {
+	if len(value) > maxValueSize {
+		return 0, fmt.Errorf("wal: %d-byte value is too large to log", len(value))
+	}
 	header := make([]byte, HeaderSize)
 	ts := uint64(time.Now().UnixNano())
-	valSize := uint32(len(value))
 
 	binary.LittleEndian.PutUint64(header[4:12], ts)
 	binary.LittleEndian.PutUint64(header[12:20], uint64(key))
-	binary.LittleEndian.PutUint32(header[20:24], valSize)
+	binary.LittleEndian.PutUint32(header[20:24], opFlag|uint32(len(value)))
+	header[24] = byte(op)
 
 	checksum := crc32.NewIEEE()
 	checksum.Write(header[12:])
@@ -54,13 +264,24 @@ func (w *WAL) Append(key common.KeyType, value common.ValueType) error {
 	binary.LittleEndian.PutUint32(header[0:4], checksum.Sum32())
 
 	if _, err := w.buf.Write(header); err != nil {
-		return err
+		return 0, err
 	}
 	if _, err := w.buf.Write(value); err != nil {
-		return err
+		return 0, err
 	}
+	return int64(len(header) + len(value)), nil
+}
 
-	return w.buf.Flush()
+// discardPartial cuts the file back to its last whole entry after a failed
+// append, e.g. on a full disk. Replay stops at a torn entry, so one left in
+// place would hide every entry appended after it; and bufio.Writer keeps
+// failing once a write has. The caller holds w.mu.
+func (w *WAL) discardPartial(err error) error {
+	w.buf.Reset(w.file)
+	if terr := w.file.Truncate(w.size); terr != nil {
+		return fmt.Errorf("%w (and truncating the partial entry: %v)", err, terr)
+	}
+	return err
 }
 
 func (w *WAL) Sync() error {
@@ -75,6 +296,7 @@ func (w *WAL) Close() error {
 	return w.file.Close()
 }
 
+// Truncate drops every entry. Offsets carry on from where the log ended.
 func (w *WAL) Truncate() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
@@ -82,6 +304,13 @@ func (w *WAL) Truncate() error {
 		return err
 	}
 	path := w.file.Name()
+	// The new base is recorded first: a crash before the truncation leaves
+	// the old entries readable again at higher offsets, never new entries at
+	// offsets already handed out.
+	base := w.base + w.size
+	if err := writeBaseOffset(offsetMetaPath(path), base); err != nil {
+		return err
+	}
 	if err := w.file.Close(); err != nil {
 		return err
 	}
@@ -91,6 +320,8 @@ func (w *WAL) Truncate() error {
 	}
 	w.file = f
 	w.buf = bufio.NewWriter(f)
+	w.base = base
+	w.size = 0
 	return w.file.Sync()
 }
 
@@ -110,42 +341,175 @@ func (w *WAL) Size() (int64, error) {
 type WALIterator struct {
 	reader *bufio.Reader
 	file   *os.File
+	offset int64
 }
 
+// NewIterator iterates over every entry still in the log.
 func (w *WAL) NewIterator() (*WALIterator, error) {
-	f, err := os.Open(w.file.Name())
+	w.mu.Lock()
+	base := w.base
+	w.mu.Unlock()
+	return w.NewIteratorAt(base)
+}
+
+// NewIteratorAt iterates from the entry at offset, one returned by Append or
+// WALIterator.Offset.
+func (w *WAL) NewIteratorAt(offset int64) (*WALIterator, error) {
+	w.mu.Lock()
+	name, base, end := w.file.Name(), w.base, w.base+w.size
+	w.mu.Unlock()
+	if offset < base {
+		return nil, ErrOffsetTruncated
+	}
+	if offset > end {
+		return nil, ErrOffsetOutOfRange
+	}
+
+	f, err := os.Open(name)
 	if err != nil {
 		return nil, err
 	}
+	if _, err := f.Seek(offset-base, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
 	return &WALIterator{
 		file:   f,
 		reader: bufio.NewReader(f),
+		offset: offset,
 	}, nil
 }
 
-func (it *WALIterator) Next() (common.Record, error) {
+// Offset is the offset of the entry after the last one Next returned.
+func (it *WALIterator) Offset() int64 {
+	return it.offset
+}
+
+func (it *WALIterator) Next() (WALEntry, error) {
+	entry, _, err := it.next()
+	return entry, err
+}
+
+// NextRaw returns the next entry exactly as logged, header and checksum
+// included; DecodeWALEntry parses it.
+func (it *WALIterator) NextRaw() ([]byte, error) {
+	_, raw, err := it.next()
+	return raw, err
+}
+
+func (it *WALIterator) next() (WALEntry, []byte, error) {
+	entry, raw, err := readEntry(it.reader)
+	if err != nil {
+		return WALEntry{}, nil, err
+	}
+	it.offset += int64(len(raw))
+	return entry, raw, nil
+}
+
+// DecodeWALEntry parses one entry returned by WALIterator.NextRaw.
+func DecodeWALEntry(raw []byte) (WALEntry, error) {
+	// Check the length first so a bad size field can't force a large
+	// allocation.
+	if len(raw) < legacyHeaderSize {
+		return WALEntry{}, errors.New("wal: short entry")
+	}
+	headerSize, valSize := legacyHeaderSize, binary.LittleEndian.Uint32(raw[20:24])
+	if valSize&opFlag != 0 {
+		headerSize, valSize = HeaderSize, valSize&valSizeMask
+	} else {
+		valSize &^= rangeDeleteFlag
+	}
+	if int64(len(raw)) != int64(headerSize)+int64(valSize) {
+		return WALEntry{}, errors.New("wal: entry length mismatch")
+	}
+	entry, _, err := readEntry(bytes.NewReader(raw))
+	return entry, err
+}
+
+func readEntry(r io.Reader) (WALEntry, []byte, error) {
 	header := make([]byte, HeaderSize)
-	if _, err := io.ReadFull(it.reader, header); err != nil {
-		return common.Record{}, err
+	if _, err := io.ReadFull(r, header[:legacyHeaderSize]); err != nil {
+		return WALEntry{}, nil, err
 	}
 
 	storedCRC := binary.LittleEndian.Uint32(header[0:4])
 	key := common.KeyType(binary.LittleEndian.Uint64(header[12:20]))
 	valSize := binary.LittleEndian.Uint32(header[20:24])
+	var op WALOp
+	if valSize&opFlag != 0 {
+		if _, err := io.ReadFull(r, header[legacyHeaderSize:]); err != nil {
+			return WALEntry{}, nil, io.ErrUnexpectedEOF
+		}
+		op = WALOp(header[legacyHeaderSize])
+		valSize &= valSizeMask
+	} else {
+		// An old-format entry.
+		header = header[:legacyHeaderSize]
+		op = WALPut
+		if valSize&rangeDeleteFlag != 0 {
+			op = WALRangeDelete
+		}
+		valSize &^= rangeDeleteFlag
+	}
+	// The size is not covered by a checked CRC yet, so a torn header must
+	// not decide how much to allocate.
+	if valSize > maxValueSize {
+		return WALEntry{}, nil, errors.New("wal: corrupted value size")
+	}
 
 	value := make([]byte, valSize)
-	if _, err := io.ReadFull(it.reader, value); err != nil {
-		return common.Record{}, errors.New("wal: corrupted value")
+	if _, err := io.ReadFull(r, value); err != nil {
+		return WALEntry{}, nil, errors.New("wal: corrupted value")
 	}
 
 	checksum := crc32.NewIEEE()
 	checksum.Write(header[12:])
 	checksum.Write(value)
 	if checksum.Sum32() != storedCRC {
-		return common.Record{}, errors.New("wal: crc mismatch")
+		return WALEntry{}, nil, errors.New("wal: crc mismatch")
 	}
+	raw := append(header, value...)
 
-	return common.Record{Key: key, Value: value}, nil
+	if op == WALPut && len(header) == legacyHeaderSize && len(value) == 0 {
+		op = WALDelete
+	}
+	switch op {
+	case WALPut, WALDelete, WALMerge:
+		return WALEntry{Record: common.Record{Key: key, Value: value}, Op: op}, raw, nil
+	case WALRangeDelete:
+		if len(value) != 8 {
+			return WALEntry{}, nil, errors.New("wal: corrupted range delete")
+		}
+		end := common.KeyType(binary.LittleEndian.Uint64(value))
+		return WALEntry{Record: common.Record{Key: key}, Op: op, End: end}, raw, nil
+	}
+	return WALEntry{}, nil, fmt.Errorf("wal: unknown op %d", uint8(op))
+}
+
+// CheckWAL reads every entry of the log file at path. It returns the number
+// of entries and bytes that read cleanly and, if the file does not end after
+// them, why the next entry could not be read.
+func CheckWAL(path string) (entries int, valid int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		_, raw, err := readEntry(r)
+		if err == io.EOF {
+			return entries, valid, nil
+		}
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = errors.New("wal: torn entry header")
+			}
+			return entries, valid, err
+		}
+		entries++
+		valid += int64(len(raw))
+	}
 }
 
 func (it *WALIterator) Close() {
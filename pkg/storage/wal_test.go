@@ -1,8 +1,14 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
 	"io"
+	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 
 	"neurodb/pkg/common"
@@ -16,10 +22,10 @@ func TestWALAppendIterateAndTruncate(t *testing.T) {
 	}
 	defer w.Close()
 
-	if err := w.Append(common.KeyType(1), []byte("one")); err != nil {
+	if _, err := w.Append(common.KeyType(1), []byte("one")); err != nil {
 		t.Fatalf("append key=1: %v", err)
 	}
-	if err := w.Append(common.KeyType(2), []byte("two")); err != nil {
+	if _, err := w.Append(common.KeyType(2), []byte("two")); err != nil {
 		t.Fatalf("append key=2: %v", err)
 	}
 
@@ -79,3 +85,399 @@ func TestWALAppendIterateAndTruncate(t *testing.T) {
 	}
 	it2.Close()
 }
+
+func openBackend(t *testing.T, path string) *DiskBackend {
+	t.Helper()
+	backend, err := NewDiskBackend(path, nil)
+	if err != nil {
+		t.Fatalf("open backend: %v", err)
+	}
+	return backend
+}
+
+func TestLoadAllAppliesRangeDeletesInOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "neuro.db")
+	backend := openBackend(t, path)
+	for k := common.KeyType(0); k < 10; k++ {
+		if err := backend.Write(k, []byte("old")); err != nil {
+			t.Fatalf("write %d: %v", k, err)
+		}
+	}
+	if err := backend.DeleteRange(3, 7); err != nil {
+		t.Fatalf("delete range: %v", err)
+	}
+	if err := backend.Write(5, []byte("new")); err != nil {
+		t.Fatalf("write after delete: %v", err)
+	}
+	backend.Close()
+
+	backend = openBackend(t, path)
+	defer backend.Close()
+	records, tombstones, merges, err := backend.LoadAll()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(tombstones) != 1 || tombstones[0] != (common.RangeTombstone{Start: 3, End: 7}) {
+		t.Fatalf("tombstones = %v", tombstones)
+	}
+	if len(merges) != 0 {
+		t.Fatalf("merges = %v", merges)
+	}
+	got := make(map[common.KeyType]string)
+	for _, r := range records {
+		got[r.Key] = string(r.Value)
+	}
+	if len(got) != 7 || got[5] != "new" || got[2] != "old" || got[7] != "old" {
+		t.Fatalf("records after replay = %v", got)
+	}
+	for _, k := range []common.KeyType{3, 4, 6} {
+		if _, ok := got[k]; ok {
+			t.Fatalf("key %d survived the range delete", k)
+		}
+	}
+}
+
+func TestWALOffsetsResumeAndSurviveTruncate(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "neuro.wal")
+	w, err := OpenWAL(walPath)
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+
+	var offsets []int64
+	for i := 0; i < 5; i++ {
+		off, err := w.Append(common.KeyType(i), []byte{byte('a' + i)})
+		if err != nil {
+			t.Fatalf("append key=%d: %v", i, err)
+		}
+		if len(offsets) > 0 && off <= offsets[len(offsets)-1] {
+			t.Fatalf("offset %d not after %d", off, offsets[len(offsets)-1])
+		}
+		offsets = append(offsets, off)
+	}
+
+	it, err := w.NewIteratorAt(offsets[2])
+	if err != nil {
+		t.Fatalf("iterator at offset %d: %v", offsets[2], err)
+	}
+	for i := 2; i < 5; i++ {
+		e, err := it.Next()
+		if err != nil || e.Key != common.KeyType(i) {
+			it.Close()
+			t.Fatalf("entry %d: key=%d err=%v", i, e.Key, err)
+		}
+		if i < 4 && it.Offset() != offsets[i+1] {
+			it.Close()
+			t.Fatalf("offset after entry %d = %d, want %d", i, it.Offset(), offsets[i+1])
+		}
+	}
+	it.Close()
+
+	end := w.CurrentOffset()
+	if err := w.Truncate(); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	if _, err := w.NewIteratorAt(offsets[2]); err != ErrOffsetTruncated {
+		t.Fatalf("expected ErrOffsetTruncated for a dropped entry, got %v", err)
+	}
+	if _, err := w.NewIteratorAt(end + 1); err != ErrOffsetOutOfRange {
+		t.Fatalf("expected ErrOffsetOutOfRange past the end, got %v", err)
+	}
+	off, err := w.Append(common.KeyType(9), []byte("z"))
+	if err != nil {
+		t.Fatalf("append after truncate: %v", err)
+	}
+	if off != end {
+		t.Fatalf("offset after truncate = %d, want %d", off, end)
+	}
+	w.Close()
+
+	// The base offset is persisted, so a reopened log keeps counting.
+	w, err = OpenWAL(walPath)
+	if err != nil {
+		t.Fatalf("reopen wal: %v", err)
+	}
+	defer w.Close()
+	it, err = w.NewIteratorAt(end)
+	if err != nil {
+		t.Fatalf("iterator after reopen: %v", err)
+	}
+	defer it.Close()
+	if e, err := it.Next(); err != nil || e.Key != 9 {
+		t.Fatalf("entry after reopen: key=%d err=%v", e.Key, err)
+	}
+	if w.CurrentOffset() != it.Offset() {
+		t.Fatalf("current offset %d, want %d", w.CurrentOffset(), it.Offset())
+	}
+}
+
+func TestWALAppendBatchMatchesSingleAppends(t *testing.T) {
+	dir := t.TempDir()
+	single, err := OpenWAL(filepath.Join(dir, "single.wal"))
+	if err != nil {
+		t.Fatalf("open single wal: %v", err)
+	}
+	defer single.Close()
+	batch, err := OpenWAL(filepath.Join(dir, "batch.wal"))
+	if err != nil {
+		t.Fatalf("open batch wal: %v", err)
+	}
+	defer batch.Close()
+
+	records := make([]common.Record, 50)
+	for i := range records {
+		records[i] = common.Record{Key: common.KeyType(i * 3), Value: []byte(strings.Repeat("v", i))}
+	}
+	for _, r := range records {
+		if _, err := single.Append(r.Key, r.Value); err != nil {
+			t.Fatalf("append key=%d: %v", r.Key, err)
+		}
+	}
+	if off, err := batch.AppendBatch(records); err != nil || off != 0 {
+		t.Fatalf("append batch: offset %d err %v", off, err)
+	}
+	if off, err := batch.AppendBatch(nil); err != nil || off != batch.CurrentOffset() {
+		t.Fatalf("empty batch: offset %d err %v, want %d", off, err, batch.CurrentOffset())
+	}
+	if single.CurrentOffset() != batch.CurrentOffset() {
+		t.Fatalf("batch ends at %d, single appends at %d", batch.CurrentOffset(), single.CurrentOffset())
+	}
+
+	singleIt, err := single.NewIterator()
+	if err != nil {
+		t.Fatalf("single iterator: %v", err)
+	}
+	defer singleIt.Close()
+	batchIt, err := batch.NewIterator()
+	if err != nil {
+		t.Fatalf("batch iterator: %v", err)
+	}
+	defer batchIt.Close()
+	for i := 0; ; i++ {
+		want, wantErr := singleIt.Next()
+		got, gotErr := batchIt.Next()
+		if wantErr == io.EOF && gotErr == io.EOF {
+			if i != len(records) {
+				t.Fatalf("iterated %d entries, want %d", i, len(records))
+			}
+			break
+		}
+		if wantErr != nil || gotErr != nil {
+			t.Fatalf("entry %d: single err %v, batch err %v", i, wantErr, gotErr)
+		}
+		if got.Key != want.Key || !bytes.Equal(got.Value, want.Value) || batchIt.Offset() != singleIt.Offset() {
+			t.Fatalf("entry %d: batch key=%d val=%q at %d, single key=%d val=%q at %d",
+				i, got.Key, got.Value, batchIt.Offset(), want.Key, want.Value, singleIt.Offset())
+		}
+	}
+}
+
+func TestWALRecordsOpTypes(t *testing.T) {
+	w, err := OpenWAL(filepath.Join(t.TempDir(), "neuro.wal"))
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	defer w.Close()
+
+	if _, err := w.Append(1, []byte("one")); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if _, err := w.AppendDelete(2); err != nil {
+		t.Fatalf("append delete: %v", err)
+	}
+	if _, err := w.AppendRangeDelete(10, 20); err != nil {
+		t.Fatalf("append range delete: %v", err)
+	}
+	if _, err := w.AppendBatch([]common.Record{{Key: 3, Value: []byte("three")}, {Key: 4}}); err != nil {
+		t.Fatalf("append batch: %v", err)
+	}
+	want := []WALEntry{
+		{Record: common.Record{Key: 1, Value: []byte("one")}, Op: WALPut},
+		{Record: common.Record{Key: 2}, Op: WALDelete},
+		{Record: common.Record{Key: 10}, Op: WALRangeDelete, End: 20},
+		{Record: common.Record{Key: 3, Value: []byte("three")}, Op: WALPut},
+		{Record: common.Record{Key: 4}, Op: WALDelete},
+	}
+
+	it, err := w.NewIterator()
+	if err != nil {
+		t.Fatalf("new iterator: %v", err)
+	}
+	defer it.Close()
+	for i, wantEntry := range want {
+		raw, err := it.NextRaw()
+		if err != nil {
+			t.Fatalf("entry %d: %v", i, err)
+		}
+		got, err := DecodeWALEntry(raw)
+		if err != nil {
+			t.Fatalf("decode entry %d: %v", i, err)
+		}
+		if got.Op != wantEntry.Op || got.Key != wantEntry.Key || got.End != wantEntry.End || !bytes.Equal(got.Value, wantEntry.Value) {
+			t.Fatalf("entry %d = %s key=%d end=%d val=%q, want %s key=%d end=%d val=%q", i,
+				got.Op, got.Key, got.End, got.Value, wantEntry.Op, wantEntry.Key, wantEntry.End, wantEntry.Value)
+		}
+	}
+	if _, err := it.Next(); err != io.EOF {
+		t.Fatalf("expected EOF after %d entries, got %v", len(want), err)
+	}
+}
+
+// legacyFrame encodes an entry the way logs were written before the op byte.
+func legacyFrame(key common.KeyType, valSize uint32, value []byte) []byte {
+	header := make([]byte, legacyHeaderSize)
+	binary.LittleEndian.PutUint64(header[4:12], 1)
+	binary.LittleEndian.PutUint64(header[12:20], uint64(key))
+	binary.LittleEndian.PutUint32(header[20:24], valSize)
+	checksum := crc32.NewIEEE()
+	checksum.Write(header[12:])
+	checksum.Write(value)
+	binary.LittleEndian.PutUint32(header[0:4], checksum.Sum32())
+	return append(header, value...)
+}
+
+func TestWALReadsOldFormatEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "neuro.db")
+	end := make([]byte, 8)
+	binary.LittleEndian.PutUint64(end, 9)
+	var old []byte
+	old = append(old, legacyFrame(1, 3, []byte("one"))...)
+	old = append(old, legacyFrame(2, 0, nil)...)
+	old = append(old, legacyFrame(5, rangeDeleteFlag|8, end)...)
+	if err := os.WriteFile(path+".wal", old, 0644); err != nil {
+		t.Fatalf("write old log: %v", err)
+	}
+
+	// New entries go after the old ones in the same file.
+	backend := openBackend(t, path)
+	if err := backend.Write(7, []byte("new")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := backend.BatchWrite([]common.Record{{Key: 1}}); err != nil {
+		t.Fatalf("batch write: %v", err)
+	}
+
+	it, err := backend.IterateFrom(0)
+	if err != nil {
+		t.Fatalf("iterate: %v", err)
+	}
+	var ops []WALOp
+	for {
+		e, err := it.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			it.Close()
+			t.Fatalf("entry %d: %v", len(ops), err)
+		}
+		ops = append(ops, e.Op)
+	}
+	it.Close()
+	wantOps := []WALOp{WALPut, WALDelete, WALRangeDelete, WALPut, WALDelete}
+	if !slices.Equal(ops, wantOps) {
+		t.Fatalf("ops = %v, want %v", ops, wantOps)
+	}
+	if entries, valid, err := CheckWAL(path + ".wal"); err != nil || entries != 5 || valid != backend.CurrentOffset() {
+		t.Fatalf("check: %d entries, %d bytes, err %v", entries, valid, err)
+	}
+
+	records, tombstones, merges, err := backend.LoadAll()
+	backend.Close()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(tombstones) != 1 || tombstones[0] != (common.RangeTombstone{Start: 5, End: 9}) {
+		t.Fatalf("tombstones = %v", tombstones)
+	}
+	if len(merges) != 0 {
+		t.Fatalf("merges = %v", merges)
+	}
+	got := make(map[common.KeyType]string)
+	for _, r := range records {
+		got[r.Key] = string(r.Value)
+	}
+	if len(got) != 3 || got[1] != "" || got[2] != "" || got[7] != "new" {
+		t.Fatalf("records after replay = %v", got)
+	}
+}
+
+func TestWALRejectsOversizedValueLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "neuro.wal")
+	w, err := OpenWAL(path)
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	if _, err := w.Append(1, []byte("one")); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	valid := w.CurrentOffset()
+	w.Close()
+
+	// A torn header claiming a value of nearly 1GiB.
+	header := make([]byte, HeaderSize)
+	binary.LittleEndian.PutUint32(header[20:24], opFlag|valSizeMask)
+	header[24] = byte(WALPut)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+	if _, err := f.Write(header); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+	f.Close()
+
+	entries, n, err := CheckWAL(path)
+	if entries != 1 || n != valid || err == nil || !strings.Contains(err.Error(), "value size") {
+		t.Fatalf("check: %d entries, %d bytes, err %v", entries, n, err)
+	}
+}
+
+func TestLoadAllReturnsMergeChains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "neuro.db")
+	backend := openBackend(t, path)
+	entries := []WALEntry{
+		{Record: common.Record{Key: 1, Value: []byte("10")}, Op: WALPut},
+		{Record: common.Record{Key: 1, Value: []byte("+1")}, Op: WALMerge},
+		{Record: common.Record{Key: 2, Value: []byte("+2")}, Op: WALMerge},
+		{Record: common.Record{Key: 3, Value: []byte("+3")}, Op: WALMerge},
+		{Record: common.Record{Key: 3, Value: []byte("30")}, Op: WALPut},
+		{Record: common.Record{Key: 4, Value: []byte("+4")}, Op: WALMerge},
+		{Record: common.Record{Key: 4}, Op: WALRangeDelete, End: 6},
+		{Record: common.Record{Key: 5, Value: []byte("+5")}, Op: WALMerge},
+		{Record: common.Record{Key: 1, Value: []byte("+6")}, Op: WALMerge},
+	}
+	if err := backend.BatchWriteEntries(entries); err != nil {
+		t.Fatalf("batch write: %v", err)
+	}
+	backend.Close()
+
+	backend = openBackend(t, path)
+	defer backend.Close()
+	records, _, merges, err := backend.LoadAll()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	// A put ends a key's chain; a range delete ends it with an empty base.
+	if len(records) != 1 || records[0].Key != 3 || string(records[0].Value) != "30" {
+		t.Fatalf("records = %v", records)
+	}
+	got := make(map[common.KeyType]MergeChain)
+	for _, c := range merges {
+		got[c.Key] = c
+	}
+	want := map[common.KeyType]MergeChain{
+		1: {Key: 1, Value: []byte("10"), HasBase: true, Operands: [][]byte{[]byte("+1"), []byte("+6")}},
+		2: {Key: 2, Operands: [][]byte{[]byte("+2")}},
+		5: {Key: 5, HasBase: true, Operands: [][]byte{[]byte("+5")}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("merges = %v", merges)
+	}
+	for k, w := range want {
+		c := got[k]
+		if c.HasBase != w.HasBase || !bytes.Equal(c.Value, w.Value) || !slices.EqualFunc(c.Operands, w.Operands, bytes.Equal) {
+			t.Fatalf("chain for key %d = %+v, want %+v", k, c, w)
+		}
+	}
+}